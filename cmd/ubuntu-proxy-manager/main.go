@@ -2,31 +2,239 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/ubuntu/ubuntu-proxy-manager/internal/app"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/config"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/migration"
 )
 
+// exitNameOwnershipDenied is the exit code used when the bus security policy
+// doesn't allow the service to own its D-Bus name.
+const exitNameOwnershipDenied = 3
+
 type cmd interface {
 	Wait() error
 	Quit()
 }
 
 func main() {
-	c, err := app.New()
+	if len(os.Args) > 1 && os.Args[1] == "show" {
+		os.Exit(show(os.Args[2:], func() ([]byte, error) { return app.SupportBundle() }))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config-check" {
+		os.Exit(configCheck(os.Args[2:], filepath.Join("/", config.DefaultPath)))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importConfig(os.Args[2:], os.Stdin,
+			func() (migration.Plan, error) { return migration.Scan("/") },
+			func(plan migration.Plan) error { return app.Import(plan) }))
+	}
+
+	os.Exit(start(func(ctx context.Context) (cmd, error) { return app.New(ctx) }))
+}
+
+// start creates the application with newApp and runs it. A signal received
+// while the application is created cancels its creation, and the program
+// exits with the conventional exit code for this signal.
+func start(newApp func(context.Context) (cmd, error)) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	type result struct {
+		c   cmd
+		err error
+	}
+	created := make(chan result, 1)
+	go func() {
+		c, err := newApp(ctx)
+		created <- result{c, err}
+	}()
+
+	var r result
+	select {
+	case sig := <-sigs:
+		signal.Stop(sigs)
+		log.Infof("Received %s while starting, exiting", sig)
+		return 128 + int(sig.(syscall.Signal))
+	case r = <-created:
+		signal.Stop(sigs)
+	}
+
+	if errors.Is(r.err, app.ErrNameOwnershipDenied) {
+		log.Errorf("Failed to create app: %v", r.err)
+		return exitNameOwnershipDenied
+	}
+	if r.err != nil {
+		log.Errorf("Failed to create app: %v", r.err)
+		return 1
+	}
+
+	return run(r.c)
+}
+
+// show prints the support bundle returned by bundle, as requested by the show
+// command arguments.
+func show(args []string, bundle func() ([]byte, error)) int {
+	var printBundle bool
+
+	fSet := flag.NewFlagSet("ubuntu-proxy-manager show", flag.ContinueOnError)
+	fSet.BoolVar(&printBundle, "bundle", false, "")
+	fSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+ ubuntu-proxy-manager show --bundle
+
+Print a support bundle summarizing the proxy configuration of the system, as a
+JSON document with credentials masked.`)
+	}
+
+	err := fSet.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil || len(fSet.Args()) > 0 || !printBundle {
+		if err == nil {
+			fSet.Usage()
+		}
+		return 2
+	}
+
+	data, err := bundle()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	fmt.Println(string(data))
+
+	return 0
+}
+
+// configCheck checks the configuration file given as argument, or the one at
+// defaultPath, and prints every problem found.
+func configCheck(args []string, defaultPath string) int {
+	fSet := flag.NewFlagSet("ubuntu-proxy-manager config-check", flag.ContinueOnError)
+	fSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+ ubuntu-proxy-manager config-check [path]
+
+Check the configuration file at path (default: %s), printing every problem
+found with its location. Exit with a non-zero code if any problem is found.
+`, defaultPath)
+	}
+
+	err := fSet.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil || len(fSet.Args()) > 1 {
+		if err == nil {
+			fSet.Usage()
+		}
+		return 2
+	}
+
+	path := defaultPath
+	if len(fSet.Args()) == 1 {
+		path = fSet.Arg(0)
+	}
+
+	problems, err := config.Check(path)
+	if errors.Is(err, fs.ErrNotExist) && len(fSet.Args()) == 0 {
+		fmt.Printf("No configuration file at %s, the defaults are used\n", path)
+		return 0
+	}
 	if err != nil {
-		log.Errorf("Failed to create app: %v", err)
-		os.Exit(1)
+		log.Error(err)
+		return 1
 	}
 
-	os.Exit(run(c))
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: OK\n", path)
+
+	return 0
+}
+
+// importConfig prints the plan returned by scan, importing the proxy
+// configuration written by hand, and applies it with apply once confirmed on
+// in, as requested by the import command arguments.
+func importConfig(args []string, in io.Reader, scan func() (migration.Plan, error), apply func(migration.Plan) error) int {
+	var dryRun, yes bool
+
+	fSet := flag.NewFlagSet("ubuntu-proxy-manager import", flag.ContinueOnError)
+	fSet.BoolVar(&dryRun, "dry-run", false, "")
+	fSet.BoolVar(&yes, "yes", false, "")
+	fSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage:
+ ubuntu-proxy-manager import [--dry-run] [--yes]
+
+Import the proxy configuration written by hand in /etc/environment,
+/etc/environment.d, /etc/apt/apt.conf and /etc/apt/apt.conf.d. Once the plan
+is confirmed, the settings are applied and the imported directives are
+commented out. The directives which can't be imported are left untouched.
+
+Options:
+ --dry-run   print the plan without applying it
+ --yes       apply the plan without asking for confirmation`)
+	}
+
+	err := fSet.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil || len(fSet.Args()) > 0 {
+		if err == nil {
+			fSet.Usage()
+		}
+		return 2
+	}
+
+	plan, err := scan()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	fmt.Print(plan)
+	if dryRun || plan.Empty() {
+		return 0
+	}
+
+	if !yes {
+		fmt.Print("Apply this plan? [y/N] ")
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Nothing was imported.")
+			return 1
+		}
+	}
+
+	if err := apply(plan); err != nil {
+		log.Error(err)
+		return 1
+	}
+	fmt.Println("The proxy configuration was imported.")
+
+	return 0
 }
 
 func run(c cmd) int {
@@ -115,7 +323,10 @@ When activated, it will listen for D-Bus calls to set the system proxy
 configuration (APT, environment, GSettings). The program will exit if no D-Bus
 call is received shortly after activation.
 
-The program does not take any arguments.`)
+The program does not take any arguments. Run "ubuntu-proxy-manager show --bundle"
+to print a support bundle, "ubuntu-proxy-manager config-check [path]" to check
+the configuration file, or "ubuntu-proxy-manager import" to import the proxy
+configuration written by hand instead.`)
 	}
 
 	parseErr := fSet.Parse(os.Args[1:])
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -12,6 +15,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/ubuntu-proxy-manager/internal/app"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/migration"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
 )
 
 type myApp struct {
@@ -135,3 +140,291 @@ func TestRun(t *testing.T) {
 		})
 	}
 }
+
+func TestStart(t *testing.T) {
+	tests := map[string]struct {
+		sendSig syscall.Signal
+		newErr  error
+
+		wantReturnCode int
+	}{
+		"Start and exit successfully": {},
+
+		"Error if creation fails":            {newErr: errors.New("Error requested for New"), wantReturnCode: 1},
+		"Error if name ownership is denied":  {newErr: app.ErrNameOwnershipDenied, wantReturnCode: exitNameOwnershipDenied},
+		"Send SIGTERM during creation exits": {sendSig: syscall.SIGTERM, wantReturnCode: 143},
+		"Send SIGINT during creation exits":  {sendSig: syscall.SIGINT, wantReturnCode: 130},
+		"Send SIGHUP during creation exits":  {sendSig: syscall.SIGHUP, wantReturnCode: 129},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			initOsArgs := os.Args
+			defer func() { os.Args = initOsArgs }()
+			os.Args = []string{"ubuntu-proxy-manager"}
+
+			a := myApp{done: make(chan struct{})}
+			creating := make(chan struct{})
+			cancelled := make(chan struct{})
+			// A slow creation, only interrupted by a cancellation
+			newApp := func(ctx context.Context) (cmd, error) {
+				close(creating)
+				if tc.sendSig == 0 {
+					return &a, tc.newErr
+				}
+				select {
+				case <-ctx.Done():
+					close(cancelled)
+					return nil, ctx.Err()
+				case <-time.After(10 * time.Second):
+					return &a, nil
+				}
+			}
+
+			var rc int
+			wait := make(chan struct{})
+			go func() {
+				rc = start(newApp)
+				close(wait)
+			}()
+			<-creating
+
+			if tc.sendSig != 0 {
+				err := syscall.Kill(syscall.Getpid(), tc.sendSig)
+				require.NoError(t, err, "Teardown: kill should return no error")
+				select {
+				case <-wait:
+				case <-time.After(time.Second):
+					t.Fatal("Expected to exit promptly on a signal received during creation")
+				}
+				select {
+				case <-cancelled:
+				case <-time.After(time.Second):
+					t.Fatal("Creation should have been cancelled")
+				}
+			} else if tc.newErr == nil {
+				a.Quit()
+			}
+			<-wait
+
+			require.Equal(t, tc.wantReturnCode, rc, "Return expected code")
+		})
+	}
+}
+
+func TestShow(t *testing.T) {
+	tests := map[string]struct {
+		args        []string
+		bundleError bool
+
+		wantOut        string
+		wantErr        string
+		wantReturnCode int
+	}{
+		"Print support bundle":   {args: []string{"--bundle"}, wantOut: `{"version": "dev"}`},
+		"Accept short help flag": {args: []string{"-h"}, wantErr: "ubuntu-proxy-manager show --bundle"},
+
+		"Error if support bundle fails":    {args: []string{"--bundle"}, bundleError: true, wantReturnCode: 1},
+		"Error when not passed any option": {wantErr: "ubuntu-proxy-manager show --bundle", wantReturnCode: 2},
+		"Error when passed any argument":   {args: []string{"--bundle", "bad-arg"}, wantReturnCode: 2},
+		"Error when passed bad options":    {args: []string{"-bad-opt"}, wantReturnCode: 2},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			initOut, initErr := os.Stdout, os.Stderr
+			defer func() { os.Stdout, os.Stderr = initOut, initErr }()
+			rOut, wOut, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stdout")
+			rErr, wErr, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stderr")
+			os.Stdout, os.Stderr = wOut, wErr
+
+			rc := show(tc.args, func() ([]byte, error) {
+				if tc.bundleError {
+					return nil, errors.New("Error requested for support bundle")
+				}
+				return []byte(`{"version": "dev"}`), nil
+			})
+
+			err = wOut.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stdout")
+			os.Stdout = initOut
+			err = wErr.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stderr")
+			os.Stderr = initErr
+
+			var bufOut, bufErr bytes.Buffer
+			_, err = io.Copy(&bufOut, rOut)
+			require.NoError(t, err, "Setup: couldn't read stdout")
+			_, err = io.Copy(&bufErr, rErr)
+			require.NoError(t, err, "Setup: couldn't read stderr")
+
+			if tc.wantOut != "" {
+				require.Equal(t, tc.wantOut+"\n", bufOut.String(), "stdout doesn't contain expected output")
+			}
+			if tc.wantErr != "" {
+				require.Contains(t, bufErr.String(), tc.wantErr, "stderr doesn't contain expected output")
+			}
+			require.Equal(t, tc.wantReturnCode, rc, "Return expected code")
+		})
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := map[string]struct {
+		content   string
+		noFile    bool
+		passPath  bool
+		extraArgs []string
+
+		wantOut        string
+		wantErr        string
+		wantReturnCode int
+	}{
+		"Valid configuration file":                   {content: "max_queued_calls: 4\n", passPath: true, wantOut: "config.yaml: OK"},
+		"Valid configuration file at default path":   {content: "max_queued_calls: 4\n", wantOut: "config.yaml: OK"},
+		"Missing configuration file at default path": {noFile: true, wantOut: "the defaults are used"},
+		"Accept short help flag":                     {extraArgs: []string{"-h"}, wantErr: "ubuntu-proxy-manager config-check [path]"},
+
+		"Error on invalid configuration file": {content: "max_queued_calls: many\npolkit: never\n", passPath: true,
+			wantOut: "config.yaml: line 1, column 19: max_queued_calls: cannot unmarshal", wantReturnCode: 1},
+		"Error on missing configuration file":  {noFile: true, passPath: true, wantReturnCode: 1},
+		"Error when passed too many arguments": {passPath: true, extraArgs: []string{"other.yaml"}, wantReturnCode: 2},
+		"Error when passed bad options":        {extraArgs: []string{"-bad-opt"}, wantReturnCode: 2},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if !tc.noFile {
+				err := os.WriteFile(path, []byte(tc.content), 0600)
+				require.NoError(t, err, "Setup: couldn't write configuration file")
+			}
+			var args []string
+			if tc.passPath {
+				args = append(args, path)
+			}
+			args = append(args, tc.extraArgs...)
+
+			initOut, initErr := os.Stdout, os.Stderr
+			defer func() { os.Stdout, os.Stderr = initOut, initErr }()
+			rOut, wOut, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stdout")
+			rErr, wErr, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stderr")
+			os.Stdout, os.Stderr = wOut, wErr
+
+			rc := configCheck(args, path)
+
+			err = wOut.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stdout")
+			os.Stdout = initOut
+			err = wErr.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stderr")
+			os.Stderr = initErr
+
+			var bufOut, bufErr bytes.Buffer
+			_, err = io.Copy(&bufOut, rOut)
+			require.NoError(t, err, "Setup: couldn't read stdout")
+			_, err = io.Copy(&bufErr, rErr)
+			require.NoError(t, err, "Setup: couldn't read stderr")
+
+			if tc.wantOut != "" {
+				require.Contains(t, bufOut.String(), tc.wantOut, "stdout doesn't contain expected output")
+			}
+			if tc.wantErr != "" {
+				require.Contains(t, bufErr.String(), tc.wantErr, "stderr doesn't contain expected output")
+			}
+			require.Equal(t, tc.wantReturnCode, rc, "Return expected code")
+		})
+	}
+}
+
+func TestImportConfig(t *testing.T) {
+	plan := migration.Plan{
+		Settings:   proxy.Settings{HTTP: "http://proxy.example.com:3128"},
+		Directives: []migration.Directive{{Path: "/etc/environment", Line: 1, Text: "http_proxy=http://proxy.example.com:3128", Setting: "http", Value: "http://proxy.example.com:3128"}},
+	}
+
+	tests := map[string]struct {
+		args       []string
+		answer     string
+		emptyPlan  bool
+		scanError  bool
+		applyError bool
+
+		wantApplied    bool
+		wantOut        string
+		wantErr        string
+		wantReturnCode int
+	}{
+		"Import once confirmed":             {answer: "y\n", wantApplied: true, wantOut: "The proxy configuration was imported."},
+		"Import without confirmation":       {args: []string{"--yes"}, wantApplied: true, wantOut: "/etc/environment:1: http_proxy="},
+		"Print the plan on dry run":         {args: []string{"--dry-run"}, wantOut: "http: http://proxy.example.com:3128"},
+		"Nothing to import":                 {emptyPlan: true, wantOut: "No proxy configuration to import."},
+		"Accept short help flag":            {args: []string{"-h"}, wantErr: "ubuntu-proxy-manager import [--dry-run] [--yes]"},
+		"Do not import when not confirmed":  {answer: "n\n", wantOut: "Nothing was imported.", wantReturnCode: 1},
+		"Do not import when input is empty": {wantOut: "Nothing was imported.", wantReturnCode: 1},
+
+		"Error when scanning fails":            {scanError: true, wantReturnCode: 1},
+		"Error when applying fails":            {args: []string{"--yes"}, applyError: true, wantApplied: true, wantReturnCode: 1},
+		"Error when passed too many arguments": {args: []string{"/etc"}, wantReturnCode: 2},
+		"Error when passed bad options":        {args: []string{"-bad-opt"}, wantReturnCode: 2},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var applied bool
+			scan := func() (migration.Plan, error) {
+				if tc.scanError {
+					return migration.Plan{}, errors.New("Error requested for scan")
+				}
+				if tc.emptyPlan {
+					return migration.Plan{}, nil
+				}
+				return plan, nil
+			}
+			apply := func(p migration.Plan) error {
+				applied = true
+				require.Equal(t, plan, p, "Applied plan should be the scanned one")
+				if tc.applyError {
+					return errors.New("Error requested for apply")
+				}
+				return nil
+			}
+
+			initOut, initErr := os.Stdout, os.Stderr
+			defer func() { os.Stdout, os.Stderr = initOut, initErr }()
+			rOut, wOut, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stdout")
+			rErr, wErr, err := os.Pipe()
+			require.NoError(t, err, "Setup: couldn't create pipe for stderr")
+			os.Stdout, os.Stderr = wOut, wErr
+
+			rc := importConfig(tc.args, strings.NewReader(tc.answer), scan, apply)
+
+			err = wOut.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stdout")
+			os.Stdout = initOut
+			err = wErr.Close()
+			require.NoError(t, err, "Setup: couldn't close pipe for stderr")
+			os.Stderr = initErr
+
+			var bufOut, bufErr bytes.Buffer
+			_, err = io.Copy(&bufOut, rOut)
+			require.NoError(t, err, "Setup: couldn't read stdout")
+			_, err = io.Copy(&bufErr, rErr)
+			require.NoError(t, err, "Setup: couldn't read stderr")
+
+			if tc.wantOut != "" {
+				require.Contains(t, bufOut.String(), tc.wantOut, "stdout doesn't contain expected output")
+			}
+			if tc.wantErr != "" {
+				require.Contains(t, bufErr.String(), tc.wantErr, "stderr doesn't contain expected output")
+			}
+			require.Equal(t, tc.wantApplied, applied, "Plan should be applied only when requested")
+			require.Equal(t, tc.wantReturnCode, rc, "Return expected code")
+		})
+	}
+}
@@ -2,9 +2,14 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -12,7 +17,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/ubuntu/decorate"
 	"github.com/ubuntu/ubuntu-proxy-manager/internal/authorizer"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/config"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/notifier"
 	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/state"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -20,65 +29,364 @@ var (
 	Version = "dev"
 )
 
+// The bus name, object path and interface of the service. The bus name must
+// match the one of the shipped D-Bus activation, policy and systemd unit files,
+// which is checked on startup.
 const (
 	dbusObjectPath = "/com/ubuntu/ProxyManager"
 	dbusInterface  = "com.ubuntu.ProxyManager"
 
 	polkitApplyAction = "com.ubuntu.ProxyManager.apply"
+	polkitReadAction  = "com.ubuntu.ProxyManager.read"
 )
 
+// signalSettingsApplied is the signal sent after each successful Apply call.
+const signalSettingsApplied = "SettingsApplied"
+
 const timeout = 1 * time.Second
 
+// defaultMaxQueuedCalls is the default maximum number of apply requests being
+// handled at the same time, including the one currently being applied.
+const defaultMaxQueuedCalls = 16
+
+// busPolicyFile is the D-Bus policy file allowing the service to own its name.
+const busPolicyFile = "/usr/share/dbus-1/system.d/com.ubuntu.ProxyManager.conf"
+
+// ErrNameOwnershipDenied is returned when the bus security policy doesn't allow
+// the service to own its D-Bus name.
+var ErrNameOwnershipDenied = errors.New("not allowed to own the D-Bus name")
+
+const (
+	// errBusyName is the D-Bus error name returned when too many requests are queued.
+	errBusyName = dbusInterface + ".Error.Busy"
+	// errInvalidArgsName is the D-Bus error name returned when the given arguments are invalid.
+	errInvalidArgsName = "org.freedesktop.DBus.Error.InvalidArgs"
+)
+
 // proxyManagerBus is the object exported to the D-Bus interface.
 type proxyManagerBus struct {
+	conn       *dbus.Conn
 	authorizer authorizerer
 	proxy      proxyApplier
 
 	applyCalls    chan applyCall
 	applyResponse chan error
 
+	// pendingCalls is the number of calls being handled, either waiting for
+	// authorization, queued or being applied.
+	pendingCalls   atomic.Int32
+	maxQueuedCalls int32
+
+	stats   *callStats
+	notices *noticeLog
+
+	// busMismatches are the mismatches found between the installed bus files
+	// and the service on startup.
+	busMismatches []string
+
+	// errs are the errors that occurred outside of the main loop.
+	errs   error
+	errsMu sync.Mutex
+
 	exited bool
 	exitMu sync.RWMutex
 }
 
+// callStats counts noteworthy calls received during the activation.
+type callStats struct {
+	// busyRejections is the number of calls rejected because the queue was full.
+	busyRejections atomic.Int32
+	// legacyApplyCalls is the number of calls to the deprecated five-argument Apply method.
+	legacyApplyCalls atomic.Int32
+}
+
 // App is the main application object.
 type App struct {
 	busObject *proxyManagerBus
+	conn      *dbus.Conn
 }
 
 type options struct {
-	authorizer authorizerer
-	proxy      proxyApplier
+	authorizer     authorizerer
+	proxy          proxyApplier
+	maxQueuedCalls int
+
+	configPath string
+	busFiles   busFiles
 }
 type option func(*options)
 
 type authorizerer interface {
-	CheckSenderAllowed(string, dbus.Sender) error
+	CheckSenderAllowed(string, dbus.Sender) (authorizer.CallerIdentity, error)
+	QuerySenderAllowed(string, dbus.Sender) (authorizer.Authorization, error)
 }
 type proxyApplier interface {
-	Apply(string, string, string, string, string, string) error
+	Validate(proxy.Settings) error
+	Normalize(proxy.Settings) (proxy.Settings, []proxy.Warning, error)
+	Apply(proxy.Settings) error
+	RotateCredentials(map[string]proxy.Credentials) error
+	RetryPending() error
+	Reset() error
+	Rollback() error
+	ManagedFileContents() (map[string]string, error)
+	Configuration() (proxy.Settings, error)
+	Preview(proxy.Settings) (map[string]string, error)
+	Backends() []proxy.BackendStatus
+	LastApplied(since time.Time) (*proxy.HistoryEntry, error)
+	RecordHistory(proxy.HistoryEntry) error
+	History() ([]proxy.HistoryEntry, error)
+	SupportBundle() (proxy.Bundle, error)
+	Shutdown()
 }
 
 type applyCall struct {
 	sender dbus.Sender
-
-	http  string
-	https string
-	ftp   string
-	socks string
-	no    string
-	auto  string
+	caller authorizer.CallerIdentity
+
+	settings proxy.Settings
+	// credentials are set for RotateCredentials calls, which don't use settings.
+	credentials map[string]proxy.Credentials
+	// retryPending is set for RetryPending calls, which don't use settings.
+	retryPending bool
+	// reset is set for Reset calls, which don't use settings.
+	reset bool
+	// rollback is set for Rollback calls, which don't use settings.
+	rollback bool
 }
 
+// applyOptionEmptyMeansNoop is the Apply option overriding the empty_means_noop
+// setting of the daemon for the call.
+const applyOptionEmptyMeansNoop = "empty_means_noop"
+
+// applyOptionAPTHostProxies is the Apply option setting the proxies used by
+// APT for specific hosts, indexed by host.
+const applyOptionAPTHostProxies = "apt_host_proxies"
+
+// applyOptionNTLM is the Apply option setting the domain of the account of the
+// HTTP and HTTPS proxies, if they require NTLM authentication.
+const applyOptionNTLM = "ntlm"
+
+// applyOptionStoreID is the Apply option setting the ID of the Snap Store Proxy
+// snapd is registered against.
+const applyOptionStoreID = "store_id"
+
+// applyOptionBackends is the Apply option restricting the call to the backends
+// of the given names.
+const applyOptionBackends = "backends"
+
 // Apply is a function called via D-Bus to apply the system proxy settings.
-func (b *proxyManagerBus) Apply(sender dbus.Sender, http, https, ftp, socks, no, auto string) *dbus.Error {
+// The options passed in the trailing options dictionary, if any, are read from
+// msg.
+func (b *proxyManagerBus) Apply(sender dbus.Sender, msg dbus.Message, http, https, ftp, socks, no, auto string) *dbus.Error {
+	settings := proxy.Settings{HTTP: http, HTTPS: https, FTP: ftp, SOCKS: socks, NoProxy: no, Auto: auto}
+	optionsErr := setApplyOptions(&settings, callOptions(msg))
+
+	return b.queueSettings("Apply", sender, settings, optionsErr)
+}
+
+// ApplyWithOptions is a function called via D-Bus to apply the system proxy
+// settings, all passed in a dictionary along with the Apply options, so that
+// new settings can be added without changing the method signature. Unsupported
+// keys are refused, rather than ignored as by Apply, as they may be settings.
+func (b *proxyManagerBus) ApplyWithOptions(sender dbus.Sender, options map[string]dbus.Variant) *dbus.Error {
+	var settings proxy.Settings
+	optionsErr := setApplySettings(&settings, options)
+
+	return b.queueSettings("ApplyWithOptions", sender, settings, optionsErr)
+}
+
+// queueSettings validates the given settings, which are refused with optionsErr
+// if it isn't nil, before queuing them for the given method.
+func (b *proxyManagerBus) queueSettings(method string, sender dbus.Sender, settings proxy.Settings, optionsErr error) *dbus.Error {
+	return b.queueApplyCall(method, sender, applyCall{settings: settings}, func() error {
+		if optionsErr != nil {
+			return optionsErr
+		}
+		return b.proxy.Validate(settings)
+	})
+}
+
+// setApplySettings sets the settings and options of an ApplyWithOptions call,
+// keyed as settingArgs or their aliases and by the names of the options, to s.
+// Missing settings are empty.
+func setApplySettings(s *proxy.Settings, options map[string]dbus.Variant) error {
+	args := settingArgs(s)
+
+	if _, found := options[settingMode]; found {
+		return fmt.Errorf("setting %s is not supported: the mode follows the settings, set %s for automatic configuration or leave every setting empty to remove the configuration", settingMode, settingAutoconfigURL)
+	}
+	for alias, key := range settingAliases {
+		_, aliasFound := options[alias]
+		if _, found := options[key]; found && aliasFound {
+			return fmt.Errorf("setting %s is an alias of %s, they can't be both set", alias, key)
+		}
+	}
+
+	var unsupported []string
+	for key, v := range options {
+		if slices.Contains(applyOptions, key) {
+			continue
+		}
+		name := key
+		if canonical, ok := settingAliases[key]; ok {
+			name = canonical
+		}
+		arg, found := args[name]
+		if !found {
+			unsupported = append(unsupported, key)
+			continue
+		}
+		value, ok := v.Value().(string)
+		if !ok {
+			return fmt.Errorf("setting %s must be a string, got a value of signature %q", key, v.Signature())
+		}
+		*arg = value
+	}
+	if len(unsupported) > 0 {
+		slices.Sort(unsupported)
+		return fmt.Errorf("unsupported settings: %s", strings.Join(unsupported, ", "))
+	}
+
+	return setApplyOptions(s, options)
+}
+
+// settingAutoconfigURL is the ApplyWithOptions key of the autoconfiguration
+// URL.
+const settingAutoconfigURL = "autoconfig_url"
+
+// settingAliases are the keys accepted by ApplyWithOptions in place of the
+// canonical ones they index, such as the name of the Apply argument setting the
+// autoconfiguration URL.
+var settingAliases = map[string]string{"auto": settingAutoconfigURL}
+
+// settingMode is the key of the proxy mode, which ApplyWithOptions refuses as
+// the mode follows the settings: the autoconfiguration URL takes precedence
+// over the proxies, and empty settings remove the configuration.
+const settingMode = "mode"
+
+// settingArgs returns the fields of s, indexed by their ApplyWithOptions key.
+func settingArgs(s *proxy.Settings) map[string]*string {
+	return map[string]*string{
+		"http":               &s.HTTP,
+		"https":              &s.HTTPS,
+		"ftp":                &s.FTP,
+		"socks":              &s.SOCKS,
+		"no_proxy":           &s.NoProxy,
+		settingAutoconfigURL: &s.Auto,
+	}
+}
+
+// applyOptions are the names of the options supported by Apply.
+var applyOptions = []string{applyOptionEmptyMeansNoop, applyOptionAPTHostProxies, applyOptionNTLM, applyOptionStoreID, applyOptionBackends}
+
+// setApplyOptions sets the options of an Apply call passed in the options
+// dictionary to s.
+func setApplyOptions(s *proxy.Settings, options map[string]dbus.Variant) error {
+	if v, found := options[applyOptionEmptyMeansNoop]; found {
+		noop, ok := v.Value().(bool)
+		if !ok {
+			return fmt.Errorf("option %s must be a boolean, got a value of signature %q", applyOptionEmptyMeansNoop, v.Signature())
+		}
+		s.EmptyMeansNoop = &noop
+	}
+	if v, found := options[applyOptionAPTHostProxies]; found {
+		proxies, ok := v.Value().(map[string]string)
+		if !ok {
+			return fmt.Errorf("option %s must be a dictionary of strings, got a value of signature %q", applyOptionAPTHostProxies, v.Signature())
+		}
+		s.APTHostProxies = proxies
+	}
+	if v, found := options[applyOptionNTLM]; found {
+		domain, ok := v.Value().(string)
+		if !ok {
+			return fmt.Errorf("option %s must be a string, got a value of signature %q", applyOptionNTLM, v.Signature())
+		}
+		s.NTLMDomain = domain
+	}
+	if v, found := options[applyOptionStoreID]; found {
+		id, ok := v.Value().(string)
+		if !ok {
+			return fmt.Errorf("option %s must be a string, got a value of signature %q", applyOptionStoreID, v.Signature())
+		}
+		s.SnapStoreID = &id
+	}
+	if v, found := options[applyOptionBackends]; found {
+		backends, ok := v.Value().([]string)
+		if !ok {
+			return fmt.Errorf("option %s must be an array of strings, got a value of signature %q", applyOptionBackends, v.Signature())
+		}
+		s.Backends = backends
+	}
+	return nil
+}
+
+// RotateCredentials is a function called via D-Bus to replace the credentials
+// of the applied proxies, indexed by protocol, keeping every other setting.
+func (b *proxyManagerBus) RotateCredentials(sender dbus.Sender, credentials map[string]proxy.Credentials) *dbus.Error {
+	return b.queueApplyCall("RotateCredentials", sender, applyCall{credentials: credentials}, func() error {
+		return proxy.CheckCredentials(credentials)
+	})
+}
+
+// RetryPending is a function called via D-Bus to install the configuration
+// which couldn't be applied by the last Apply call because a prerequisite of
+// its backend was missing, if it is met now.
+func (b *proxyManagerBus) RetryPending(sender dbus.Sender) *dbus.Error {
+	return b.queueApplyCall("RetryPending", sender, applyCall{retryPending: true}, func() error { return nil })
+}
+
+// Reset is a function called via D-Bus to remove the proxy configuration of
+// every backend, whatever the empty_means_noop setting of the daemon.
+func (b *proxyManagerBus) Reset(sender dbus.Sender) *dbus.Error {
+	return b.queueApplyCall("Reset", sender, applyCall{reset: true}, func() error { return nil })
+}
+
+// Rollback is a function called via D-Bus to apply again the configuration
+// before the last successful call, such as after broken settings were pushed.
+func (b *proxyManagerBus) Rollback(sender dbus.Sender) *dbus.Error {
+	return b.queueApplyCall("Rollback", sender, applyCall{rollback: true}, func() error { return nil })
+}
+
+// queueApplyCall handles the D-Bus method modifying the system proxy settings,
+// sending the call to the main loop once validated and authorized, and waiting
+// for its result.
+func (b *proxyManagerBus) queueApplyCall(method string, sender dbus.Sender, call applyCall, validate func() error) *dbus.Error {
 	// Application was already asked to quit, so return an error without applying anything
 	if b.QuitRequested() {
 		return dbus.MakeFailedError(errors.New("application is exiting"))
 	}
 
+	defer b.pendingCalls.Add(-1)
+	if n := b.pendingCalls.Add(1); n > b.maxQueuedCalls {
+		b.stats.busyRejections.Add(1)
+		log.Warningf("Rejecting %s call from %s: %d requests are already queued", method, sender, n-1)
+		return dbus.NewError(errBusyName, []interface{}{"too many queued requests, try again later"})
+	}
+
+	log.Debugf("Sender %s called %s", sender, method)
+
+	// Requests are handled in the following order:
+	//   1. the arguments are validated, so that invalid requests are rejected
+	//      without prompting the caller for authentication;
+	//   2. the caller is authorized before queuing the request, so that a
+	//      caller stuck in an interactive authentication doesn't block the
+	//      other ones;
+	//   3. the request is queued and applied, checking prerequisites and
+	//      accessing the filesystem.
+	if err := validate(); err != nil {
+		b.recordError(err)
+		return dbus.NewError(errInvalidArgsName, []interface{}{err.Error()})
+	}
+
+	caller, err := b.authorizer.CheckSenderAllowed(polkitApplyAction, sender)
+	if err != nil {
+		b.recordError(err)
+		return dbus.MakeFailedError(err)
+	}
+
 	// Send the request to the main loop
-	b.applyCalls <- applyCall{sender, http, https, ftp, socks, no, auto}
+	call.sender, call.caller = sender, caller
+	b.applyCalls <- call
 
 	// Wait for the main loop to process the request
 	if err := <-b.applyResponse; err != nil {
@@ -87,13 +395,281 @@ func (b *proxyManagerBus) Apply(sender dbus.Sender, http, https, ftp, socks, no,
 	return nil
 }
 
+// CanApply is a function called via D-Bus to know whether the caller is allowed
+// to apply the system proxy settings, without prompting for authentication.
+// It returns "yes", "challenge" if the caller needs to authenticate, or "no".
+func (b *proxyManagerBus) CanApply(sender dbus.Sender) (string, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called CanApply", sender)
+
+	auth, err := b.authorizer.QuerySenderAllowed(polkitApplyAction, sender)
+	if err != nil {
+		log.Warningf("Couldn't query authorization for %s: %v", sender, err)
+	}
+	return string(auth), nil
+}
+
+// GetManagedFileContents is a function called via D-Bus to return the contents
+// of the files generated by the service, indexed by their path. Passwords are
+// masked in the returned contents.
+func (b *proxyManagerBus) GetManagedFileContents(sender dbus.Sender) (map[string]string, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called GetManagedFileContents", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	contents, err := b.proxy.ManagedFileContents()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	return contents, nil
+}
+
+// GetConfiguration is a function called via D-Bus to return the applied proxy
+// configuration, keyed as the settings and options of ApplyWithOptions. Empty
+// settings are omitted, and passwords are masked.
+func (b *proxyManagerBus) GetConfiguration(sender dbus.Sender) (map[string]dbus.Variant, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called GetConfiguration", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	s, err := b.proxy.Configuration()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	return settingsDict(s), nil
+}
+
+// settingsDict returns s keyed as the settings and options of
+// ApplyWithOptions. Empty settings are omitted.
+func settingsDict(s proxy.Settings) map[string]dbus.Variant {
+	dict := make(map[string]dbus.Variant)
+	for key, value := range settingArgs(&s) {
+		if *value != "" {
+			dict[key] = dbus.MakeVariant(*value)
+		}
+	}
+	if len(s.APTHostProxies) > 0 {
+		dict[applyOptionAPTHostProxies] = dbus.MakeVariant(s.APTHostProxies)
+	}
+	return dict
+}
+
+// Validate is a function called via D-Bus to validate the settings and options
+// passed in the same dictionary as ApplyWithOptions, without applying them. It
+// returns the settings as they would be applied, keyed as GetConfiguration
+// does, and the warnings about the backends which won't apply them as given,
+// followed by the deprecation notices triggered by the caller. Invalid settings
+// are refused with an error.
+func (b *proxyManagerBus) Validate(sender dbus.Sender, options map[string]dbus.Variant) (map[string]dbus.Variant, []proxy.Warning, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called Validate", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, nil, dbus.MakeFailedError(err)
+	}
+
+	var settings proxy.Settings
+	if err := setApplySettings(&settings, options); err != nil {
+		return nil, nil, dbus.MakeFailedError(err)
+	}
+
+	normalized, warnings, err := b.proxy.Normalize(settings)
+	if err != nil {
+		return nil, nil, dbus.MakeFailedError(err)
+	}
+	warnings = append(warnings, b.notices.warnings(sender)...)
+	return settingsDict(normalized), warnings, nil
+}
+
+// Preview is a function called via D-Bus to return the unified diffs of the
+// files an ApplyWithOptions call with the same dictionary would change, keyed
+// by path, without changing anything. Passwords are masked.
+func (b *proxyManagerBus) Preview(sender dbus.Sender, options map[string]dbus.Variant) (map[string]string, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called Preview", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	var settings proxy.Settings
+	if err := setApplySettings(&settings, options); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	diffs, err := b.proxy.Preview(settings)
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	return diffs, nil
+}
+
+// ListBackends is a function called via D-Bus to return the backends compiled
+// in, in the order they are applied, with their mode and whether they are
+// available on this system.
+func (b *proxyManagerBus) ListBackends(sender dbus.Sender) ([]proxy.BackendStatus, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called ListBackends", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	return b.proxy.Backends(), nil
+}
+
+// historyEntry is a successful Apply call, as returned by History.
+type historyEntry struct {
+	// Time is the time of the call, in seconds since the epoch.
+	Time           int64
+	UID            uint32
+	Username       string
+	PID            uint32
+	BusName        string
+	Operation      string
+	Settings       map[string]string
+	APTHostProxies map[string]string
+}
+
+// History is a function called via D-Bus to return the most recent successful
+// Apply calls, the latest first, with credentials masked.
+func (b *proxyManagerBus) History(sender dbus.Sender) ([]historyEntry, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called History", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+
+	history, err := b.proxy.History()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	entries := []historyEntry{}
+	for _, e := range history {
+		entries = append(entries, historyEntry{Time: e.Time.Unix(), UID: e.UID, Username: e.Username, PID: e.PID, BusName: e.BusName, Operation: e.Operation, Settings: e.Settings, APTHostProxies: e.APTHostProxies})
+	}
+	return entries, nil
+}
+
+// GetSupportBundle is a function called via D-Bus to return a JSON document
+// summarizing the proxy configuration of the system, to be attached to support
+// requests. Credentials are masked.
+func (b *proxyManagerBus) GetSupportBundle(sender dbus.Sender) (string, *dbus.Error) {
+	// Counted as pending so that the application doesn't exit before replying
+	b.pendingCalls.Add(1)
+	defer b.pendingCalls.Add(-1)
+
+	log.Debugf("Sender %s called GetSupportBundle", sender)
+
+	if _, err := b.authorizer.CheckSenderAllowed(polkitReadAction, sender); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	data, err := supportBundleJSON(b.proxy, b.busMismatches)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
 func (b *proxyManagerBus) apply(args applyCall) error {
-	log.Debugf("Sender %s called Apply: %v", args.sender, args)
+	if args.retryPending {
+		log.Infof("Retrying pending proxy configuration on behalf of uid %d (%q, pid %d)", args.caller.UID, args.caller.Username, args.caller.PID)
+
+		return b.proxy.RetryPending()
+	}
+
+	start := time.Now()
+	var err error
+	switch {
+	case args.reset:
+		log.Infof("Resetting proxy configuration on behalf of uid %d (%q, pid %d)", args.caller.UID, args.caller.Username, args.caller.PID)
+
+		err = b.proxy.Reset()
+	case args.rollback:
+		log.Infof("Rolling back proxy configuration on behalf of uid %d (%q, pid %d)", args.caller.UID, args.caller.Username, args.caller.PID)
+
+		err = b.proxy.Rollback()
+	case args.credentials != nil:
+		log.Infof("Rotating proxy credentials on behalf of uid %d (%q, pid %d)", args.caller.UID, args.caller.Username, args.caller.PID)
 
-	if err := b.authorizer.CheckSenderAllowed(polkitApplyAction, args.sender); err != nil {
+		err = b.proxy.RotateCredentials(args.credentials)
+	default:
+		log.Infof("Applying proxy settings on behalf of uid %d (%q, pid %d)", args.caller.UID, args.caller.Username, args.caller.PID)
+
+		err = b.proxy.Apply(args.settings)
+	}
+	if err != nil {
 		return err
 	}
-	return b.proxy.Apply(args.http, args.https, args.ftp, args.socks, args.no, args.auto)
+
+	// The history is kept for auditing and the signal sent to the interested
+	// components, neither failing the call.
+	entry, err := b.proxy.LastApplied(start)
+	if err != nil {
+		log.Warningf("%v", err)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+	entry.UID, entry.Username, entry.PID, entry.BusName = args.caller.UID, args.caller.Username, args.caller.PID, args.caller.BusName
+	if err := b.proxy.RecordHistory(*entry); err != nil {
+		log.Warningf("%v", err)
+	}
+	b.emitSettingsApplied(entry.SettingsHash, entry.Backends)
+	return nil
+}
+
+// emitSettingsApplied sends the SettingsApplied signal, with the hash of the
+// applied settings and the given backends whose configuration was applied or
+// removed. As every bus client receives it, the signal doesn't carry the
+// settings, which require the read authorization of GetConfiguration, nor the
+// hash of the credentials.
+func (b *proxyManagerBus) emitSettingsApplied(settingsHash string, backends []string) {
+	if backends == nil {
+		backends = []string{}
+	}
+	if err := b.conn.Emit(dbusObjectPath, dbusInterface+"."+signalSettingsApplied, settingsHash, backends); err != nil {
+		log.Warningf("Couldn't send the %s signal: %v", signalSettingsApplied, err)
+	}
+}
+
+// recordError stores an error which occurred outside of the main loop, to be
+// returned when the application exits.
+func (b *proxyManagerBus) recordError(err error) {
+	b.errsMu.Lock()
+	defer b.errsMu.Unlock()
+
+	b.errs = errors.Join(b.errs, err)
 }
 
 // QuitRequested returns true if the application has been requested to quit.
@@ -104,25 +680,86 @@ func (b *proxyManagerBus) QuitRequested() bool {
 	return b.exited
 }
 
-// New creates a new App object.
-func New(args ...option) (a *App, err error) {
-	defer decorate.OnError(&err, "cannot initialize application")
+// newProxy returns the proxy manager set up from the configuration.
+func newProxy(cfg config.Config) *proxy.Proxy {
+	var reporter proxy.Reporter
+	if cfg.NotifyEndpoint != "" {
+		n, err := notifier.New(cfg.NotifyEndpoint)
+		if err != nil {
+			log.Warningf("Not reporting Apply calls: %v", err)
+		} else {
+			reporter = n
+		}
+	}
 
-	// Don't call dbus.SystemBus which caches globally system dbus (issues in tests)
-	// Add interceptor to log dbus messages at debug level
-	// Pass context to dbus connection so we handle closing it on context cancel
-	conn, err := dbus.ConnectSystemBus(
-		dbus.WithIncomingInterceptor(func(msg *dbus.Message) {
-			log.Debugf("DBUS: %s", msg)
-		}))
+	return proxy.New(
+		proxy.WithAllowedHosts(cfg.AllowedProxyHosts),
+		proxy.WithEnvSOCKSAllProxy(cfg.EnvSOCKSAllProxy),
+		proxy.WithSystemdUserConf(cfg.SystemdUserConf),
+		proxy.WithNoProxyProfile(cfg.NoProxyProfile),
+		proxy.WithGSettingsUseSameProxy(cfg.GSettingsUseSameProxy),
+		proxy.WithGSettingsVerification(cfg.GSettingsVerify),
+		proxy.WithExtraLines(cfg.ExtraLines),
+		proxy.WithBackendModes(cfg.BackendModes),
+		proxy.WithEmptyMeansNoop(cfg.EmptyMeansNoop),
+		proxy.WithStateDir(filepath.Join("/", state.DefaultDir)),
+		proxy.WithReporter(reporter),
+	)
+}
+
+// SupportBundle returns a JSON document summarizing the proxy configuration
+// of the system, without connecting to the bus. Credentials are masked.
+func SupportBundle(args ...option) (data []byte, err error) {
+	defer decorate.OnError(&err, "cannot create support bundle")
+
+	opts := options{
+		configPath: filepath.Join("/", config.DefaultPath),
+		busFiles:   defaultBusFiles,
+	}
+	for _, f := range args {
+		f(&opts)
+	}
+
+	if opts.proxy == nil {
+		cfg, err := config.Load(opts.configPath)
+		if err != nil {
+			return nil, err
+		}
+		opts.proxy = newProxy(cfg)
+	}
+
+	return supportBundleJSON(opts.proxy, checkBusFiles(opts.busFiles))
+}
+
+// supportBundleJSON returns the support bundle of p as an indented JSON
+// document, including the version of the program and the given mismatches
+// between the installed bus files and the service.
+func supportBundleJSON(p proxyApplier, busMismatches []string) ([]byte, error) {
+	bundle, err := p.SupportBundle()
 	if err != nil {
 		return nil, err
 	}
+	bundle.Version = Version
+	bundle.Warnings = append(bundle.Warnings, busMismatches...)
+
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// New creates a new App object.
+// Cancelling ctx aborts the creation, but doesn't affect the returned App.
+func New(ctx context.Context, args ...option) (a *App, err error) {
+	defer decorate.OnError(&err, "cannot initialize application")
+	defer func() {
+		// Report the cancellation rather than the resulting connection errors
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
 
 	// Set default options
 	opts := options{
-		authorizer: authorizer.New(conn),
-		proxy:      proxy.New(),
+		configPath: filepath.Join("/", config.DefaultPath),
+		busFiles:   defaultBusFiles,
 	}
 
 	// Apply given options
@@ -130,32 +767,99 @@ func New(args ...option) (a *App, err error) {
 		f(&opts)
 	}
 
-	obj := proxyManagerBus{
-		authorizer:    opts.authorizer,
-		proxy:         opts.proxy,
-		applyCalls:    make(chan applyCall),
-		applyResponse: make(chan error),
+	cfg, err := config.Load(opts.configPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if err = conn.Export(&obj, dbusObjectPath, dbusInterface); err != nil {
-		_ = conn.Close()
+	// A mismatch with the installed bus files may prevent the service from
+	// being activated or reached, but the files may be installed elsewhere.
+	busMismatches := logBusFilesMismatches(opts.busFiles)
+
+	stats := &callStats{}
+	notices := newNoticeLog()
+
+	// Don't call dbus.SystemBus which caches globally system dbus (issues in tests)
+	// Add interceptor to log dbus messages at debug level, and to upgrade calls
+	// to deprecated method signatures
+	// Pass context to dbus connection so we handle closing it on context cancel,
+	// until the application is created
+	// Methods are exported through our own method table, to report precise
+	// errors on calls with unexpected arguments
+	methods := newMethodTable()
+	connCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	conn, err := dbus.ConnectSystemBus(
+		dbus.WithContext(connCtx),
+		dbus.WithHandler(methods),
+		dbus.WithIncomingInterceptor(func(msg *dbus.Message) {
+			log.Debugf("DBUS: %s", msg)
+			if upgradeLegacyApplyCall(msg) {
+				stats.legacyApplyCalls.Add(1)
+				sender, _ := msg.Headers[dbus.FieldSender].Value().(string)
+				notices.add(dbus.Sender(sender), noticeLegacyApplySignature)
+			}
+		}))
+	if err != nil {
 		return nil, err
 	}
-	if err = conn.Export(introspect.NewIntrospectable(&introspect.Node{
+
+	// Options not overridden are set from the configuration
+	if opts.authorizer == nil {
+		interaction := authorizer.InteractionAuto
+		if cfg.PolkitInteraction != "" {
+			interaction = authorizer.InteractionMode(cfg.PolkitInteraction)
+		}
+		opts.authorizer = authorizer.New(conn, authorizer.WithInteraction(interaction))
+	}
+	if opts.proxy == nil {
+		opts.proxy = newProxy(cfg)
+	}
+	if opts.maxQueuedCalls == 0 {
+		opts.maxQueuedCalls = cfg.MaxQueuedCalls
+	}
+	if opts.maxQueuedCalls == 0 {
+		opts.maxQueuedCalls = defaultMaxQueuedCalls
+	}
+
+	obj := proxyManagerBus{
+		conn:           conn,
+		authorizer:     opts.authorizer,
+		proxy:          opts.proxy,
+		applyCalls:     make(chan applyCall),
+		applyResponse:  make(chan error),
+		maxQueuedCalls: int32(opts.maxQueuedCalls),
+		stats:          stats,
+		notices:        notices,
+		busMismatches:  busMismatches,
+	}
+
+	// Apply accepts the options dictionary some client libraries append to
+	// every call, which carries its own options.
+	methods.export(&obj, dbusObjectPath, dbusInterface, map[string][]string{"Apply": applyOptions})
+	methods.export(introspect.NewIntrospectable(&introspect.Node{
 		Name: dbusObjectPath,
 		Interfaces: []introspect.Interface{
 			introspect.IntrospectData,
 			{
 				Name:    dbusInterface,
 				Methods: introspect.Methods(&obj),
+				Signals: []introspect.Signal{{Name: signalSettingsApplied, Args: []introspect.Arg{
+					{Name: "settings_hash", Type: "s"},
+					{Name: "backends", Type: "as"},
+				}}},
 			},
 		},
-	}), dbusObjectPath, introspect.IntrospectData.Name); err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
+	}), dbusObjectPath, introspect.IntrospectData.Name, nil)
 
 	reply, err := conn.RequestName(dbusInterface, dbus.NameFlagDoNotQueue)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.AccessDenied" {
+		_ = conn.Close()
+		log.Errorf("The bus security policy doesn't allow owning %s, check that %s is installed", dbusInterface, busPolicyFile)
+		return nil, fmt.Errorf("%w: %v", ErrNameOwnershipDenied, err)
+	}
 	if err != nil {
 		_ = conn.Close()
 		return nil, err
@@ -165,31 +869,64 @@ func New(args ...option) (a *App, err error) {
 		return nil, fmt.Errorf("D-Bus name already taken")
 	}
 
+	// Detach the connection from ctx now that the application is created
+	if !stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+
 	return &App{
 		busObject: &obj,
+		conn:      conn,
 	}, nil
 }
 
 // Wait blocks until the all operations are done, returning a joined
 // representation of all errors that occurred during the runs.
+// The D-Bus connection is closed when it returns.
 func (a *App) Wait() error {
-	var globalErr error
+	defer func() {
+		if err := a.conn.Close(); err != nil {
+			log.Warningf("Couldn't close D-Bus connection: %v", err)
+		}
+	}()
+
 	for {
 		select {
 		case call := <-a.busObject.applyCalls:
 			err := a.busObject.apply(call)
-			globalErr = errors.Join(globalErr, err)
+			if err != nil {
+				a.busObject.recordError(err)
+			}
 			a.busObject.applyResponse <- err
 		case <-time.After(timeout):
-			return globalErr
+			// Some callers are still being authorized and will queue their request.
+			if a.busObject.pendingCalls.Load() > 0 {
+				continue
+			}
+
+			if n := a.busObject.stats.busyRejections.Load(); n > 0 {
+				log.Warningf("Rejected %d Apply calls because too many requests were queued", n)
+			}
+			if n := a.busObject.stats.legacyApplyCalls.Load(); n > 0 {
+				log.Warningf("Received %d calls to the deprecated five-argument Apply method", n)
+			}
+
+			a.busObject.errsMu.Lock()
+			defer a.busObject.errsMu.Unlock()
+			return a.busObject.errs
 		}
 	}
 }
 
 // Quit signals the application to stop, waiting for current operations to finish.
+// Waiting for services, such as snapd, to apply the configuration is abandoned
+// so that the program exits promptly.
 func (a *App) Quit() {
 	log.Info("Exiting program on user request...")
 
+	a.busObject.proxy.Shutdown()
+
 	a.busObject.exitMu.Lock()
 	defer a.busObject.exitMu.Unlock()
 
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// busActivationFile is the D-Bus service file starting the service on demand.
+	busActivationFile = "/usr/share/dbus-1/system-services/com.ubuntu.ProxyManager.service"
+	// systemdUnitFile is the systemd unit running the service.
+	systemdUnitFile = "/usr/lib/systemd/system/ubuntu-proxy-manager.service"
+
+	// execPath is the path the service is installed to.
+	execPath = "/usr/libexec/ubuntu-proxy-manager"
+)
+
+// busFiles are the paths of the installed files the bus relies on to start
+// the service and allow it to own its name.
+type busFiles struct {
+	activation string
+	policy     string
+	unit       string
+}
+
+// defaultBusFiles are the paths the files are shipped to.
+var defaultBusFiles = busFiles{
+	activation: busActivationFile,
+	policy:     busPolicyFile,
+	unit:       systemdUnitFile,
+}
+
+// checkBusFiles returns the mismatches between the installed bus files and the
+// bus name and executable path of the service. The files which are absent or
+// can't be read are skipped, as the check is best effort.
+func checkBusFiles(files busFiles) (mismatches []string) {
+	for _, check := range []struct {
+		path string
+		fn   func(string) ([]string, error)
+	}{
+		{files.activation, checkActivationFile},
+		{files.policy, checkPolicyFile},
+		{files.unit, checkUnitFile},
+	} {
+		m, err := check.fn(check.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Debugf("Not checking %s: %v", check.path, err)
+			continue
+		} else if err != nil {
+			log.Warningf("Couldn't check %s: %v", check.path, err)
+			continue
+		}
+		mismatches = append(mismatches, m...)
+	}
+	return mismatches
+}
+
+// logBusFilesMismatches checks the installed bus files, logging an error for
+// each mismatch found, and returns them.
+func logBusFilesMismatches(files busFiles) []string {
+	mismatches := checkBusFiles(files)
+	for _, m := range mismatches {
+		log.Errorf("D-Bus configuration mismatch, the service may fail to start or be unreachable: %s", m)
+	}
+	return mismatches
+}
+
+// checkActivationFile checks that the D-Bus service file at path activates our
+// bus name, by starting our systemd unit or our executable.
+func checkActivationFile(path string) (mismatches []string, err error) {
+	entries, err := parseKeyFile(path, "D-BUS Service")
+	if err != nil {
+		return nil, err
+	}
+
+	if name := entries["Name"]; name != dbusInterface {
+		mismatches = append(mismatches, fmt.Sprintf("%s activates the bus name %q instead of %q", path, name, dbusInterface))
+	}
+	if unit, found := entries["SystemdService"]; found {
+		if want := filepath.Base(systemdUnitFile); unit != want && unit != "dbus-"+dbusInterface+".service" {
+			mismatches = append(mismatches, fmt.Sprintf("%s starts the systemd unit %q instead of %q", path, unit, want))
+		}
+	} else if exec := execCommand(entries["Exec"]); exec != execPath {
+		mismatches = append(mismatches, fmt.Sprintf("%s runs %q instead of %q", path, exec, execPath))
+	}
+	return mismatches, nil
+}
+
+// checkUnitFile checks that the systemd unit at path runs our executable and
+// waits for our bus name.
+func checkUnitFile(path string) (mismatches []string, err error) {
+	entries, err := parseKeyFile(path, "Service")
+	if err != nil {
+		return nil, err
+	}
+
+	if name := entries["BusName"]; name != dbusInterface {
+		mismatches = append(mismatches, fmt.Sprintf("%s waits for the bus name %q instead of %q", path, name, dbusInterface))
+	}
+	// The executable may be prefixed with special characters changing how it
+	// is run.
+	if exec := strings.TrimLeft(execCommand(entries["ExecStart"]), "-@:+!"); exec != execPath {
+		mismatches = append(mismatches, fmt.Sprintf("%s runs %q instead of %q", path, exec, execPath))
+	}
+	return mismatches, nil
+}
+
+// busPolicy is the part of a D-Bus policy file we check.
+type busPolicy struct {
+	Policies []struct {
+		Allow []struct {
+			Own             string `xml:"own,attr"`
+			SendDestination string `xml:"send_destination,attr"`
+			SendInterface   string `xml:"send_interface,attr"`
+		} `xml:"allow"`
+	} `xml:"policy"`
+}
+
+// checkPolicyFile checks that the D-Bus policy file at path allows owning our
+// bus name and calling the methods of our interface.
+func checkPolicyFile(path string) (mismatches []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy busPolicy
+	if err := xml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file: %w", err)
+	}
+
+	var owned, sendable []string
+	for _, p := range policy.Policies {
+		for _, allow := range p.Allow {
+			if allow.Own != "" {
+				owned = append(owned, allow.Own)
+			}
+			if allow.SendDestination == dbusInterface && allow.SendInterface != "" {
+				sendable = append(sendable, allow.SendInterface)
+			}
+		}
+	}
+
+	if !slices.Contains(owned, dbusInterface) {
+		mismatches = append(mismatches, fmt.Sprintf("%s doesn't allow owning the bus name %q, only %q", path, dbusInterface, owned))
+	}
+	if !slices.Contains(sendable, dbusInterface) {
+		mismatches = append(mismatches, fmt.Sprintf("%s doesn't allow calling the interface %q on %q", path, dbusInterface, dbusInterface))
+	}
+	return mismatches, nil
+}
+
+// parseKeyFile returns the entries of the given section of the key file at
+// path, as used by D-Bus service files and systemd units. Later entries
+// override earlier ones.
+func parseKeyFile(path, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	var current string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = line[1 : len(line)-1]
+		case current == section:
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				continue
+			}
+			entries[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// execCommand returns the executable of the given command line.
+func execCommand(cmdline string) string {
+	fields := strings.Fields(cmdline)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// legacyApplySignature is the signature of the pre-release Apply method, which
+// didn't take the autoconfiguration URL argument.
+const legacyApplySignature = "sssss"
+
+// upgradeLegacyApplyCall converts in place a call to the pre-release
+// five-argument Apply method into a call to the current one, with an empty
+// autoconfiguration URL.
+// It returns true if the message was upgraded.
+func upgradeLegacyApplyCall(msg *dbus.Message) bool {
+	if msg.Type != dbus.TypeMethodCall {
+		return false
+	}
+
+	iface, _ := msg.Headers[dbus.FieldInterface].Value().(string)
+	member, _ := msg.Headers[dbus.FieldMember].Value().(string)
+	signature, _ := msg.Headers[dbus.FieldSignature].Value().(dbus.Signature)
+	if iface != dbusInterface || member != "Apply" || signature.String() != legacyApplySignature {
+		return false
+	}
+
+	sender, _ := msg.Headers[dbus.FieldSender].Value().(string)
+	log.Warningf("Sender %s called the deprecated five-argument Apply method, please pass the autoconfiguration URL as a sixth argument", sender)
+
+	msg.Body = append(msg.Body, "")
+	msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(msg.Body...))
+
+	return true
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// optionsSignature is the signature of the options dictionary some client
+// libraries append to every call.
+const optionsSignature = "a{sv}"
+
+// methodTable is a D-Bus handler calling the methods exported from Go values,
+// as the godbus default handler does. It replaces it to reject calls whose
+// arguments don't match the method signature with an error naming the expected
+// and received signatures, and to accept a trailing options dictionary on the
+// methods allowing it.
+type methodTable struct {
+	mu sync.RWMutex
+	// objects maps object paths to interface names to method names.
+	objects map[dbus.ObjectPath]map[string]map[string]*busMethod
+}
+
+// newMethodTable returns an empty method table.
+func newMethodTable() *methodTable {
+	return &methodTable{objects: make(map[dbus.ObjectPath]map[string]map[string]*busMethod)}
+}
+
+// export registers the exported methods of v whose last return value is a
+// *dbus.Error as the methods of iface on path. The methods indexed in options
+// also accept a trailing options dictionary, in which only the given option
+// names are supported. The other ones are ignored.
+func (t *methodTable) export(v interface{}, path dbus.ObjectPath, iface string, options map[string][]string) {
+	methods := make(map[string]*busMethod)
+	val := reflect.ValueOf(v)
+	errType := reflect.TypeOf((*dbus.Error)(nil))
+	for i := 0; i < val.NumMethod(); i++ {
+		name := val.Type().Method(i).Name
+		fn := val.Method(i)
+		if fn.Type().NumOut() == 0 || fn.Type().Out(fn.Type().NumOut()-1) != errType {
+			continue
+		}
+		supported, withOptions := options[name]
+		methods[name] = newBusMethod(name, fn, withOptions, supported)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.objects[path] == nil {
+		t.objects[path] = make(map[string]map[string]*busMethod)
+	}
+	t.objects[path][iface] = methods
+}
+
+// LookupObject implements dbus.Handler.
+func (t *methodTable) LookupObject(path dbus.ObjectPath) (dbus.ServerObject, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	obj, found := t.objects[path]
+	if !found {
+		return nil, false
+	}
+	return busObject(maps.Clone(obj)), true
+}
+
+// busObject maps the interface names of an object to their methods.
+type busObject map[string]map[string]*busMethod
+
+// LookupInterface implements dbus.ServerObject. An empty name matches every
+// interface, as allowed by the D-Bus specification.
+func (o busObject) LookupInterface(name string) (dbus.Interface, bool) {
+	if name == "" {
+		all := make(busInterface)
+		for _, methods := range o {
+			maps.Copy(all, methods)
+		}
+		return all, true
+	}
+	methods, found := o[name]
+	return busInterface(methods), found
+}
+
+// busInterface maps the method names of an interface to their methods.
+type busInterface map[string]*busMethod
+
+// LookupMethod implements dbus.Interface.
+func (i busInterface) LookupMethod(name string) (dbus.Method, bool) {
+	m, found := i[name]
+	return m, found
+}
+
+// busMethod is a method exported on the bus.
+type busMethod struct {
+	name string
+	fn   reflect.Value
+	// signature is the expected signature of the call, without the arguments
+	// set from the message, such as the sender.
+	signature string
+	// withOptions is true if a trailing options dictionary is accepted.
+	withOptions bool
+	// options are the names of the supported options.
+	options []string
+}
+
+var (
+	senderType  = reflect.TypeOf(dbus.Sender(""))
+	messageType = reflect.TypeOf(dbus.Message{})
+)
+
+func newBusMethod(name string, fn reflect.Value, withOptions bool, options []string) *busMethod {
+	var signature string
+	for i := 0; i < fn.Type().NumIn(); i++ {
+		if in := fn.Type().In(i); in != senderType && in != messageType {
+			signature += dbus.SignatureOfType(in).String()
+		}
+	}
+	return &busMethod{name: name, fn: fn, signature: signature, withOptions: withOptions, options: options}
+}
+
+// callOptions returns the options dictionary passed as trailing argument of
+// msg, calling a method accepting one, or nil if none was passed. The
+// unsupported options are included.
+func callOptions(msg dbus.Message) map[string]dbus.Variant {
+	if len(msg.Body) == 0 {
+		return nil
+	}
+	options, _ := msg.Body[len(msg.Body)-1].(map[string]dbus.Variant)
+	return options
+}
+
+// DecodeArguments implements dbus.ArgumentDecoder, checking the signature of
+// the call before decoding its arguments.
+func (m *busMethod) DecodeArguments(_ *dbus.Conn, sender string, msg *dbus.Message, body []interface{}) ([]interface{}, error) {
+	got, _ := msg.Headers[dbus.FieldSignature].Value().(dbus.Signature)
+
+	switch {
+	case got.String() == m.signature:
+	case m.withOptions && got.String() == m.signature+optionsSignature:
+		options, _ := body[len(body)-1].(map[string]dbus.Variant)
+		var unsupported []string
+		for key := range options {
+			if !slices.Contains(m.options, key) {
+				unsupported = append(unsupported, key)
+			}
+		}
+		if len(unsupported) > 0 {
+			slices.Sort(unsupported)
+			log.Warningf("Ignoring options %s passed by %s to %s: they are not supported", strings.Join(unsupported, ", "), sender, m.name)
+		}
+		body = body[:len(body)-1]
+	default:
+		log.Warningf("Rejecting %s call from %s: expected arguments of signature %q, got %q", m.name, sender, m.signature, got)
+		return nil, dbus.NewError(errInvalidArgsName, []interface{}{
+			fmt.Sprintf("%s expects arguments of signature %q, got %q", m.name, m.signature, got),
+		})
+	}
+
+	args := make([]interface{}, m.NumArguments())
+	var decode []interface{}
+	for i := range args {
+		v := reflect.New(m.fn.Type().In(i))
+		args[i] = v.Interface()
+		switch v.Elem().Type() {
+		case senderType:
+			v.Elem().SetString(sender)
+		case messageType:
+			v.Elem().Set(reflect.ValueOf(*msg))
+		default:
+			decode = append(decode, args[i])
+		}
+	}
+	if err := dbus.Store(body, decode...); err != nil {
+		log.Warningf("Rejecting %s call from %s: %v", m.name, sender, err)
+		return nil, dbus.NewError(errInvalidArgsName, []interface{}{fmt.Sprintf("invalid arguments for %s: %v", m.name, err)})
+	}
+	return args, nil
+}
+
+// Call implements dbus.Method, calling the method with the decoded arguments.
+func (m *busMethod) Call(args ...interface{}) ([]interface{}, error) {
+	params := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		params[i] = reflect.ValueOf(arg).Elem()
+	}
+
+	ret := m.fn.Call(params)
+	last := ret[len(ret)-1]
+	out := make([]interface{}, 0, len(ret)-1)
+	for _, v := range ret[:len(ret)-1] {
+		out = append(out, v.Interface())
+	}
+	if last.IsNil() {
+		return out, nil
+	}
+	return out, last.Interface().(*dbus.Error)
+}
+
+// NumArguments implements dbus.Method.
+func (m *busMethod) NumArguments() int { return m.fn.Type().NumIn() }
+
+// NumReturns implements dbus.Method.
+func (m *busMethod) NumReturns() int { return m.fn.Type().NumOut() }
+
+// ArgumentValue implements dbus.Method.
+func (m *busMethod) ArgumentValue(i int) interface{} {
+	return reflect.Zero(m.fn.Type().In(i)).Interface()
+}
+
+// ReturnValue implements dbus.Method.
+func (m *busMethod) ReturnValue(i int) interface{} {
+	return reflect.Zero(m.fn.Type().Out(i)).Interface()
+}
@@ -2,14 +2,27 @@ package app
 
 import (
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/authorizer"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
 )
 
 // MockAuthorizer is a mock authorizer.
 type MockAuthorizer struct {
 	RejectAuth bool
+	CallCount  atomic.Int32
+
+	// BlockSender is a sender for which authorization blocks until Unblock is closed.
+	BlockSender dbus.Sender
+	Unblock     chan struct{}
+
+	// QueryResult is the result returned by QuerySenderAllowed.
+	QueryResult authorizer.Authorization
+	QueryError  bool
 }
 
 // MockProxy is a mock proxy.
@@ -17,20 +30,102 @@ type MockProxy struct {
 	ApplyCount   int
 	ApplyError   bool
 	SleepOnApply time.Duration
+	// LastApplySettings and LastValidateSettings record the settings of the
+	// last Apply and Validate calls.
+	LastApplySettings    proxy.Settings
+	LastValidateSettings proxy.Settings
+	ValidateError        bool
+	// validateMu protects LastValidateSettings, as Validate is called
+	// concurrently by the D-Bus handlers.
+	validateMu sync.Mutex
+	// LastRotateCredentials records the credentials of the last RotateCredentials call.
+	LastRotateCredentials map[string]proxy.Credentials
+	RotateCount           int
+	RotateError           bool
+
+	RetryPendingCount int
+	RetryPendingError bool
+
+	ResetCount int
+	ResetError bool
+
+	RollbackCount int
+	RollbackError bool
+
+	ManagedFiles      map[string]string
+	ManagedFilesError bool
+
+	AppliedSettings      proxy.Settings
+	AppliedSettingsError bool
+
+	// NormalizedSettings and Warnings are returned by Normalize, whose last
+	// settings are recorded in LastNormalizeSettings.
+	LastNormalizeSettings proxy.Settings
+	NormalizedSettings    proxy.Settings
+	Warnings              []proxy.Warning
+
+	BackendStatuses []proxy.BackendStatus
+
+	// AppliedBackends and AppliedSettingsHash are reported by LastApplied.
+	AppliedBackends     []string
+	AppliedSettingsHash string
+	// HistoryUIDs records the callers passed to RecordHistory.
+	HistoryUIDs []uint32
+	// LastRecorded is the last entry passed to RecordHistory.
+	LastRecorded proxy.HistoryEntry
+	HistoryError bool
+	Entries      []proxy.HistoryEntry
+
+	// LastPreviewSettings records the settings of the last Preview call.
+	LastPreviewSettings proxy.Settings
+	PreviewDiffs        map[string]string
+	PreviewError        bool
+
+	Bundle      proxy.Bundle
+	BundleError bool
+
+	ShutdownCount int
 }
 
 // CheckSenderAllowed is a mock implementation of authorizerer, returning an error if requested in the mock.
-func (m *MockAuthorizer) CheckSenderAllowed(_ string, _ dbus.Sender) (err error) {
+func (m *MockAuthorizer) CheckSenderAllowed(_ string, sender dbus.Sender) (authorizer.CallerIdentity, error) {
+	m.CallCount.Add(1)
+
+	if m.BlockSender != "" && m.BlockSender == sender {
+		<-m.Unblock
+	}
+
 	if m.RejectAuth {
-		err = errors.New("authorization rejected")
+		return authorizer.CallerIdentity{}, errors.New("authorization rejected")
 	}
 
-	return err
+	return authorizer.CallerIdentity{UID: 1000, Username: "bob", PID: 10000, BusName: string(sender)}, nil
+}
+
+// QuerySenderAllowed is a mock implementation of authorizerer, returning the result requested in the mock.
+func (m *MockAuthorizer) QuerySenderAllowed(_ string, _ dbus.Sender) (authorizer.Authorization, error) {
+	if m.QueryError {
+		return authorizer.AuthorizationNo, errors.New("authorization query error")
+	}
+	return m.QueryResult, nil
+}
+
+// Validate is a mock implementation of proxier, returning an error if requested in the mock.
+func (m *MockProxy) Validate(s proxy.Settings) error {
+	m.validateMu.Lock()
+	m.LastValidateSettings = s
+	m.validateMu.Unlock()
+
+	if m.ValidateError {
+		return errors.New("proxy validation error")
+	}
+	return nil
 }
 
 // Apply is a mock implementation of proxier, returning an error if requested in the mock.
-func (m *MockProxy) Apply(_, _, _, _, _, _ string) error {
+func (m *MockProxy) Apply(s proxy.Settings) error {
 	m.ApplyCount++
+	m.LastApplySettings = s
 
 	if m.SleepOnApply > 0 {
 		time.Sleep(m.SleepOnApply)
@@ -42,6 +137,115 @@ func (m *MockProxy) Apply(_, _, _, _, _, _ string) error {
 	return nil
 }
 
+// RotateCredentials is a mock implementation of proxier, returning an error if requested in the mock.
+func (m *MockProxy) RotateCredentials(creds map[string]proxy.Credentials) error {
+	m.RotateCount++
+	m.LastRotateCredentials = creds
+
+	if m.RotateError {
+		return errors.New("proxy credentials rotation error")
+	}
+	return nil
+}
+
+// RetryPending is a mock implementation of proxier, returning an error if requested in the mock.
+func (m *MockProxy) RetryPending() error {
+	m.RetryPendingCount++
+
+	if m.RetryPendingError {
+		return errors.New("pending proxy configuration error")
+	}
+	return nil
+}
+
+// Shutdown is a mock implementation of proxier, counting its calls.
+func (m *MockProxy) Shutdown() {
+	m.ShutdownCount++
+}
+
+// Reset is a mock implementation of proxier, returning an error if requested in the mock.
+func (m *MockProxy) Reset() error {
+	m.ResetCount++
+
+	if m.ResetError {
+		return errors.New("proxy reset error")
+	}
+	return nil
+}
+
+// Rollback is a mock implementation of proxier, returning an error if requested in the mock.
+func (m *MockProxy) Rollback() error {
+	m.RollbackCount++
+
+	if m.RollbackError {
+		return errors.New("proxy rollback error")
+	}
+	return nil
+}
+
+// ManagedFileContents is a mock implementation of proxier, returning the files requested in the mock.
+func (m *MockProxy) ManagedFileContents() (map[string]string, error) {
+	if m.ManagedFilesError {
+		return nil, errors.New("managed files read error")
+	}
+	return m.ManagedFiles, nil
+}
+
+// Configuration is a mock implementation of proxier, returning the settings requested in the mock.
+func (m *MockProxy) Configuration() (proxy.Settings, error) {
+	if m.AppliedSettingsError {
+		return proxy.Settings{}, errors.New("applied configuration read error")
+	}
+	return m.AppliedSettings, nil
+}
+
+// Normalize is a mock implementation of proxier, returning the settings and warnings
+// requested in the mock, or an error if requested in the mock.
+func (m *MockProxy) Normalize(s proxy.Settings) (proxy.Settings, []proxy.Warning, error) {
+	m.LastNormalizeSettings = s
+
+	if m.ValidateError {
+		return proxy.Settings{}, nil, errors.New("proxy validation error")
+	}
+	return m.NormalizedSettings, m.Warnings, nil
+}
+
+// Backends is a mock implementation of proxier, returning the backends requested in the mock.
+func (m *MockProxy) Backends() []proxy.BackendStatus {
+	return m.BackendStatuses
+}
+
+// LastApplied is a mock implementation of proxier, returning a call at the given
+// time to the backends requested in the mock.
+func (m *MockProxy) LastApplied(since time.Time) (*proxy.HistoryEntry, error) {
+	return &proxy.HistoryEntry{Time: since, Operation: "apply", Backends: m.AppliedBackends, SettingsHash: m.AppliedSettingsHash}, nil
+}
+
+// RecordHistory is a mock implementation of proxier, recording the caller.
+func (m *MockProxy) RecordHistory(entry proxy.HistoryEntry) error {
+	m.HistoryUIDs = append(m.HistoryUIDs, entry.UID)
+	m.LastRecorded = entry
+	return nil
+}
+
+// History is a mock implementation of proxier, returning the entries requested in the mock.
+func (m *MockProxy) History() ([]proxy.HistoryEntry, error) {
+	if m.HistoryError {
+		return nil, errors.New("history read error")
+	}
+	return m.Entries, nil
+}
+
+// Preview is a mock implementation of proxier, returning the diffs requested in the mock.
+func (m *MockProxy) Preview(s proxy.Settings) (map[string]string, error) {
+	m.LastPreviewSettings = s
+
+	if m.PreviewError {
+		return nil, errors.New("proxy preview error")
+	}
+	return m.PreviewDiffs, nil
+}
+
 // WithAuthorizer overrides the default authorizer implementation.
 func WithAuthorizer(a authorizerer) func(*options) {
 	return func(o *options) {
@@ -55,3 +259,43 @@ func WithProxy(p proxyApplier) func(*options) {
 		o.proxy = p
 	}
 }
+
+// WithMaxQueuedCalls overrides the default maximum number of queued apply requests.
+func WithMaxQueuedCalls(n int) func(*options) {
+	return func(o *options) {
+		o.maxQueuedCalls = n
+	}
+}
+
+// BusyRejections returns the number of calls rejected because the queue was full.
+func (a *App) BusyRejections() int {
+	return int(a.busObject.stats.busyRejections.Load())
+}
+
+// LegacyApplyCalls returns the number of calls to the deprecated five-argument Apply method.
+func (a *App) LegacyApplyCalls() int {
+	return int(a.busObject.stats.legacyApplyCalls.Load())
+}
+
+// WithConfigPath overrides the default configuration file path.
+func WithConfigPath(path string) func(*options) {
+	return func(o *options) {
+		o.configPath = path
+	}
+}
+
+// WithBusFiles overrides the paths of the installed D-Bus activation, policy
+// and systemd unit files checked against the service.
+func WithBusFiles(activation, policy, unit string) func(*options) {
+	return func(o *options) {
+		o.busFiles = busFiles{activation: activation, policy: policy, unit: unit}
+	}
+}
+
+// SupportBundle is a mock implementation of proxier, returning the bundle requested in the mock.
+func (m *MockProxy) SupportBundle() (proxy.Bundle, error) {
+	if m.BundleError {
+		return proxy.Bundle{}, errors.New("support bundle error")
+	}
+	return m.Bundle, nil
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/config"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/migration"
+)
+
+// Import applies the settings of plan, as an Apply call would, without
+// connecting to the bus. The calls of a running service wait for it to
+// complete, as both lock the state directory. Once applied, the directives they were imported from
+// are commented out. Nothing is done if the plan is empty.
+func Import(plan migration.Plan, args ...option) (err error) {
+	defer decorate.OnError(&err, "cannot import proxy configuration")
+
+	// Applying empty settings would remove the current configuration.
+	if plan.Empty() {
+		return nil
+	}
+
+	opts := options{
+		configPath: filepath.Join("/", config.DefaultPath),
+	}
+	for _, f := range args {
+		f(&opts)
+	}
+
+	if opts.proxy == nil {
+		cfg, err := config.Load(opts.configPath)
+		if err != nil {
+			return err
+		}
+		opts.proxy = newProxy(cfg)
+	}
+
+	log.Infof("Importing proxy configuration from %d directives", len(plan.Directives))
+	if err := opts.proxy.Apply(plan.Settings); err != nil {
+		return err
+	}
+
+	return migration.CommentOut(plan.Directives)
+}
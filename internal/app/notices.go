@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"golang.org/x/exp/slices"
+)
+
+// Notice is a deprecation or removal notice returned to D-Bus callers.
+type Notice struct {
+	// ID is a stable identifier for the deprecated behavior.
+	ID string
+	// Message describes the deprecated behavior and how to migrate away from it.
+	Message string
+	// RemovalVersion is the version in which the deprecated behavior will be removed.
+	RemovalVersion string
+}
+
+const (
+	noticeLegacyApplySignature = "legacy-apply-signature"
+)
+
+// warningDeprecated is the kind of the Validate warnings reporting the
+// deprecation notices triggered by the caller.
+const warningDeprecated = "deprecated"
+
+// notices is the table of all deprecation notices, indexed by their identifier.
+// It is the only source of truth for deprecated behaviors: the table of the
+// README must list the same notices.
+var notices = map[string]Notice{
+	noticeLegacyApplySignature: {
+		ID:             noticeLegacyApplySignature,
+		Message:        "Apply was called with five arguments, pass the autoconfiguration URL as a sixth argument",
+		RemovalVersion: "0.3",
+	},
+}
+
+// noticeLog records the deprecation notices triggered by each caller during
+// the activation.
+type noticeLog struct {
+	mu      sync.Mutex
+	senders map[dbus.Sender][]string
+}
+
+func newNoticeLog() *noticeLog {
+	return &noticeLog{senders: make(map[dbus.Sender][]string)}
+}
+
+// add records that sender triggered the notice id. Each notice is recorded
+// only once per sender.
+func (l *noticeLog) add(sender dbus.Sender, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if slices.Contains(l.senders[sender], id) {
+		return
+	}
+	log.Debugf("Sender %s triggered deprecation notice %q", sender, id)
+	l.senders[sender] = append(l.senders[sender], id)
+}
+
+// get returns the notices triggered by sender, in the order they were first
+// triggered.
+func (l *noticeLog) get(sender dbus.Sender) []Notice {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := make([]Notice, 0, len(l.senders[sender]))
+	for _, id := range l.senders[sender] {
+		r = append(r, notices[id])
+	}
+	return r
+}
+
+// warnings returns the notices triggered by sender as warnings of the
+// deprecated kind, with the identifier and the removal version of each notice
+// in its reason.
+func (l *noticeLog) warnings(sender dbus.Sender) []proxy.Warning {
+	var r []proxy.Warning
+	for _, n := range l.get(sender) {
+		r = append(r, proxy.Warning{Kind: warningDeprecated, Reason: fmt.Sprintf("%s: %s, removal in %s", n.ID, n.Message, n.RemovalVersion)})
+	}
+	return r
+}
+
+// Notices is a function called via D-Bus to return the deprecation notices
+// triggered by the caller's requests during this activation.
+func (b *proxyManagerBus) Notices(sender dbus.Sender) ([]Notice, *dbus.Error) {
+	return b.notices.get(sender), nil
+}
@@ -3,9 +3,11 @@
 package authorizer
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -23,8 +25,13 @@ type caller interface {
 type options struct {
 	authority  caller
 	credLookup caller
+	logind     func(dbus.ObjectPath) caller
+	// usernameLookup resolves the name of a user, from the passwd file
+	// under root by default.
+	usernameLookup func(uid uint32) (string, error)
 
-	root string
+	interaction InteractionMode
+	root        string
 }
 
 type option func(*options)
@@ -34,9 +41,51 @@ type option func(*options)
 type Authorizer struct {
 	authority   caller
 	credsLookup caller
+	logind      func(dbus.ObjectPath) caller
+
+	usernameLookup func(uid uint32) (string, error)
+
+	interaction InteractionMode
 	root        string
 }
 
+// InteractionMode defines when callers can be prompted for authentication.
+type InteractionMode string
+
+const (
+	// InteractionAuto only prompts callers from an active graphical session.
+	InteractionAuto InteractionMode = "auto"
+	// InteractionAlways always allows prompting callers.
+	InteractionAlways InteractionMode = "always"
+	// InteractionNever never prompts callers, failing fast instead.
+	InteractionNever InteractionMode = "never"
+)
+
+// logindManagerPath is the object path of the logind manager.
+const logindManagerPath = "/org/freedesktop/login1"
+
+// CallerIdentity identifies the user and process behind an authorized D-Bus call.
+type CallerIdentity struct {
+	UID uint32
+	// Username is empty if it couldn't be resolved.
+	Username string
+	PID      uint32
+	BusName  string
+}
+
+// Authorization is the result of an authorization query which doesn't
+// interact with the user.
+type Authorization string
+
+const (
+	// AuthorizationYes means the caller is authorized without authenticating.
+	AuthorizationYes Authorization = "yes"
+	// AuthorizationChallenge means the caller can be authorized by authenticating.
+	AuthorizationChallenge Authorization = "challenge"
+	// AuthorizationNo means the caller can't be authorized.
+	AuthorizationNo Authorization = "no"
+)
+
 type polkitCheckFlags uint32
 
 const (
@@ -47,6 +96,10 @@ const (
 	// This means that the CheckAuthorization() method will block while the user
 	// is being asked to authenticate.
 	checkAllowInteraction polkitCheckFlags = 0x01
+
+	// checkNone is a polkit flag indicating that the authorization check must
+	// not interact with the user.
+	checkNone polkitCheckFlags = 0x00
 )
 
 type polkitAuthSubject struct {
@@ -71,87 +124,265 @@ func New(bus *dbus.Conn, args ...option) *Authorizer {
 	opts := options{
 		authority:  authority,
 		credLookup: credsLookup,
-		root:       "/",
+		logind: func(path dbus.ObjectPath) caller {
+			return bus.Object("org.freedesktop.login1", path)
+		},
+		interaction: InteractionAuto,
+		root:        "/",
 	}
 
 	// Apply given options
 	for _, f := range args {
 		f(&opts)
 	}
+	if opts.usernameLookup == nil {
+		root := opts.root
+		opts.usernameLookup = func(uid uint32) (string, error) { return lookupUsername(root, uid) }
+	}
 
 	return &Authorizer{
-		authority:   opts.authority,
-		credsLookup: opts.credLookup,
-		root:        opts.root,
+		authority:      opts.authority,
+		credsLookup:    opts.credLookup,
+		logind:         opts.logind,
+		usernameLookup: opts.usernameLookup,
+		interaction:    opts.interaction,
+		root:           opts.root,
 	}
 }
 
-// CheckSenderAllowed returns nil if the user is allowed to perform a given operation.
+// WithInteraction sets when callers can be prompted for authentication.
+func WithInteraction(mode InteractionMode) func(*options) {
+	return func(o *options) {
+		o.interaction = mode
+	}
+}
+
+// CheckSenderAllowed returns the identity of the caller if the user is allowed
+// to perform a given operation.
 // Based on the D-Bus sender it will query the user's credentials and then
 // attempt to authorize the action using polkit.
-func (a Authorizer) CheckSenderAllowed(action string, sender dbus.Sender) (err error) {
+func (a Authorizer) CheckSenderAllowed(action string, sender dbus.Sender) (id CallerIdentity, err error) {
 	log.Debugf("Check if sender %s is allowed to perform action %q", sender, action)
 	defer decorate.OnError(&err, "permission denied")
 
+	uid, pid, err := a.senderCredentials(sender)
+	if err != nil {
+		return id, err
+	}
+
+	if err := a.isAllowed(action, sender, pid, uid); err != nil {
+		return id, err
+	}
+
+	username, err := a.usernameLookup(uid)
+	if err != nil {
+		log.Debugf("Couldn't resolve username for uid %d: %v", uid, err)
+	}
+
+	return CallerIdentity{
+		UID:      uid,
+		Username: username,
+		PID:      pid,
+		BusName:  string(sender),
+	}, nil
+}
+
+// QuerySenderAllowed returns whether the sender is allowed to perform a given
+// operation, can be allowed by authenticating, or can't be allowed.
+// Contrary to CheckSenderAllowed, it never prompts the user for authentication.
+func (a Authorizer) QuerySenderAllowed(action string, sender dbus.Sender) (auth Authorization, err error) {
+	log.Debugf("Query if sender %s is allowed to perform action %q", sender, action)
+	defer decorate.OnError(&err, "couldn't query authorization")
+
+	uid, pid, err := a.senderCredentials(sender)
+	if err != nil {
+		return AuthorizationNo, err
+	}
+
+	if uid == 0 {
+		log.Debug("Authorized as being administrator")
+		return AuthorizationYes, nil
+	}
+
+	result, err := a.checkAuthorization(action, sender, pid, uid, checkNone)
+	if err != nil {
+		return AuthorizationNo, err
+	}
+
+	switch {
+	case result.IsAuthorized:
+		return AuthorizationYes, nil
+	case result.IsChallenge:
+		return AuthorizationChallenge, nil
+	default:
+		return AuthorizationNo, nil
+	}
+}
+
+// senderCredentials returns the uid and pid of the given D-Bus sender.
+func (a Authorizer) senderCredentials(sender dbus.Sender) (uid, pid uint32, err error) {
 	credsResult := make(map[string]dbus.Variant)
 	if err = a.credsLookup.Call("org.freedesktop.DBus.GetConnectionCredentials", 0, string(sender)).Store(&credsResult); err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	var uid, pid uint32
 	uid, ok := credsResult["UnixUserID"].Value().(uint32)
 	if !ok {
-		return errors.New("can't get uid from dbus credentials")
+		return 0, 0, errors.New("can't get uid from dbus credentials")
 	}
 	pid, ok = credsResult["ProcessID"].Value().(uint32)
 	if !ok {
-		return errors.New("can't get pid from dbus credentials")
+		return 0, 0, errors.New("can't get pid from dbus credentials")
 	}
 
-	return a.isAllowed(action, pid, uid)
+	return uid, pid, nil
 }
 
-// isAllowed returns nil if the given uid/pid are allowed to perform the given action.
-func (a Authorizer) isAllowed(action string, pid uint32, uid uint32) (err error) {
+// isAllowed returns nil if the given sender, with the given uid/pid, is allowed
+// to perform the given action.
+func (a Authorizer) isAllowed(action string, sender dbus.Sender, pid uint32, uid uint32) (err error) {
 	if uid == 0 {
 		log.Debug("Authorized as being administrator")
 		return nil
 	}
 
+	flags := checkNone
+	if a.interactionAllowed(pid) {
+		flags = checkAllowInteraction
+	}
+
+	result, err := a.checkAuthorization(action, sender, pid, uid, flags)
+	if err != nil {
+		return err
+	}
+
+	if !result.IsAuthorized {
+		return errors.New("polkit denied access")
+	}
+	return nil
+}
+
+// interactionAllowed returns true if the process can be prompted for
+// authentication, which is only useful from an active graphical session.
+func (a Authorizer) interactionAllowed(pid uint32) bool {
+	switch a.interaction {
+	case InteractionAlways:
+		return true
+	case InteractionNever:
+		return false
+	}
+
+	var sessionPath dbus.ObjectPath
+	if err := a.logind(logindManagerPath).Call("org.freedesktop.login1.Manager.GetSessionByPID", 0, pid).Store(&sessionPath); err != nil {
+		log.Debugf("Couldn't find session of process %d, not allowing interaction: %v", pid, err)
+		return false
+	}
+
+	props := make(map[string]dbus.Variant)
+	if err := a.logind(sessionPath).Call("org.freedesktop.DBus.Properties.GetAll", 0, "org.freedesktop.login1.Session").Store(&props); err != nil {
+		log.Debugf("Couldn't get properties of session %q, not allowing interaction: %v", sessionPath, err)
+		return false
+	}
+
+	sessionType, _ := props["Type"].Value().(string)
+	active, _ := props["Active"].Value().(bool)
+	// Seat is a (so) structure, with an empty seat ID if the session has no seat
+	var seat string
+	if s, ok := props["Seat"].Value().([]interface{}); ok && len(s) > 0 {
+		seat, _ = s[0].(string)
+	}
+
+	graphical := sessionType == "x11" || sessionType == "wayland" || sessionType == "mir"
+	log.Debugf("Session %q of process %d: type %q, active %t, seat %q", sessionPath, pid, sessionType, active, seat)
+	return graphical && active && seat != ""
+}
+
+// checkAuthorization asks polkit whether the given uid/pid are allowed to
+// perform the given action.
+// The user is only prompted for authentication if flags allow interaction.
+func (a Authorizer) checkAuthorization(action string, sender dbus.Sender, pid uint32, uid uint32, flags polkitCheckFlags) (result polkitAuthResult, err error) {
+	subject, err := a.processSubject(pid, uid)
+	if errors.Is(err, fs.ErrPermission) {
+		// With hidepid, the processes of other users can't be inspected, but
+		// polkit can still identify the caller from its bus name.
+		log.Warningf("Couldn't read the stat file of process %d, /proc may be mounted with hidepid: authorizing bus name %s instead", pid, sender)
+		subject = polkitAuthSubject{
+			Kind: "system-bus-name",
+			Details: map[string]dbus.Variant{
+				"name": dbus.MakeVariant(string(sender)),
+			},
+		}
+	} else if err != nil {
+		return result, err
+	}
+
+	var callFlags dbus.Flags
+	if flags&checkAllowInteraction != 0 {
+		callFlags = dbus.FlagAllowInteractiveAuthorization
+	}
+
+	var details map[string]string
+	err = a.authority.Call(
+		"org.freedesktop.PolicyKit1.Authority.CheckAuthorization", callFlags,
+		subject, action, details, flags, "").Store(&result)
+	if err != nil {
+		return result, fmt.Errorf("call to polkit failed: %w", err)
+	}
+	log.Debugf("Polkit call result, authorized: %t, challenge: %t", result.IsAuthorized, result.IsChallenge)
+
+	return result, nil
+}
+
+// processSubject returns the polkit subject identifying the process with the
+// given pid, whose start time is read from its stat file.
+func (a Authorizer) processSubject(pid uint32, uid uint32) (subject polkitAuthSubject, err error) {
 	f, err := os.Open(filepath.Join(a.root, fmt.Sprintf("proc/%d/stat", pid)))
 	if err != nil {
-		return fmt.Errorf("couldn't open stat file for process: %w", err)
+		return subject, fmt.Errorf("couldn't open stat file for process: %w", err)
 	}
 	defer func() { _ = f.Close() }()
 
 	startTime, err := getStartTimeFromReader(f)
 	if err != nil {
-		return err
+		return subject, err
 	}
 
-	subject := polkitAuthSubject{
+	return polkitAuthSubject{
 		Kind: "unix-process",
 		Details: map[string]dbus.Variant{
 			"pid":        dbus.MakeVariant(pid),
 			"start-time": dbus.MakeVariant(startTime),
 			"uid":        dbus.MakeVariant(uid),
 		},
-	}
+	}, nil
+}
 
-	var result polkitAuthResult
-	var details map[string]string
-	err = a.authority.Call(
-		"org.freedesktop.PolicyKit1.Authority.CheckAuthorization", dbus.FlagAllowInteractiveAuthorization,
-		subject, action, details, checkAllowInteraction, "").Store(&result)
+// lookupUsername returns the name of the user with the given uid, as defined
+// in the passwd file under root.
+func lookupUsername(root string, uid uint32) (name string, err error) {
+	defer decorate.OnError(&err, "can't look up user %d", uid)
+
+	// #nosec G304 - path not controllable by user
+	f, err := os.Open(filepath.Join(root, "etc/passwd"))
 	if err != nil {
-		return fmt.Errorf("call to polkit failed: %w", err)
+		return "", err
 	}
-	log.Debugf("Polkit call result, authorized: %t", result.IsAuthorized)
+	defer func() { _ = f.Close() }()
 
-	if !result.IsAuthorized {
-		return errors.New("polkit denied access")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[2] != strconv.FormatUint(uint64(uid), 10) {
+			continue
+		}
+		return fields[0], nil
 	}
-	return nil
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.New("no such user")
 }
 
 // getStartTimeFromReader determines the start time from a process stat file content
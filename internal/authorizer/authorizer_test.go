@@ -1,6 +1,9 @@
 package authorizer_test
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -26,10 +29,12 @@ func TestCheckSenderAllowed(t *testing.T) {
 		wantPolkitError      bool
 		wantCredsLookupError bool
 
-		wantErr bool
+		wantUsername string
+		wantErr      bool
 	}{
-		"Root is always authorized":        {uid: 0},
-		"Valid process and UID authorized": {pid: 10000, uid: 1000, polkitAuthorize: true},
+		"Root is always authorized":                             {uid: 0, wantUsername: "root"},
+		"Valid process and UID authorized":                      {pid: 10000, uid: 1000, polkitAuthorize: true, wantUsername: "bob"},
+		"Authorized with empty username if user does not exist": {pid: 10000, uid: 1001, polkitAuthorize: true},
 
 		// Unauthorized cases
 		"Unauthorized if polkit call returns an error":     {pid: 10000, uid: 1000, wantPolkitError: true, wantErr: true},
@@ -58,18 +63,231 @@ func TestCheckSenderAllowed(t *testing.T) {
 				tc.credsPID = tc.pid
 			}
 
+			polkit := &authorizer.PolkitObjMock{IsAuthorized: tc.polkitAuthorize, WantPolkitError: tc.wantPolkitError}
 			a := authorizer.New(
 				bus,
-				authorizer.WithAuthority(&authorizer.PolkitObjMock{IsAuthorized: tc.polkitAuthorize, WantPolkitError: tc.wantPolkitError}),
+				authorizer.WithAuthority(polkit),
 				authorizer.WithCredLookup(&authorizer.CredsObjMock{UID: tc.credsUID, PID: tc.credsPID, WantLookupError: tc.wantCredsLookupError}),
+				authorizer.WithLogind(&authorizer.LogindObjMock{Type: "wayland", Active: true, Seat: "seat0"}),
+				authorizer.WithRoot("testdata"),
+			)
+
+			id, err := a.CheckSenderAllowed("my-action", ":1.42")
+			if tc.wantErr {
+				require.Error(t, err, "CheckSenderAllowed should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "CheckSenderAllowed failed but shouldn't have")
+			require.Equal(t, authorizer.CallerIdentity{UID: tc.uid, Username: tc.wantUsername, PID: tc.pid, BusName: ":1.42"}, id, "Caller identity doesn't match")
+			if tc.uid != 0 {
+				require.True(t, polkit.InteractionRequested, "CheckSenderAllowed should allow user interaction")
+				require.Equal(t, "unix-process", polkit.SubjectKind, "Polkit subject should be the caller process")
+			}
+		})
+	}
+}
+
+func TestCheckSenderAllowedUsernameLookup(t *testing.T) {
+	t.Cleanup(testutils.StartLocalSystemBus())
+
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	tests := map[string]struct {
+		lookupError bool
+
+		wantUsername string
+	}{
+		"Username is resolved by the lookup":             {wantUsername: "alice"},
+		"Authorized with empty username if lookup fails": {lookupError: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var lookedUp []uint32
+			a := authorizer.New(
+				bus,
+				authorizer.WithAuthority(&authorizer.PolkitObjMock{IsAuthorized: true}),
+				authorizer.WithCredLookup(&authorizer.CredsObjMock{UID: uint32(1000), PID: uint32(10000)}),
+				authorizer.WithLogind(&authorizer.LogindObjMock{Type: "wayland", Active: true, Seat: "seat0"}),
+				authorizer.WithRoot("testdata"),
+				authorizer.WithUsernameLookup(func(uid uint32) (string, error) {
+					lookedUp = append(lookedUp, uid)
+					if tc.lookupError {
+						return "", errors.New("lookup error")
+					}
+					return "alice", nil
+				}),
+			)
+
+			id, err := a.CheckSenderAllowed("my-action", ":1.42")
+			require.NoError(t, err, "CheckSenderAllowed failed but shouldn't have")
+			require.Equal(t, []uint32{1000}, lookedUp, "Username of the caller should have been looked up once")
+			require.Equal(t, authorizer.CallerIdentity{UID: 1000, Username: tc.wantUsername, PID: 10000, BusName: ":1.42"}, id, "Caller identity doesn't match")
+		})
+	}
+}
+
+func TestCheckSenderAllowedInteraction(t *testing.T) {
+	t.Cleanup(testutils.StartLocalSystemBus())
+
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	tests := map[string]struct {
+		session     authorizer.LogindObjMock
+		interaction authorizer.InteractionMode
+
+		wantInteraction bool
+	}{
+		"Interactive for active X11 session":     {session: authorizer.LogindObjMock{Type: "x11", Active: true, Seat: "seat0"}, wantInteraction: true},
+		"Interactive for active Wayland session": {session: authorizer.LogindObjMock{Type: "wayland", Active: true, Seat: "seat0"}, wantInteraction: true},
+		"Interactive when forced for ssh session": {
+			session: authorizer.LogindObjMock{Type: "tty", Active: true}, interaction: authorizer.InteractionAlways, wantInteraction: true},
+
+		"Not interactive for ssh session":                    {session: authorizer.LogindObjMock{Type: "tty", Active: true}},
+		"Not interactive for process without session":        {session: authorizer.LogindObjMock{NoSession: true}},
+		"Not interactive for inactive graphical session":     {session: authorizer.LogindObjMock{Type: "wayland", Seat: "seat0"}},
+		"Not interactive for graphical session without seat": {session: authorizer.LogindObjMock{Type: "x11", Active: true}},
+		"Not interactive when disabled for graphical session": {
+			session: authorizer.LogindObjMock{Type: "wayland", Active: true, Seat: "seat0"}, interaction: authorizer.InteractionNever},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.interaction == "" {
+				tc.interaction = authorizer.InteractionAuto
+			}
+
+			polkit := &authorizer.PolkitObjMock{IsAuthorized: true}
+			a := authorizer.New(
+				bus,
+				authorizer.WithAuthority(polkit),
+				authorizer.WithCredLookup(&authorizer.CredsObjMock{UID: uint32(1000), PID: uint32(10000)}),
+				authorizer.WithLogind(&tc.session),
+				authorizer.WithInteraction(tc.interaction),
+				authorizer.WithRoot("testdata"),
+			)
+
+			_, err := a.CheckSenderAllowed("my-action", ":1.42")
+			require.NoError(t, err, "CheckSenderAllowed failed but shouldn't have")
+			require.Equal(t, tc.wantInteraction, polkit.InteractionRequested, "Interactive flag passed to polkit doesn't match")
+		})
+	}
+}
+
+func TestQuerySenderAllowed(t *testing.T) {
+	t.Cleanup(testutils.StartLocalSystemBus())
+
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	tests := map[string]struct {
+		pid uint32
+		uid uint32
+
+		credsPID        any
+		polkitAuthorize bool
+		polkitChallenge bool
+
+		wantPolkitError bool
+
+		want    authorizer.Authorization
+		wantErr bool
+	}{
+		"Root is always authorized":                {uid: 0, want: authorizer.AuthorizationYes},
+		"Authorized without authentication":        {pid: 10000, uid: 1000, polkitAuthorize: true, want: authorizer.AuthorizationYes},
+		"Authorized with an interactive challenge": {pid: 10000, uid: 1000, polkitChallenge: true, want: authorizer.AuthorizationChallenge},
+		"Not authorized":                           {pid: 10000, uid: 1000, want: authorizer.AuthorizationNo},
+
+		"Error if polkit call returns an error":          {pid: 10000, uid: 1000, wantPolkitError: true, want: authorizer.AuthorizationNo, wantErr: true},
+		"Error if creds lookup PID is not a number":      {pid: 10000, uid: 1000, credsPID: "NaN", want: authorizer.AuthorizationNo, wantErr: true},
+		"Error if PID file does not exist on the system": {pid: 99999, uid: 1000, want: authorizer.AuthorizationNo, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.credsPID == nil {
+				tc.credsPID = tc.pid
+			}
+
+			polkit := &authorizer.PolkitObjMock{IsAuthorized: tc.polkitAuthorize, IsChallenge: tc.polkitChallenge, WantPolkitError: tc.wantPolkitError}
+			a := authorizer.New(
+				bus,
+				authorizer.WithAuthority(polkit),
+				authorizer.WithCredLookup(&authorizer.CredsObjMock{UID: tc.uid, PID: tc.credsPID}),
 				authorizer.WithRoot("testdata"),
 			)
 
+			got, err := a.QuerySenderAllowed("my-action", ":1.42")
+			require.False(t, polkit.InteractionRequested, "QuerySenderAllowed should never allow user interaction")
+			require.Equal(t, tc.want, got, "Authorization result doesn't match")
 			if tc.wantErr {
-				require.Error(t, a.CheckSenderAllowed("my-action", "sender"))
+				require.Error(t, err, "QuerySenderAllowed should have failed but didn't")
 				return
 			}
-			require.NoError(t, a.CheckSenderAllowed("my-action", "sender"))
+			require.NoError(t, err, "QuerySenderAllowed failed but shouldn't have")
+		})
+	}
+}
+
+func TestHidepidFallback(t *testing.T) {
+	t.Cleanup(testutils.StartLocalSystemBus())
+
+	t.Parallel()
+
+	if os.Geteuid() == 0 {
+		t.Skip("Unreadable stat files can't be simulated as root")
+	}
+
+	bus := testutils.NewDbusConn(t)
+
+	// With hidepid, the stat files of the processes of other users are unreadable.
+	root := t.TempDir()
+	statPath := filepath.Join(root, "proc", "10000", "stat")
+	err := os.MkdirAll(filepath.Dir(statPath), 0700)
+	require.NoError(t, err, "Setup: Couldn't create process directory")
+	err = os.WriteFile(statPath, nil, 0000)
+	require.NoError(t, err, "Setup: Couldn't create unreadable stat file")
+
+	tests := map[string]struct {
+		query bool
+	}{
+		"CheckSenderAllowed authorizes the bus name": {},
+		"QuerySenderAllowed authorizes the bus name": {query: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			polkit := &authorizer.PolkitObjMock{IsAuthorized: true}
+			a := authorizer.New(
+				bus,
+				authorizer.WithAuthority(polkit),
+				authorizer.WithCredLookup(&authorizer.CredsObjMock{UID: uint32(1000), PID: uint32(10000)}),
+				authorizer.WithLogind(&authorizer.LogindObjMock{NoSession: true}),
+				authorizer.WithRoot(root),
+			)
+
+			if tc.query {
+				got, err := a.QuerySenderAllowed("my-action", ":1.42")
+				require.NoError(t, err, "QuerySenderAllowed failed but shouldn't have")
+				require.Equal(t, authorizer.AuthorizationYes, got, "Authorization result doesn't match")
+			} else {
+				_, err := a.CheckSenderAllowed("my-action", ":1.42")
+				require.NoError(t, err, "CheckSenderAllowed failed but shouldn't have")
+			}
+			require.Equal(t, "system-bus-name", polkit.SubjectKind, "Polkit subject should fall back to the bus name")
 		})
 	}
 }
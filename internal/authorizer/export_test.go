@@ -20,6 +20,21 @@ func WithCredLookup(c caller) func(*options) {
 	}
 }
 
+// WithLogind overrides the default logind objects implementation.
+func WithLogind(c caller) func(*options) {
+	return func(o *options) {
+		o.logind = func(dbus.ObjectPath) caller { return c }
+	}
+}
+
+// WithUsernameLookup overrides the default username lookup, reading the passwd
+// file under the root.
+func WithUsernameLookup(lookup func(uid uint32) (string, error)) func(*options) {
+	return func(o *options) {
+		o.usernameLookup = lookup
+	}
+}
+
 // WithRoot overrides the filesystem root for the authorizer.
 func WithRoot(root string) func(*options) {
 	return func(o *options) {
@@ -30,13 +45,19 @@ func WithRoot(root string) func(*options) {
 // PolkitObjMock is a mock for the polkit object.
 type PolkitObjMock struct {
 	IsAuthorized    bool
+	IsChallenge     bool
 	WantPolkitError bool
 
+	// InteractionRequested is true if any call allowed user interaction.
+	InteractionRequested bool
+	// SubjectKind is the kind of the subject of the last call.
+	SubjectKind string
+
 	actionRequested string
 }
 
 // Call mocks the polkit object call.
-func (d *PolkitObjMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.Call {
+func (d *PolkitObjMock) Call(_ string, flags dbus.Flags, args ...interface{}) *dbus.Call {
 	var errPolkit error
 
 	content, ok := args[1].(string)
@@ -46,6 +67,20 @@ func (d *PolkitObjMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.
 
 	d.actionRequested = content
 
+	subject, ok := args[0].(polkitAuthSubject)
+	if !ok {
+		panic("Expected polkit subject as first argument")
+	}
+	d.SubjectKind = subject.Kind
+
+	checkFlags, ok := args[3].(polkitCheckFlags)
+	if !ok {
+		panic("Expected polkit flags as fourth argument")
+	}
+	if checkFlags&checkAllowInteraction != 0 || flags&dbus.FlagAllowInteractiveAuthorization != 0 {
+		d.InteractionRequested = true
+	}
+
 	if d.WantPolkitError {
 		errPolkit = errors.New("Polkit error")
 	}
@@ -55,7 +90,7 @@ func (d *PolkitObjMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.
 		Body: []interface{}{
 			[]interface{}{
 				d.IsAuthorized,
-				true,
+				d.IsChallenge,
 				map[string]string{
 					"polkit.retains_authorization_after_challenge": "true",
 					"polkit.dismissed": "true",
@@ -89,3 +124,32 @@ func (d *CredsObjMock) Call(_ string, _ dbus.Flags, _ ...interface{}) *dbus.Call
 			}},
 	}
 }
+
+// LogindObjMock is a mock for the logind manager and session objects.
+type LogindObjMock struct {
+	// NoSession makes the session lookup fail.
+	NoSession bool
+	Type      string
+	Active    bool
+	Seat      string
+}
+
+// Call mocks the logind objects calls.
+func (d *LogindObjMock) Call(method string, _ dbus.Flags, _ ...interface{}) *dbus.Call {
+	switch method {
+	case "org.freedesktop.login1.Manager.GetSessionByPID":
+		if d.NoSession {
+			return &dbus.Call{Err: errors.New("no session for process")}
+		}
+		return &dbus.Call{Body: []interface{}{dbus.ObjectPath("/org/freedesktop/login1/session/_31")}}
+	case "org.freedesktop.DBus.Properties.GetAll":
+		return &dbus.Call{Body: []interface{}{
+			map[string]dbus.Variant{
+				"Type":   dbus.MakeVariant(d.Type),
+				"Active": dbus.MakeVariant(d.Active),
+				"Seat":   dbus.MakeVariant([]interface{}{d.Seat, dbus.ObjectPath("/org/freedesktop/login1/seat/seat0")}),
+			}},
+		}
+	}
+	panic("unexpected logind call " + method)
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an issue found in the configuration file.
+type Problem struct {
+	// Line and Column locate the problem in the file. They are 0 if unknown.
+	Line   int
+	Column int
+	// Field is the path of the offending field, such as extra_lines.apt[0].
+	Field   string
+	Message string
+}
+
+// String returns the problem prefixed with its location and field.
+func (p Problem) String() string {
+	var parts []string
+	if p.Line > 0 && p.Column > 0 {
+		parts = append(parts, fmt.Sprintf("line %d, column %d", p.Line, p.Column))
+	} else if p.Line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d", p.Line))
+	}
+	if p.Field != "" {
+		parts = append(parts, p.Field)
+	}
+	return strings.Join(append(parts, p.Message), ": ")
+}
+
+// Problems is the list of problems found in a configuration file, in the
+// order they appear.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	lines := make([]string, 0, len(ps))
+	for _, p := range ps {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// syntaxErrorRegexp matches the YAML syntax errors locating the problem.
+var syntaxErrorRegexp = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// typeErrorRegexp matches the line prefix of the YAML type errors.
+var typeErrorRegexp = regexp.MustCompile(`^line \d+: `)
+
+// parse decodes the configuration file content, returning every problem found
+// instead of stopping at the first one.
+func parse(data []byte) (Config, Problems) {
+	cfg := defaultConfig()
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		p := Problem{Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+		if m := syntaxErrorRegexp.FindStringSubmatch(err.Error()); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Message = m[2]
+		}
+		return Config{}, Problems{p}
+	}
+
+	// Empty files only contain comments, if anything.
+	if root.Kind == 0 || len(root.Content) == 0 {
+		return cfg, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind == yaml.ScalarNode && doc.Tag == "!!null" {
+		return cfg, nil
+	}
+
+	nodes := make(map[string]*yaml.Node)
+	if problems := checkNode(doc, reflect.TypeOf(cfg), "", nodes); len(problems) > 0 {
+		return Config{}, problems
+	}
+	if err := doc.Decode(&cfg); err != nil {
+		return Config{}, Problems{{Line: doc.Line, Column: doc.Column, Message: err.Error()}}
+	}
+
+	problems := cfg.validate(func(field string) Problem {
+		p := Problem{Field: field}
+		if n, found := nodes[field]; found {
+			p.Line, p.Column = n.Line, n.Column
+		}
+		return p
+	})
+	if len(problems) > 0 {
+		return Config{}, problems
+	}
+	return cfg, nil
+}
+
+// checkNode returns the problems of node n decoded into a value of type t at
+// the given field path: unknown or duplicate keys, and wrong types. The nodes
+// of the fields are stored in nodes, indexed by their path.
+func checkNode(n *yaml.Node, t reflect.Type, path string, nodes map[string]*yaml.Node) (problems Problems) {
+	nodes[path] = n
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return nil
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return Problems{{Line: n.Line, Column: n.Column, Field: path, Message: "must be a mapping"}}
+		}
+
+		fields := yamlFields(t)
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			field := k.Value
+			if path != "" {
+				field = path + "." + k.Value
+			}
+
+			if seen[k.Value] {
+				problems = append(problems, Problem{Line: k.Line, Column: k.Column, Field: field, Message: "duplicate key"})
+				continue
+			}
+			seen[k.Value] = true
+
+			f, found := fields[k.Value]
+			if !found {
+				keys := maps.Keys(fields)
+				slices.Sort(keys)
+				problems = append(problems, Problem{Line: k.Line, Column: k.Column, Field: field,
+					Message: fmt.Sprintf("unknown key, must be one of %s", strings.Join(keys, ", "))})
+				continue
+			}
+			problems = append(problems, checkNode(v, f.Type, field, nodes)...)
+		}
+		return problems
+
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && n.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			problems = append(problems, checkNode(v, t.Elem(), path+"."+k.Value, nodes)...)
+		}
+		return problems
+
+	case t.Kind() == reflect.Slice && n.Kind == yaml.SequenceNode:
+		for i, item := range n.Content {
+			problems = append(problems, checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), nodes)...)
+		}
+		return problems
+	}
+
+	if err := n.Decode(reflect.New(t).Interface()); err != nil {
+		msg := err.Error()
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+			msg = typeErrorRegexp.ReplaceAllString(typeErr.Errors[0], "")
+		}
+		return Problems{{Line: n.Line, Column: n.Column, Field: path, Message: msg}}
+	}
+	return nil
+}
+
+// yamlFields returns the fields of the struct type t, indexed by their YAML key.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
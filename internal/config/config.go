@@ -0,0 +1,184 @@
+// Package config loads the daemon configuration file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/authorizer"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/notifier"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultPath is the relative path to the daemon configuration file.
+const DefaultPath = "etc/ubuntu-proxy-manager/config.yaml"
+
+// Config is the daemon configuration.
+type Config struct {
+	// AllowedProxyHosts restricts the proxy hosts that can be applied. Entries
+	// are exact hosts, wildcards (*.example.com) or CIDRs (10.0.0.0/8).
+	// An empty list means no restriction.
+	AllowedProxyHosts []string `yaml:"allowed_proxy_hosts"`
+
+	// MaxQueuedCalls is the maximum number of apply requests handled at the
+	// same time. 0 means the default value.
+	MaxQueuedCalls int `yaml:"max_queued_calls"`
+
+	// GSettingsUseSameProxy renders identical proxies as a single HTTP section
+	// with use-same-proxy enabled in the GSettings overrides.
+	GSettingsUseSameProxy bool `yaml:"gsettings_use_same_proxy"`
+
+	// GSettingsVerify queries gsettings after applying the configuration and
+	// warns about the values which differ from the applied ones.
+	GSettingsVerify bool `yaml:"gsettings_verify"`
+
+	// EnvSOCKSAllProxy sets all_proxy to the SOCKS proxy in the environment
+	// when it is the only proxy set. It is enabled by default.
+	EnvSOCKSAllProxy bool `yaml:"env_socks_all_proxy"`
+
+	// SystemdUserConf also sets the proxy variables of the systemd user
+	// managers, and not only the system one.
+	SystemdUserConf bool `yaml:"systemd_user_conf"`
+
+	// NoProxyProfile is the profile of exclusions added to no_proxy whenever a
+	// proxy is set. An empty value means no exclusion is added.
+	NoProxyProfile string `yaml:"no_proxy_profile"`
+
+	// PolkitInteraction defines when callers can be prompted for
+	// authentication: "auto" (only from active graphical sessions), "always"
+	// or "never". An empty value means "auto".
+	PolkitInteraction string `yaml:"polkit_interaction"`
+
+	// ExtraLines are raw lines appended to the file managed by each backend,
+	// under the environment, apt and gsettings keys.
+	ExtraLines proxy.ExtraLines `yaml:"extra_lines"`
+
+	// BackendModes sets the mode of each backend, indexed by name
+	// (environment, legacy-environment, pam-env, systemd, profile, apt,
+	// gsettings, dconf, gdm, kde, libproxy, containerd, fwupd, podman, git,
+	// pip, gradle, r, rubygems, cargo, subversion, conda, microk8s, curl,
+	// snapd, lxd, incus, livepatch, cntlm or custom):
+	// "managed" (the default, except for legacy-environment, pam-env,
+	// systemd, dconf, gdm, libproxy, cargo, conda, curl and cntlm),
+	// "remove-only" (its configuration is removed whatever the settings) or
+	// "disabled" (its configuration is left untouched, the default for
+	// legacy-environment, pam-env, systemd, dconf, gdm, libproxy, cargo,
+	// conda, curl and cntlm).
+	BackendModes map[string]string `yaml:"backend_modes"`
+
+	// EmptyMeansNoop makes Apply calls with empty settings succeed without
+	// changing anything, rather than removing the configuration. Callers can
+	// override it for each call.
+	EmptyMeansNoop bool `yaml:"empty_means_noop"`
+
+	// NotifyEndpoint is a unix socket path or a local http:// URL to which the
+	// outcome of each Apply call is POSTed. An empty value disables it.
+	NotifyEndpoint string `yaml:"notify_endpoint"`
+}
+
+// Load reads the configuration file at path. If the file doesn't exist, the
+// default configuration is returned. If the file is invalid, the returned error
+// is a Problems listing every problem found.
+func Load(path string) (cfg Config, err error) {
+	defer decorate.OnError(&err, "couldn't load configuration file %q", path)
+
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Debugf("No configuration file at %q, using defaults", path)
+		return defaultConfig(), nil
+	} else if err != nil {
+		return Config{}, err
+	}
+
+	cfg, problems := parse(data)
+	if len(problems) > 0 {
+		return Config{}, problems
+	}
+	return cfg, nil
+}
+
+// Check reads the configuration file at path and returns every problem found.
+// It returns an error wrapping fs.ErrNotExist if the file doesn't exist.
+func Check(path string) (problems Problems, err error) {
+	defer decorate.OnError(&err, "couldn't check configuration file %q", path)
+
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, problems = parse(data)
+	return problems, nil
+}
+
+// defaultConfig returns the configuration used when no file is present.
+func defaultConfig() Config {
+	return Config{
+		EnvSOCKSAllProxy: true,
+	}
+}
+
+// validate returns the problems of the decoded configuration, locating them
+// with the given function.
+func (cfg Config) validate(at func(field string) Problem) (problems Problems) {
+	add := func(field string, format string, a ...any) {
+		p := at(field)
+		p.Message = fmt.Sprintf(format, a...)
+		problems = append(problems, p)
+	}
+
+	if cfg.MaxQueuedCalls < 0 {
+		add("max_queued_calls", "must be positive")
+	}
+	if cfg.NoProxyProfile != "" && !slices.Contains(proxy.NoProxyProfiles, cfg.NoProxyProfile) {
+		add("no_proxy_profile", "unknown profile %q, must be one of %s", cfg.NoProxyProfile, strings.Join(proxy.NoProxyProfiles, ", "))
+	}
+	switch authorizer.InteractionMode(cfg.PolkitInteraction) {
+	case "", authorizer.InteractionAuto, authorizer.InteractionAlways, authorizer.InteractionNever:
+	default:
+		add("polkit_interaction", "unknown mode %q, must be one of auto, always, never", cfg.PolkitInteraction)
+	}
+	for _, b := range []struct {
+		name  string
+		lines []string
+	}{
+		{"environment", cfg.ExtraLines.Environment},
+		{"apt", cfg.ExtraLines.APT},
+		{"gsettings", cfg.ExtraLines.GSettings},
+	} {
+		if len(b.lines) > 0 {
+			if err := proxy.CheckBackend(b.name); err != nil {
+				add("extra_lines."+b.name, "%v", err)
+				continue
+			}
+		}
+		for i, line := range b.lines {
+			if err := proxy.CheckExtraLine(b.name, line); err != nil {
+				add(fmt.Sprintf("extra_lines.%s[%d]", b.name, i), "extra line %v", err)
+			}
+		}
+	}
+	backends := maps.Keys(cfg.BackendModes)
+	slices.Sort(backends)
+	for _, backend := range backends {
+		if err := proxy.CheckBackendMode(backend, cfg.BackendModes[backend]); err != nil {
+			add("backend_modes."+backend, "%v", err)
+		}
+	}
+	if cfg.NotifyEndpoint != "" {
+		if err := notifier.ValidateEndpoint(cfg.NotifyEndpoint); err != nil {
+			add("notify_endpoint", "%v", err)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,145 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/config"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+		noFile  bool
+
+		want    config.Config
+		wantErr bool
+	}{
+		"Default configuration when file does not exist": {noFile: true, want: config.Config{EnvSOCKSAllProxy: true}},
+		"Default configuration when file is empty":       {content: "", want: config.Config{EnvSOCKSAllProxy: true}},
+		"Load allowed proxy hosts": {
+			content: "allowed_proxy_hosts:\n  - proxy.example.com\n  - '*.corp.example.com'\n  - 10.0.0.0/8\n",
+			want:    config.Config{AllowedProxyHosts: []string{"proxy.example.com", "*.corp.example.com", "10.0.0.0/8"}, EnvSOCKSAllProxy: true},
+		},
+		"Load maximum number of queued calls":        {content: "max_queued_calls: 4\n", want: config.Config{MaxQueuedCalls: 4, EnvSOCKSAllProxy: true}},
+		"Load GSettings use-same-proxy rendering":    {content: "gsettings_use_same_proxy: true\n", want: config.Config{GSettingsUseSameProxy: true, EnvSOCKSAllProxy: true}},
+		"Load GSettings verification":                {content: "gsettings_verify: true\n", want: config.Config{GSettingsVerify: true, EnvSOCKSAllProxy: true}},
+		"Load no_proxy exclusion profile":            {content: "no_proxy_profile: loopback+linklocal\n", want: config.Config{NoProxyProfile: "loopback+linklocal", EnvSOCKSAllProxy: true}},
+		"Load polkit interaction mode":               {content: "polkit_interaction: never\n", want: config.Config{PolkitInteraction: "never", EnvSOCKSAllProxy: true}},
+		"Disable SOCKS all_proxy in the environment": {content: "env_socks_all_proxy: false\n", want: config.Config{}},
+		"Load systemd user managers configuration":   {content: "systemd_user_conf: true\n", want: config.Config{SystemdUserConf: true, EnvSOCKSAllProxy: true}},
+		"Load empty settings as no-op":               {content: "empty_means_noop: true\n", want: config.Config{EmptyMeansNoop: true, EnvSOCKSAllProxy: true}},
+		"Load unix socket notification endpoint":     {content: "notify_endpoint: /run/agent.sock\n", want: config.Config{NotifyEndpoint: "/run/agent.sock", EnvSOCKSAllProxy: true}},
+		"Load local URL notification endpoint":       {content: "notify_endpoint: http://localhost:8080/proxy\n", want: config.Config{NotifyEndpoint: "http://localhost:8080/proxy", EnvSOCKSAllProxy: true}},
+		"Load extra lines": {
+			content: "extra_lines:\n  environment:\n    - FOO=bar\n  apt:\n    - 'Acquire::http::Timeout \"10\";'\n",
+			want:    config.Config{ExtraLines: proxy.ExtraLines{Environment: []string{"FOO=bar"}, APT: []string{`Acquire::http::Timeout "10";`}}, EnvSOCKSAllProxy: true},
+		},
+		"Load backend modes": {
+			content: "backend_modes:\n  apt: remove-only\n  gsettings: disabled\n",
+			want:    config.Config{BackendModes: map[string]string{"apt": "remove-only", "gsettings": "disabled"}, EnvSOCKSAllProxy: true},
+		},
+
+		"Error on unknown key":                     {content: "allowed_hosts: [proxy.example.com]\n", wantErr: true},
+		"Error on invalid YAML":                    {content: "allowed_proxy_hosts: [proxy.example.com\n", wantErr: true},
+		"Error on wrong type":                      {content: "max_queued_calls: many\n", wantErr: true},
+		"Error on negative maximum queued calls":   {content: "max_queued_calls: -1\n", wantErr: true},
+		"Error on unknown no_proxy profile":        {content: "no_proxy_profile: everything\n", wantErr: true},
+		"Error on unknown polkit interaction mode": {content: "polkit_interaction: sometimes\n", wantErr: true},
+		"Error on unknown extra lines backend":     {content: "extra_lines:\n  dnf: [proxy=http://example.com]\n", wantErr: true},
+		"Error on conflicting extra line":          {content: "extra_lines:\n  apt: ['Acquire::https::Proxy \"DIRECT\";']\n", wantErr: true},
+		"Error on unknown backend mode":            {content: "backend_modes:\n  apt: sometimes\n", wantErr: true},
+		"Error on unknown backend in modes":        {content: "backend_modes:\n  dnf: disabled\n", wantErr: true},
+		"Error on remote notification endpoint":    {content: "notify_endpoint: http://agent.example.com/proxy\n", wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if !tc.noFile {
+				err := os.WriteFile(path, []byte(tc.content), 0600)
+				require.NoError(t, err, "Setup: couldn't write configuration file")
+			}
+
+			got, err := config.Load(path)
+			if tc.wantErr {
+				require.Error(t, err, "Load should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Load failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Loaded configuration doesn't match")
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+		noFile  bool
+
+		wantErr bool
+	}{
+		"Valid configuration has no problem":   {fixture: "valid.yaml"},
+		"Empty configuration has no problem":   {fixture: "empty.yaml"},
+		"Syntax error is located":              {fixture: "syntax_error.yaml"},
+		"Unknown keys and backends are listed": {fixture: "unknown_keys.yaml"},
+		"Wrong types are listed":               {fixture: "wrong_types.yaml"},
+		"Invalid values are listed":            {fixture: "invalid_values.yaml"},
+		"Duplicate keys are listed":            {fixture: "duplicate_keys.yaml"},
+		"Configuration must be a mapping":      {fixture: "not_a_mapping.yaml"},
+
+		"Error when file does not exist": {fixture: "does-not-exist.yaml", wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(testutils.TestFamilyPath(t), tc.fixture)
+			problems, err := config.Check(path)
+			if tc.wantErr {
+				require.Error(t, err, "Check should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Check failed but shouldn't have")
+			require.NotContains(t, problems.Error(), "hunter2", "Problems should not contain extra lines")
+
+			// Load reports the same problems
+			_, loadErr := config.Load(path)
+			if len(problems) == 0 {
+				require.NoError(t, loadErr, "Load failed but shouldn't have")
+			} else {
+				var loadProblems config.Problems
+				require.ErrorAs(t, loadErr, &loadProblems, "Load should have returned the problems")
+				require.Equal(t, problems, loadProblems, "Load should have returned the same problems")
+			}
+
+			var got string
+			for _, p := range problems {
+				got += p.String() + "\n"
+			}
+			gotPath := filepath.Join(t.TempDir(), "problems")
+			err = os.WriteFile(gotPath, []byte(got), 0600)
+			require.NoError(t, err, "Setup: couldn't write problems")
+			testutils.CompareTreesWithFiltering(t, gotPath, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
+
+func TestMain(m *testing.M) {
+	testutils.InstallUpdateFlag()
+	flag.Parse()
+
+	m.Run()
+}
@@ -0,0 +1,89 @@
+package migration
+
+import (
+	"regexp"
+	"strings"
+)
+
+// aptProxyRegexp matches the Acquire::<protocol>::Proxy directives, optionally
+// for a given host, and their trailing comment. APT option names are case
+// insensitive.
+var aptProxyRegexp = regexp.MustCompile(`(?i)^Acquire::([a-z0-9+-]+)::Proxy(?:::([^\s"]+))?\s+"([^"]*)"\s*;\s*(?://.*)?$`)
+
+// aptBackupSuffixes are the suffixes of the files of apt.conf.d which APT
+// ignores.
+var aptBackupSuffixes = []string{".disabled", ".bak", ".save", ".dpkg-old", ".dpkg-dist", ".dpkg-new", ".dpkg-tmp", ".ucf-old", ".ucf-dist", ".ucf-new", "~"}
+
+// aptConfFragment returns true if the file of apt.conf.d with the given name
+// is read by APT.
+func aptConfFragment(name string) bool {
+	for _, suffix := range aptBackupSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return !strings.HasPrefix(name, ".")
+}
+
+// parseAPTConf returns the proxy directives of the APT configuration file at
+// path. Only the Acquire::<protocol>::Proxy "<url>"; statements written on
+// their own line can be imported. The other proxy statements are reported.
+func parseAPTConf(path, content string) (directives []Directive, unsupported []Unsupported) {
+	var inComment bool
+	for i, text := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(text)
+
+		// Skip block comments, which may span several lines.
+		if inComment {
+			end := strings.Index(line, "*/")
+			if end < 0 {
+				continue
+			}
+			inComment = false
+			line = strings.TrimSpace(line[end+2:])
+		}
+		if strings.HasPrefix(line, "/*") {
+			end := strings.Index(line[2:], "*/")
+			if end < 0 {
+				inComment = true
+				continue
+			}
+			line = strings.TrimSpace(line[end+4:])
+		}
+
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		u := Unsupported{Path: path, Line: i + 1, Text: text}
+		m := aptProxyRegexp.FindStringSubmatch(line)
+		if m == nil {
+			if !strings.Contains(strings.ToLower(line), "proxy") {
+				continue
+			}
+			switch lower := strings.ToLower(line); {
+			case strings.Contains(lower, "proxy-auto-detect"), strings.Contains(lower, "proxyautodetect"):
+				u.Reason = "proxy auto-detection commands are not supported"
+			default:
+				u.Reason = `only Acquire::<protocol>::Proxy "<url>"; statements on their own line are supported`
+			}
+			unsupported = append(unsupported, u)
+			continue
+		}
+
+		setting, host, value := strings.ToLower(m[1]), m[2], m[3]
+		switch {
+		case !isSetting(setting) || setting == settingNoProxy:
+			u.Reason = "unknown protocol"
+		case host != "":
+			u.Reason = "per-host proxies are not supported"
+		case value == "" || strings.EqualFold(value, "DIRECT") || strings.EqualFold(value, "false"):
+			u.Reason = "direct connections are not supported"
+		default:
+			directives = append(directives, Directive{Path: path, Line: i + 1, Text: text, Setting: setting, Value: value, comment: "//"})
+			continue
+		}
+		unsupported = append(unsupported, u)
+	}
+	return directives, unsupported
+}
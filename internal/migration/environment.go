@@ -0,0 +1,88 @@
+package migration
+
+import (
+	"strings"
+)
+
+// parseEnvironment returns the proxy directives of the environment file at
+// path, in the format of /etc/environment and environment.d: one KEY=VALUE
+// assignment per line, the value being optionally quoted. Both lowercase and
+// uppercase variable names are recognized, and the other variables are
+// ignored, as well as the block of entries managed by ubuntu-proxy-manager.
+func parseEnvironment(path, content string) (directives []Directive, unsupported []Unsupported) {
+	// Like the backend writing it, the managed block ends at its footer or at
+	// the first line which isn't a proxy variable.
+	var inManagedBlock bool
+	for i, text := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(text)
+		switch {
+		case line == managedEntriesHeader:
+			inManagedBlock = true
+			continue
+		case inManagedBlock && line == managedEntriesFooter:
+			inManagedBlock = false
+			continue
+		case inManagedBlock && isProxyVariable(line):
+			continue
+		}
+		inManagedBlock = false
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// pam_env accepts shell-like export statements.
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		setting, isProxy := strings.CutSuffix(key, "_proxy")
+		if key == settingNoProxy {
+			setting = settingNoProxy
+		}
+		if !isProxy {
+			continue
+		}
+
+		u := Unsupported{Path: path, Line: i + 1, Text: text}
+		value, ok := unquote(strings.TrimSpace(value))
+		switch {
+		case setting == "all":
+			u.Reason = "all_proxy is not supported, set the proxy of each protocol instead"
+		case !isSetting(setting):
+			u.Reason = "unknown proxy variable"
+		case !ok:
+			u.Reason = "unterminated quoted value"
+		case value == "":
+			u.Reason = "empty value"
+		case strings.ContainsAny(value, "$`"):
+			u.Reason = "variable expansions are not supported"
+		default:
+			directives = append(directives, Directive{Path: path, Line: i + 1, Text: text, Setting: setting, Value: value, comment: "#"})
+			continue
+		}
+		unsupported = append(unsupported, u)
+	}
+	return directives, unsupported
+}
+
+// isProxyVariable returns true if line assigns a proxy variable.
+func isProxyVariable(line string) bool {
+	key, _, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	return found && (strings.HasSuffix(key, "_proxy") || key == settingNoProxy)
+}
+
+// unquote returns value without its enclosing single or double quotes, if any.
+// It returns false if a quote isn't terminated.
+func unquote(value string) (string, bool) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return value, true
+	}
+	if len(value) < 2 || value[len(value)-1] != value[0] {
+		return value, false
+	}
+	return value[1 : len(value)-1], true
+}
@@ -0,0 +1,7 @@
+package migration
+
+// ParseEnvironment is the parser of the environment files, exported for tests.
+var ParseEnvironment = parseEnvironment
+
+// ParseAPTConf is the parser of the APT configuration files, exported for tests.
+var ParseAPTConf = parseAPTConf
@@ -0,0 +1,303 @@
+// Package migration imports the proxy configuration written by hand before
+// ubuntu-proxy-manager was installed.
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ubuntu/decorate"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"golang.org/x/exp/slices"
+)
+
+// The settings which can be imported, named after their environment variable.
+const (
+	settingHTTP    = "http"
+	settingHTTPS   = "https"
+	settingFTP     = "ftp"
+	settingSOCKS   = "socks"
+	settingNoProxy = "no_proxy"
+)
+
+// managedHeader starts the files generated by ubuntu-proxy-manager, which are
+// never imported.
+const managedHeader = "### This file was generated by ubuntu-proxy-manager"
+
+// managedEntriesHeader and managedEntriesFooter delimit the block of entries
+// managed by ubuntu-proxy-manager in a shared file, which is never imported.
+const (
+	managedEntriesHeader = "### The proxy entries below are managed by ubuntu-proxy-manager - manual changes to them will be overwritten"
+	managedEntriesFooter = "### End of the proxy entries managed by ubuntu-proxy-manager"
+)
+
+// importedMarker follows the comment prefix of the imported directives once
+// commented out.
+const importedMarker = "Imported by ubuntu-proxy-manager: "
+
+// Directive is a proxy directive written by hand, which can be imported.
+type Directive struct {
+	Path string
+	// Line is the line number of the directive, starting at 1.
+	Line int
+	// Text is the line of the directive.
+	Text string
+	// Setting is the imported setting: http, https, ftp, socks or no_proxy.
+	Setting string
+	Value   string
+
+	// comment is the comment prefix of the file format.
+	comment string
+}
+
+// Unsupported is a proxy directive written by hand, which can't be imported.
+type Unsupported struct {
+	Path string
+	// Line is the line number of the directive, starting at 1.
+	Line int
+	// Text is the line of the directive.
+	Text string
+	// Reason is why the directive can't be imported.
+	Reason string
+}
+
+// Plan is the result of a scan: the settings to apply, the directives they
+// are imported from and the ones which can't be imported.
+type Plan struct {
+	Settings    proxy.Settings
+	Directives  []Directive
+	Unsupported []Unsupported
+}
+
+// fileParser parses the proxy directives of a file, given its path and
+// content.
+type fileParser func(path, content string) ([]Directive, []Unsupported)
+
+// Scan looks for the proxy directives written by hand in the environment and
+// APT configuration files under root, and returns the plan importing them.
+// The directives of the environment files come first, and the ones
+// conflicting with a previous directive aren't imported.
+func Scan(root string) (plan Plan, err error) {
+	defer decorate.OnError(&err, "couldn't scan proxy configuration")
+
+	files, err := knownFiles(root)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	imported := make(map[string]Directive)
+	for _, f := range files {
+		// #nosec G304 - path not controllable by user
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return Plan{}, err
+		}
+		content := string(data)
+		if strings.HasPrefix(content, managedHeader) {
+			continue
+		}
+
+		directives, unsupported := f.parse(f.path, content)
+		plan.Unsupported = append(plan.Unsupported, unsupported...)
+		for _, d := range directives {
+			if err := validate(d.Setting, d.Value); err != nil {
+				plan.Unsupported = append(plan.Unsupported, d.unsupported(err.Error()))
+				continue
+			}
+			if prev, found := imported[d.Setting]; found && prev.Value != d.Value {
+				plan.Unsupported = append(plan.Unsupported, d.unsupported(
+					fmt.Sprintf("conflicts with %s:%d, setting %s to %q", prev.Path, prev.Line, d.Setting, proxy.RedactPasswords(prev.Value))))
+				continue
+			}
+			imported[d.Setting] = d
+			plan.Directives = append(plan.Directives, d)
+		}
+	}
+
+	for setting, d := range imported {
+		*settingsField(&plan.Settings, setting) = d.Value
+	}
+	return plan, nil
+}
+
+// knownFile is a file which may contain proxy directives written by hand.
+type knownFile struct {
+	path  string
+	parse fileParser
+}
+
+// knownFiles returns the existing files under root which may contain proxy
+// directives written by hand.
+func knownFiles(root string) ([]knownFile, error) {
+	var files []knownFile
+	for _, dir := range []struct {
+		file   string
+		dir    string
+		parse  fileParser
+		accept func(name string) bool
+	}{
+		{"etc/environment", "etc/environment.d", parseEnvironment, func(name string) bool { return strings.HasSuffix(name, ".conf") }},
+		{"etc/apt/apt.conf", "etc/apt/apt.conf.d", parseAPTConf, aptConfFragment},
+	} {
+		paths := []string{filepath.Join(root, dir.file)}
+		entries, err := os.ReadDir(filepath.Join(root, dir.dir))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		// Fragments are read in lexical order, as APT and systemd do.
+		for _, e := range entries {
+			if !e.IsDir() && dir.accept(e.Name()) {
+				paths = append(paths, filepath.Join(root, dir.dir, e.Name()))
+			}
+		}
+
+		for _, path := range paths {
+			if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			files = append(files, knownFile{path: path, parse: dir.parse})
+		}
+	}
+	return files, nil
+}
+
+// validate returns an error if value can't be applied to the given setting.
+func validate(setting, value string) error {
+	var s proxy.Settings
+	*settingsField(&s, setting) = value
+	return proxy.New().Validate(s)
+}
+
+// settingsField returns the field of s corresponding to setting.
+func settingsField(s *proxy.Settings, setting string) *string {
+	switch setting {
+	case settingHTTP:
+		return &s.HTTP
+	case settingHTTPS:
+		return &s.HTTPS
+	case settingFTP:
+		return &s.FTP
+	case settingSOCKS:
+		return &s.SOCKS
+	case settingNoProxy:
+		return &s.NoProxy
+	}
+	panic(fmt.Sprintf("unknown setting %q", setting))
+}
+
+// unsupported returns d as a directive which can't be imported for the given
+// reason.
+func (d Directive) unsupported(reason string) Unsupported {
+	return Unsupported{Path: d.Path, Line: d.Line, Text: d.Text, Reason: reason}
+}
+
+// String returns the location and the text of the directive, with credentials
+// masked.
+func (d Directive) String() string {
+	return fmt.Sprintf("%s:%d: %s", d.Path, d.Line, proxy.RedactPasswords(d.Text))
+}
+
+// String returns the location and the text of the directive, with credentials
+// masked, and why it can't be imported.
+func (u Unsupported) String() string {
+	return fmt.Sprintf("%s:%d: %s (%s)", u.Path, u.Line, proxy.RedactPasswords(u.Text), u.Reason)
+}
+
+// Empty returns true if the plan doesn't import anything.
+func (p Plan) Empty() bool {
+	return len(p.Directives) == 0
+}
+
+// String returns the description of the plan, with credentials masked.
+func (p Plan) String() string {
+	var out strings.Builder
+
+	if p.Empty() {
+		out.WriteString("No proxy configuration to import.\n")
+	} else {
+		out.WriteString("Settings to apply:\n")
+		for _, setting := range []string{settingHTTP, settingHTTPS, settingFTP, settingSOCKS, settingNoProxy} {
+			if v := *settingsField(&p.Settings, setting); v != "" {
+				fmt.Fprintf(&out, "  %s: %s\n", setting, proxy.RedactPasswords(v))
+			}
+		}
+		out.WriteString("Directives to comment out once imported:\n")
+		for _, d := range p.Directives {
+			fmt.Fprintf(&out, "  %s\n", d)
+		}
+	}
+
+	if len(p.Unsupported) > 0 {
+		out.WriteString("Directives which can't be imported, left untouched:\n")
+		for _, u := range p.Unsupported {
+			fmt.Fprintf(&out, "  %s\n", u)
+		}
+	}
+
+	return out.String()
+}
+
+// CommentOut comments out the given directives in their file, leaving the
+// other lines untouched. It fails without modifying a file if any of its
+// directives changed since it was scanned.
+func CommentOut(directives []Directive) (err error) {
+	defer decorate.OnError(&err, "couldn't comment out imported proxy directives")
+
+	var paths []string
+	byPath := make(map[string][]Directive)
+	for _, d := range directives {
+		if _, found := byPath[d.Path]; !found {
+			paths = append(paths, d.Path)
+		}
+		byPath[d.Path] = append(byPath[d.Path], d)
+	}
+
+	var errs error
+	for _, path := range paths {
+		errs = errors.Join(errs, commentOutInFile(path, byPath[path]))
+	}
+	return errs
+}
+
+// commentOutInFile comments out the given directives of the file at path,
+// replacing it atomically.
+func commentOutInFile(path string, directives []Directive) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for _, d := range directives {
+		if d.Line > len(lines) || lines[d.Line-1] != d.Text {
+			return fmt.Errorf("%s changed since it was scanned", path)
+		}
+		lines[d.Line-1] = d.comment + " " + importedMarker + d.Text
+	}
+
+	tmpPath := path + ".new"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// isSetting returns true if name is a setting which can be imported.
+func isSetting(name string) bool {
+	return slices.Contains([]string{settingHTTP, settingHTTPS, settingFTP, settingSOCKS, settingNoProxy}, name)
+}
@@ -0,0 +1,86 @@
+package migration_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/migration"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestScan(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		root             string
+		changeAfterScan  bool
+		unreadableConfig bool
+
+		wantScanErr       bool
+		wantCommentOutErr bool
+	}{
+		"Environment and APT directives are imported": {root: "environment_and_apt"},
+		"Conflicting directives are not imported":     {root: "conflicts"},
+		"Files managed by us are not imported":        {root: "managed_files"},
+		"Invalid values are not imported":             {root: "invalid_values"},
+		"Nothing to import":                           {root: "nothing_to_import"},
+
+		"Error when a directive changed since the scan": {root: "environment_and_apt", changeAfterScan: true, wantCommentOutErr: true},
+		"Error when a configuration file is unreadable": {root: "environment_and_apt", unreadableConfig: true, wantScanErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			temp := t.TempDir()
+			root := filepath.Join(temp, "root")
+			src := filepath.Join(testutils.TestFamilyPath(t), tc.root)
+			err := shutil.CopyTree(src, root, nil)
+			require.NoError(t, err, "Setup: couldn't copy fixture")
+			if tc.unreadableConfig {
+				// A directory can't be read as a file, even by root.
+				path := filepath.Join(root, "etc", "environment")
+				require.NoError(t, os.Remove(path), "Setup: couldn't remove configuration file")
+				require.NoError(t, os.Mkdir(path, 0700), "Setup: couldn't replace configuration file")
+			}
+
+			plan, err := migration.Scan(root)
+			if tc.wantScanErr {
+				require.Error(t, err, "Scan should fail")
+				return
+			}
+			require.NoError(t, err, "Scan should succeed")
+
+			if tc.changeAfterScan {
+				path := filepath.Join(root, "etc", "apt", "apt.conf.d", "80proxy")
+				err := os.WriteFile(path, []byte("Acquire::http::Proxy \"http://new-proxy.example.com:3128\";\n"), 0600)
+				require.NoError(t, err, "Setup: couldn't change configuration file")
+			}
+
+			err = migration.CommentOut(plan.Directives)
+			if tc.wantCommentOutErr {
+				require.Error(t, err, "CommentOut should fail")
+			} else {
+				require.NoError(t, err, "CommentOut should succeed")
+			}
+
+			// The plan lists absolute paths, which change between runs.
+			err = os.WriteFile(filepath.Join(temp, "plan"), []byte(strings.ReplaceAll(plan.String(), root, "ROOT")), 0600)
+			require.NoError(t, err, "Setup: couldn't write plan")
+			testutils.CompareTreesWithFiltering(t, temp, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
+
+func TestMain(m *testing.M) {
+	testutils.InstallUpdateFlag()
+	flag.Parse()
+
+	m.Run()
+}
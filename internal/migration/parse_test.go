@@ -0,0 +1,102 @@
+package migration_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/migration"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+	}{
+		"Lowercase variables":         {fixture: "lowercase_variables"},
+		"Uppercase quoted variables":  {fixture: "uppercase_quoted_variables"},
+		"Export statements":           {fixture: "export_statements"},
+		"Other variables are ignored": {fixture: "other_variables_are_ignored"},
+		"Comments and blank lines":    {fixture: "comments_and_blank_lines"},
+		"Credentials are kept":        {fixture: "credentials"},
+		"Unsupported variables":       {fixture: "unsupported_variables"},
+		"Windows line endings":        {fixture: "windows_line_endings"},
+		"No final newline":            {fixture: "no_final_newline"},
+		"Empty file":                  {fixture: "empty"},
+		"Lines without an assignment": {fixture: "lines_without_assignment"},
+
+		"Managed block is ignored":                {fixture: "managed_block"},
+		"Managed block without footer is ignored": {fixture: "managed_block_without_footer"},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(testutils.TestFamilyPath(t), tc.fixture)
+			content, err := os.ReadFile(path)
+			require.NoError(t, err, "Setup: couldn't read fixture")
+
+			directives, unsupported := migration.ParseEnvironment(path, string(content))
+			compareParsed(t, directives, unsupported)
+		})
+	}
+}
+
+func TestParseAPTConf(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+	}{
+		"Single directives":                {fixture: "single_directives"},
+		"Case insensitive keys":            {fixture: "case_insensitive_keys"},
+		"Whitespace and trailing comments": {fixture: "whitespace_and_trailing_comments"},
+		"Comments":                         {fixture: "comments"},
+		"Per-host and direct proxies":      {fixture: "per_host_and_direct"},
+		"Nested blocks":                    {fixture: "nested_blocks"},
+		"Auto-detection":                   {fixture: "auto_detection"},
+		"Several statements on a line":     {fixture: "several_statements_on_a_line"},
+		"Unknown protocol":                 {fixture: "unknown_protocol"},
+		"Other directives are ignored":     {fixture: "other_directives_are_ignored"},
+		"Credentials are kept":             {fixture: "credentials"},
+		"Windows line endings":             {fixture: "windows_line_endings"},
+		"Empty file":                       {fixture: "empty"},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(testutils.TestFamilyPath(t), tc.fixture)
+			content, err := os.ReadFile(path)
+			require.NoError(t, err, "Setup: couldn't read fixture")
+
+			directives, unsupported := migration.ParseAPTConf(path, string(content))
+			compareParsed(t, directives, unsupported)
+		})
+	}
+}
+
+// compareParsed compares the parsed directives and the unsupported ones to
+// the golden file of the test.
+func compareParsed(t *testing.T, directives []migration.Directive, unsupported []migration.Unsupported) {
+	t.Helper()
+
+	var got string
+	for _, d := range directives {
+		got += fmt.Sprintf("import %s=%q from %s\n", d.Setting, d.Value, d)
+	}
+	for _, u := range unsupported {
+		got += fmt.Sprintf("unsupported %s\n", u)
+	}
+
+	gotPath := filepath.Join(t.TempDir(), "parsed")
+	err := os.WriteFile(gotPath, []byte(got), 0600)
+	require.NoError(t, err, "Setup: couldn't write parsed directives")
+	testutils.CompareTreesWithFiltering(t, gotPath, testutils.GoldenPath(t), testutils.Update())
+}
@@ -0,0 +1,24 @@
+package notifier
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Option is a notifier option.
+type Option = option
+
+// WithTimeout overrides the maximum duration of a notification.
+func WithTimeout(timeout time.Duration) func(*options) {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithDialer overrides the function opening connections to the endpoint.
+func WithDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(*options) {
+	return func(o *options) {
+		o.dial = dial
+	}
+}
@@ -0,0 +1,137 @@
+// Package notifier reports the outcome of Apply calls to a local agent, over a
+// unix socket or a local HTTP endpoint.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+)
+
+// defaultTimeout is the maximum duration of a notification, as the Apply call
+// waits for it to complete.
+const defaultTimeout = 2 * time.Second
+
+// Notifier POSTs the outcome of Apply calls as JSON to a local endpoint.
+type Notifier struct {
+	url    string
+	client *http.Client
+}
+
+type options struct {
+	timeout time.Duration
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+}
+type option func(*options)
+
+// New returns a notifier for the given endpoint, which is either the absolute
+// path of a unix socket or an http:// URL pointing to the local machine.
+func New(endpoint string, args ...option) (n *Notifier, err error) {
+	defer decorate.OnError(&err, "couldn't create notifier")
+
+	opts := options{
+		timeout: defaultTimeout,
+		dial:    (&net.Dialer{}).DialContext,
+	}
+	for _, f := range args {
+		f(&opts)
+	}
+
+	network, address, reqURL, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		url: reqURL,
+		client: &http.Client{
+			// The transport never goes through a proxy: the endpoint is local,
+			// and the proxy may be the very thing being misconfigured.
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return opts.dial(ctx, network, address)
+				},
+			},
+			Timeout: opts.timeout,
+		},
+	}, nil
+}
+
+// ValidateEndpoint returns an error if endpoint is neither the absolute path of
+// a unix socket nor an http:// URL pointing to the local machine.
+func ValidateEndpoint(endpoint string) error {
+	_, _, _, err := parseEndpoint(endpoint)
+	return err
+}
+
+// parseEndpoint returns the network and address to connect to for the given
+// endpoint, and the URL of the requests.
+func parseEndpoint(endpoint string) (network, address, reqURL string, err error) {
+	if filepath.IsAbs(endpoint) {
+		return "unix", endpoint, "http://localhost/", nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != "http" {
+		return "", "", "", fmt.Errorf("endpoint %q must be a unix socket path or an http:// URL", endpoint)
+	}
+	if u.User != nil {
+		return "", "", "", fmt.Errorf("endpoint %q must not contain credentials", u.Redacted())
+	}
+	if !isLocalHost(u.Hostname()) {
+		return "", "", "", fmt.Errorf("endpoint %q must point to the local machine", endpoint)
+	}
+
+	address = u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return "tcp", address, u.String(), nil
+}
+
+// isLocalHost returns true if host is localhost or a loopback address.
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Report POSTs the given outcome of an Apply call to the endpoint.
+func (n Notifier) Report(last proxy.LastApply) (err error) {
+	defer decorate.OnError(&err, "couldn't notify %s", n.url)
+
+	data, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Notifying %s of the Apply call", n.url)
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
+//go:build !noapt
+
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
-	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -24,45 +28,151 @@ func (p setting) aptString() string {
 	return fmt.Sprintf("Acquire::%s::Proxy \"%s\";\n", strings.ToLower(p.protocol.String()), p.escapedURL)
 }
 
-// applyToAPT applies the proxy configuration in the form of APT settings in /etc/apt/apt.conf.d
+// aptHostProxyRegexp matches the per-host proxy statements of the APT
+// configuration file.
+var aptHostProxyRegexp = regexp.MustCompile(`^Acquire::http::Proxy::(\S+) "(.*)";$`)
+
+// aptStrings formats a per-host proxy to be used in an APT configuration file.
+// The same proxy is used for HTTP and HTTPS.
+func (h hostProxy) aptStrings() string {
+	var content string
+	for _, proto := range []protocol{protocolHTTP, protocolHTTPS} {
+		content += fmt.Sprintf("Acquire::%s::Proxy::%s \"%s\";\n", strings.ToLower(proto.String()), h.host, h.value())
+	}
+	return content
+}
+
+// aptBackend applies the proxy configuration in the form of APT settings in
+// /etc/apt/apt.conf.d.
+type aptBackend struct {
+	path string
+
+	// extraLines are appended to the generated configuration.
+	extraLines []string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("apt", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return aptBackend{path: filepath.Join(opts.root, defaultAPTConfigPath), extraLines: opts.extraLines.APT, fs: r}
+	})
+}
+
+func (b aptBackend) name() string    { return "apt" }
+func (b aptBackend) paths() []string { return []string{b.path} }
+
+func (b aptBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolAuto:
+		return "APT doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply applies the proxy configuration to the APT configuration file.
 // If there are no proxy settings to apply, the APT proxy config file is removed.
-func (p Proxy) applyToAPT() (err error) {
+func (b aptBackend) apply(ctx context.Context, settings []setting) error {
+	return b.applyHostProxies(ctx, settings, nil)
+}
+
+// applyHostProxies applies the proxy configuration and the per-host proxies to
+// the APT configuration file. If there are neither proxy settings nor per-host
+// proxies to apply, the APT proxy config file is removed.
+func (b aptBackend) applyHostProxies(ctx context.Context, settings []setting, hostProxies []hostProxy) (err error) {
 	defer decorate.OnError(&err, "couldn't apply apt proxy configuration")
 
-	if p.noSupportedProtocols(unsupportedAPTProtocols) {
-		log.Debug("No proxy settings to apply, removing apt proxy config file if it exists")
-		if err := os.Remove(p.aptConfigPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return err
+	// APT can't connect to an IPv6 link-local proxy with a zone identifier, so
+	// refuse the configuration rather than writing one it can't use.
+	for _, s := range settings {
+		if slices.Contains(unsupportedAPTProtocols, s.protocol) {
+			continue
+		}
+		if _, zone := hostZone(s.url); zone != "" {
+			return fmt.Errorf("%s proxy host has zone identifier %q, which is not supported by APT", s.protocol, zone)
+		}
+	}
+	for _, h := range hostProxies {
+		if h.proxy == nil {
+			continue
+		}
+		if _, zone := hostZone(h.proxy.url); zone != "" {
+			return fmt.Errorf("proxy host for %s has zone identifier %q, which is not supported by APT", h.host, zone)
 		}
-		return nil
 	}
 
-	log.Debugf("Applying APT proxy configuration to %q", p.aptConfigPath)
+	remove := noSupportedProtocols(settings, unsupportedAPTProtocols) && len(hostProxies) == 0
+
+	log.Debugf("Applying APT proxy configuration to %q", b.path)
+	return applyConfigFile(ctx, b.fs, b.path, withExtraLines(aptConfig(settings, hostProxies), b.extraLines), remove)
+}
 
-	content := p.aptConfig()
-	if prev, err := previousConfig(p.aptConfigPath); err == nil && prev == content {
-		log.Debugf("APT proxy configuration at %q is already up to date", p.aptConfigPath)
-		return nil
-	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
+// appliedHostProxies returns the per-host proxies of the APT configuration
+// file, indexed by host. Files not generated by ubuntu-proxy-manager have none.
+func (b aptBackend) appliedHostProxies() (proxies map[string]string, err error) {
+	defer decorate.OnError(&err, "couldn't read apt per-host proxies")
+
+	content, err := previousConfig(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(content, confHeader) {
+		return nil, nil
 	}
 
-	// Check if the parent directory exists - attempt to create the structure if not
-	// In practice this is close to impossible because apt itself ships files to
-	// this directory, but this simplifies testing a bit for us
-	if err := createParentDirectories(p.aptConfigPath); err != nil {
-		return err
+	for _, line := range strings.Split(content, "\n") {
+		// Extra lines are not part of the proxy settings.
+		if line == extraLinesHeader {
+			break
+		}
+
+		m := aptHostProxyRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if proxies == nil {
+			proxies = make(map[string]string)
+		}
+		proxies[m[1]] = m[2]
 	}
 
-	return safeWriteFile(p.aptConfigPath, content)
+	return proxies, nil
 }
 
-// aptConfig returns the formatted APT proxy configuration file to be written.
-func (p Proxy) aptConfig() string {
+// aptConfig returns the formatted APT proxy configuration file to be written,
+// the per-host proxies following the global ones.
+func aptConfig(settings []setting, hostProxies []hostProxy) string {
 	content := fmt.Sprintln(confHeader)
-	for _, p := range p.settings {
+	for _, p := range sortedSettings(settings) {
 		content += p.aptString()
 	}
+	for _, h := range aptHostProxies(settings, hostProxies) {
+		content += h.aptStrings()
+	}
 
 	return content
 }
+
+// aptHostProxies returns the given per-host proxies, along with the ones
+// reaching the hosts of the no_proxy setting directly, as APT doesn't read
+// no_proxy in all of its transports. They are sorted by host, and the given
+// per-host proxies take precedence.
+func aptHostProxies(settings []setting, hostProxies []hostProxy) []hostProxy {
+	all := slices.Clone(hostProxies)
+	for _, s := range settings {
+		if s.protocol != protocolNo {
+			continue
+		}
+		for _, host := range directHosts(s.escapedURL) {
+			if slices.ContainsFunc(all, func(h hostProxy) bool { return strings.EqualFold(h.host, host) }) {
+				continue
+			}
+			all = append(all, hostProxy{host: host})
+		}
+	}
+
+	slices.SortFunc(all, func(a, b hostProxy) bool { return a.host < b.host })
+	return all
+}
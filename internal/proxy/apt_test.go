@@ -0,0 +1,69 @@
+//go:build !noapt
+
+package proxy_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestAPTHostProxies(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		settings     proxy.Settings
+		allowedHosts []string
+
+		wantErr bool
+	}{
+		"Per-host proxies follow the global ones": {settings: proxy.Settings{
+			HTTP:           "http://example.com:8080",
+			APTHostProxies: map[string]string{"mirror.example.com": "DIRECT", "archive.example.org": "http://user:p@ss@other.example.com:3128"},
+		}},
+		"Per-host proxies without global proxy":      {settings: proxy.Settings{APTHostProxies: map[string]string{"archive.example.org": "http://example.com:8080"}}},
+		"Per-host proxies with unsupported settings": {settings: proxy.Settings{NoProxy: "localhost", APTHostProxies: map[string]string{"mirror.example.com": "DIRECT"}}},
+		"No proxy hosts are reached directly": {
+			settings: proxy.Settings{HTTP: "http://example.com:8080", NoProxy: `localhost, Mirror.Example.com,"10.0.0.1", .example.net, *.example.org, 10.0.0.0/8, [::1], host:8080, *`},
+		},
+		"Per-host proxies take precedence over no_proxy": {settings: proxy.Settings{
+			HTTP:           "http://example.com:8080",
+			NoProxy:        "localhost,mirror.example.com",
+			APTHostProxies: map[string]string{"mirror.example.com": "http://other.example.com:3128"},
+		}},
+		"No proxy alone removes the file": {settings: proxy.Settings{NoProxy: "localhost"}},
+		"Per-host proxy allowed by policy": {
+			settings:     proxy.Settings{APTHostProxies: map[string]string{"archive.example.org": "http://proxy.example.com:3128", "mirror.example.com": "DIRECT"}},
+			allowedHosts: []string{"proxy.example.com"},
+		},
+
+		"Error on invalid host":                {settings: proxy.Settings{APTHostProxies: map[string]string{"mirror.example.com::Other": "DIRECT"}}, wantErr: true},
+		"Error on empty host":                  {settings: proxy.Settings{APTHostProxies: map[string]string{"": "DIRECT"}}, wantErr: true},
+		"Error on proxy without scheme":        {settings: proxy.Settings{APTHostProxies: map[string]string{"mirror.example.com": "example.com:8080"}}, wantErr: true},
+		"Error on proxy with zone identifier":  {settings: proxy.Settings{APTHostProxies: map[string]string{"mirror.example.com": "http://[fe80::1%eth0]:3128"}}, wantErr: true},
+		"Error on proxy host denied by policy": {settings: proxy.Settings{APTHostProxies: map[string]string{"mirror.example.com": "http://evil.example.org"}}, allowedHosts: []string{"proxy.example.com"}, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			// Only the APT backend is managed.
+			modes := proxy.WithBackendModes(proxy.OnlyBackend("apt"))
+
+			err := proxy.New(proxy.WithRoot(root), proxy.WithAllowedHosts(tc.allowedHosts), modes).Apply(tc.settings)
+			if tc.wantErr {
+				require.Error(t, err, "Apply should have failed but didn't")
+				require.NoFileExists(t, filepath.Join(root, proxy.DefaultAPTConfigPath), "No configuration should have been written")
+				return
+			}
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// backend is a system component to which proxy settings are applied.
+//
+// Rendering must be deterministic: given the same settings, a backend must
+// produce byte-identical content on every call. Settings are iterated in the
+// order they are given, and any option or map-backed value must be serialized
+// in a canonical order. This guarantees that files which are already up to
+// date are never rewritten, preserving their modification time.
+type backend interface {
+	// name returns the unique name of the backend.
+	name() string
+
+	// paths returns the files managed by the backend.
+	paths() []string
+
+	// apply applies the given proxy settings to the backend. Filesystem
+	// mutations are abandoned once ctx is done.
+	apply(ctx context.Context, settings []setting) error
+
+	// skipReason returns why the backend can't express settings of the given
+	// protocol, or an empty string if it can.
+	skipReason(proto protocol) string
+}
+
+// sharedFilesBackend is a backend managing entries of files shared with other
+// programs, rather than only whole files. Its shared files are never removed.
+type sharedFilesBackend interface {
+	backend
+
+	// sharesFiles marks the backends sharing their files.
+	sharesFiles()
+}
+
+// optInBackend is a backend which is disabled unless its mode is set.
+type optInBackend interface {
+	backend
+
+	// optIn marks the backends disabled by default.
+	optIn()
+}
+
+// externalStateBackend is a backend storing its configuration outside of
+// files, through an API or a command, which can't be previewed.
+type externalStateBackend interface {
+	backend
+
+	// externalState marks the backends storing their configuration outside
+	// of files.
+	externalState()
+}
+
+// probedBackend is a backend which is only applied if its prerequisites are met
+// on the system, such as the program it configures being installed.
+type probedBackend interface {
+	backend
+
+	// unavailableReason returns why the backend isn't applied on this system,
+	// or an empty string if it is.
+	unavailableReason() string
+}
+
+// credentialsSkippingBackend is a backend which can't pass the credentials of
+// the proxies of some protocols.
+type credentialsSkippingBackend interface {
+	backend
+
+	// credentialsSkipReason returns why the backend can't pass the credentials
+	// of proxies of the given protocol, or an empty string if it can.
+	credentialsSkipReason(proto protocol) string
+}
+
+// hostProxiesBackend is a backend which can also set proxies for specific
+// hosts, applied instead of apply with applyHostProxies.
+type hostProxiesBackend interface {
+	backend
+
+	// applyHostProxies applies the given proxy settings and per-host proxies
+	// to the backend. Filesystem mutations are abandoned once ctx is done.
+	applyHostProxies(ctx context.Context, settings []setting, hostProxies []hostProxy) error
+
+	// appliedHostProxies returns the per-host proxies of the applied
+	// configuration, indexed by host.
+	appliedHostProxies() (map[string]string, error)
+}
+
+// ntlmBackend is a backend authenticating to NTLM proxies on behalf of the
+// other backends, applied instead of apply with applyNTLM.
+type ntlmBackend interface {
+	backend
+
+	// applyNTLM applies the given NTLM proxy to the backend, or removes its
+	// configuration if ntlm is nil. Filesystem mutations are abandoned once
+	// ctx is done.
+	applyNTLM(ctx context.Context, ntlm *ntlmProxy) error
+}
+
+// snapStoreBackend is a backend which can also register the device against a
+// Snap Store Proxy, applied instead of apply with applySnapStore.
+type snapStoreBackend interface {
+	backend
+
+	// applySnapStore applies the given proxy settings to the backend, and
+	// sets the Snap Store Proxy to the given store ID, unsetting it if the ID
+	// is empty. The Snap Store Proxy is left untouched if storeID is nil.
+	applySnapStore(ctx context.Context, settings []setting, storeID *string) error
+}
+
+// applyBackend applies the given settings to b, along with the per-host
+// proxies if b supports them, the NTLM proxy if b authenticates to it, or the
+// Snap Store Proxy if b registers against it.
+func applyBackend(ctx context.Context, b backend, settings []setting, hostProxies []hostProxy, ntlm *ntlmProxy, storeID *string) error {
+	if hb, ok := b.(hostProxiesBackend); ok {
+		return hb.applyHostProxies(ctx, settings, hostProxies)
+	}
+	if nb, ok := b.(ntlmBackend); ok {
+		return nb.applyNTLM(ctx, ntlm)
+	}
+	if sb, ok := b.(snapStoreBackend); ok {
+		return sb.applySnapStore(ctx, settings, storeID)
+	}
+	return b.apply(ctx, settings)
+}
+
+// backendFactories maps the names of the backends compiled in to the functions
+// creating them from the options and runners. Backends excluded at build time, with the
+// noapt or nogsettings tags, aren't registered.
+var backendFactories = make(map[string]backendFactory)
+
+// backendFactory creates a backend from the options, performing its filesystem
+// mutations and running its commands with the given runners.
+type backendFactory func(opts options, r *fsRunner, c *commandRunner) backend
+
+// registerBackend registers the function creating the backend of the given
+// name. It must be called from an init function of the backend file.
+func registerBackend(name string, newBackend backendFactory) {
+	backendFactories[name] = newBackend
+}
+
+// CompiledBackends returns the names of the backends compiled in, in the order
+// they are applied.
+func CompiledBackends() (names []string) {
+	for _, name := range BackendNames {
+		if _, found := backendFactories[name]; found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CheckBackend returns an error if name isn't the name of a backend, or if the
+// backend was excluded from this build.
+func CheckBackend(name string) error {
+	if !slices.Contains(BackendNames, name) {
+		return fmt.Errorf("unknown backend %q, must be one of %s", name, strings.Join(BackendNames, ", "))
+	}
+	if _, found := backendFactories[name]; !found {
+		return fmt.Errorf("backend %q is not available in this build", name)
+	}
+	return nil
+}
+
+// SkippedSetting is a setting which a backend couldn't express, and skipped.
+type SkippedSetting struct {
+	Backend  string `json:"backend"`
+	Protocol string `json:"protocol"`
+	Reason   string `json:"reason"`
+}
+
+// skippedSettings returns the settings skipped by each of the given backends,
+// in the order of the backends and settings.
+// The all setting is never reported, as it is derived from the other ones.
+func skippedSettings(backends []backend, settings []setting) (skipped []SkippedSetting) {
+	for _, b := range backends {
+		for _, s := range settings {
+			if s.protocol == protocolAll {
+				continue
+			}
+			if reason := b.skipReason(s.protocol); reason != "" {
+				skipped = append(skipped, SkippedSetting{Backend: b.name(), Protocol: strings.ToLower(s.protocol.String()), Reason: reason})
+			}
+		}
+	}
+	return skipped
+}
+
+// Kinds of the warnings about valid proxy settings.
+const (
+	// WarningUnsupportedProtocol is reported when a backend skips a setting.
+	WarningUnsupportedProtocol = "unsupported-protocol"
+	// WarningIgnoredCredentials is reported when a backend can't pass the
+	// credentials of a proxy.
+	WarningIgnoredCredentials = "ignored-credentials"
+)
+
+// Warning is a problem with valid proxy settings, which don't apply as given
+// to a backend.
+type Warning struct {
+	// Kind is one of WarningUnsupportedProtocol or WarningIgnoredCredentials.
+	Kind     string `json:"kind"`
+	Backend  string `json:"backend"`
+	Protocol string `json:"protocol"`
+	Reason   string `json:"reason"`
+}
+
+// settingWarnings returns the warnings about the given settings for each of
+// the given backends, in the order of the backends and settings.
+// The all setting is never reported, as it is derived from the other ones.
+func settingWarnings(backends []backend, settings []setting) (warnings []Warning) {
+	for _, b := range backends {
+		for _, s := range settings {
+			if s.protocol == protocolAll {
+				continue
+			}
+			proto := strings.ToLower(s.protocol.String())
+			if reason := b.skipReason(s.protocol); reason != "" {
+				warnings = append(warnings, Warning{Kind: WarningUnsupportedProtocol, Backend: b.name(), Protocol: proto, Reason: reason})
+				continue
+			}
+			cb, ok := b.(credentialsSkippingBackend)
+			if !ok || s.url == nil || s.url.User == nil {
+				continue
+			}
+			if reason := cb.credentialsSkipReason(s.protocol); reason != "" {
+				warnings = append(warnings, Warning{Kind: WarningIgnoredCredentials, Backend: b.name(), Protocol: proto, Reason: reason})
+			}
+		}
+	}
+	return warnings
+}
+
+// programDirs are the directories, relative to the root, where the programs
+// configured by the probed backends are looked for.
+var programDirs = []string{"usr/local/sbin", "usr/local/bin", "usr/sbin", "usr/bin", "sbin", "bin", "snap/bin"}
+
+// missingProgramReason returns why a backend configuring any of the given
+// programs isn't applied: none of them is installed under root. It returns an
+// empty string if one of them is.
+func missingProgramReason(root string, programs ...string) string {
+	var quoted []string
+	for _, program := range programs {
+		for _, dir := range programDirs {
+			if fi, err := os.Stat(filepath.Join(root, dir, program)); err == nil && !fi.IsDir() {
+				return ""
+			}
+		}
+		quoted = append(quoted, fmt.Sprintf("%q", program))
+	}
+	return fmt.Sprintf("couldn't find an executable for %s", strings.Join(quoted, " or "))
+}
+
+// unitDirs are the directories, relative to the root, where the systemd units
+// configured by the probed backends are looked for.
+var unitDirs = []string{"etc/systemd/system", "usr/local/lib/systemd/system", "usr/lib/systemd/system", "lib/systemd/system"}
+
+// missingUnitReason returns why a backend configuring any of the given systemd
+// units isn't applied: none of them is installed under root. It returns an
+// empty string if one of them is.
+func missingUnitReason(root string, units ...string) string {
+	var quoted []string
+	for _, unit := range units {
+		for _, dir := range unitDirs {
+			if fi, err := os.Stat(filepath.Join(root, dir, unit)); err == nil && !fi.IsDir() {
+				return ""
+			}
+		}
+		quoted = append(quoted, fmt.Sprintf("%q", unit))
+	}
+	return fmt.Sprintf("couldn't find a systemd unit for %s", strings.Join(quoted, " or "))
+}
+
+// normalizeRendered returns the rendered content of a file as every backend
+// writes it: UTF-8 without byte order mark, with LF line endings and exactly one
+// trailing newline. Invalid UTF-8 sequences are replaced, so that the content
+// written is always the content compared on the next call.
+func normalizeRendered(content string) string {
+	content = strings.ToValidUTF8(content, "\uFFFD")
+	content = strings.TrimPrefix(content, "\uFEFF")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+	return strings.TrimRight(content, "\n") + "\n"
+}
+
+// applyConfigFile writes content to path if it differs from the current file
+// content, creating parent directories if needed. The content is normalized
+// first with normalizeRendered.
+// If remove is true, the file is removed instead. No error is returned if it
+// doesn't exist.
+func applyConfigFile(ctx context.Context, r *fsRunner, path, content string, remove bool) error {
+	if remove {
+		log.Debugf("No proxy settings to apply, removing %q if it exists", path)
+		if err := r.remove(ctx, path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content = normalizeRendered(content)
+	if prev, err := previousConfig(path); err == nil && prev == content {
+		log.Debugf("Proxy configuration at %q is already up to date", path)
+		return nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Check if the parent directory exists - attempt to create the structure if not
+	if err := createParentDirectories(ctx, r, path); err != nil {
+		return err
+	}
+
+	return safeWriteFile(ctx, r, path, content, 0644)
+}
+
+// applySharedConfigFile writes content to path, a file shared with other
+// programs or edited by hand, creating parent directories if needed. Unlike
+// applyConfigFile, content is written verbatim so that the lines which aren't
+// managed keep their encoding and line endings, and the file keeps its mode.
+// It is created with perm if it doesn't exist.
+func applySharedConfigFile(ctx context.Context, r *fsRunner, path, content string, perm fs.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := createParentDirectories(ctx, r, path); err != nil {
+		return err
+	}
+
+	return safeWriteFile(ctx, r, path, content, perm)
+}
+
+// managedBlockConfig returns content with the managed block removed and, if
+// there are entries to set, added back at the end of the file, so that they
+// override the entries set earlier. A block whose end marker was removed ends
+// at its last line matching entryRegexp. The other lines are kept verbatim.
+func managedBlockConfig(content, entries string, entryRegexp *regexp.Regexp) string {
+	lines := strings.SplitAfter(content, "\n")
+	var out strings.Builder
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimRight(lines[i], "\r\n") != managedEntriesHeader {
+			out.WriteString(lines[i])
+			continue
+		}
+		for i+1 < len(lines) && entryRegexp.MatchString(lines[i+1]) {
+			i++
+		}
+		if i+1 < len(lines) && strings.TrimRight(lines[i+1], "\r\n") == managedEntriesFooter {
+			i++
+		}
+	}
+	result := out.String()
+
+	if entries == "" {
+		return result
+	}
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result + managedEntriesHeader + "\n" + entries + managedEntriesFooter + "\n"
+}
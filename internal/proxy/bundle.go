@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// lastApplyStateFile is the state file recording the last Apply call.
+const lastApplyStateFile = "last-apply.json"
+
+// Bundle summarizes the proxy configuration of the system, to be attached to
+// support requests. Credentials are masked.
+type Bundle struct {
+	// Version is the version of the program, set by the caller.
+	Version string `json:"version"`
+	// LastApply is the last recorded Apply call, if any.
+	LastApply *LastApply `json:"last_apply"`
+	// Files describes every file managed by the backends.
+	Files []BundleFile `json:"files"`
+	// Drift is true if any managed file changed since the last Apply call.
+	Drift bool `json:"drift"`
+	// Tools lists the external tools used by the backends.
+	Tools []BundleTool `json:"tools"`
+	// Warnings lists the problems found while assembling the bundle.
+	Warnings []string `json:"warnings"`
+}
+
+// LastApply is the state recorded by an Apply call.
+type LastApply struct {
+	Time time.Time `json:"time"`
+	// Operation is the call that applied the settings, either apply,
+	// rotate-credentials, reset or rollback.
+	Operation string `json:"operation,omitempty"`
+	// Settings are the canonical applied settings, indexed by protocol.
+	Settings map[string]string `json:"settings"`
+	// APTHostProxies are the canonical applied APT per-host proxies, indexed
+	// by host.
+	APTHostProxies map[string]string `json:"apt_host_proxies,omitempty"`
+	// SettingsHash identifies the applied settings. It is unset in the
+	// states recorded by previous versions.
+	SettingsHash *SettingsHash `json:"settings_hash,omitempty"`
+	// Error is the error returned by the Apply call, if any.
+	Error string `json:"error,omitempty"`
+	// Files are the SHA-256 checksums of the managed files once applied,
+	// indexed by path. Removed files have an empty checksum.
+	Files map[string]string `json:"files"`
+	// Skipped lists the settings which backends couldn't express.
+	Skipped []SkippedSetting `json:"skipped,omitempty"`
+	// Backends lists the mode which governed the outcome of each backend.
+	Backends []BackendResult `json:"backends,omitempty"`
+	// Commands lists the external commands run by the backends.
+	Commands []CommandRecord `json:"commands,omitempty"`
+}
+
+// BundleFile describes a file managed by a backend.
+type BundleFile struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
+	Exists  bool   `json:"exists"`
+	// Managed is true if the file was generated by ubuntu-proxy-manager, or
+	// contains entries it manages in a file shared with other programs.
+	Managed bool `json:"managed"`
+	// MatchesLastApply is unset if no Apply call was recorded.
+	MatchesLastApply *bool `json:"matches_last_apply,omitempty"`
+	// Content is only set for managed files.
+	Content string `json:"content,omitempty"`
+}
+
+// BundleTool describes an external tool used by the backends.
+type BundleTool struct {
+	Name    string `json:"name"`
+	Found   bool   `json:"found"`
+	Version string `json:"version,omitempty"`
+}
+
+// SupportBundle inspects the managed files, the recorded state and the
+// external tools to summarize the proxy configuration of the system.
+func (p Proxy) SupportBundle() (b Bundle, err error) {
+	defer decorate.OnError(&err, "couldn't assemble support bundle")
+
+	b.Files, b.Tools, b.Warnings = []BundleFile{}, []BundleTool{}, []string{}
+
+	if p.state != nil {
+		var last LastApply
+		if err := p.state.Load(lastApplyStateFile, &last); errors.Is(err, fs.ErrNotExist) {
+			b.Warnings = append(b.Warnings, "No Apply call was recorded")
+		} else if err != nil {
+			b.Warnings = append(b.Warnings, err.Error())
+		} else {
+			b.LastApply = &last
+			if last.Error != "" {
+				b.Warnings = append(b.Warnings, fmt.Sprintf("The last Apply call failed: %s", last.Error))
+			}
+			for _, s := range last.Skipped {
+				b.Warnings = append(b.Warnings, fmt.Sprintf("The %s backend skipped the %s setting: %s", s.Backend, s.Protocol, s.Reason))
+			}
+		}
+
+		pending, err := p.loadPending()
+		if err != nil {
+			b.Warnings = append(b.Warnings, err.Error())
+		}
+		for _, c := range pending {
+			b.Warnings = append(b.Warnings, fmt.Sprintf("The %s configuration is pending until its prerequisites are met: %s", c.Backend, redactPasswords(c.Reason)))
+		}
+	}
+
+	for _, backend := range p.backends {
+		for _, path := range backend.paths() {
+			f, err := p.inspectFile(backend.name(), path)
+			if err != nil {
+				return Bundle{}, err
+			}
+			// Shared files exist whether they contain managed entries or not.
+			if _, shared := backend.(sharedFilesBackend); f.Exists && !f.Managed && !shared {
+				b.Warnings = append(b.Warnings, fmt.Sprintf("%s exists but is not managed by ubuntu-proxy-manager", f.Path))
+			}
+
+			if b.LastApply != nil {
+				checksum, err := fileChecksum(path)
+				if err != nil {
+					return Bundle{}, err
+				}
+				matches := checksum == b.LastApply.Files[f.Path]
+				f.MatchesLastApply = &matches
+				if !matches {
+					b.Drift = true
+					b.Warnings = append(b.Warnings, fmt.Sprintf("%s changed since the last Apply call", f.Path))
+				}
+			}
+
+			b.Files = append(b.Files, f)
+		}
+	}
+
+	var tools [][]string
+	// The GLib tools are only used by the GSettings backend.
+	if slices.Contains(CompiledBackends(), "gsettings") {
+		tools = append(tools, p.glibCompileSchemasCmd, p.gsettingsCmd)
+	}
+	for _, cmd := range tools {
+		t := probeTool(cmd)
+		if !t.Found {
+			b.Warnings = append(b.Warnings, fmt.Sprintf("%s was not found", t.Name))
+		}
+		b.Tools = append(b.Tools, t)
+	}
+
+	return b, nil
+}
+
+// inspectFile describes the file managed by backend at path.
+func (p Proxy) inspectFile(backend, path string) (f BundleFile, err error) {
+	f = BundleFile{Backend: backend, Path: p.displayPath(path)}
+
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+	f.Exists = true
+	if fi.Size() > maxManagedFileSize {
+		return f, fmt.Errorf("%q is larger than %d bytes", path, maxManagedFileSize)
+	}
+
+	content, err := previousConfig(path)
+	if err != nil {
+		return f, err
+	}
+	if f.Managed = managedContent(content); f.Managed {
+		f.Content = redactPasswords(content)
+	}
+
+	return f, nil
+}
+
+// displayPath returns path relative to the root of the proxy manager, as an
+// absolute path.
+func (p Proxy) displayPath(path string) string {
+	rel, err := filepath.Rel(p.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+// recordLastApply saves the given settings and backend results, the result of
+// the Apply call and the checksums of the managed files in the state
+// directory, and sends them to the reporter. Failures are only logged, as they don't affect the applied
+// configuration.
+func (p Proxy) recordLastApply(operation string, settings []setting, hostProxies []hostProxy, results []BackendResult, applyErr error) {
+	if p.state == nil && p.reporter == nil {
+		return
+	}
+
+	last, err := p.lastApply(operation, settings, hostProxies, results, applyErr)
+	if err != nil {
+		log.Warningf("Couldn't record the state of the last applied configuration: %v", err)
+		return
+	}
+
+	if p.state != nil {
+		if err := p.state.Save(lastApplyStateFile, last); err != nil {
+			log.Warningf("Couldn't record the state of the last applied configuration: %v", err)
+		}
+	}
+	if p.reporter != nil {
+		if err := p.reporter.Report(last); err != nil {
+			log.Warningf("Couldn't report the outcome of the Apply call: %v", err)
+		}
+	}
+}
+
+// lastApply returns the state of the given operation with the given settings,
+// per-host proxies, backend results and result. Credentials are masked.
+func (p Proxy) lastApply(operation string, settings []setting, hostProxies []hostProxy, results []BackendResult, applyErr error) (LastApply, error) {
+	last := LastApply{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Settings:  make(map[string]string),
+		Files:     make(map[string]string),
+	}
+	for _, s := range settings {
+		last.Settings[strings.ToLower(s.protocol.String())] = redactPasswords(s.escapedURL)
+	}
+	for _, h := range hostProxies {
+		if last.APTHostProxies == nil {
+			last.APTHostProxies = make(map[string]string)
+		}
+		last.APTHostProxies[h.host] = redactPasswords(h.value())
+	}
+	if applyErr != nil {
+		last.Error = redactPasswords(applyErr.Error())
+	}
+	hash := hashSettings(settings)
+	last.SettingsHash = &hash
+	last.Skipped = skippedSettings(p.managedBackends(), settings)
+	last.Backends = results
+	last.Commands = p.commands.recorded()
+	for _, b := range p.backends {
+		for _, path := range b.paths() {
+			checksum, err := fileChecksum(path)
+			if err != nil {
+				return LastApply{}, err
+			}
+			last.Files[p.displayPath(path)] = checksum
+		}
+	}
+
+	return last, nil
+}
+
+// fileChecksum returns the hexadecimal SHA-256 checksum of the file at path,
+// or an empty string if it doesn't exist.
+func fileChecksum(path string) (string, error) {
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// probeTool returns whether the given command is available, and its version.
+func probeTool(cmd []string) BundleTool {
+	t := BundleTool{Name: filepath.Base(cmd[0])}
+	if _, err := exec.LookPath(cmd[0]); err != nil {
+		return t
+	}
+	t.Found = true
+
+	versionCmd := append(slices.Clone(cmd), "--version")
+	// #nosec G204 - path not controllable by user
+	out, err := exec.Command(versionCmd[0], versionCmd[1:]...).Output()
+	if err != nil {
+		log.Debugf("Couldn't get the version of %s: %v", t.Name, err)
+		return t
+	}
+	t.Version, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+
+	return t
+}
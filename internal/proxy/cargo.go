@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedCargoProtocols lists the protocols that are not supported by Cargo.
+var unsupportedCargoProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolNo, protocolAuto}
+
+// cargoProxyRegexp matches the proxy key of a TOML table.
+var cargoProxyRegexp = regexp.MustCompile(`^\s*proxy\s*=`)
+
+// cargoBackend applies the proxy configuration to the proxy key of the [http]
+// table of /etc/cargo/config.toml, the configuration of Cargo when its home,
+// CARGO_HOME, is set to the system directory /etc/cargo. The file is shared:
+// only the proxy key is managed, and the rest of the file is left untouched.
+// As Cargo doesn't read it unless told to, the backend is disabled unless its
+// mode is set.
+type cargoBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("cargo", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return cargoBackend{path: filepath.Join(opts.root, defaultCargoConfigPath), fs: r}
+	})
+}
+
+func (b cargoBackend) name() string    { return "cargo" }
+func (b cargoBackend) paths() []string { return []string{b.path} }
+func (b cargoBackend) sharesFiles()    {}
+func (b cargoBackend) optIn()          {}
+
+func (b cargoBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP, protocolSOCKS:
+		return "Cargo has a single proxy setting, used for HTTP and HTTPS"
+	case protocolNo:
+		return "Cargo only reads the hosts bypassing the proxy from the environment"
+	case protocolAuto:
+		return "Cargo doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply replaces the proxy key of the [http] table with the given proxy
+// settings. If there are no proxy settings to apply, the key is removed, but
+// the file never is.
+func (b cargoBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply Cargo proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := cargoConfig(prev, settings)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying Cargo proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// cargoConfig returns content with the proxy key of the [http] table replaced
+// by the given settings. Cargo has a single proxy key for every request: it is
+// set to the HTTPS proxy if there is one, as registries are reached over HTTPS,
+// and to the HTTP proxy otherwise.
+func cargoConfig(content string, settings []setting) string {
+	var proxy string
+	for _, s := range settings {
+		if slices.Contains(unsupportedCargoProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported Cargo proxy setting %q", s.protocol)
+			continue
+		}
+		if s.protocol == protocolHTTPS || proxy == "" {
+			proxy = s.escapedURL
+		}
+	}
+	var key string
+	if proxy != "" {
+		key = fmt.Sprintf("proxy = \"%s\"\n", tomlEscaper.Replace(proxy))
+	}
+	// Unlike INI options, TOML keys have no continuation lines.
+	return replaceSectionOptions(content, "http", cargoProxyRegexp, key, false)
+}
@@ -0,0 +1,62 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestCargoConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost"}
+
+	tests := map[string]struct {
+		fixture  string
+		settings proxy.Settings
+	}{
+		"Create file":                                      {settings: set},
+		"HTTP proxy is used without HTTPS proxy":           {settings: proxy.Settings{HTTP: "http://example.com:8080"}},
+		"Add http table after the other ones":              {fixture: "no_http_table", settings: set},
+		"Add proxy key to the http table":                  {fixture: "http_with_keys", settings: set},
+		"Replace proxy key set by hand":                    {fixture: "hand_written_proxy", settings: set},
+		"Replace previously managed proxy key":             {fixture: "previously_managed", settings: set},
+		"Remove managed proxy key":                         {fixture: "previously_managed"},
+		"Remove proxy key set by hand, keep indented keys": {fixture: "hand_written_proxy"},
+		"File without proxy key is left untouched":         {fixture: "http_with_keys"},
+		"Missing file is not created on removal":           {},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+
+			// Only the Cargo backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("cargo")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultCargoConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultCargoConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
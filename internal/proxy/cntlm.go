@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// cntlmListen is the address of the local cntlm listener, through which
+	// the other backends reach the NTLM proxies.
+	cntlmListen = "127.0.0.1:3128"
+	// cntlmListenURL is the proxy URL of the local cntlm listener.
+	cntlmListenURL = "http://" + cntlmListen
+)
+
+// cntlmOptionRegexp matches the options of the cntlm configuration file set by
+// the backend, along with the password hashes which would take precedence over
+// the managed password.
+var cntlmOptionRegexp = regexp.MustCompile(`(?i)^\s*(Username|Domain|Password|PassLM|PassNT|PassNTLMv2|Proxy|NoProxy|Listen)(\s|$)`)
+
+// ntlmDomainRegexp matches the NetBIOS and DNS names of NTLM domains.
+var ntlmDomainRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// ntlmProxy is the account and the parent proxies cntlm authenticates to with
+// NTLM on behalf of the other backends.
+type ntlmProxy struct {
+	domain   string
+	username string
+	password string
+	// parents are the host:port of the proxies, in the order cntlm tries them.
+	parents []string
+	// noProxy are the wildcard patterns of the hosts cntlm reaches directly.
+	noProxy []string
+}
+
+// newNTLMProxy returns the NTLM proxy of the given domain made of the HTTP and
+// HTTPS proxies of settings, and the settings in which they are replaced by the
+// local cntlm listener. If domain is empty, settings are returned unchanged.
+func newNTLMProxy(domain string, settings []setting) (ntlm *ntlmProxy, local []setting, err error) {
+	if domain == "" {
+		return nil, settings, nil
+	}
+	defer decorate.OnError(&err, "couldn't set NTLM proxy")
+
+	if !ntlmDomainRegexp.MatchString(domain) {
+		return nil, nil, fmt.Errorf("invalid NTLM domain %q", domain)
+	}
+
+	ntlm = &ntlmProxy{domain: domain}
+	for _, s := range settings {
+		switch s.protocol {
+		case protocolHTTP, protocolHTTPS:
+			if s.url.User == nil {
+				return nil, nil, fmt.Errorf("the %s proxy has no credentials to authenticate with", s.protocol)
+			}
+			if ntlm.username != "" && s.url.User.Username() != ntlm.username {
+				return nil, nil, errors.New("the HTTP and HTTPS proxies must use the same NTLM account")
+			}
+			ntlm.username = s.url.User.Username()
+			ntlm.password, _ = s.url.User.Password()
+			if !slices.Contains(ntlm.parents, s.url.Host) {
+				ntlm.parents = append(ntlm.parents, s.url.Host)
+			}
+
+			s, err = newSetting(s.protocol, cntlmListenURL)
+			if err != nil {
+				return nil, nil, err
+			}
+		case protocolAll:
+			// The HTTP and HTTPS proxies now differ from the others.
+			continue
+		case protocolNo:
+			ntlm.noProxy = wildcardNonProxyHosts(s.escapedURL)
+		}
+		local = append(local, s)
+	}
+	if len(ntlm.parents) == 0 {
+		return nil, nil, errors.New("NTLM authentication requires an HTTP or HTTPS proxy")
+	}
+
+	return ntlm, local, nil
+}
+
+// cntlmBackend applies the NTLM proxy to the options of /etc/cntlm.conf, the
+// configuration of the cntlm authenticating proxy, which the other backends
+// are pointed at instead. The file is shared: only the account, parent proxy,
+// no proxy and listener options are managed, and the rest of the file is left
+// untouched. The backend is disabled unless its mode is set.
+type cntlmBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("cntlm", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return cntlmBackend{path: filepath.Join(opts.root, defaultCntlmConfigPath), fs: r}
+	})
+}
+
+func (b cntlmBackend) name() string    { return "cntlm" }
+func (b cntlmBackend) paths() []string { return []string{b.path} }
+func (b cntlmBackend) sharesFiles()    {}
+func (b cntlmBackend) optIn()          {}
+
+// skipReason always returns an empty string, as the backend only applies the
+// NTLM proxy, whatever the other settings.
+func (b cntlmBackend) skipReason(protocol) string { return "" }
+
+// apply removes the managed options, as the configuration of the backend only
+// comes from the NTLM proxy applied with applyNTLM.
+func (b cntlmBackend) apply(ctx context.Context, _ []setting) error {
+	return b.applyNTLM(ctx, nil)
+}
+
+// applyNTLM replaces the managed options of the cntlm configuration file with
+// the given NTLM proxy. If ntlm is nil, the options are removed, but the file
+// never is. The file keeps its mode, and is only readable by root if it is
+// created. cntlm must be restarted for the configuration to take effect.
+func (b cntlmBackend) applyNTLM(ctx context.Context, ntlm *ntlmProxy) (err error) {
+	defer decorate.OnError(&err, "couldn't apply cntlm proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := cntlmConfig(prev, ntlm)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	// The file holds the password of the NTLM account.
+	log.Debugf("Applying cntlm proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0600)
+}
+
+// cntlmConfig returns content with the managed options removed, wherever they
+// are, as cntlm uses every Proxy option and the last of the others, and, if
+// ntlm isn't nil, added back at the end of the file. Values are written
+// verbatim, as cntlm doesn't unquote them. The other lines are kept verbatim.
+func cntlmConfig(content string, ntlm *ntlmProxy) string {
+	lines := strings.SplitAfter(content, "\n")
+	var out strings.Builder
+	for _, line := range lines {
+		if strings.TrimRight(line, "\r\n") == managedEntriesHeader || cntlmOptionRegexp.MatchString(line) {
+			continue
+		}
+		out.WriteString(line)
+	}
+	result := out.String()
+
+	if ntlm == nil {
+		return result
+	}
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	result += managedEntriesHeader + "\n"
+	result += fmt.Sprintf("Username\t%s\n", ntlm.username)
+	result += fmt.Sprintf("Domain\t\t%s\n", ntlm.domain)
+	if ntlm.password != "" {
+		result += fmt.Sprintf("Password\t%s\n", ntlm.password)
+	}
+	for _, parent := range ntlm.parents {
+		result += fmt.Sprintf("Proxy\t\t%s\n", parent)
+	}
+	if len(ntlm.noProxy) > 0 {
+		result += fmt.Sprintf("NoProxy\t\t%s\n", strings.Join(ntlm.noProxy, ", "))
+	}
+	return result + fmt.Sprintf("Listen\t\t%s\n", cntlmListen)
+}
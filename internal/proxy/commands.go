@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// maxCommandOutput is the maximum size of the output recorded for each command.
+const maxCommandOutput = 4096
+
+// secretArgRegexp matches the command arguments which look like they contain
+// credentials: URLs with user information, or credential assignments.
+var secretArgRegexp = regexp.MustCompile(`(?i)://[^/\s]*@|(passw(or)?d|secret|token)\w*=`)
+
+// CommandRecord describes an external command run by a backend.
+type CommandRecord struct {
+	// Args are the command and its arguments. The ones looking like they
+	// contain credentials are masked.
+	Args []string `json:"args"`
+	// Duration is the time the command took to complete.
+	Duration time.Duration `json:"duration"`
+	// ExitStatus is the exit status of the command, or -1 if it didn't exit
+	// normally.
+	ExitStatus int `json:"exit_status"`
+	// Error is set if the command couldn't be started.
+	Error string `json:"error,omitempty"`
+	// Output is the combined output of the command, with credentials masked.
+	Output string `json:"output,omitempty"`
+	// Truncated is true if the output was longer than recorded.
+	Truncated bool `json:"truncated,omitempty"`
+	// SecretInArgs is true if any argument looked like it contained
+	// credentials, which must never be passed to commands.
+	SecretInArgs bool `json:"secret_in_args,omitempty"`
+}
+
+// commandRunner runs the external commands of the backends, recording each
+// invocation until the next reset.
+type commandRunner struct {
+	mu      sync.Mutex
+	records []CommandRecord
+	// hooks are the post-apply hooks requested since the last reset, indexed
+	// by name.
+	hooks map[string]func(context.Context) error
+
+	// dryRun is set while previewing an Apply call: the commands are then
+	// never run, and have no output.
+	dryRun bool
+}
+
+// newCommandRunner returns a runner which hasn't recorded any command yet.
+func newCommandRunner() *commandRunner {
+	return &commandRunner{}
+}
+
+// reset forgets about the commands recorded and the hooks requested so far.
+func (r *commandRunner) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = nil
+	r.hooks = nil
+}
+
+// requestHook requests hook to run once every backend is applied. Several
+// backends may request the hook of the same name, which only runs once.
+func (r *commandRunner) requestHook(name string, hook func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hooks == nil {
+		r.hooks = make(map[string]func(context.Context) error)
+	}
+	if _, found := r.hooks[name]; !found {
+		r.hooks[name] = hook
+	}
+}
+
+// runHooks runs the hooks requested since the last reset, once each and in the
+// order of their names, and forgets about them. The hooks aren't run while
+// previewing.
+func (r *commandRunner) runHooks(ctx context.Context) (err error) {
+	r.mu.Lock()
+	hooks := r.hooks
+	r.hooks = nil
+	r.mu.Unlock()
+
+	if r.dryRun {
+		return nil
+	}
+
+	names := maps.Keys(hooks)
+	slices.Sort(names)
+	for _, name := range names {
+		log.Debugf("Running post-apply hook %s", name)
+		err = errors.Join(err, hooks[name](ctx))
+	}
+	return err
+}
+
+// recorded returns the commands run since the last reset, in the order they
+// completed.
+func (r *commandRunner) recorded() []CommandRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CommandRecord(nil), r.records...)
+}
+
+// run runs cmd and returns its standard output, or its combined output if
+// combined is true, as exec.Cmd.Output and exec.Cmd.CombinedOutput do.
+func (r *commandRunner) run(cmd *exec.Cmd, combined bool) ([]byte, error) {
+	if r.dryRun {
+		log.Debugf("Not running %s while previewing", cmd.Args[0])
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	all := &lockedBuffer{}
+	cmd.Stdout = io.MultiWriter(&out, all)
+	cmd.Stderr = all
+	if combined {
+		cmd.Stderr = cmd.Stdout
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	rec := newCommandRecord(cmd.Args, time.Since(start), all.String(), err)
+
+	if rec.SecretInArgs {
+		log.Warningf("Command %s was passed arguments looking like credentials", rec.Args[0])
+	}
+	log.Debugf("Ran %s in %s, exit status %d: %s", strings.Join(rec.Args, " "), rec.Duration, rec.ExitStatus, rec.Output)
+
+	r.mu.Lock()
+	r.records = append(r.records, rec)
+	r.mu.Unlock()
+
+	return out.Bytes(), err
+}
+
+// newCommandRecord returns the record of the command run with the given
+// arguments, masking credentials and truncating its output.
+func newCommandRecord(args []string, duration time.Duration, output string, err error) CommandRecord {
+	rec := CommandRecord{Duration: duration}
+
+	for _, arg := range args {
+		if secretArgRegexp.MatchString(arg) {
+			rec.SecretInArgs = true
+			arg = redactedPassword
+		}
+		rec.Args = append(rec.Args, arg)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		rec.ExitStatus = exitErr.ExitCode()
+	default:
+		rec.ExitStatus = -1
+		rec.Error = redactPasswords(err.Error())
+	}
+
+	// Passwords are masked before truncating, as a password cut from the
+	// separators around it wouldn't be recognized anymore.
+	output = redactPasswords(output)
+	if len(output) > maxCommandOutput {
+		// Don't leave a partial UTF-8 sequence behind.
+		output = strings.ToValidUTF8(output[:maxCommandOutput], "")
+		rec.Truncated = true
+	}
+	rec.Output = output
+
+	return rec
+}
+
+// lockedBuffer is a buffer safe for concurrent writes, as the standard and
+// error outputs of a command are copied concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,6 @@
+//go:build !noapt
+
+package proxy_test
+
+// aptCompiledIn is true if the APT backend is compiled in.
+const aptCompiledIn = true
@@ -0,0 +1,6 @@
+//go:build nogsettings
+
+package proxy_test
+
+// gsettingsCompiledIn is true if the GSettings backend is compiled in.
+const gsettingsCompiledIn = false
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// unsupportedCondaProtocols lists the protocols that are not supported by conda.
+var unsupportedCondaProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolNo, protocolAuto}
+
+// condaProxyRegexp matches the proxy_servers key of a condarc file.
+var condaProxyRegexp = regexp.MustCompile(`^proxy_servers\s*:`)
+
+// condaBackend applies the proxy configuration to the proxy_servers key of
+// /etc/conda/.condarc, the system-wide configuration of conda and mamba. The
+// file is shared: only the proxy_servers key is managed, and the rest of the
+// file is left untouched. As conda may not be installed, the backend is
+// disabled unless its mode is set.
+type condaBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("conda", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return condaBackend{path: filepath.Join(opts.root, defaultCondaConfigPath), fs: r}
+	})
+}
+
+func (b condaBackend) name() string    { return "conda" }
+func (b condaBackend) paths() []string { return []string{b.path} }
+func (b condaBackend) sharesFiles()    {}
+func (b condaBackend) optIn()          {}
+
+func (b condaBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "conda only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "conda only supports SOCKS proxies with an optional dependency"
+	case protocolNo:
+		return "conda only reads the hosts bypassing the proxy from the environment"
+	case protocolAuto:
+		return "conda doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply replaces the proxy_servers key of the condarc file with the given proxy
+// settings. If there are no proxy settings to apply, the key is removed, but
+// the file never is.
+func (b condaBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply conda proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content, err := condaConfig(prev, settings)
+	if err != nil {
+		return err
+	}
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying conda proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// condaConfig returns content with the proxy_servers key replaced by the given
+// settings, indexed by the scheme of the requests they apply to. The content
+// is only edited line by line, to keep the comments of administrators, so it
+// is parsed before and after to make sure the result is a YAML mapping with
+// the expected proxy_servers.
+func condaConfig(content string, settings []setting) (string, error) {
+	proxies := make(map[string]string)
+	for _, s := range settings {
+		if slices.Contains(unsupportedCondaProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported conda proxy setting %q", s.protocol)
+			continue
+		}
+		proxies[strings.ToLower(s.protocol.String())] = s.escapedURL
+	}
+
+	if err := unmarshalCondaConfig(content, &map[string]any{}); err != nil {
+		return "", fmt.Errorf("existing configuration isn't a YAML mapping: %v", err)
+	}
+
+	var entry string
+	if len(proxies) > 0 {
+		entry = "proxy_servers:\n"
+		schemes := maps.Keys(proxies)
+		slices.Sort(schemes)
+		for _, scheme := range schemes {
+			entry += fmt.Sprintf("  %s: %s\n", scheme, yamlQuote(proxies[scheme]))
+		}
+	}
+	result := replaceYAMLKey(content, condaProxyRegexp, entry)
+
+	var got struct {
+		ProxyServers map[string]string `yaml:"proxy_servers"`
+	}
+	if err := unmarshalCondaConfig(result, &got); err != nil {
+		return "", fmt.Errorf("couldn't merge proxy_servers with the existing configuration: %v", err)
+	}
+	if !maps.Equal(got.ProxyServers, proxies) {
+		return "", errors.New("couldn't merge proxy_servers with the existing configuration: proxy_servers is also set in another form")
+	}
+	return result, nil
+}
+
+// unmarshalCondaConfig parses content as YAML into v. Invalid UTF-8 sequences,
+// which the parser refuses, are replaced first: they can only be in the values
+// the backend doesn't manage, which are written back verbatim.
+func unmarshalCondaConfig(content string, v any) error {
+	return yaml.Unmarshal([]byte(strings.ToValidUTF8(content, "\uFFFD")), v)
+}
@@ -0,0 +1,72 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestCondaConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "http://bob'smith:p@ss@example.com:8443", NoProxy: "localhost"}
+
+	tests := map[string]struct {
+		fixture  string
+		settings proxy.Settings
+
+		wantErr bool
+	}{
+		"Create file":                                  {settings: set},
+		"Only supported proxies are set":               {settings: proxy.Settings{HTTP: "http://example.com:8080", FTP: "ftp://example.com:2121", SOCKS: "socks://example.com:1080"}},
+		"Add proxy servers after the other keys":       {fixture: "with_channels", settings: set},
+		"Replace proxy servers set by hand":            {fixture: "hand_written_proxy", settings: set},
+		"Replace previously managed proxy servers":     {fixture: "previously_managed", settings: set},
+		"Remove managed proxy servers":                 {fixture: "previously_managed"},
+		"Remove proxy servers set by hand":             {fixture: "hand_written_proxy"},
+		"File without proxy servers is left untouched": {fixture: "with_channels"},
+		"Missing file is not created on removal":       {},
+
+		"Error on configuration which is not a mapping": {fixture: "not_a_mapping", settings: set, wantErr: true},
+		"Error on proxy servers set in a flow mapping":  {fixture: "flow_mapping", settings: set, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+
+			// Only the conda backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("conda")))
+			err := p.Apply(tc.settings)
+			if tc.wantErr {
+				require.Error(t, err, "Apply should have failed but didn't")
+				// The configuration is left untouched.
+				testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+				return
+			}
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultCondaConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultCondaConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedContainerdProtocols lists the protocols that are not supported by containerd.
+var unsupportedContainerdProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// systemdEnvEscaper escapes a value to be quoted in an Environment= directive
+// of a systemd unit, where % starts a specifier.
+var systemdEnvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%")
+
+// containerdString formats a proxy setting to be set in the environment of the
+// containerd service.
+func (p setting) containerdString() string {
+	if slices.Contains(unsupportedContainerdProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported containerd proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	return fmt.Sprintf("Environment=\"%s_PROXY=%s\"\n", strings.ToUpper(p.protocol.String()), systemdEnvEscaper.Replace(value))
+}
+
+// containerdBackend applies the proxy configuration in the form of a systemd
+// drop-in setting the environment of the containerd service, used for image
+// pulls. It is only applied if the service is installed.
+type containerdBackend struct {
+	root string
+	path string
+
+	fs       *fsRunner
+	reloader daemonReloader
+}
+
+func init() {
+	registerBackend("containerd", func(opts options, r *fsRunner, c *commandRunner) backend {
+		return containerdBackend{
+			root:     opts.root,
+			path:     filepath.Join(opts.root, defaultContainerdConfigPath),
+			fs:       r,
+			reloader: newDaemonReloader(opts, c),
+		}
+	})
+}
+
+func (b containerdBackend) name() string    { return "containerd" }
+func (b containerdBackend) paths() []string { return []string{b.path} }
+
+func (b containerdBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "containerd only pulls images over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "containerd has no environment variable for SOCKS proxies"
+	case protocolAuto:
+		return "containerd doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the containerd configuration isn't applied:
+// the containerd service isn't installed.
+func (b containerdBackend) unavailableReason() string {
+	return missingUnitReason(b.root, "containerd.service")
+}
+
+// apply applies the proxy configuration to the containerd service drop-in.
+// If there are no proxy settings to apply, the drop-in is removed. If the
+// drop-in changed, the systemd manager is reloaded once every backend is
+// applied, but the service must be restarted for the configuration to take
+// effect. Nothing is done if the service isn't installed.
+func (b containerdBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply containerd proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping containerd proxy configuration", reason)
+		return nil
+	}
+
+	content := containerdConfig(settings)
+	remove := noSupportedProtocols(settings, unsupportedContainerdProtocols)
+	changed, err := configFileChanged(b.path, content, remove)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Applying containerd proxy configuration to %q", b.path)
+	if err := applyConfigFile(ctx, b.fs, b.path, content, remove); err != nil {
+		return err
+	}
+
+	if changed {
+		b.reloader.request()
+	}
+	return nil
+}
+
+// containerdConfig returns the formatted containerd service drop-in to be written.
+func containerdConfig(settings []setting) string {
+	content := fmt.Sprintln(confHeader)
+	content += "[Service]\n"
+	for _, p := range sortedSettings(settings) {
+		content += p.containerdString()
+	}
+
+	return content
+}
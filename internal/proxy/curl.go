@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedCurlProtocols lists the protocols that are not supported by the curl backend.
+var unsupportedCurlProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// curlManagedOptionRegexp matches the options of the managed curl stanza.
+var curlManagedOptionRegexp = regexp.MustCompile(`^(proxy|noproxy)\s*=`)
+
+// curlValueEscaper escapes a value to be quoted in a curl configuration file.
+var curlValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// curlBackend applies the proxy configuration to a stanza of the system curl
+// configuration file, /etc/curlrc. The file is shared: only the stanza is
+// managed, and the rest of the file is left untouched. As curl doesn't read
+// it unless built or told to, the backend is disabled unless its mode is set.
+type curlBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("curl", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return curlBackend{path: filepath.Join(opts.root, defaultCurlConfigPath), fs: r}
+	})
+}
+
+func (b curlBackend) name() string    { return "curl" }
+func (b curlBackend) paths() []string { return []string{b.path} }
+func (b curlBackend) sharesFiles()    {}
+func (b curlBackend) optIn()          {}
+
+func (b curlBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP, protocolSOCKS:
+		return "curl has a single proxy setting, used for HTTP and HTTPS"
+	case protocolAuto:
+		return "curl doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply replaces the managed stanza of the curl configuration with the given
+// proxy settings. If there are no proxy settings to apply, the stanza is
+// removed, but the file never is.
+func (b curlBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply curl proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := curlConfig(prev, settings)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying curl proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// curlConfig returns content with the managed stanza removed and, if there are
+// settings to apply, added back at the end of the file, so that it overrides
+// the proxy options set earlier. curl has a single proxy option: it is set to
+// the HTTPS proxy if there is one, and to the HTTP proxy otherwise. The other
+// lines are kept verbatim.
+func curlConfig(content string, settings []setting) string {
+	var proxy, noProxy string
+	for _, s := range settings {
+		if slices.Contains(unsupportedCurlProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported curl proxy setting %q", s.protocol)
+			continue
+		}
+		switch s.protocol {
+		case protocolHTTP:
+			if proxy == "" {
+				proxy = s.escapedURL
+			}
+		case protocolHTTPS:
+			proxy = s.escapedURL
+		case protocolNo:
+			noProxy = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(s.escapedURL)
+		}
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	var out strings.Builder
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimRight(lines[i], "\r\n") != managedEntriesHeader {
+			out.WriteString(lines[i])
+			continue
+		}
+		for i+1 < len(lines) && curlManagedOptionRegexp.MatchString(lines[i+1]) {
+			i++
+		}
+	}
+	result := out.String()
+
+	if proxy == "" && noProxy == "" {
+		return result
+	}
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	result += managedEntriesHeader + "\n"
+	if proxy != "" {
+		result += fmt.Sprintf("proxy = \"%s\"\n", curlValueEscaper.Replace(proxy))
+	}
+	if noProxy != "" {
+		result += fmt.Sprintf("noproxy = \"%s\"\n", curlValueEscaper.Replace(noProxy))
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestCurlConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost, .example.com, 10.0.0.0/8"}
+
+	tests := map[string]struct {
+		fixture  string
+		settings proxy.Settings
+	}{
+		"Create file":                                {settings: set},
+		"HTTP proxy is used without HTTPS proxy":     {settings: proxy.Settings{HTTP: "http://example.com:8080"}},
+		"Only no proxy hosts":                        {settings: proxy.Settings{NoProxy: "localhost"}},
+		"Stanza is added at the end of the file":     {fixture: "existing_options", settings: set},
+		"Stanza is replaced at the end of the file":  {fixture: "previously_managed", settings: set},
+		"Remove stanza, keeping the other options":   {fixture: "previously_managed"},
+		"File without stanza is left untouched":      {fixture: "existing_options"},
+		"Unsupported settings don't create the file": {settings: proxy.Settings{FTP: "ftp://example.com:2121", Auto: "http://example.com/proxy.pac"}},
+		"Missing file is not created on removal":     {},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+
+			// Only the curl backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("curl")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultCurlConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultCurlConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
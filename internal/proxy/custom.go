@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// customFileExt is the extension of the declarations of custom files.
+const customFileExt = ".yaml"
+
+// customFile is a file declared by the administrator, rendered from a Go
+// template receiving the proxy settings.
+type customFile struct {
+	// name is the basename of the declaration, without extension.
+	name string
+	// path is the path of the rendered file, under the root.
+	path string
+	tmpl *template.Template
+}
+
+// customFileData are the proxy settings passed to the templates of the custom
+// files. Empty fields are not set.
+type customFileData struct {
+	HTTP    string
+	HTTPS   string
+	FTP     string
+	SOCKS   string
+	NoProxy string
+	Auto    string
+}
+
+// newCustomFileData returns the template data of the given settings.
+func newCustomFileData(settings []setting) (data customFileData) {
+	for _, s := range settings {
+		switch s.protocol {
+		case protocolHTTP:
+			data.HTTP = s.escapedURL
+		case protocolHTTPS:
+			data.HTTPS = s.escapedURL
+		case protocolFTP:
+			data.FTP = s.escapedURL
+		case protocolSOCKS:
+			data.SOCKS = s.escapedURL
+		case protocolNo:
+			data.NoProxy = s.escapedURL
+		case protocolAuto:
+			data.Auto = s.escapedURL
+		}
+	}
+	return data
+}
+
+// loadCustomFiles returns the custom files declared in dir, in the order of
+// their declarations, with their paths under root. Each declaration is a YAML
+// file with the absolute path of the file to render and its template. No error
+// is returned if dir doesn't exist.
+func loadCustomFiles(root, dir string) (files []customFile, err error) {
+	defer decorate.OnError(&err, "couldn't load custom files declared in %q", dir)
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != customFileExt {
+			continue
+		}
+		f, err := loadCustomFile(root, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range files {
+			if other.path == f.path {
+				return nil, fmt.Errorf("%q and %q both declare %q", other.name, f.name, f.path)
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// loadCustomFile parses the custom file declared at path.
+func loadCustomFile(root, path string) (f customFile, err error) {
+	name := strings.TrimSuffix(filepath.Base(path), customFileExt)
+	defer decorate.OnError(&err, "invalid custom file %q", name)
+
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return customFile{}, err
+	}
+	var decl struct {
+		Path     string `yaml:"path"`
+		Template string `yaml:"template"`
+	}
+	if err := yaml.Unmarshal(data, &decl); err != nil {
+		return customFile{}, err
+	}
+
+	if !filepath.IsAbs(decl.Path) || filepath.Clean(decl.Path) != decl.Path || decl.Path == "/" {
+		return customFile{}, fmt.Errorf("path %q must be an absolute and clean file path", decl.Path)
+	}
+	if decl.Template == "" {
+		return customFile{}, errors.New("template must be set")
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(decl.Template)
+	if err != nil {
+		return customFile{}, err
+	}
+
+	return customFile{name: name, path: filepath.Join(root, decl.Path), tmpl: tmpl}, nil
+}
+
+// customBackend renders the custom files declared by the administrator in
+// /etc/ubuntu-proxy-manager/custom.d, so that sites can configure the tools the
+// other backends don't cover. The declarations are read once, when the proxy
+// manager is created.
+type customBackend struct {
+	files []customFile
+	// loadErr is the error loading the declarations, returned on every apply.
+	loadErr error
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("custom", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		files, err := loadCustomFiles(opts.root, filepath.Join(opts.root, defaultCustomFilesDir))
+		if err != nil {
+			log.Warningf("Custom files won't be rendered: %v", err)
+		}
+		return customBackend{files: files, loadErr: err, fs: r}
+	})
+}
+
+// rejectManagedPaths returns the backend without its custom files if one of
+// them is declared at a path managed by another of the given backends, so that
+// they don't overwrite each other on every apply.
+func (b customBackend) rejectManagedPaths(backends []backend) customBackend {
+	if b.loadErr != nil {
+		return b
+	}
+
+	for _, f := range b.files {
+		for _, other := range backends {
+			if other.name() == b.name() || !slices.Contains(other.paths(), f.path) {
+				continue
+			}
+			err := fmt.Errorf("couldn't load custom files: invalid custom file %q: %q is managed by the %s backend", f.name, f.path, other.name())
+			log.Warningf("Custom files won't be rendered: %v", err)
+			return customBackend{loadErr: err, fs: b.fs}
+		}
+	}
+	return b
+}
+
+func (b customBackend) name() string { return "custom" }
+
+func (b customBackend) paths() (paths []string) {
+	for _, f := range b.files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+// skipReason always returns an empty string, as the templates decide which
+// settings they render.
+func (b customBackend) skipReason(protocol) string { return "" }
+
+// apply renders the custom files with the given proxy settings. If there are no
+// proxy settings to apply, or if a template renders nothing but whitespace, its
+// file is removed. The other files are applied even if one of them fails.
+func (b customBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply custom proxy configuration")
+
+	if b.loadErr != nil {
+		return b.loadErr
+	}
+
+	data := newCustomFileData(settings)
+	for _, f := range b.files {
+		if fileErr := f.apply(ctx, b.fs, data, len(settings) == 0); fileErr != nil {
+			err = errors.Join(err, fileErr)
+		}
+	}
+	return err
+}
+
+// apply renders the custom file with the given data, or removes it if remove
+// is true.
+func (f customFile) apply(ctx context.Context, r *fsRunner, data customFileData, remove bool) (err error) {
+	defer decorate.OnError(&err, "couldn't apply custom file %q", f.name)
+
+	var content strings.Builder
+	if !remove {
+		if err := f.tmpl.Execute(&content, data); err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Applying custom proxy configuration to %q", f.path)
+	return applyConfigFile(ctx, r, f.path, content.String(), strings.TrimSpace(content.String()) == "")
+}
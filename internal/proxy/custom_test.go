@@ -0,0 +1,84 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestCustomFiles(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "http://user:p@ss@example.com:8443", FTP: "ftp://example.com:2121", NoProxy: "localhost,.example.net"}
+
+	tests := map[string]struct {
+		fixture    string
+		settings   proxy.Settings
+		removeOnly bool
+
+		wantErr bool
+	}{
+		"Render declared files":                      {fixture: "declarations", settings: set},
+		"Replace previously rendered files":          {fixture: "previously_rendered", settings: set},
+		"Remove file whose template renders nothing": {fixture: "previously_rendered", settings: proxy.Settings{HTTP: "http://example.com:8080"}},
+		"Remove files without settings":              {fixture: "previously_rendered"},
+		"Remove files in remove-only mode":           {fixture: "previously_rendered", settings: set, removeOnly: true},
+		"Missing files are not created on removal":   {fixture: "declarations"},
+		"Nothing is done without declarations":       {settings: set},
+
+		"Error on relative path":                            {fixture: "relative_path", settings: set, wantErr: true},
+		"Error on invalid template":                         {fixture: "invalid_template", settings: set, wantErr: true},
+		"Error on files declared twice":                     {fixture: "duplicate_paths", settings: set, wantErr: true},
+		"Error on files managed by another backend":         {fixture: "backend_path", settings: set, wantErr: true},
+		"Error on unknown field, rendering the other files": {fixture: "unknown_field", settings: set, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+
+			// Only the custom backend is managed.
+			modes := proxy.OnlyBackend("custom")
+			if tc.removeOnly {
+				modes["custom"] = proxy.BackendModeRemoveOnly
+			}
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(modes))
+			err := p.Apply(tc.settings)
+			if tc.wantErr {
+				require.Error(t, err, "Apply should have failed but didn't")
+				testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+				return
+			}
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first := make(map[string]string)
+			for _, path := range p.ManagedPaths() {
+				// #nosec G304 - test path
+				if content, err := os.ReadFile(path); err == nil {
+					first[path] = string(content)
+				}
+			}
+			require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+			for path, content := range first {
+				// #nosec G304 - test path
+				second, err := os.ReadFile(path)
+				require.NoError(t, err, "Custom file %q should still exist after the second Apply", path)
+				require.Equal(t, content, string(second), "Second Apply should not change custom file %q", path)
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// systemdBootedPath is the relative path of the directory which only exists
+// if the system was booted with systemd, as checked by sd_booted(3).
+const systemdBootedPath = "run/systemd/system"
+
+// daemonReloaderHook is the name of the post-apply hook reloading the systemd
+// manager, shared by every backend writing systemd drop-ins.
+const daemonReloaderHook = "daemon-reload"
+
+// daemonReloader reloads the configuration of the systemd manager once the
+// drop-ins of the backends changed, so that they are used by the services
+// started or restarted from then on.
+type daemonReloader struct {
+	root     string
+	cmd      []string
+	commands *commandRunner
+}
+
+// newDaemonReloader returns a reloader of the systemd manager running under
+// the root of opts.
+func newDaemonReloader(opts options, c *commandRunner) daemonReloader {
+	return daemonReloader{root: opts.root, cmd: opts.systemctlCmd, commands: c}
+}
+
+// request requests the systemd manager to be reloaded once every backend is
+// applied, so that it is only reloaded once when several drop-ins changed.
+func (r daemonReloader) request() {
+	r.commands.requestHook(daemonReloaderHook, r.reload)
+}
+
+// reload runs systemctl daemon-reload. Nothing is done if the system wasn't
+// booted with systemd, as while building an image, since the drop-ins are then
+// read on the next boot.
+func (r daemonReloader) reload(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(r.root, systemdBootedPath)); err != nil {
+		log.Debug("The system wasn't booted with systemd, not reloading its configuration")
+		return nil
+	}
+
+	args := append(slices.Clone(r.cmd[1:]), "daemon-reload")
+	log.Debug("Reloading the systemd manager configuration")
+
+	// #nosec G204 - path not controllable by user
+	out, err := r.commands.run(exec.CommandContext(ctx, r.cmd[0], args...), true)
+	if err != nil {
+		return fmt.Errorf("couldn't run systemctl daemon-reload: %w: %s", err, out)
+	}
+	return nil
+}
+
+// configFileChanged returns true if applyConfigFile would change the file at
+// path when called with the same content and remove arguments.
+func configFileChanged(path, content string, remove bool) (bool, error) {
+	prev, err := previousConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return !remove, nil
+	} else if err != nil {
+		return false, err
+	}
+	return remove || prev != normalizeRendered(content), nil
+}
@@ -0,0 +1,219 @@
+//go:build !nogsettings
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// dconfLockedKeys lists the keys of the proxy schema locked in the dconf
+// system database, so that users can't override any of them, set or not.
+var dconfLockedKeys = []string{
+	"/system/proxy/mode",
+	"/system/proxy/autoconfig-url",
+	"/system/proxy/ignore-hosts",
+	"/system/proxy/use-same-proxy",
+	"/system/proxy/http/enabled",
+	"/system/proxy/http/host",
+	"/system/proxy/http/port",
+	"/system/proxy/http/use-authentication",
+	"/system/proxy/http/authentication-user",
+	"/system/proxy/http/authentication-password",
+	"/system/proxy/https/host",
+	"/system/proxy/https/port",
+	"/system/proxy/ftp/host",
+	"/system/proxy/ftp/port",
+	"/system/proxy/socks/host",
+	"/system/proxy/socks/port",
+}
+
+// dconfSystemDB is the name of the dconf system database the keys are written
+// to for the users.
+const dconfSystemDB = "local"
+
+// dconfGDMSystemDB is the name of the dconf system database the keys are
+// written to for the GDM greeter.
+const dconfGDMSystemDB = "gdm"
+
+// dconfSection returns the section of a dconf key file setting the keys of the
+// given child of the proxy schema, or of the schema itself if child is empty.
+func dconfSection(child string) string {
+	if child == "" {
+		return "[system/proxy]"
+	}
+	return fmt.Sprintf("[system/proxy/%s]", child)
+}
+
+// dconfBackend applies the proxy configuration to the local dconf system
+// database, with every proxy key locked, then runs dconf update to compile it.
+// Unlike the GSchema override of the GSettings backend, which only changes the
+// defaults, users can't override the locked keys. The backend is disabled
+// unless its mode is set.
+type dconfBackend struct {
+	// db is the name of the system database.
+	db        string
+	path      string
+	locksPath string
+	// profilePath is the dconf profile of the users, which must read the
+	// system database.
+	profilePath string
+	dbPath      string
+
+	dconfCmd []string
+
+	// useSameProxy renders a single HTTP section with use-same-proxy enabled
+	// when all protocols use the same proxy.
+	useSameProxy bool
+
+	fs       *fsRunner
+	commands *commandRunner
+}
+
+func init() {
+	registerBackend("dconf", func(opts options, r *fsRunner, c *commandRunner) backend {
+		return dconfBackend{
+			db:           dconfSystemDB,
+			path:         filepath.Join(opts.root, defaultDconfConfigPath),
+			locksPath:    filepath.Join(opts.root, defaultDconfLocksPath),
+			profilePath:  filepath.Join(opts.root, defaultDconfProfilePath),
+			dbPath:       filepath.Join(opts.root, defaultDconfDBPath),
+			dconfCmd:     opts.dconfCmd,
+			useSameProxy: opts.gsettingsUseSameProxy,
+			fs:           r,
+			commands:     c,
+		}
+	})
+}
+
+func (b dconfBackend) name() string    { return "dconf" }
+func (b dconfBackend) paths() []string { return []string{b.path, b.locksPath} }
+func (b dconfBackend) optIn()          {}
+
+// gdmBackend applies the proxy configuration to the gdm dconf system database,
+// read by the GDM greeter, as the dconf backend does for the users, so that the
+// login screen can reach the network behind the proxy. The backend is disabled
+// unless its mode is set.
+type gdmBackend struct {
+	dconfBackend
+}
+
+func init() {
+	registerBackend("gdm", func(opts options, r *fsRunner, c *commandRunner) backend {
+		return gdmBackend{dconfBackend{
+			db:           dconfGDMSystemDB,
+			path:         filepath.Join(opts.root, defaultDconfGDMConfigPath),
+			locksPath:    filepath.Join(opts.root, defaultDconfGDMLocksPath),
+			profilePath:  filepath.Join(opts.root, defaultDconfGDMProfilePath),
+			dbPath:       filepath.Join(opts.root, defaultDconfDBPath),
+			dconfCmd:     opts.dconfCmd,
+			useSameProxy: opts.gsettingsUseSameProxy,
+			fs:           r,
+			commands:     c,
+		}}
+	})
+}
+
+func (b gdmBackend) name() string { return "gdm" }
+
+// skipReason always returns an empty string, as dconf can express every
+// setting, like GSettings.
+func (b dconfBackend) skipReason(protocol) string { return "" }
+
+// unavailableReason returns why the dconf database isn't applied: dconf isn't
+// installed.
+func (b dconfBackend) unavailableReason() string {
+	if _, err := exec.LookPath(b.dconfCmd[0]); err != nil {
+		return fmt.Sprintf("couldn't find an executable for %q", b.dconfCmd[0])
+	}
+	return ""
+}
+
+// apply applies the proxy configuration to the key file and the locks of the
+// dconf system database, then compiles it if any of them changed. If there are
+// no proxy settings to apply, both are removed. Nothing is done if dconf isn't
+// installed.
+func (b dconfBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply dconf proxy configuration")
+
+	if _, err := exec.LookPath(b.dconfCmd[0]); err != nil {
+		log.Warningf("Couldn't find an executable for %q, not applying dconf proxy configuration", b.dconfCmd[0])
+		return nil
+	}
+
+	remove := len(settings) == 0
+	if !remove {
+		b.checkProfile()
+	}
+
+	var changed bool
+	for _, f := range []struct{ path, content string }{
+		{b.path, gsettingsConfig(settings, b.useSameProxy, dconfSection)},
+		{b.locksPath, dconfLocks()},
+	} {
+		path, content := f.path, f.content
+		prev, err := previousConfig(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		exists := err == nil
+		if (remove && exists) || (!remove && (!exists || prev != normalizeRendered(content))) {
+			changed = true
+		}
+
+		log.Debugf("Applying dconf proxy configuration to %q", path)
+		if err := applyConfigFile(ctx, b.fs, path, content, remove); err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return b.runDconfUpdate(ctx)
+}
+
+// checkProfile warns if the dconf profile doesn't read the system database, as
+// the keys written to it wouldn't be used.
+func (b dconfBackend) checkProfile() {
+	content, err := previousConfig(b.profilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warningf("Couldn't check the dconf profile %q: %v", b.profilePath, err)
+		return
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "system-db:"+b.db {
+			return
+		}
+	}
+	log.Warningf("The dconf profile %q doesn't read the %s system database: add system-db:%s to it for the enforced proxy settings to be used", b.profilePath, b.db, b.db)
+}
+
+// dconfLocks returns the formatted locks of the dconf system database to be
+// written.
+func dconfLocks() string {
+	return fmt.Sprintln(confHeader) + strings.Join(dconfLockedKeys, "\n") + "\n"
+}
+
+// runDconfUpdate compiles the dconf system databases.
+func (b dconfBackend) runDconfUpdate(ctx context.Context) error {
+	args := append(slices.Clone(b.dconfCmd[1:]), "update", b.dbPath)
+	log.Debugf("Running dconf update on %q", b.dbPath)
+
+	// #nosec G204 - path not controllable by user
+	out, err := b.commands.run(exec.CommandContext(ctx, b.dconfCmd[0], args...), true)
+	if err != nil {
+		return fmt.Errorf("couldn't run dconf update: %w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//go:build !nogsettings
+
+package proxy_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+// dconfUpdateRunFile is written by the dconf mock with the database directory it updated.
+const dconfUpdateRunFile = ".ran-dconf-update"
+
+func TestDconfConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://user:p@ss@example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost,example.net"}
+
+	tests := map[string]struct {
+		previous *proxy.Settings
+		settings proxy.Settings
+		mockMode string
+		disabled bool
+		gdm      bool
+
+		wantUpdate bool
+		wantErr    bool
+	}{
+		"Enforce manual proxies":                             {settings: set, wantUpdate: true},
+		"Enforce autoconfiguration URL":                      {settings: proxy.Settings{Auto: "http://example.com/proxy.pac"}, wantUpdate: true},
+		"Update changed configuration":                       {previous: &proxy.Settings{HTTP: "http://old.example.com:8080"}, settings: set, wantUpdate: true},
+		"Up to date configuration isn't updated":             {previous: &set, settings: set},
+		"Remove configuration":                               {previous: &set, wantUpdate: true},
+		"Nothing to remove isn't updated":                    {},
+		"Configuration is left untouched without dconf":      {previous: &set, mockMode: "-Missing-"},
+		"Configuration is left untouched by default":         {previous: &set, settings: proxy.Settings{HTTP: "http://other.example.com:8080"}, disabled: true},
+		"Enforce manual proxies on the greeter":              {settings: set, gdm: true, wantUpdate: true},
+		"Remove greeter configuration":                       {previous: &set, gdm: true, wantUpdate: true},
+		"Greeter configuration is left untouched by default": {previous: &set, settings: proxy.Settings{HTTP: "http://other.example.com:8080"}, gdm: true, disabled: true},
+
+		"Error when dconf update fails": {settings: set, mockMode: "-Exit1-", wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root, temp := t.TempDir(), t.TempDir()
+			profilePath, profile, backend := proxy.DefaultDconfProfilePath, "user-db:user\nsystem-db:local\n", "dconf"
+			if tc.gdm {
+				profilePath, profile, backend = proxy.DefaultDconfGDMProfilePath, "user-db:user\nsystem-db:gdm\nfile-db:/usr/share/gdm/greeter-dconf-defaults\n", "gdm"
+			}
+			err := os.MkdirAll(filepath.Join(root, filepath.Dir(profilePath)), 0700)
+			require.NoError(t, err, "Setup: couldn't create dconf profile directory")
+			err = os.WriteFile(filepath.Join(root, profilePath), []byte(profile), 0600)
+			require.NoError(t, err, "Setup: couldn't write dconf profile")
+
+			// Only the dconf or gdm backend is managed.
+			modes := proxy.OnlyBackend(backend)
+
+			if tc.previous != nil {
+				p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(modes), proxy.WithDconfCmd(mockDconfCmd(t, temp, "")))
+				err := p.Apply(*tc.previous)
+				require.NoError(t, err, "Setup: couldn't apply previous configuration")
+				err = os.Remove(filepath.Join(temp, dconfUpdateRunFile))
+				require.NoError(t, err, "Setup: dconf update should have run for the previous configuration")
+			}
+
+			if tc.disabled {
+				delete(modes, backend)
+			}
+			cmd := mockDconfCmd(t, temp, tc.mockMode)
+			if tc.mockMode == "-Missing-" {
+				cmd = []string{"does-not-exist"}
+			}
+			err = proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(modes), proxy.WithDconfCmd(cmd)).Apply(tc.settings)
+			if tc.wantErr {
+				require.Error(t, err, "Apply should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// #nosec G304 - test path
+			db, err := os.ReadFile(filepath.Join(temp, dconfUpdateRunFile))
+			if !tc.wantUpdate {
+				require.ErrorIs(t, err, os.ErrNotExist, "dconf update should not have run")
+			} else {
+				require.NoError(t, err, "dconf update should have run")
+				require.Equal(t, filepath.Join(root, "etc/dconf/db"), string(db), "dconf update should have compiled the system databases of the root")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
+
+func TestMockDconf(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	// -- runDir mode update dbPath
+	runDir, mode, dbPath := args[1], args[2], args[4]
+
+	if mode == "-Exit1-" {
+		fmt.Println("EXIT 1 requested in mock")
+		os.Exit(1)
+	}
+
+	err := os.WriteFile(filepath.Join(runDir, dconfUpdateRunFile), []byte(strings.TrimSpace(dbPath)), 0600)
+	require.NoError(t, err, "Setup: Couldn't write dconf update run file")
+}
+
+func mockDconfCmd(t *testing.T, runDir, mode string) []string {
+	t.Helper()
+
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockDconf", "--", runDir, mode}
+}
@@ -1,10 +1,9 @@
 package proxy
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"io/fs"
-	"os"
+	"path/filepath"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -35,44 +34,88 @@ func (p setting) envString() string {
 		strings.ToLower(fmt.Sprint(p.protocol)), value)
 }
 
-// applyToEnvironment applies the proxy configuration in the form of
-// environment variables set in /etc/environment.d.
-// If there are no proxy settings to apply, the environment file is removed.
-func (p Proxy) applyToEnvironment() (err error) {
-	defer decorate.OnError(&err, "couldn't apply environment proxy configuration")
+// envBackend applies the proxy configuration in the form of environment
+// variables set in /etc/environment.d.
+type envBackend struct {
+	path string
 
-	if p.noSupportedProtocols(unsupportedEnvProtocols) {
-		log.Debug("No proxy settings to apply, removing environment file if it exists")
-		if err := os.Remove(p.envConfigPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return err
-		}
-		return nil
-	}
+	// socksAllProxy sets all_proxy to the SOCKS proxy when it is the only one set.
+	socksAllProxy bool
 
-	log.Debugf("Applying environment proxy configuration to %q", p.envConfigPath)
+	// extraLines are appended to the generated configuration.
+	extraLines []string
 
-	content := p.envConfig()
-	if prev, err := previousConfig(p.envConfigPath); err == nil && prev == content {
-		log.Debugf("Environment proxy configuration at %q is already up to date", p.envConfigPath)
-		return nil
-	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
-	}
+	fs *fsRunner
+}
 
-	// Check if the parent directory exists - attempt to create the structure if not
-	if err := createParentDirectories(p.envConfigPath); err != nil {
-		return err
+func init() {
+	registerBackend("environment", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return envBackend{path: filepath.Join(opts.root, defaultEnvConfigPath), socksAllProxy: opts.envSOCKSAllProxy, extraLines: opts.extraLines.Environment, fs: r}
+	})
+}
+
+func (b envBackend) name() string    { return "environment" }
+func (b envBackend) paths() []string { return []string{b.path} }
+
+func (b envBackend) skipReason(proto protocol) string {
+	if proto == protocolAuto {
+		return "autoconfiguration URLs have no environment variable"
 	}
+	return ""
+}
+
+// apply applies the proxy configuration to the environment configuration file.
+// If there are no proxy settings to apply, the environment file is removed.
+func (b envBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply environment proxy configuration")
 
-	return safeWriteFile(p.envConfigPath, content)
+	log.Debugf("Applying environment proxy configuration to %q", b.path)
+	return applyConfigFile(ctx, b.fs, b.path, withExtraLines(envConfig(settings, b.socksAllProxy), b.extraLines), noSupportedProtocols(settings, unsupportedEnvProtocols))
 }
 
 // envConfig returns the formatted environment proxy configuration file to be written.
-func (p Proxy) envConfig() string {
-	content := fmt.Sprintln(confHeader)
-	for _, p := range p.settings {
+// If socksAllProxy is true and SOCKS is the only proxy set, all_proxy is also
+// set to the SOCKS proxy, as most tools don't read socks_proxy.
+func envConfig(settings []setting, socksAllProxy bool) string {
+	return fmt.Sprintln(confHeader) + envVariables(settings, socksAllProxy)
+}
+
+// envVariables returns the proxy environment variables, one per line.
+func envVariables(settings []setting, socksAllProxy bool) string {
+	var content string
+	for _, p := range envSettings(settings, socksAllProxy) {
 		content += p.envString()
 	}
 
 	return content
 }
+
+// envSettings returns the sorted settings set as environment variables. If
+// socksAllProxy is true and SOCKS is the only proxy set, an all_proxy setting
+// follows the SOCKS one.
+func envSettings(settings []setting, socksAllProxy bool) (vars []setting) {
+	loneSOCKS := socksAllProxy && onlySOCKSProxy(settings)
+
+	for _, p := range sortedSettings(settings) {
+		vars = append(vars, p)
+		if loneSOCKS && p.protocol == protocolSOCKS {
+			vars = append(vars, setting{protocol: protocolAll, escapedURL: p.escapedURL})
+		}
+	}
+	return vars
+}
+
+// onlySOCKSProxy returns true if the SOCKS proxy is set, and none of the HTTP,
+// HTTPS and FTP proxies are.
+func onlySOCKSProxy(settings []setting) bool {
+	var socks bool
+	for _, s := range settings {
+		switch s.protocol {
+		case protocolSOCKS:
+			socks = true
+		case protocolHTTP, protocolHTTPS, protocolFTP:
+			return false
+		}
+	}
+	return socks
+}
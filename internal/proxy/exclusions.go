@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// NoProxyProfileLoopback excludes the IPv4 and IPv6 loopback addresses from the proxy.
+	NoProxyProfileLoopback = "loopback"
+	// NoProxyProfileLinkLocal additionally excludes the link-local networks,
+	// where cloud and container metadata endpoints live.
+	NoProxyProfileLinkLocal = "loopback+linklocal"
+	// NoProxyProfileHostname additionally excludes the hostname of the machine.
+	NoProxyProfileHostname = "loopback+linklocal+hostname"
+)
+
+// NoProxyProfiles lists the supported no_proxy exclusion profiles.
+var NoProxyProfiles = []string{NoProxyProfileLoopback, NoProxyProfileLinkLocal, NoProxyProfileHostname}
+
+var (
+	loopbackExclusions  = []string{"localhost", "127.0.0.1", "::1"}
+	linkLocalExclusions = []string{"169.254.0.0/16", "fe80::/10"}
+)
+
+// noProxyExclusions returns the hosts to exclude from the proxy according to
+// the configured no_proxy profile.
+func (p Proxy) noProxyExclusions() []string {
+	var exclusions []string
+	switch p.noProxyProfile {
+	case "":
+		return nil
+	case NoProxyProfileLoopback:
+		exclusions = loopbackExclusions
+	case NoProxyProfileLinkLocal:
+		exclusions = append(slices.Clone(loopbackExclusions), linkLocalExclusions...)
+	case NoProxyProfileHostname:
+		exclusions = append(slices.Clone(loopbackExclusions), linkLocalExclusions...)
+		hostname, err := p.hostname()
+		if err != nil {
+			log.Warningf("Couldn't resolve hostname, not excluding it from the proxy: %v", err)
+			break
+		}
+		exclusions = append(exclusions, hostname)
+	default:
+		log.Warningf("Unknown no_proxy profile %q, not adding any exclusion", p.noProxyProfile)
+	}
+
+	return exclusions
+}
+
+// addExclusions appends the given exclusions to the no_proxy value, skipping
+// the ones which are already present.
+func addExclusions(noproxy string, exclusions []string) string {
+	var existing []string
+	for _, host := range strings.Split(noproxy, ",") {
+		if host = strings.Trim(host, ` '"`); host != "" {
+			existing = append(existing, host)
+		}
+	}
+
+	for _, host := range exclusions {
+		if slices.Contains(existing, host) {
+			continue
+		}
+		existing = append(existing, host)
+		if noproxy != "" {
+			noproxy += ","
+		}
+		noproxy += host
+	}
+
+	return noproxy
+}
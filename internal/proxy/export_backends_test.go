@@ -0,0 +1,31 @@
+//go:build !noapt && !nogsettings
+
+package proxy
+
+import (
+	"math/rand"
+)
+
+// GVariantStringList returns the GVariant text format of the given string array.
+var GVariantStringList = gvariantStringList
+
+// RenderedConfigs returns the configuration rendered by each backend for the
+// given proxy settings, indexed by backend name. If r is not nil, the settings
+// are shuffled before being rendered.
+func RenderedConfigs(r *rand.Rand, s Settings) (map[string]string, error) {
+	settings, err := newSettings(s)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		r.Shuffle(len(settings), func(i, j int) { settings[i], settings[j] = settings[j], settings[i] })
+	}
+
+	return map[string]string{
+		envBackend{}.name():        envConfig(settings, true),
+		aptBackend{}.name():        aptConfig(settings, nil),
+		gsettingsBackend{}.name():  gsettingsConfig(settings, false, gschemaSection),
+		containerdBackend{}.name(): containerdConfig(settings),
+		fwupdBackend{}.name():      fwupdConfig(settings),
+	}, nil
+}
@@ -1,6 +1,9 @@
 package proxy
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"time"
+)
 
 // WithRoot overrides the filesystem root for the proxy manager.
 func WithRoot(path string) func(o *options) {
@@ -9,6 +12,13 @@ func WithRoot(path string) func(o *options) {
 	}
 }
 
+// WithHostname overrides the function returning the hostname of the machine.
+func WithHostname(f func() (string, error)) func(o *options) {
+	return func(o *options) {
+		o.hostname = f
+	}
+}
+
 // WithGlibCompileSchemasCmd overrides the glib-compile-schemas command for the proxy manager.
 func WithGlibCompileSchemasCmd(cmd []string) func(o *options) {
 	return func(o *options) {
@@ -16,9 +26,146 @@ func WithGlibCompileSchemasCmd(cmd []string) func(o *options) {
 	}
 }
 
+// WithFilesystem overrides the filesystem performing the mutations of the backends.
+func WithFilesystem(fsys filesystem) func(o *options) {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// WithGSettingsCmd overrides the gsettings command used to verify the applied configuration.
+func WithGSettingsCmd(cmd []string) func(o *options) {
+	return func(o *options) {
+		o.gsettingsCmd = cmd
+	}
+}
+
+// WithDconfCmd overrides the dconf command compiling the system databases.
+func WithDconfCmd(cmd []string) func(o *options) {
+	return func(o *options) {
+		o.dconfCmd = cmd
+	}
+}
+
+// WithSystemctlCmd overrides the systemctl command reloading the systemd
+// manager.
+func WithSystemctlCmd(cmd []string) func(o *options) {
+	return func(o *options) {
+		o.systemctlCmd = cmd
+	}
+}
+
+// WithSnapdSocket overrides the socket of the snapd REST API.
+func WithSnapdSocket(path string) func(o *options) {
+	return func(o *options) {
+		o.snapdSocket = path
+	}
+}
+
+// WithSnapdChangeTimeout overrides the time after which waiting for a snapd
+// change is abandoned.
+func WithSnapdChangeTimeout(timeout time.Duration) func(o *options) {
+	return func(o *options) {
+		o.snapdChangeTimeout = timeout
+	}
+}
+
+// WithLXDSocket overrides the socket of the LXD REST API.
+func WithLXDSocket(path string) func(o *options) {
+	return func(o *options) {
+		o.lxdSocket = path
+	}
+}
+
+// WithIncusSocket overrides the socket of the REST API of Incus.
+func WithIncusSocket(path string) func(o *options) {
+	return func(o *options) {
+		o.incusSocket = path
+	}
+}
+
+// WithLivepatchCmd overrides the canonical-livepatch command.
+func WithLivepatchCmd(cmd []string) func(o *options) {
+	return func(o *options) {
+		o.livepatchCmd = cmd
+	}
+}
+
 const ConfHeader = confHeader
 const DefaultEnvConfigPath = defaultEnvConfigPath
+const DefaultLegacyEnvConfigPath = defaultLegacyEnvConfigPath
+const DefaultPamEnvConfigPath = defaultPamEnvConfigPath
+const DefaultSystemdConfigPath = defaultSystemdConfigPath
+const DefaultSystemdUserConfigPath = defaultSystemdUserConfigPath
+const DefaultProfileConfigPath = defaultProfileConfigPath
+const DefaultProfileCshConfigPath = defaultProfileCshConfigPath
+const DefaultProfileFishConfigPath = defaultProfileFishConfigPath
 const DefaultAPTConfigPath = defaultAPTConfigPath
 const DefaultGLibSchemaPath = defaultGLibSchemaPath
+const DefaultDconfConfigPath = defaultDconfConfigPath
+const DefaultDconfLocksPath = defaultDconfLocksPath
+const DefaultDconfProfilePath = defaultDconfProfilePath
+const DefaultDconfGDMConfigPath = defaultDconfGDMConfigPath
+const DefaultDconfGDMLocksPath = defaultDconfGDMLocksPath
+const DefaultDconfGDMProfilePath = defaultDconfGDMProfilePath
+const DefaultLibproxyConfigPath = defaultLibproxyConfigPath
+const DefaultContainerdConfigPath = defaultContainerdConfigPath
+const DefaultFwupdConfigPath = defaultFwupdConfigPath
+const DefaultFwupdRefreshConfigPath = defaultFwupdRefreshConfigPath
+const DefaultSnapdDropInPath = defaultSnapdDropInPath
+const DefaultPodmanConfigPath = defaultPodmanConfigPath
+const DefaultGitIncludePath = defaultGitIncludePath
+const DefaultGitConfigPath = defaultGitConfigPath
+const DefaultPipConfigPath = defaultPipConfigPath
+const DefaultGradleConfigPath = defaultGradleConfigPath
+const DefaultRConfigPath = defaultRConfigPath
+const DefaultRubyGemsConfigPath = defaultRubyGemsConfigPath
+const DefaultCargoConfigPath = defaultCargoConfigPath
+const DefaultSubversionConfigPath = defaultSubversionConfigPath
+const DefaultCondaConfigPath = defaultCondaConfigPath
+const DefaultMicroK8sConfigPath = defaultMicroK8sConfigPath
+const DefaultCurlConfigPath = defaultCurlConfigPath
+const DefaultCntlmConfigPath = defaultCntlmConfigPath
+const DefaultCustomFilesDir = defaultCustomFilesDir
+const DefaultKDEConfigPath = defaultKDEConfigPath
+const ManagedEntriesHeader = managedEntriesHeader
 
 var DefaultGSettingsConfigPath = filepath.Join(defaultGLibSchemaPath, gschemaOverrideFile)
+
+// ManagedPaths returns the files managed by all backends of the proxy manager.
+func (p Proxy) ManagedPaths() (paths []string) {
+	for _, b := range p.backends {
+		paths = append(paths, b.paths()...)
+	}
+	return paths
+}
+
+// BackendMode returns the mode of the backend with the given name.
+func (p Proxy) BackendMode(name string) string {
+	for _, b := range p.backends {
+		if b.name() == name {
+			return p.backendMode(b)
+		}
+	}
+	return ""
+}
+
+// OnlyBackend returns the backend modes managing the backend of the given name
+// only, every other backend compiled in being disabled.
+func OnlyBackend(name string) map[string]string {
+	modes := make(map[string]string)
+	for _, b := range CompiledBackends() {
+		modes[b] = BackendModeDisabled
+	}
+	modes[name] = BackendModeManaged
+	return modes
+}
+
+// HashSettings returns the hash of the given settings.
+func HashSettings(s Settings) (SettingsHash, error) {
+	settings, err := newSettings(s)
+	if err != nil {
+		return SettingsHash{}, err
+	}
+	return hashSettings(settings), nil
+}
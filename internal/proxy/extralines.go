@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// extraLinesHeader separates the extra lines from the generated configuration.
+const extraLinesHeader = "### Extra lines from the ubuntu-proxy-manager configuration"
+
+var (
+	// credentialsRegexp matches lines which look like they contain credentials.
+	credentialsRegexp = regexp.MustCompile(`(?i)://[^/\s]*@|passw(or)?d|secret|token`)
+
+	// managedEnvKeyRegexp matches the environment variables set by the environment backend.
+	managedEnvKeyRegexp = regexp.MustCompile(`(?i)^\s*(export\s+)?(http|https|ftp|socks|no|all)_proxy\s*=`)
+	// managedAPTKeyRegexp matches the APT proxy directives.
+	managedAPTKeyRegexp = regexp.MustCompile(`(?i)^\s*Acquire::[^:\s]+::Proxy\b`)
+	// managedGSettingsKeyRegexp matches the keys of the proxy schemas set by the GSettings backend.
+	managedGSettingsKeyRegexp = regexp.MustCompile(`^\s*(mode|autoconfig-url|ignore-hosts|use-same-proxy|host|port|use-authentication|authentication-user|authentication-password)\s*=`)
+
+	// managedKeyRegexps maps the backend names to the regexp matching their managed keys.
+	managedKeyRegexps = map[string]*regexp.Regexp{
+		"environment": managedEnvKeyRegexp,
+		"apt":         managedAPTKeyRegexp,
+		"gsettings":   managedGSettingsKeyRegexp,
+	}
+)
+
+// ExtraLines are raw lines appended verbatim to the file managed by each
+// backend, for the directives which are not modeled by the proxy manager.
+type ExtraLines struct {
+	Environment []string
+	APT         []string
+	GSettings   []string
+}
+
+// Check returns an error if any extra line spans several lines, looks like it
+// contains credentials or conflicts with a key managed by its backend.
+func (l ExtraLines) Check() (err error) {
+	for _, b := range []struct {
+		name  string
+		lines []string
+	}{
+		{"environment", l.Environment},
+		{"apt", l.APT},
+		{"gsettings", l.GSettings},
+	} {
+		for i, line := range b.lines {
+			if lineErr := CheckExtraLine(b.name, line); lineErr != nil {
+				err = errors.Join(err, fmt.Errorf("extra %s line %d %w", b.name, i+1, lineErr))
+			}
+		}
+	}
+
+	return err
+}
+
+// CheckExtraLine returns an error if the extra line for the given backend
+// spans several lines, looks like it contains credentials or conflicts with a
+// key managed by the backend.
+func CheckExtraLine(backend, line string) error {
+	managedKey, found := managedKeyRegexps[backend]
+	if !found {
+		return fmt.Errorf("is for unknown backend %q", backend)
+	}
+
+	// Lines are not included in the errors, as they could contain credentials
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("must be a single line")
+	} else if credentialsRegexp.MatchString(line) {
+		return errors.New("looks like it contains credentials")
+	} else if managedKey.MatchString(line) {
+		return errors.New("conflicts with a proxy setting managed by ubuntu-proxy-manager")
+	}
+	return nil
+}
+
+// withExtraLines appends the given extra lines to the configuration content,
+// below a separator comment.
+func withExtraLines(content string, lines []string) string {
+	if len(lines) == 0 {
+		return content
+	}
+
+	content += fmt.Sprintln(extraLinesHeader)
+	for _, line := range lines {
+		content += fmt.Sprintln(line)
+	}
+
+	return content
+}
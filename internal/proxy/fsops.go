@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// filesystem performs the filesystem mutations of the backends.
+type filesystem interface {
+	Remove(name string) error
+	MkdirAll(path string, perm fs.FileMode) error
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+}
+
+// osFilesystem is the filesystem of the system.
+type osFilesystem struct{}
+
+func (osFilesystem) Remove(name string) error                     { return os.Remove(name) }
+func (osFilesystem) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFilesystem) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+
+// WriteFile writes data to name, which ends up with perm as its mode even if it
+// already existed, whatever the umask.
+func (osFilesystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	// #nosec G304 - path is built from the root option
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// Restrict the mode before writing, so that data never is readable by
+	// more users than perm allows.
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TimeoutError is returned when a filesystem operation doesn't complete before
+// the deadline of the Apply call, or when a path is still used by such an
+// abandoned operation.
+type TimeoutError struct {
+	Op   string
+	Path string
+	// Pending is true if the operation was refused because an abandoned
+	// operation on the same path didn't complete yet.
+	Pending bool
+}
+
+func (e TimeoutError) Error() string {
+	if e.Pending {
+		return fmt.Sprintf("can't %s %q: a previous operation on this path didn't complete yet, the filesystem may be unresponsive", e.Op, e.Path)
+	}
+	return fmt.Sprintf("%s %q didn't complete in time, the filesystem may be unresponsive", e.Op, e.Path)
+}
+
+// DiskFullError is returned when a file can't be written because its filesystem
+// is full. The previous version of the file is left intact.
+type DiskFullError struct {
+	Path string
+	// Filesystem is the mount point of the filesystem containing Path.
+	Filesystem string
+}
+
+func (e DiskFullError) Error() string {
+	return fmt.Sprintf("can't write %q: no space left on the filesystem mounted on %q", e.Path, e.Filesystem)
+}
+
+// Unwrap returns syscall.ENOSPC, so that the error matches it.
+func (e DiskFullError) Unwrap() error {
+	return syscall.ENOSPC
+}
+
+// mountPoint returns the mount point of the filesystem containing path, which
+// is the topmost parent directory on the same device. It falls back to the
+// parent directory of path if it can't be determined.
+func mountPoint(path string) string {
+	dir := filepath.Dir(path)
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return dir
+	}
+
+	for dir != "/" {
+		parent := filepath.Dir(dir)
+		var parentSt syscall.Stat_t
+		if err := syscall.Stat(parent, &parentSt); err != nil || parentSt.Dev != st.Dev {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+// fsRunner runs filesystem mutations in the background, abandoning the ones
+// which don't complete before the deadline of the given context.
+//
+// An abandoned operation can't be interrupted and may complete later on. Until
+// it does, any new operation on the same paths is refused, so that it can't
+// overwrite the result of a subsequent Apply call.
+type fsRunner struct {
+	fs filesystem
+
+	mu sync.Mutex
+	// generation identifies each operation.
+	generation uint64
+	// pending maps the paths of abandoned operations to their generation.
+	pending map[string]uint64
+	// full is set once a write failed because the filesystem is full, until
+	// the next Apply call.
+	full *DiskFullError
+}
+
+// newFSRunner returns a runner for the mutations of the given filesystem.
+func newFSRunner(fsys filesystem) *fsRunner {
+	return &fsRunner{fs: fsys, pending: make(map[string]uint64)}
+}
+
+func (r *fsRunner) remove(ctx context.Context, path string) error {
+	return r.run(ctx, "remove", func() error { return r.fs.Remove(path) }, path)
+}
+
+func (r *fsRunner) mkdirAll(ctx context.Context, path string, perm fs.FileMode) error {
+	if err := r.diskFull(); err != nil {
+		return fmt.Errorf("skipped creating directory %q: %w", path, err)
+	}
+	return r.run(ctx, "create directory", func() error { return r.fs.MkdirAll(path, perm) }, path)
+}
+
+func (r *fsRunner) writeFile(ctx context.Context, path string, data []byte, perm fs.FileMode) error {
+	if err := r.diskFull(); err != nil {
+		return fmt.Errorf("skipped writing %q: %w", path, err)
+	}
+	return r.run(ctx, "write", func() error { return r.fs.WriteFile(path, data, perm) }, path)
+}
+
+func (r *fsRunner) rename(ctx context.Context, oldpath, newpath string) error {
+	return r.run(ctx, "rename", func() error { return r.fs.Rename(oldpath, newpath) }, oldpath, newpath)
+}
+
+// resetDiskFull forgets about a previously full filesystem, so that writes are
+// attempted again.
+func (r *fsRunner) resetDiskFull() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.full = nil
+}
+
+// setDiskFull records that the filesystem is full, so that the following
+// writes and directory creations are skipped as they would fail too. Renames
+// and removals still run, so that previous files can be restored.
+func (r *fsRunner) setDiskFull(err DiskFullError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full == nil {
+		r.full = &err
+	}
+}
+
+// diskFull returns the DiskFullError recorded since the last reset, if any.
+func (r *fsRunner) diskFull() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full == nil {
+		return nil
+	}
+	return *r.full
+}
+
+// run runs the operation f on the given paths, returning a TimeoutError if it
+// doesn't complete before ctx is done.
+func (r *fsRunner) run(ctx context.Context, op string, f func() error, paths ...string) error {
+	r.mu.Lock()
+	for _, path := range paths {
+		if _, found := r.pending[path]; found {
+			r.mu.Unlock()
+			return TimeoutError{Op: op, Path: path, Pending: true}
+		}
+	}
+	r.generation++
+	gen := r.generation
+	r.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, path := range paths {
+			if r.pending[path] == gen {
+				log.Warningf("Abandoned %s operation on %q completed", op, path)
+				delete(r.pending, path)
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The operation may have completed in the meantime.
+	select {
+	case err := <-done:
+		return err
+	default:
+	}
+	for _, path := range paths {
+		r.pending[path] = gen
+	}
+	log.Warningf("Abandoning %s operation on %q: %v", op, paths[0], ctx.Err())
+	return TimeoutError{Op: op, Path: paths[0]}
+}
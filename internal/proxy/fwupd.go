@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedFwupdProtocols lists the protocols that are not supported by fwupd.
+var unsupportedFwupdProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// fwupdString formats a proxy setting to be set in the environment of the
+// fwupd services. Both the lowercase and uppercase variables are set, as
+// libcurl only reads http_proxy in lowercase.
+func (p setting) fwupdString() string {
+	if slices.Contains(unsupportedFwupdProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported fwupd proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+	value = systemdEnvEscaper.Replace(value)
+
+	return fmt.Sprintf("Environment=\"%s_proxy=%s\"\nEnvironment=\"%s_PROXY=%s\"\n",
+		strings.ToLower(p.protocol.String()), value,
+		strings.ToUpper(p.protocol.String()), value)
+}
+
+// fwupdBackend applies the proxy configuration in the form of systemd drop-ins
+// setting the environment of the fwupd daemon and of the service refreshing
+// its firmware metadata. It is only applied if fwupd is installed.
+type fwupdBackend struct {
+	root        string
+	path        string
+	refreshPath string
+
+	fs       *fsRunner
+	reloader daemonReloader
+}
+
+func init() {
+	registerBackend("fwupd", func(opts options, r *fsRunner, c *commandRunner) backend {
+		return fwupdBackend{
+			root:        opts.root,
+			path:        filepath.Join(opts.root, defaultFwupdConfigPath),
+			refreshPath: filepath.Join(opts.root, defaultFwupdRefreshConfigPath),
+			fs:          r,
+			reloader:    newDaemonReloader(opts, c),
+		}
+	})
+}
+
+func (b fwupdBackend) name() string    { return "fwupd" }
+func (b fwupdBackend) paths() []string { return []string{b.path, b.refreshPath} }
+
+func (b fwupdBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "fwupd only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "fwupd has no environment variable for SOCKS proxies"
+	case protocolAuto:
+		return "fwupd doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the fwupd configuration isn't applied: none of
+// the fwupd services is installed.
+func (b fwupdBackend) unavailableReason() string {
+	return missingUnitReason(b.root, "fwupd.service", "fwupd-refresh.service")
+}
+
+// apply applies the proxy configuration to the drop-ins of the fwupd and
+// fwupd-refresh services. If there are no proxy settings to apply, the
+// drop-ins are removed. If any of them changed, the systemd manager is
+// reloaded once every backend is applied. The fwupd service must then be
+// restarted for the configuration to take effect, while fwupd-refresh reads it
+// on its next run. Nothing is done if the services aren't installed.
+func (b fwupdBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply fwupd proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping fwupd proxy configuration", reason)
+		return nil
+	}
+
+	content := fwupdConfig(settings)
+	remove := noSupportedProtocols(settings, unsupportedFwupdProtocols)
+
+	var changed bool
+	for _, f := range []struct{ service, path string }{
+		{"fwupd", b.path},
+		{"fwupd-refresh", b.refreshPath},
+	} {
+		c, err := configFileChanged(f.path, content, remove)
+		if err != nil {
+			return err
+		}
+		changed = changed || c
+
+		log.Debugf("Applying %s proxy configuration to %q", f.service, f.path)
+		if err := applyConfigFile(ctx, b.fs, f.path, content, remove); err != nil {
+			return err
+		}
+	}
+
+	if changed {
+		b.reloader.request()
+	}
+	return nil
+}
+
+// fwupdConfig returns the formatted fwupd services drop-in to be written.
+func fwupdConfig(settings []setting) string {
+	content := fmt.Sprintln(confHeader)
+	content += "[Service]\n"
+	for _, p := range sortedSettings(settings) {
+		content += p.fwupdString()
+	}
+
+	return content
+}
@@ -0,0 +1,53 @@
+package proxy_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestFwupdConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost, 127.0.0.1"}
+
+	tests := map[string]struct {
+		fixture  string
+		settings proxy.Settings
+		// units are the fwupd units installed.
+		units []string
+	}{
+		"Create drop-ins":                          {settings: set, units: []string{"fwupd.service", "fwupd-refresh.service"}},
+		"Create drop-ins with only fwupd-refresh":  {settings: set, units: []string{"fwupd-refresh.service"}},
+		"Replace previously managed drop-ins":      {fixture: "previously_managed", settings: set, units: []string{"fwupd.service"}},
+		"Unsupported settings remove the drop-ins": {fixture: "previously_managed", settings: proxy.Settings{FTP: "ftp://example.com:2121"}, units: []string{"fwupd.service"}},
+		"Remove drop-ins":                          {fixture: "previously_managed", units: []string{"fwupd.service"}},
+		"Nothing is done if fwupd isn't installed": {fixture: "previously_managed", settings: set},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+			if len(tc.units) > 0 {
+				installUnits(t, root, tc.units...)
+			}
+
+			// Only the fwupd backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("fwupd")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedGitProtocols lists the protocols that are not supported by git.
+var unsupportedGitProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// gitValueEscaper escapes a value to be quoted in a git configuration file.
+var gitValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// gitBackend applies the proxy configuration to the system-wide git
+// configuration. The settings are written to a dedicated file, included by
+// /etc/gitconfig: only the include entry of /etc/gitconfig is managed, and the
+// rest of it is left untouched. The backend is only applied if git is
+// installed.
+type gitBackend struct {
+	root          string
+	includePath   string
+	gitconfigPath string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("git", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return gitBackend{
+			root:          opts.root,
+			includePath:   filepath.Join(opts.root, defaultGitIncludePath),
+			gitconfigPath: filepath.Join(opts.root, defaultGitConfigPath),
+			fs:            r,
+		}
+	})
+}
+
+func (b gitBackend) name() string    { return "git" }
+func (b gitBackend) paths() []string { return []string{b.includePath, b.gitconfigPath} }
+func (b gitBackend) sharesFiles()    {}
+
+func (b gitBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "git only uses proxies for HTTP and HTTPS remotes"
+	case protocolSOCKS:
+		return "git has no setting for SOCKS proxies besides its HTTP proxy"
+	case protocolAuto:
+		return "git doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the git configuration isn't applied: git isn't
+// installed.
+func (b gitBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "git")
+}
+
+// apply writes the proxy configuration to the dedicated git configuration file,
+// and includes it from /etc/gitconfig. If there are no proxy settings to apply,
+// the dedicated file and its include entry are removed, but /etc/gitconfig
+// never is. Nothing is done if git isn't installed.
+func (b gitBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply git proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping git proxy configuration", reason)
+		return nil
+	}
+
+	remove := noSupportedProtocols(settings, unsupportedGitProtocols)
+
+	prev, err := previousConfig(b.gitconfigPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// The include entry refers to the dedicated file as seen on the system.
+	gitconfig := gitIncludeConfig(prev, "/"+defaultGitIncludePath, !remove)
+
+	log.Debugf("Applying git proxy configuration to %q", b.includePath)
+	// The dedicated file is written before being included, and removed once no
+	// longer included.
+	if !remove {
+		if err := applyConfigFile(ctx, b.fs, b.includePath, gitConfig(settings), false); err != nil {
+			return err
+		}
+	}
+	if gitconfig != prev {
+		log.Debugf("Updating include entry of %q", b.gitconfigPath)
+		if err := applySharedConfigFile(ctx, b.fs, b.gitconfigPath, gitconfig, 0644); err != nil {
+			return err
+		}
+	}
+	if remove {
+		return applyConfigFile(ctx, b.fs, b.includePath, "", true)
+	}
+	return nil
+}
+
+// gitConfig returns the formatted dedicated git configuration file to be
+// written. Git has a single proxy setting for HTTP and HTTPS remotes: the HTTPS
+// proxy is used if set, as most remotes are reached over HTTPS, and the HTTP
+// proxy otherwise. Each host bypassing the proxy disables it for its remotes.
+func gitConfig(settings []setting) string {
+	var proxy, noProxy string
+	for _, s := range settings {
+		if slices.Contains(unsupportedGitProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported git proxy setting %q", s.protocol)
+			continue
+		}
+		switch s.protocol {
+		case protocolHTTP:
+			if proxy == "" {
+				proxy = s.escapedURL
+			}
+		case protocolHTTPS:
+			proxy = s.escapedURL
+		case protocolNo:
+			noProxy = s.escapedURL
+		}
+	}
+
+	content := fmt.Sprintln(confHeader)
+	if proxy != "" {
+		content += fmt.Sprintf("[http]\n\tproxy = \"%s\"\n", gitValueEscaper.Replace(proxy))
+	}
+	for _, host := range gitNoProxyHosts(noProxy) {
+		for _, scheme := range []string{"http", "https"} {
+			content += fmt.Sprintf("[http \"%s://%s\"]\n\tproxy = \"\"\n", scheme, gitValueEscaper.Replace(host))
+		}
+	}
+
+	return content
+}
+
+// gitNoProxyHosts returns the hosts of a no_proxy list as matched by the
+// http.<url>.* options of git, where * matches a single domain component.
+// Domain suffixes match the domain and its subdomains. The entries git can't
+// match, such as IP ranges, are skipped.
+func gitNoProxyHosts(noProxy string) (hosts []string) {
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.Trim(strings.TrimSpace(entry), `"'`)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || strings.Contains(entry, "/") {
+			log.Debugf("Skipping no_proxy entry %q, which git can't match", entry)
+			continue
+		}
+		// Bare IPv6 addresses are bracketed in URLs.
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() == nil {
+			entry = "[" + entry + "]"
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if domain == entry {
+			hosts = append(hosts, entry)
+			continue
+		}
+		hosts = append(hosts, domain, "*."+domain)
+	}
+	return hosts
+}
+
+// gitIncludeConfig returns the content of /etc/gitconfig with the include
+// entry of the dedicated file removed and, if include is true, added back at
+// the end of the file, after the managed entries header. The other lines are
+// kept verbatim.
+func gitIncludeConfig(content, includePath string, include bool) string {
+	entry := []string{managedEntriesHeader, "[include]", "\tpath = " + includePath}
+
+	lines := strings.SplitAfter(content, "\n")
+	var out strings.Builder
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimRight(lines[i], "\r\n") != managedEntriesHeader {
+			out.WriteString(lines[i])
+			continue
+		}
+		// Skip the include entry following the header, if unchanged.
+		if i+2 < len(lines) && strings.TrimSpace(lines[i+1]) == entry[1] && strings.TrimSpace(lines[i+2]) == strings.TrimSpace(entry[2]) {
+			i += 2
+		}
+	}
+
+	result := out.String()
+	if !include {
+		return result
+	}
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result + strings.Join(entry, "\n") + "\n"
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedGradleProtocols lists the protocols that are not supported by Gradle.
+var unsupportedGradleProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// gradleString formats a proxy setting as the Java system properties set by
+// Gradle.
+func (p setting) gradleString() string {
+	if slices.Contains(unsupportedGradleProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported Gradle proxy setting %q", p.protocol)
+		return ""
+	}
+
+	if p.protocol == protocolNo {
+		hosts := wildcardNonProxyHosts(p.escapedURL)
+		if len(hosts) == 0 {
+			return ""
+		}
+		// Java uses the HTTP exceptions for HTTPS as well.
+		return gradleProperty("systemProp.http.nonProxyHosts", strings.Join(hosts, "|"))
+	}
+
+	prefix := "systemProp." + strings.ToLower(p.protocol.String()) + "."
+	content := gradleProperty(prefix+"proxyHost", p.url.Hostname())
+	if port := p.url.Port(); port != "" {
+		content += gradleProperty(prefix+"proxyPort", port)
+	}
+	if user := p.url.User; user != nil {
+		content += gradleProperty(prefix+"proxyUser", user.Username())
+		if password, set := user.Password(); set {
+			content += gradleProperty(prefix+"proxyPassword", password)
+		}
+	}
+	return content
+}
+
+// gradleProperty returns a line of a Java properties file setting key to value.
+// Properties files are read as ISO-8859-1, so the other characters are escaped.
+func gradleProperty(key, value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case i == 0 && r == ' ':
+			// Leading spaces are otherwise ignored.
+			b.WriteString(`\ `)
+		case r < 0x20 || r > 0x7e:
+			if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+				fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+				continue
+			}
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return fmt.Sprintf("%s=%s\n", key, b.String())
+}
+
+// wildcardNonProxyHosts returns the hosts of a no_proxy list as patterns where
+// * is a wildcard, such as Java nonProxyHosts and Subversion proxy exceptions.
+// Domain suffixes match the domain and its subdomains. The entries a pattern
+// can't match, such as IP ranges, are skipped.
+func wildcardNonProxyHosts(noProxy string) (hosts []string) {
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.Trim(strings.TrimSpace(entry), `"'`)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			log.Debugf("Skipping no_proxy entry %q, which a wildcard pattern can't match", entry)
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if domain == entry || domain == "" {
+			hosts = append(hosts, entry)
+			continue
+		}
+		hosts = append(hosts, domain, "*."+domain)
+	}
+	return hosts
+}
+
+// gradleBackend applies the proxy configuration in the form of the Java system
+// properties set by Gradle, in a system-wide gradle.properties file. The
+// backend is only applied if Gradle is installed.
+type gradleBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("gradle", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return gradleBackend{root: opts.root, path: filepath.Join(opts.root, defaultGradleConfigPath), fs: r}
+	})
+}
+
+func (b gradleBackend) name() string    { return "gradle" }
+func (b gradleBackend) paths() []string { return []string{b.path} }
+
+func (b gradleBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "Gradle only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "Gradle only supports HTTP and HTTPS proxies"
+	case protocolAuto:
+		return "Gradle doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the Gradle configuration isn't applied: Gradle
+// isn't installed.
+func (b gradleBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "gradle")
+}
+
+// apply applies the proxy configuration to the Gradle properties file.
+// If there are no proxy settings to apply, the file is removed. Nothing is done
+// if Gradle isn't installed.
+func (b gradleBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply Gradle proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping Gradle proxy configuration", reason)
+		return nil
+	}
+
+	log.Debugf("Applying Gradle proxy configuration to %q", b.path)
+	return applyConfigFile(ctx, b.fs, b.path, gradleConfig(settings), noSupportedProtocols(settings, unsupportedGradleProtocols))
+}
+
+// gradleConfig returns the formatted Gradle properties file to be written.
+func gradleConfig(settings []setting) string {
+	content := fmt.Sprintln(confHeader)
+	for _, p := range sortedSettings(settings) {
+		content += p.gradleString()
+	}
+
+	return content
+}
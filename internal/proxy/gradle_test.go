@@ -0,0 +1,43 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestGradleConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		settings     proxy.Settings
+		notInstalled bool
+	}{
+		"No proxy hosts are separated by pipes":     {settings: proxy.Settings{HTTP: "http://example.com:8080", NoProxy: `localhost, .example.com, *.example.org, "example.net", 10.0.0.0/8, ::1`}},
+		"No proxy wildcard is kept":                 {settings: proxy.Settings{HTTP: "http://example.com:8080", NoProxy: "*"}},
+		"Proxy without port":                        {settings: proxy.Settings{HTTPS: "https://example.com"}},
+		"Credentials are escaped":                   {settings: proxy.Settings{HTTPS: `https://us\er: pässw😀rd@example.com:8443`}},
+		"Unsupported settings are not written":      {settings: proxy.Settings{FTP: "ftp://example.com:2121", SOCKS: "socks://example.com:1080", Auto: "http://example.com/proxy.pac"}},
+		"Nothing is done if Gradle isn't installed": {settings: proxy.Settings{HTTP: "http://example.com:8080"}, notInstalled: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if !tc.notInstalled {
+				installPrograms(t, root, "gradle")
+			}
+
+			// Only the Gradle backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("gradle")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
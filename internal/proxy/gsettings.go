@@ -1,13 +1,19 @@
+//go:build !nogsettings
+
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/ubuntu/decorate"
@@ -22,18 +28,36 @@ const (
 // unsupportedGSettingsProtocols lists the protocols that are not supported by GSettings.
 var unsupportedGSettingsProtocols = []protocol{protocolAll}
 
-// gsettingsString formats a proxy setting to be used in a GSchema override file.
-func (p setting) gsettingsString() string {
+// gschemaSection returns the section of a GSchema override file setting the
+// keys of the given child of the proxy schema, or of the schema itself if child
+// is empty.
+func gschemaSection(child string) string {
+	if child == "" {
+		return fmt.Sprintf("[%s]", systemProxySchemaID)
+	}
+	return fmt.Sprintf("[%s.%s]", systemProxySchemaID, child)
+}
+
+// gsettingsString formats a proxy setting to be used in a GSchema override
+// file, or in another key file of GVariant values whose sections are returned by
+// section.
+func (p setting) gsettingsString(section func(child string) string) string {
 	if slices.Contains(unsupportedGSettingsProtocols, p.protocol) {
 		log.Debugf("Skipping unsupported GSettings proxy setting %q", p.protocol)
 		return ""
 	}
 
-	var section, settings string
+	var header, settings string
 	switch p.protocol {
 	case protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS:
-		section = fmt.Sprintf("[%s.%s]", systemProxySchemaID, strings.ToLower(p.protocol.String()))
-		settings = fmt.Sprintf("host='%s'\n", p.url.Hostname())
+		header = section(strings.ToLower(p.protocol.String()))
+		// GSettings doesn't support zone identifiers, the proxy is expected to
+		// be reachable through the default route.
+		host, zone := hostZone(p.url)
+		if zone != "" {
+			log.Warningf("Removing zone identifier %q from GSettings %s proxy host, as it is not supported", zone, p.protocol)
+		}
+		settings = fmt.Sprintf("host='%s'\n", host)
 		if p.url.Port() != "" {
 			settings += fmt.Sprintf("port=%s\n", p.url.Port())
 		}
@@ -52,79 +76,227 @@ func (p setting) gsettingsString() string {
 		}
 	case protocolNo:
 		// Ignored hosts are configured at the root level
-		section = fmt.Sprintf("[%s]", systemProxySchemaID)
+		header = section("")
 
-		hosts := strings.Split(p.escapedURL, ",")
-		for i, host := range hosts {
-			hosts[i] = wrapHostIfNeeded(host)
+		hosts := ignoredHosts(p.escapedURL)
+		// Omit the key rather than setting an empty list
+		if len(hosts) == 0 {
+			log.Debug("No ignored hosts left after removing empty entries, skipping ignore-hosts")
+			return ""
 		}
-		settings = fmt.Sprintf("ignore-hosts=[%s]\n", strings.Join(hosts, ","))
+		settings = fmt.Sprintf("ignore-hosts=%s\n", gvariantStringList(hosts))
 	case protocolAuto:
 		// Autoconfig URL is configured at the root level
-		section = fmt.Sprintf("[%s]", systemProxySchemaID)
+		header = section("")
 		settings = fmt.Sprintf("autoconfig-url='%s'\n", p.escapedURL)
 	}
 
-	return fmt.Sprintf("%s\n%s\n", section, settings)
+	return fmt.Sprintf("%s\n%s\n", header, settings)
 }
 
-// applyToGSettings applies the proxy configuration in the form of a GSchema override file,
-// then runs glib-compile-schemas to make the changes visible to GSettings.
-// If there are no proxy settings to apply, the GSchema override file is removed.
-func (p Proxy) applyToGSettings() (err error) {
-	defer decorate.OnError(&err, "couldn't apply GSettings proxy configuration")
+// ignoredHosts returns the non empty hosts of the given no_proxy value,
+// without quotes and surrounding whitespace.
+func ignoredHosts(noproxy string) (hosts []string) {
+	for _, host := range strings.Split(noproxy, ",") {
+		if host = strings.Trim(host, ` '"`); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
 
-	// On the off chance that the user is not running GNOME, we want to print a warning and quietly return.
-	if _, err := exec.LookPath(p.glibCompileSchemasCmd[0]); err != nil {
-		log.Warningf("Couldn't find an executable for %q, not applying GSettings proxy configuration", p.glibCompileSchemasCmd[0])
-		return nil
+// gsettingsBackend applies the proxy configuration in the form of a GSchema
+// override file, then runs glib-compile-schemas to make the changes visible to
+// GSettings.
+type gsettingsBackend struct {
+	path string
+
+	glibCompileSchemasCmd []string
+	glibSchemasPath       string
+
+	// useSameProxy renders a single HTTP section with use-same-proxy enabled
+	// when all protocols use the same proxy.
+	useSameProxy bool
+
+	// verify compares the effective GSettings values with the applied ones
+	// by running gsettingsCmd once the schemas are compiled.
+	verify       bool
+	gsettingsCmd []string
+
+	// extraLines are appended to the generated configuration.
+	extraLines []string
+
+	fs       *fsRunner
+	commands *commandRunner
+}
+
+func init() {
+	registerBackend("gsettings", func(opts options, r *fsRunner, c *commandRunner) backend {
+		glibSchemasPath := filepath.Join(opts.root, defaultGLibSchemaPath)
+		return gsettingsBackend{
+			path:                  filepath.Join(glibSchemasPath, gschemaOverrideFile),
+			glibSchemasPath:       glibSchemasPath,
+			glibCompileSchemasCmd: opts.glibCompileSchemasCmd,
+			useSameProxy:          opts.gsettingsUseSameProxy,
+			verify:                opts.gsettingsVerify,
+			gsettingsCmd:          opts.gsettingsCmd,
+			extraLines:            opts.extraLines.GSettings,
+			fs:                    r,
+			commands:              c,
+		}
+	})
+}
+
+func (b gsettingsBackend) name() string    { return "gsettings" }
+func (b gsettingsBackend) paths() []string { return []string{b.path} }
+
+// skipReason always returns an empty string, as GSettings can express every
+// setting.
+func (b gsettingsBackend) skipReason(protocol) string { return "" }
+
+// unavailableReason returns why the GSettings configuration isn't applied:
+// glib-compile-schemas or the GLib schema directory is missing.
+func (b gsettingsBackend) unavailableReason() string {
+	if _, err := exec.LookPath(b.glibCompileSchemasCmd[0]); err != nil {
+		return fmt.Sprintf("couldn't find an executable for %q", b.glibCompileSchemasCmd[0])
+	}
+	if stat, err := os.Stat(b.glibSchemasPath); errors.Is(err, fs.ErrNotExist) || err == nil && !stat.IsDir() {
+		return fmt.Sprintf("GLib schema directory %q doesn't exist", b.glibSchemasPath)
 	}
+	return ""
+}
 
-	// Check if the parent directory exists - fail if it doesn't, as it means we
-	// don't have any defined proxy XML schema to override.
-	if stat, err := os.Stat(p.glibSchemasPath); err != nil {
-		return fmt.Errorf("couldn't find GLib schema directory: %w", err)
-	} else if !stat.IsDir() {
-		return fmt.Errorf("GLib schema path %q is not a directory", filepath.Dir(p.gsettingsConfigPath))
+// credentialsSkipReason returns why the credentials of proxies of the given
+// protocol are ignored: GSettings only authenticates to the HTTP proxy.
+func (b gsettingsBackend) credentialsSkipReason(proto protocol) string {
+	if proto == protocolHTTP {
+		return ""
 	}
+	return "GSettings only supports authentication to the HTTP proxy"
+}
+
+// apply applies the proxy configuration to the GSchema override file.
+// If there are no proxy settings to apply, the GSchema override file is removed.
+func (b gsettingsBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply GSettings proxy configuration")
+
+	if len(settings) == 0 {
+		// Nothing is left to install once the prerequisites are met, so
+		// the error isn't a prerequisiteError anymore.
+		var prereqErr prerequisiteError
+		if err := b.checkPrerequisites(""); errors.As(err, &prereqErr) {
+			if prereqErr.skip {
+				log.Warning(prereqErr.err)
+				return nil
+			}
+			return prereqErr.err
+		} else if err != nil {
+			return err
+		}
 
-	if len(p.settings) == 0 {
 		log.Debug("No proxy settings to apply, removing GSchema override file if it exists")
 
 		// If we managed to remove something, we need to recompile the schemas
 		// to propagate the change to GSettings.
-		if err := os.Remove(p.gsettingsConfigPath); err == nil {
-			log.Debugf("Removed GSettings override file at %q", p.gsettingsConfigPath)
-			return p.runGlibCompileSchemas()
+		if err := b.fs.remove(ctx, b.path); err == nil {
+			log.Debugf("Removed GSettings override file at %q", b.path)
+			return b.runGlibCompileSchemas()
 		} else if !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
 		return nil
 	}
-	log.Debugf("Applying GSettings proxy configuration to %q", p.gsettingsConfigPath)
+	log.Debugf("Applying GSettings proxy configuration to %q", b.path)
+
+	content := normalizeRendered(withExtraLines(gsettingsConfig(settings, b.useSameProxy, gschemaSection), b.extraLines))
+	if err := b.install(ctx, content); err != nil {
+		return err
+	}
+
+	b.verifyEffectiveValues(settings)
+	return nil
+}
+
+// GLibSchemaDirError is returned when the GLib schema directory can't be used.
+type GLibSchemaDirError struct {
+	Path string
+	// PrerequisiteMissing is true if the directory doesn't exist or isn't a
+	// directory, and false on I/O errors, such as permission denied.
+	PrerequisiteMissing bool
+	Err                 error
+}
 
-	content := p.gsettingsConfig()
-	prevContent, err := previousConfig(p.gsettingsConfigPath)
+func (e GLibSchemaDirError) Error() string {
+	switch {
+	case errors.Is(e.Err, fs.ErrNotExist):
+		return fmt.Sprintf("GLib schema directory %q doesn't exist: install the gsettings-desktop-schemas package, which provides the proxy schema", e.Path)
+	case e.PrerequisiteMissing:
+		return fmt.Sprintf("GLib schema path %q is not a directory: remove the file, which may come from a broken overlay, then reinstall the gsettings-desktop-schemas package", e.Path)
+	default:
+		return fmt.Sprintf("couldn't access GLib schema directory %q: %v: check the permissions of the directory and its parents, and the filesystem or overlay mounted on it", e.Path, e.Err)
+	}
+}
+
+func (e GLibSchemaDirError) Unwrap() error { return e.Err }
+
+// checkPrerequisites returns a prerequisiteError keeping the given rendered
+// content if glib-compile-schemas or the GLib schema directory is missing.
+// The backend is skipped without failing in the former case, as the user is
+// likely not running GNOME. A GLibSchemaDirError is returned as is if the
+// directory can't be accessed.
+func (b gsettingsBackend) checkPrerequisites(content string) error {
+	if _, err := exec.LookPath(b.glibCompileSchemasCmd[0]); err != nil {
+		return prerequisiteError{
+			err:     fmt.Errorf("couldn't find an executable for %q, not applying GSettings proxy configuration", b.glibCompileSchemasCmd[0]),
+			content: content,
+			skip:    true,
+		}
+	}
+
+	// Check if the parent directory exists - fail if it doesn't, as it means we
+	// don't have any defined proxy XML schema to override.
+	stat, err := os.Stat(b.glibSchemasPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		return prerequisiteError{err: GLibSchemaDirError{Path: b.glibSchemasPath, PrerequisiteMissing: true, Err: err}, content: content}
+	case err != nil:
+		return GLibSchemaDirError{Path: b.glibSchemasPath, Err: err}
+	case !stat.IsDir():
+		return prerequisiteError{err: GLibSchemaDirError{Path: b.glibSchemasPath, PrerequisiteMissing: true, Err: syscall.ENOTDIR}, content: content}
+	}
+
+	return nil
+}
+
+// install writes the given rendered content to the override file and compiles
+// the schemas, restoring the previous file on failure. It returns a
+// prerequisiteError if glib-compile-schemas or the schema directory is missing.
+func (b gsettingsBackend) install(ctx context.Context, content string) error {
+	if err := b.checkPrerequisites(content); err != nil {
+		return err
+	}
+
+	prevContent, err := previousConfig(b.path)
 	if err == nil && prevContent == content {
-		log.Debugf("GSettings proxy configuration at %q is already up to date", p.gsettingsConfigPath)
+		log.Debugf("GSettings proxy configuration at %q is already up to date", b.path)
 		return nil
 	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	backupPath, moveBack, err := backupFileIfExists(p.gsettingsConfigPath)
+	backupPath, moveBack, err := backupFileIfExists(ctx, b.fs, b.path)
 	if err != nil {
 		return err
 	}
 
-	if err := safeWriteFile(p.gsettingsConfigPath, content); err != nil {
+	if err := safeWriteFile(ctx, b.fs, b.path, content, 0644); err != nil {
 		// If we failed to write the configuration to disk, revert to the
 		// previous version of the configuration file.
 		moveBackErr := moveBack()
 		return errors.Join(err, moveBackErr)
 	}
 
-	if err := p.runGlibCompileSchemas(); err != nil {
+	if err := b.runGlibCompileSchemas(); err != nil {
 		// If we failed to recompile the schemas (due to our fault or not),
 		// revert to the previous version of the configuration file.
 		moveBackErr := moveBack()
@@ -133,32 +305,66 @@ func (p Proxy) applyToGSettings() (err error) {
 
 	if _, err := os.Stat(backupPath); err == nil {
 		log.Debugf("Removing backup file at %q", backupPath)
-		return os.Remove(backupPath)
+		if err := b.fs.remove(ctx, backupPath); err != nil {
+			return err
+		}
 	} else if !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	// No backup file to remove, we're done.
 	return nil
 }
 
-// gsettingsConfig returns the formatted GSettings proxy configuration file to be written.
-func (p Proxy) gsettingsConfig() string {
+// gsettingsConfig returns the formatted GSettings proxy configuration file to be written,
+// whose sections are returned by section.
+// If useSameProxy is true and all protocols use the HTTP proxy, only the HTTP
+// section is written and use-same-proxy is enabled.
+func gsettingsConfig(settings []setting, useSameProxy bool, section func(child string) string) string {
+	sameProxy := useSameProxy && sameProxyForAllProtocols(settings)
+
 	content := fmt.Sprintln(confHeader)
-	for _, p := range p.settings {
-		content += p.gsettingsString()
+	for _, p := range sortedSettings(settings) {
+		if sameProxy && slices.Contains([]protocol{protocolHTTPS, protocolFTP, protocolSOCKS}, p.protocol) {
+			continue
+		}
+		content += p.gsettingsString(section)
+	}
+	content += section("") + "\n"
+	content += fmt.Sprintf("mode='%s'\n", gsettingsProxyMode(settings))
+	if sameProxy {
+		content += "use-same-proxy=true\n"
 	}
-	content += fmt.Sprintf("[%s]\n", systemProxySchemaID)
-	content += fmt.Sprintf("mode='%s'\n", p.gsettingsProxyMode())
 
 	return content
 }
 
+// sameProxyForAllProtocols returns true if the HTTPS, FTP and SOCKS proxies are
+// all set, and point to the same host and port as the HTTP proxy.
+func sameProxyForAllProtocols(settings []setting) bool {
+	proxies := make(map[protocol]*url.URL)
+	for _, s := range settings {
+		proxies[s.protocol] = s.url
+	}
+
+	http, ok := proxies[protocolHTTP]
+	if !ok {
+		return false
+	}
+	for _, proto := range []protocol{protocolHTTPS, protocolFTP, protocolSOCKS} {
+		u, ok := proxies[proto]
+		if !ok || u.Hostname() != http.Hostname() || u.Port() != http.Port() {
+			return false
+		}
+	}
+
+	return true
+}
+
 // gsettingsProxyMode returns the GSettings proxy mode to be used.
 // If an autoconfig URL is set, auto is returned.
 // If only specific protocols are set, manual is returned.
-func (p Proxy) gsettingsProxyMode() string {
-	for _, setting := range p.settings {
+func gsettingsProxyMode(settings []setting) string {
+	for _, setting := range settings {
 		if setting.protocol == protocolAuto {
 			return "auto"
 		}
@@ -168,12 +374,12 @@ func (p Proxy) gsettingsProxyMode() string {
 }
 
 // runGlibCompileSchemas runs glib-compile-schemas on the default GSettings schema path.
-func (p Proxy) runGlibCompileSchemas() error {
-	glibCompileSchemasCmd := append(p.glibCompileSchemasCmd, "--strict", p.glibSchemasPath)
-	log.Debugf("Running glib-compile-schemas on %q", p.glibSchemasPath)
+func (b gsettingsBackend) runGlibCompileSchemas() error {
+	glibCompileSchemasCmd := append(b.glibCompileSchemasCmd, "--strict", b.glibSchemasPath)
+	log.Debugf("Running glib-compile-schemas on %q", b.glibSchemasPath)
 
 	// #nosec G204 - path not controllable by user
-	out, err := exec.Command(glibCompileSchemasCmd[0], glibCompileSchemasCmd[1:]...).CombinedOutput()
+	out, err := b.commands.run(exec.Command(glibCompileSchemasCmd[0], glibCompileSchemasCmd[1:]...), true)
 	if err != nil {
 		return fmt.Errorf("couldn't run glib-compile-schemas: %w: %s", err, out)
 	}
@@ -184,11 +390,66 @@ func (p Proxy) runGlibCompileSchemas() error {
 	return nil
 }
 
-// wrapHostIfNeeded wraps the host in single quotes if it is not already wrapped.
-func wrapHostIfNeeded(host string) string {
-	trimmedHost := strings.Trim(host, ` '"`)
+// gvariantStringList returns the GVariant text format of the given string
+// array, as printed by g_variant_print.
+func gvariantStringList(values []string) string {
+	if len(values) == 0 {
+		return "@as []"
+	}
+
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = gvariantString(v)
+	}
+	return fmt.Sprintf("[%s]", strings.Join(quoted, ", "))
+}
+
+// gvariantString returns the GVariant text format of the given string, as
+// printed by g_variant_print: strings containing a single quote are wrapped in
+// double quotes, and non printable characters are escaped.
+func gvariantString(s string) string {
+	quote := '\''
+	if strings.ContainsRune(s, '\'') {
+		quote = '"'
+	}
+
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, c := range s {
+		if c == quote || c == '\\' {
+			b.WriteRune('\\')
+		}
+		if unicode.IsGraphic(c) {
+			b.WriteRune(c)
+			continue
+		}
+
+		switch c {
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			if c < 0x10000 {
+				fmt.Fprintf(&b, `\u%04x`, c)
+			} else {
+				fmt.Fprintf(&b, `\U%08x`, c)
+			}
+		}
+	}
+	b.WriteRune(quote)
 
-	return fmt.Sprintf("'%s'", trimmedHost)
+	return b.String()
 }
 
 // escapeSingleQuote escapes single quotes in the given string.
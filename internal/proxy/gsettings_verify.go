@@ -0,0 +1,113 @@
+//go:build !nogsettings
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// gsettingsValue is a GSettings key with its value in the GVariant text format.
+type gsettingsValue struct {
+	schema string
+	key    string
+	value  string
+}
+
+// verifyEffectiveValues queries gsettings for the applied proxy values and
+// warns about the ones which differ, naming the likely cause.
+// It is a no-op if the verification is disabled.
+func (b gsettingsBackend) verifyEffectiveValues(settings []setting) {
+	if !b.verify {
+		return
+	}
+
+	if _, err := exec.LookPath(b.gsettingsCmd[0]); err != nil {
+		log.Warningf("Couldn't find an executable for %q, not verifying GSettings proxy configuration", b.gsettingsCmd[0])
+		return
+	}
+	log.Debug("Verifying effective GSettings proxy configuration")
+
+	for _, want := range gsettingsExpectedValues(settings, b.useSameProxy) {
+		got, err := b.gsettingsGet(want.schema, want.key, false)
+		if err != nil {
+			log.Warningf("Couldn't verify GSettings proxy configuration: %v", err)
+			return
+		}
+		if got == want.value {
+			continue
+		}
+
+		// With the memory backend, gsettings only reads the schema defaults
+		// and their overrides, which tells a competing override file apart
+		// from a dconf setting.
+		cause := "a dconf setting of the user or of a dconf system database takes precedence"
+		if def, err := b.gsettingsGet(want.schema, want.key, true); err != nil {
+			cause = fmt.Sprintf("couldn't determine the cause: %v", err)
+		} else if def != want.value {
+			cause = "another GSchema override file with a higher priority takes precedence"
+		}
+		log.Warningf("GSettings %s %s is %s instead of %s: %s", want.schema, want.key, got, want.value, cause)
+	}
+}
+
+// gsettingsGet returns the value of the given GSettings key in the GVariant
+// text format. If defaultsOnly is true, user and system dconf databases are
+// ignored.
+func (b gsettingsBackend) gsettingsGet(schema, key string, defaultsOnly bool) (string, error) {
+	gsettingsCmd := append(slices.Clone(b.gsettingsCmd), "get", schema, key)
+
+	// #nosec G204 - path not controllable by user
+	cmd := exec.Command(gsettingsCmd[0], gsettingsCmd[1:]...)
+	cmd.Env = os.Environ()
+	if defaultsOnly {
+		cmd.Env = append(cmd.Env, "GSETTINGS_BACKEND=memory")
+	}
+
+	out, err := b.commands.run(cmd, false)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get %s %s: %w", schema, key, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gsettingsExpectedValues returns the GSettings values applied for the given
+// settings. Authentication keys are not included, so that credentials are
+// never read back.
+func gsettingsExpectedValues(settings []setting, useSameProxy bool) []gsettingsValue {
+	sameProxy := useSameProxy && sameProxyForAllProtocols(settings)
+
+	values := []gsettingsValue{{systemProxySchemaID, "mode", gvariantString(gsettingsProxyMode(settings))}}
+	for _, s := range settings {
+		switch s.protocol {
+		case protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS:
+			if sameProxy && s.protocol != protocolHTTP {
+				continue
+			}
+			schema := fmt.Sprintf("%s.%s", systemProxySchemaID, strings.ToLower(s.protocol.String()))
+			host, _ := hostZone(s.url)
+			values = append(values, gsettingsValue{schema, "host", gvariantString(host)})
+			if port, err := strconv.Atoi(s.url.Port()); err == nil {
+				values = append(values, gsettingsValue{schema, "port", strconv.Itoa(port)})
+			}
+		case protocolNo:
+			if hosts := ignoredHosts(s.escapedURL); len(hosts) > 0 {
+				values = append(values, gsettingsValue{systemProxySchemaID, "ignore-hosts", gvariantStringList(hosts)})
+			}
+		case protocolAuto:
+			values = append(values, gsettingsValue{systemProxySchemaID, "autoconfig-url", gvariantString(s.escapedURL)})
+		}
+	}
+	if sameProxy {
+		values = append(values, gsettingsValue{systemProxySchemaID, "use-same-proxy", "true"})
+	}
+
+	return values
+}
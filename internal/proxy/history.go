@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+// historyStateFile is the state file recording the successful Apply calls.
+const historyStateFile = "history.json"
+
+// maxHistoryEntries is the number of Apply calls kept in the history.
+const maxHistoryEntries = 100
+
+// HistoryEntry records a successful Apply call.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// UID is the user ID of the caller.
+	UID uint32 `json:"uid"`
+	// Username is the name of the caller, empty if it couldn't be resolved.
+	Username string `json:"username,omitempty"`
+	// PID is the process ID of the caller.
+	PID uint32 `json:"pid,omitempty"`
+	// BusName is the unique D-Bus name of the caller.
+	BusName string `json:"bus_name,omitempty"`
+	// Operation is the call that applied the settings, as in LastApply.
+	Operation string `json:"operation"`
+	// Settings are the canonical applied settings, indexed by protocol, with
+	// credentials masked.
+	Settings map[string]string `json:"settings"`
+	// APTHostProxies are the canonical applied APT per-host proxies, indexed
+	// by host, with credentials masked.
+	APTHostProxies map[string]string `json:"apt_host_proxies,omitempty"`
+	// Backends lists the backends whose configuration was applied or removed.
+	Backends []string `json:"backends,omitempty"`
+	// SettingsHash is the hash of the applied settings, without the
+	// credentials, as in LastApply. It is empty if it wasn't recorded.
+	SettingsHash string `json:"settings_hash,omitempty"`
+}
+
+// LastApplied returns the last Apply call, with its caller unset, if it
+// succeeded since the given time. It returns nil for calls which didn't change
+// anything, as with empty settings meaning no-op, and without a state
+// directory.
+func (p Proxy) LastApplied(since time.Time) (entry *HistoryEntry, err error) {
+	defer decorate.OnError(&err, "couldn't read the last Apply call")
+
+	if p.state == nil {
+		return nil, nil
+	}
+
+	var last LastApply
+	if err := p.state.Load(lastApplyStateFile, &last); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if last.Error != "" || last.Time.Before(since) {
+		log.Debug("No new successful Apply call")
+		return nil, nil
+	}
+
+	entry = &HistoryEntry{Time: last.Time, Operation: last.Operation, Settings: last.Settings, APTHostProxies: last.APTHostProxies}
+	if last.SettingsHash != nil {
+		entry.SettingsHash = last.SettingsHash.Settings
+	}
+	for _, r := range last.Backends {
+		if r.Mode != BackendModeDisabled && !r.AlreadyClean {
+			entry.Backends = append(entry.Backends, r.Backend)
+		}
+	}
+	return entry, nil
+}
+
+// RecordHistory adds the given Apply call to the history. Only the most recent
+// calls are kept. Nothing is recorded without a state directory.
+func (p Proxy) RecordHistory(entry HistoryEntry) (err error) {
+	defer decorate.OnError(&err, "couldn't record the Apply call in the history")
+
+	if p.state == nil {
+		return nil
+	}
+
+	history, err := p.History()
+	if err != nil {
+		return err
+	}
+
+	history = append([]HistoryEntry{entry}, history...)
+	if len(history) > maxHistoryEntries {
+		history = history[:maxHistoryEntries]
+	}
+	return p.state.Save(historyStateFile, history)
+}
+
+// History returns the most recent successful Apply calls, the latest first.
+// It is empty if none was recorded, or without a state directory.
+func (p Proxy) History() (history []HistoryEntry, err error) {
+	defer decorate.OnError(&err, "couldn't read the history of Apply calls")
+
+	if p.state == nil {
+		return nil, nil
+	}
+	if err := p.state.Load(historyStateFile, &history); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
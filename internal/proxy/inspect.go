@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// maxManagedFileSize is the maximum size of a managed file returned by
+// ManagedFileContents.
+const maxManagedFileSize = 64 * 1024
+
+// redactedPassword replaces passwords in the returned managed file contents.
+const redactedPassword = "***"
+
+var (
+	// urlPasswordRegexp matches the password of a URL with credentials.
+	urlPasswordRegexp = regexp.MustCompile(`(\w+://[^:@/\s"]+:)[^@\s"]+@`)
+	// gsettingsPasswordRegexp matches the password of a GSettings authenticated proxy.
+	gsettingsPasswordRegexp = regexp.MustCompile(`(?m)^(authentication-password=)'.*'$`)
+	// gradlePasswordRegexp matches the password of a Gradle authenticated proxy.
+	gradlePasswordRegexp = regexp.MustCompile(`(?m)^(systemProp\.https?\.proxyPassword=).*$`)
+	// subversionPasswordRegexp matches the password of a Subversion authenticated proxy.
+	subversionPasswordRegexp = regexp.MustCompile(`(?m)^(http-proxy-password\s*[=:]\s*).*$`)
+	// cntlmPasswordRegexp matches the password of the cntlm account.
+	cntlmPasswordRegexp = regexp.MustCompile(`(?m)^(Password\s+).*$`)
+)
+
+// ManagedFileContents returns the contents of every managed file which exists
+// and was generated by ubuntu-proxy-manager, or contains entries it manages,
+// indexed by their path.
+// Passwords are masked in the returned contents.
+func (p Proxy) ManagedFileContents() (contents map[string]string, err error) {
+	defer decorate.OnError(&err, "couldn't read managed files")
+
+	contents = make(map[string]string)
+	for _, b := range p.backends {
+		for _, path := range b.paths() {
+			fi, err := os.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if fi.Size() > maxManagedFileSize {
+				return nil, fmt.Errorf("%q is larger than %d bytes", path, maxManagedFileSize)
+			}
+
+			content, err := previousConfig(path)
+			if err != nil {
+				return nil, err
+			}
+			if !managedContent(content) {
+				log.Debugf("Skipping %q, which is not managed by ubuntu-proxy-manager", path)
+				continue
+			}
+
+			contents[path] = redactPasswords(content)
+		}
+	}
+
+	return contents, nil
+}
+
+// Configuration returns the applied proxy settings, read back from the managed
+// files and the recorded state as RotateCredentials does, with passwords masked.
+// The settings are empty if no configuration is applied.
+func (p Proxy) Configuration() (s Settings, err error) {
+	defer decorate.OnError(&err, "couldn't read applied proxy configuration")
+
+	s, err = p.currentSettings()
+	if errors.Is(err, ErrNoConfiguration) {
+		log.Debugf("No applied proxy configuration: %v", err)
+		return Settings{}, nil
+	} else if err != nil {
+		return Settings{}, err
+	}
+
+	for _, uri := range []*string{&s.HTTP, &s.HTTPS, &s.FTP, &s.SOCKS, &s.Auto} {
+		*uri = redactPasswords(*uri)
+	}
+	for host, value := range s.APTHostProxies {
+		s.APTHostProxies[host] = redactPasswords(value)
+	}
+	return s, nil
+}
+
+// managedContent returns true if content was generated by ubuntu-proxy-manager,
+// or contains entries it manages in a file shared with other programs.
+func managedContent(content string) bool {
+	return strings.HasPrefix(content, confHeader) || slices.Contains(strings.Split(content, "\n"), managedEntriesHeader)
+}
+
+// RedactPasswords masks the passwords of the proxy URLs in the given text.
+func RedactPasswords(text string) string {
+	return redactPasswords(text)
+}
+
+// redactPasswords masks the proxy passwords in the given managed file content.
+func redactPasswords(content string) string {
+	content = urlPasswordRegexp.ReplaceAllString(content, "${1}"+redactedPassword+"@")
+	content = gsettingsPasswordRegexp.ReplaceAllString(content, "${1}'"+redactedPassword+"'")
+	content = gradlePasswordRegexp.ReplaceAllString(content, "${1}"+redactedPassword)
+	content = subversionPasswordRegexp.ReplaceAllString(content, "${1}"+redactedPassword)
+	return cntlmPasswordRegexp.ReplaceAllString(content, "${1}"+redactedPassword)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedKDEProtocols lists the protocols that are not supported by KDE.
+var unsupportedKDEProtocols = []protocol{protocolAll}
+
+// kdeProxyKeys maps the protocols to the keys of the [Proxy Settings] group
+// setting them.
+var kdeProxyKeys = map[protocol]string{
+	protocolHTTP:  "httpProxy",
+	protocolHTTPS: "httpsProxy",
+	protocolFTP:   "ftpProxy",
+	protocolSOCKS: "socksProxy",
+	protocolNo:    "NoProxyFor",
+	protocolAuto:  "Proxy Config Script",
+}
+
+const (
+	// kdeProxyTypeManual is the ProxyType of manually set proxies.
+	kdeProxyTypeManual = 1
+	// kdeProxyTypeAutoConfig is the ProxyType of autoconfiguration URLs.
+	kdeProxyTypeAutoConfig = 2
+)
+
+// kdeProxyKeyRegexp matches the keys of the [Proxy Settings] group managed by
+// the backend.
+var kdeProxyKeyRegexp = regexp.MustCompile(`^\s*(ProxyType|httpProxy|httpsProxy|ftpProxy|socksProxy|NoProxyFor|Proxy Config Script)\s*=`)
+
+// kdeValueEscaper escapes a value of a KDE configuration file.
+var kdeValueEscaper = strings.NewReplacer(`\`, `\\`)
+
+// kdeString formats a proxy setting as a key of the KDE proxy settings.
+func (p setting) kdeString() string {
+	if slices.Contains(unsupportedKDEProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported KDE proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	return fmt.Sprintf("%s=%s\n", kdeProxyKeys[p.protocol], kdeValueEscaper.Replace(value))
+}
+
+// kdeBackend applies the proxy configuration to the [Proxy Settings] group of
+// /etc/xdg/kioslaverc, the system defaults of the KDE network settings. The
+// file is shared: only the proxy keys are managed, and the rest of the file is
+// left untouched. The backend is only applied if KDE is installed.
+type kdeBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("kde", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return kdeBackend{root: opts.root, path: filepath.Join(opts.root, defaultKDEConfigPath), fs: r}
+	})
+}
+
+func (b kdeBackend) name() string    { return "kde" }
+func (b kdeBackend) paths() []string { return []string{b.path} }
+func (b kdeBackend) sharesFiles()    {}
+
+// skipReason returns no reason, as KDE supports every protocol.
+func (b kdeBackend) skipReason(proto protocol) string { return "" }
+
+// unavailableReason returns why the KDE configuration isn't applied: KDE isn't
+// installed.
+func (b kdeBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "plasmashell", "kioclient", "kioclient5")
+}
+
+// apply replaces the proxy keys of the [Proxy Settings] group with the given
+// proxy settings. If there are no proxy settings to apply, the keys are
+// removed, but the file never is. Nothing is done if KDE isn't installed.
+func (b kdeBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply KDE proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping KDE proxy configuration", reason)
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := replaceINIOptions(prev, "Proxy Settings", kdeProxyKeyRegexp, kdeConfig(settings))
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying KDE proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// kdeConfig returns the proxy keys of the [Proxy Settings] group, or an empty
+// string if there are no settings to apply. As with GSettings, autoconfiguration
+// URLs are prioritized over the manual proxy settings.
+func kdeConfig(settings []setting) string {
+	if noSupportedProtocols(settings, unsupportedKDEProtocols) {
+		return ""
+	}
+
+	proxyType := kdeProxyTypeManual
+	var content string
+	for _, p := range sortedSettings(settings) {
+		if p.protocol == protocolAuto {
+			proxyType = kdeProxyTypeAutoConfig
+		}
+		content += p.kdeString()
+	}
+
+	return fmt.Sprintf("ProxyType=%d\n", proxyType) + content
+}
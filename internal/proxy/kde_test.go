@@ -0,0 +1,64 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestKDEConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", SOCKS: "socks://example.com:1080", NoProxy: "localhost, 127.0.0.1"}
+
+	tests := map[string]struct {
+		fixture      string
+		settings     proxy.Settings
+		notInstalled bool
+	}{
+		"Create file":                               {settings: set},
+		"Autoconfiguration URL takes precedence":    {settings: proxy.Settings{HTTP: "http://example.com:8080", Auto: "http://example.com/proxy.pac"}},
+		"Add proxy settings after the other groups": {fixture: "other_groups", settings: set},
+		"Replace proxy settings set by hand":        {fixture: "proxy_settings_set_by_hand", settings: set},
+		"Remove proxy settings, keeping the others": {fixture: "proxy_settings_set_by_hand"},
+		"File without proxy settings is untouched":  {fixture: "other_groups"},
+		"Missing file is not created on removal":    {},
+		"Nothing is done if KDE isn't installed":    {fixture: "other_groups", settings: set, notInstalled: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+			if !tc.notInstalled {
+				installPrograms(t, root, "plasmashell")
+			}
+
+			// Only the KDE backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("kde")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultKDEConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultKDEConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+// legacyEnvVariableRegexp matches the proxy variables of the managed block of
+// the system environment file.
+var legacyEnvVariableRegexp = regexp.MustCompile(`^(?i)(http|https|ftp|socks|no|all)_proxy=`)
+
+// legacyEnvBackend applies the proxy configuration to a managed block of
+// /etc/environment, which pam_env reads for the sessions, such as cron jobs,
+// that don't read environment.d. The file is shared: only the block is
+// managed, and the rest of the file is left untouched. The backend is disabled
+// unless its mode is set.
+type legacyEnvBackend struct {
+	path string
+
+	// socksAllProxy sets all_proxy to the SOCKS proxy when it is the only one set.
+	socksAllProxy bool
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("legacy-environment", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return legacyEnvBackend{path: filepath.Join(opts.root, defaultLegacyEnvConfigPath), socksAllProxy: opts.envSOCKSAllProxy, fs: r}
+	})
+}
+
+func (b legacyEnvBackend) name() string    { return "legacy-environment" }
+func (b legacyEnvBackend) paths() []string { return []string{b.path} }
+func (b legacyEnvBackend) sharesFiles()    {}
+func (b legacyEnvBackend) optIn()          {}
+
+func (b legacyEnvBackend) skipReason(proto protocol) string {
+	if proto == protocolAuto {
+		return "autoconfiguration URLs have no environment variable"
+	}
+	return ""
+}
+
+// apply replaces the managed block of the system environment file with the
+// given proxy settings. If there are no proxy settings to apply, the block is
+// removed, but the file never is.
+func (b legacyEnvBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply legacy environment proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := legacyEnvConfig(prev, envVariables(settings, b.socksAllProxy))
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying legacy environment proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// legacyEnvConfig returns content with the managed block replaced by the given
+// variables, as managedBlockConfig does.
+func legacyEnvConfig(content, variables string) string {
+	return managedBlockConfig(content, variables, legacyEnvVariableRegexp)
+}
@@ -0,0 +1,69 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestLegacyEnvConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost"}
+
+	tests := map[string]struct {
+		fixture  string
+		settings proxy.Settings
+		disabled bool
+	}{
+		"Create file":                                  {settings: set},
+		"Add block at the end of the file":             {fixture: "path_only", settings: set},
+		"Add block to a file without trailing newline": {fixture: "without_trailing_newline", settings: set},
+		"Add block after variables set by hand":        {fixture: "hand_written_proxy", settings: set},
+		"Move previously managed block to the end":     {fixture: "previously_managed", settings: set},
+		"Replace block without end marker":             {fixture: "missing_end_marker", settings: set},
+		"Set all_proxy with a lone SOCKS proxy":        {fixture: "path_only", settings: proxy.Settings{SOCKS: "socks://example.com:1080"}},
+		"Remove managed block":                         {fixture: "previously_managed"},
+		"Remove managed block without end marker":      {fixture: "missing_end_marker"},
+		"Variables set by hand are left untouched":     {fixture: "hand_written_proxy"},
+		"Missing file is not created on removal":       {},
+		"File is left untouched by default":            {fixture: "previously_managed", settings: set, disabled: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+
+			// Only the legacy environment backend is managed.
+			modes := proxy.OnlyBackend("legacy-environment")
+			if tc.disabled {
+				delete(modes, "legacy-environment")
+			}
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(modes))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultLegacyEnvConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultLegacyEnvConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedLibproxyProtocols lists the protocols that are not supported by
+// the libproxy system configuration file.
+var unsupportedLibproxyProtocols = []protocol{protocolSOCKS, protocolAll, protocolAuto}
+
+// libproxyString formats a proxy setting as a variable of the libproxy system
+// configuration file.
+func (p setting) libproxyString() string {
+	if slices.Contains(unsupportedLibproxyProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported libproxy proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	return fmt.Sprintf("%s_PROXY=\"%s\"\n", strings.ToUpper(p.protocol.String()), value)
+}
+
+// libproxyBackend applies the proxy configuration to /etc/sysconfig/proxy,
+// read by the sysconfig module of libproxy, so that the applications using
+// libproxy outside of GNOME and KDE use the same proxies as the rest of the
+// system. As only some distributions' libproxy builds read it, the backend is
+// disabled unless its mode is set.
+type libproxyBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("libproxy", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return libproxyBackend{path: filepath.Join(opts.root, defaultLibproxyConfigPath), fs: r}
+	})
+}
+
+func (b libproxyBackend) name() string    { return "libproxy" }
+func (b libproxyBackend) paths() []string { return []string{b.path} }
+func (b libproxyBackend) optIn()          {}
+
+func (b libproxyBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolSOCKS:
+		return "the libproxy system configuration has no setting for SOCKS proxies"
+	case protocolAuto:
+		return "the libproxy system configuration doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply applies the proxy configuration to the libproxy system configuration
+// file. If there are no proxy settings to apply, the file is removed.
+func (b libproxyBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply libproxy proxy configuration")
+
+	log.Debugf("Applying libproxy proxy configuration to %q", b.path)
+	return applyConfigFile(ctx, b.fs, b.path, libproxyConfig(settings), noSupportedProtocols(settings, unsupportedLibproxyProtocols))
+}
+
+// libproxyConfig returns the formatted libproxy system configuration file to
+// be written. The proxies are only used once enabled.
+func libproxyConfig(settings []setting) string {
+	content := fmt.Sprintln(confHeader)
+	content += "PROXY_ENABLED=\"yes\"\n"
+	for _, p := range sortedSettings(settings) {
+		content += p.libproxyString()
+	}
+
+	return content
+}
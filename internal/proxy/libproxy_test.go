@@ -0,0 +1,44 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestLibproxyConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		settings proxy.Settings
+	}{
+		"Manual proxies are enabled": {settings: proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", FTP: "ftp://example.com:2121", NoProxy: `localhost, "example.net"`}},
+		"Proxy with credentials":     {settings: proxy.Settings{HTTP: "http://user:p@ss@example.com:8080"}},
+		"Unsupported settings are not written": {
+			settings: proxy.Settings{HTTP: "http://example.com:8080", SOCKS: "socks://example.com:1080", Auto: "http://example.com/proxy.pac"},
+		},
+		"File is removed with unsupported settings only": {settings: proxy.Settings{SOCKS: "socks://example.com:1080", Auto: "http://example.com/proxy.pac"}},
+		"File is removed without settings":               {},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			// Only the libproxy backend is managed.
+			modes := proxy.WithBackendModes(proxy.OnlyBackend("libproxy"))
+
+			// A previous configuration is always replaced or removed.
+			err := proxy.New(proxy.WithRoot(root), modes).Apply(proxy.Settings{HTTP: "http://old.example.com:8080"})
+			require.NoError(t, err, "Setup: couldn't apply previous configuration")
+
+			err = proxy.New(proxy.WithRoot(root), modes).Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedLivepatchProtocols lists the protocols that are not supported by
+// the livepatch client.
+var unsupportedLivepatchProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// livepatchProxyKeys maps the supported protocols to the livepatch client
+// configuration keys setting them.
+var livepatchProxyKeys = map[protocol]string{
+	protocolHTTP:  "http-proxy",
+	protocolHTTPS: "https-proxy",
+	protocolNo:    "no-proxy",
+}
+
+// livepatchKeys lists the livepatch client configuration keys managed by the
+// backend, in the order they are passed.
+var livepatchKeys = []string{"http-proxy", "https-proxy", "no-proxy"}
+
+// livepatchBackend applies the proxy configuration to the livepatch client, by
+// running canonical-livepatch config, so that patches are downloaded through
+// the proxy.
+type livepatchBackend struct {
+	cmd []string
+
+	commands *commandRunner
+}
+
+func init() {
+	registerBackend("livepatch", func(opts options, _ *fsRunner, c *commandRunner) backend {
+		cmd := opts.livepatchCmd
+		if cmd == nil {
+			cmd = []string{filepath.Join(opts.root, defaultLivepatchCmdPath)}
+		}
+		return livepatchBackend{cmd: cmd, commands: c}
+	})
+}
+
+func (b livepatchBackend) name() string { return "livepatch" }
+
+// paths returns no file, as the configuration is stored by the livepatch
+// client.
+func (b livepatchBackend) paths() []string { return nil }
+func (b livepatchBackend) externalState()  {}
+
+// unavailableReason returns why the livepatch configuration isn't applied: the
+// canonical-livepatch snap isn't installed.
+func (b livepatchBackend) unavailableReason() string {
+	if _, err := exec.LookPath(b.cmd[0]); err != nil {
+		return fmt.Sprintf("couldn't find an executable for %q", b.cmd[0])
+	}
+	return ""
+}
+
+// credentialsSkipReason always returns a reason, as credentials can't be passed
+// to canonical-livepatch and applying them fails.
+func (b livepatchBackend) credentialsSkipReason(protocol) string {
+	return "canonical-livepatch can't be passed proxy credentials, applying them fails"
+}
+
+func (b livepatchBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "livepatch only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "livepatch doesn't support SOCKS proxies"
+	case protocolAuto:
+		return "livepatch doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply sets the proxy keys of the livepatch client configuration to the given
+// proxy settings, unless they already have these values. If there are no proxy
+// settings to apply, the keys are cleared. Nothing is done if the
+// canonical-livepatch snap isn't installed.
+func (b livepatchBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply livepatch proxy configuration")
+
+	if _, err := exec.LookPath(b.cmd[0]); err != nil {
+		log.Debugf("Couldn't find an executable for %q, skipping livepatch proxy configuration", b.cmd[0])
+		return nil
+	}
+
+	want, err := livepatchConfig(settings)
+	if err != nil {
+		return err
+	}
+	if noSupportedProtocols(settings, unsupportedLivepatchProtocols) {
+		log.Debug("No proxy settings to apply, clearing livepatch proxy keys if they are set")
+	}
+
+	current, err := b.config(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only the keys which differ are passed, an empty value clearing a key.
+	var changes []string
+	for _, key := range livepatchKeys {
+		if want[key] != current[key] {
+			changes = append(changes, fmt.Sprintf("%s=%s", key, want[key]))
+		}
+	}
+	if len(changes) == 0 {
+		log.Debug("livepatch proxy configuration is already up to date")
+		return nil
+	}
+
+	log.Debug("Applying livepatch proxy configuration")
+	args := append(slices.Clone(b.cmd[1:]), append([]string{"config"}, changes...)...)
+	// #nosec G204 - the command and the keys are not controllable by user
+	if out, err := b.commands.run(exec.CommandContext(ctx, b.cmd[0], args...), true); err != nil {
+		return fmt.Errorf("%s failed: %w\n%s", b.cmd[0], err, strings.TrimSpace(redactPasswords(string(out))))
+	}
+	return nil
+}
+
+// livepatchConfig returns the values of the livepatch proxy keys. Proxies
+// with credentials are refused, as the values are passed on the command line.
+func livepatchConfig(settings []setting) (map[string]string, error) {
+	config := make(map[string]string)
+	for _, s := range settings {
+		if slices.Contains(unsupportedLivepatchProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported livepatch proxy setting %q", s.protocol)
+			continue
+		}
+		value := s.escapedURL
+		if s.protocol == protocolNo {
+			value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+		} else if s.url.User != nil {
+			return nil, fmt.Errorf("%s proxy has credentials, which can't be passed to canonical-livepatch", s.protocol)
+		}
+		config[livepatchProxyKeys[s.protocol]] = value
+	}
+	return config, nil
+}
+
+// config returns the values of the proxy keys of the livepatch client
+// configuration, as printed by canonical-livepatch config in the form of
+// "key: value" lines. The unset keys are absent.
+func (b livepatchBackend) config(ctx context.Context) (map[string]string, error) {
+	args := append(slices.Clone(b.cmd[1:]), "config")
+	// #nosec G204 - the command is not controllable by user
+	out, err := b.commands.run(exec.CommandContext(ctx, b.cmd[0], args...), false)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read livepatch configuration: %w", err)
+	}
+
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		key = strings.TrimSpace(key)
+		if !found || !slices.Contains(livepatchKeys, key) {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		if value != "" {
+			config[key] = value
+		}
+	}
+	return config, scanner.Err()
+}
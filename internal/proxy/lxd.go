@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedLXDProtocols lists the protocols that are not supported by LXD and
+// Incus.
+var unsupportedLXDProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// lxdProxyKeys maps the supported protocols to the LXD and Incus server
+// configuration keys setting them.
+var lxdProxyKeys = map[protocol]string{
+	protocolHTTP:  "core.proxy_http",
+	protocolHTTPS: "core.proxy_https",
+	protocolNo:    "core.proxy_ignore_hosts",
+}
+
+// lxdBackend applies the proxy configuration to the server configuration of
+// LXD, through its REST API, so that image downloads go through the proxy.
+type lxdBackend struct {
+	socket string
+	// product is the name of the server in logs and errors.
+	product string
+}
+
+// incusBackend applies the proxy configuration to the server configuration of
+// Incus, the fork of LXD which kept its REST API and proxy keys.
+type incusBackend struct {
+	lxdBackend
+}
+
+func init() {
+	registerBackend("lxd", func(opts options, _ *fsRunner, _ *commandRunner) backend {
+		socket := opts.lxdSocket
+		if socket == "" {
+			socket = filepath.Join(opts.root, defaultLXDSocketPath)
+		}
+		return lxdBackend{socket: socket, product: "LXD"}
+	})
+	registerBackend("incus", func(opts options, _ *fsRunner, _ *commandRunner) backend {
+		socket := opts.incusSocket
+		if socket == "" {
+			socket = filepath.Join(opts.root, defaultIncusSocketPath)
+		}
+		return incusBackend{lxdBackend{socket: socket, product: "Incus"}}
+	})
+}
+
+func (b lxdBackend) name() string   { return "lxd" }
+func (b incusBackend) name() string { return "incus" }
+
+// paths returns no file, as the configuration is stored by the server.
+func (b lxdBackend) paths() []string { return nil }
+func (b lxdBackend) externalState()  {}
+
+// unavailableReason returns why the server configuration isn't applied: the
+// server isn't installed.
+func (b lxdBackend) unavailableReason() string {
+	if _, err := os.Stat(b.socket); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("%s socket %q doesn't exist", b.product, b.socket)
+	}
+	return ""
+}
+
+func (b lxdBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return b.product + " only downloads images over HTTP and HTTPS"
+	case protocolSOCKS:
+		return b.product + " doesn't support SOCKS proxies"
+	case protocolAuto:
+		return b.product + " doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply sets the proxy keys of the server configuration to the given proxy
+// settings, unless they already have these values. If there are no proxy
+// settings to apply, the keys are unset. Nothing is done if the server isn't
+// installed.
+func (b lxdBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply %s proxy configuration", b.product)
+
+	if _, err := os.Stat(b.socket); errors.Is(err, fs.ErrNotExist) {
+		log.Debugf("%s socket %q doesn't exist, skipping %s proxy configuration", b.product, b.socket, b.product)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	client := lxdClient{http: unixSocketHTTPClient(b.socket), product: b.product}
+	current, err := client.serverConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := lxdConfig(settings)
+	if noSupportedProtocols(settings, unsupportedLXDProtocols) {
+		log.Debugf("No proxy settings to apply, unsetting %s proxy keys if they are set", b.product)
+	}
+
+	// Only the keys which differ are sent, an empty value unsetting a key.
+	changes := make(map[string]string)
+	for _, key := range lxdProxyKeys {
+		if want[key] != current[key] {
+			changes[key] = want[key]
+		}
+	}
+	if len(changes) == 0 {
+		log.Debugf("%s proxy configuration is already up to date", b.product)
+		return nil
+	}
+
+	log.Debugf("Applying %s proxy configuration through %q", b.product, b.socket)
+	return client.updateServerConfig(ctx, changes)
+}
+
+// lxdConfig returns the values of the LXD and Incus proxy keys.
+func lxdConfig(settings []setting) map[string]string {
+	config := make(map[string]string)
+	for _, s := range settings {
+		if slices.Contains(unsupportedLXDProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported LXD and Incus proxy setting %q", s.protocol)
+			continue
+		}
+		value := s.escapedURL
+		if s.protocol == protocolNo {
+			value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+		}
+		config[lxdProxyKeys[s.protocol]] = value
+	}
+	return config
+}
+
+// lxdClient is a client of the LXD REST API, shared by Incus.
+type lxdClient struct {
+	http *http.Client
+	// product is the name of the server in errors.
+	product string
+}
+
+// lxdResponse is a response of the LXD REST API.
+type lxdResponse struct {
+	Type     string          `json:"type"`
+	Error    string          `json:"error"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// lxdServer is the part of the LXD server information we use.
+type lxdServer struct {
+	Config map[string]any `json:"config"`
+}
+
+// serverConfig returns the values of the proxy keys of the server
+// configuration. The unset keys are absent.
+func (c lxdClient) serverConfig(ctx context.Context) (map[string]string, error) {
+	resp, err := c.request(ctx, http.MethodGet, "/1.0", nil)
+	if err != nil {
+		return nil, err
+	}
+	var server lxdServer
+	if err := json.Unmarshal(resp.Metadata, &server); err != nil {
+		return nil, fmt.Errorf("invalid %s server information: %w", c.product, err)
+	}
+
+	config := make(map[string]string)
+	for _, key := range lxdProxyKeys {
+		if s, ok := server.Config[key].(string); ok && s != "" {
+			config[key] = s
+		}
+	}
+	return config, nil
+}
+
+// updateServerConfig sets the given keys of the server configuration, keeping
+// the other ones. Empty values unset their key.
+func (c lxdClient) updateServerConfig(ctx context.Context, config map[string]string) error {
+	body, err := json.Marshal(map[string]any{"config": config})
+	if err != nil {
+		return err
+	}
+	_, err = c.request(ctx, http.MethodPatch, "/1.0", body)
+	return err
+}
+
+// request sends a request to the LXD REST API, returning an error if the
+// server answers with an error.
+func (c lxdClient) request(ctx context.Context, method, path string, body []byte) (lxdResponse, error) {
+	// The host is ignored, as requests are sent to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://lxd"+path, bytes.NewReader(body))
+	if err != nil {
+		return lxdResponse{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return lxdResponse{}, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return lxdResponse{}, err
+	}
+	var resp lxdResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return lxdResponse{}, fmt.Errorf("invalid %s response: %w", c.product, err)
+	}
+	if resp.Type == "error" {
+		return lxdResponse{}, fmt.Errorf("%s: %s", c.product, resp.Error)
+	}
+	return resp, nil
+}
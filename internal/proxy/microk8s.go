@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedMicroK8sProtocols lists the protocols that are not supported by
+// the containerd service of MicroK8s.
+var unsupportedMicroK8sProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// microK8sVariableRegexp matches the proxy variables of the managed block of
+// the MicroK8s containerd environment file.
+var microK8sVariableRegexp = regexp.MustCompile(`^export (HTTP|HTTPS|NO)_PROXY=`)
+
+// microK8sString formats a proxy setting as a line of the MicroK8s containerd
+// environment file. Only the uppercase variable is set, as containerd reads it
+// first.
+func (p setting) microK8sString() string {
+	if slices.Contains(unsupportedMicroK8sProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported MicroK8s proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+	return shExport(strings.ToUpper(p.protocol.String())+"_PROXY", value)
+}
+
+// microK8sBackend applies the proxy configuration to a managed block of the
+// containerd-env file of the MicroK8s snap, sourced by its containerd service
+// before it starts, so that the nodes pull images through the proxy. The file
+// is shared: only the block is managed, and the rest of the file is left
+// untouched.
+type microK8sBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("microk8s", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return microK8sBackend{path: filepath.Join(opts.root, defaultMicroK8sConfigPath), fs: r}
+	})
+}
+
+func (b microK8sBackend) name() string    { return "microk8s" }
+func (b microK8sBackend) paths() []string { return []string{b.path} }
+func (b microK8sBackend) sharesFiles()    {}
+
+func (b microK8sBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "MicroK8s only pulls images over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "containerd has no environment variable for SOCKS proxies"
+	case protocolAuto:
+		return "containerd doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the MicroK8s configuration isn't applied:
+// MicroK8s isn't installed.
+func (b microK8sBackend) unavailableReason() string {
+	if _, err := os.Stat(filepath.Dir(b.path)); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("MicroK8s arguments directory %q doesn't exist", filepath.Dir(b.path))
+	}
+	return ""
+}
+
+// apply replaces the managed block of the MicroK8s containerd environment file
+// with the given proxy settings. If there are no proxy settings to apply, the
+// block is removed, but the file never is. Nothing is done if MicroK8s isn't
+// installed. The containerd service of MicroK8s must be restarted for the
+// configuration to take effect.
+func (b microK8sBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply MicroK8s proxy configuration")
+
+	if _, err := os.Stat(filepath.Dir(b.path)); errors.Is(err, fs.ErrNotExist) {
+		log.Debugf("MicroK8s arguments directory %q doesn't exist, skipping MicroK8s proxy configuration", filepath.Dir(b.path))
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var variables string
+	for _, p := range sortedSettings(settings) {
+		variables += p.microK8sString()
+	}
+	content := managedBlockConfig(prev, variables, microK8sVariableRegexp)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying MicroK8s proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// BackendModeManaged applies the settings to the backend. It is the default,
+	// except for the opt-in backends.
+	BackendModeManaged = "managed"
+	// BackendModeRemoveOnly removes the files of the backend on every Apply
+	// call, whatever the settings, so that it can be cleaned up without being
+	// configured anymore.
+	BackendModeRemoveOnly = "remove-only"
+	// BackendModeDisabled leaves the files of the backend untouched.
+	BackendModeDisabled = "disabled"
+)
+
+// BackendModes lists the supported backend modes.
+var BackendModes = []string{BackendModeManaged, BackendModeRemoveOnly, BackendModeDisabled}
+
+// BackendNames lists the names of every backend, as used in the configuration,
+// in the order they are applied. See CompiledBackends for the ones available in
+// this build.
+var BackendNames = []string{"environment", "legacy-environment", "pam-env", "systemd", "profile", "apt", "gsettings", "dconf", "gdm", "kde", "libproxy", "containerd", "fwupd", "podman", "git", "pip", "gradle", "r", "rubygems", "cargo", "subversion", "conda", "microk8s", "curl", "snapd", "lxd", "incus", "livepatch", "cntlm", "custom"}
+
+// BackendResult is the outcome of an Apply call for a backend.
+type BackendResult struct {
+	Backend string `json:"backend"`
+	// Mode is the backend mode which governed the outcome.
+	Mode string `json:"mode"`
+	// AlreadyClean is true if the configuration of the backend was to be
+	// removed, but none of its files existed.
+	AlreadyClean bool `json:"already_clean,omitempty"`
+}
+
+// BackendStatus describes a backend compiled in.
+type BackendStatus struct {
+	Name string `json:"name"`
+	// Mode is the mode of the backend. It is disabled unless managed or
+	// remove-only.
+	Mode string `json:"mode"`
+	// Available is false if the prerequisites of the backend aren't met on
+	// this system, such as the program it configures being installed. The
+	// backend is then skipped.
+	Available bool `json:"available"`
+	// Reason is why the backend isn't available.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Backends returns the status of the backends compiled in, in the order they
+// are applied.
+func (p Proxy) Backends() (statuses []BackendStatus) {
+	for _, b := range p.backends {
+		status := BackendStatus{Name: b.name(), Mode: p.backendMode(b), Available: true}
+		if pb, ok := b.(probedBackend); ok {
+			if status.Reason = pb.unavailableReason(); status.Reason != "" {
+				status.Available = false
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// CheckBackendMode returns an error if backend isn't the name of a backend
+// available in this build or mode isn't a supported backend mode.
+func CheckBackendMode(backend, mode string) error {
+	if err := CheckBackend(backend); err != nil {
+		return err
+	}
+	if !slices.Contains(BackendModes, mode) {
+		return fmt.Errorf("unknown mode %q, must be one of %s", mode, strings.Join(BackendModes, ", "))
+	}
+	return nil
+}
+
+// backendMode returns the mode of the given backend, managed if unset, or
+// disabled for the opt-in backends.
+func (p Proxy) backendMode(b backend) string {
+	if mode, found := p.backendModes[b.name()]; found {
+		return mode
+	}
+	if _, optIn := b.(optInBackend); optIn {
+		return BackendModeDisabled
+	}
+	return BackendModeManaged
+}
+
+// selectBackends returns a copy of p whose backends other than the ones of the
+// given names are disabled. Every backend is selected if names is nil. It
+// returns an error if a backend isn't available or is already disabled.
+func (p Proxy) selectBackends(names []string) (Proxy, error) {
+	if names == nil {
+		return p, nil
+	}
+	if len(names) == 0 {
+		return p, errors.New("no backend selected")
+	}
+	for _, name := range names {
+		if err := CheckBackend(name); err != nil {
+			return p, err
+		}
+	}
+
+	modes := make(map[string]string)
+	for _, b := range p.backends {
+		mode := p.backendMode(b)
+		if !slices.Contains(names, b.name()) {
+			mode = BackendModeDisabled
+		} else if mode == BackendModeDisabled {
+			return p, fmt.Errorf("the %s backend is disabled and can't be selected", b.name())
+		}
+		modes[b.name()] = mode
+	}
+	p.backendModes = modes
+	return p, nil
+}
+
+// managedBackends returns the backends to which the settings are applied.
+func (p Proxy) managedBackends() (backends []backend) {
+	for _, b := range p.backends {
+		if p.backendMode(b) == BackendModeManaged {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// backendResults returns the mode of each backend, in the order of the
+// backends, before applying the given settings, per-host proxies and NTLM
+// proxy. The backends whose configuration is to be removed are already clean if
+// none of their files exist, or if none of their shared files contain managed
+// entries. The backends without files are never reported as already clean.
+func (p Proxy) backendResults(settings []setting, hostProxies []hostProxy, ntlm *ntlmProxy) (results []BackendResult) {
+	for _, b := range p.backends {
+		r := BackendResult{Backend: b.name(), Mode: p.backendMode(b)}
+		_, perHost := b.(hostProxiesBackend)
+		empty := len(settings) == 0 && (!perHost || len(hostProxies) == 0)
+		if _, authenticates := b.(ntlmBackend); authenticates {
+			empty = ntlm == nil
+		}
+		if r.Mode == BackendModeRemoveOnly || (r.Mode == BackendModeManaged && empty) {
+			_, shared := b.(sharedFilesBackend)
+			r.AlreadyClean = len(b.paths()) > 0
+			for _, path := range b.paths() {
+				if shared {
+					if content, err := previousConfig(path); err == nil && managedContent(content) {
+						r.AlreadyClean = false
+					}
+					continue
+				}
+				if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+					r.AlreadyClean = false
+				}
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
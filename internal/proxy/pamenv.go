@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+// pamEnvVariableRegexp matches the proxy variables of the managed block of the
+// pam_env configuration file.
+var pamEnvVariableRegexp = regexp.MustCompile(`^(?i)(http|https|ftp|socks|no|all)_proxy\s`)
+
+// pamEnvExport returns the pam_env configuration line setting a variable by
+// default. The value is double-quoted, and the characters pam_env would expand
+// or unescape are escaped.
+func pamEnvExport(name, value string) string {
+	return fmt.Sprintf("%s DEFAULT=\"%s\"\n", name, strings.NewReplacer(`\`, `\\`, "$", `\$`, "@", `\@`).Replace(value))
+}
+
+// pamEnvBackend applies the proxy configuration to a managed block of
+// /etc/security/pam_env.conf, so that the sessions opened through PAM without
+// a systemd user manager, such as cron jobs, some display managers and SSH
+// sessions, get the proxy variables. The file is shared: only the block is
+// managed, and the rest of the file is left untouched. The backend is disabled
+// unless its mode is set.
+type pamEnvBackend struct {
+	path string
+
+	// socksAllProxy sets all_proxy to the SOCKS proxy when it is the only one set.
+	socksAllProxy bool
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("pam-env", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return pamEnvBackend{path: filepath.Join(opts.root, defaultPamEnvConfigPath), socksAllProxy: opts.envSOCKSAllProxy, fs: r}
+	})
+}
+
+func (b pamEnvBackend) name() string    { return "pam-env" }
+func (b pamEnvBackend) paths() []string { return []string{b.path} }
+func (b pamEnvBackend) sharesFiles()    {}
+func (b pamEnvBackend) optIn()          {}
+
+func (b pamEnvBackend) skipReason(proto protocol) string {
+	if proto == protocolAuto {
+		return "autoconfiguration URLs have no environment variable"
+	}
+	return ""
+}
+
+// apply replaces the managed block of the pam_env configuration file with the
+// given proxy settings. If there are no proxy settings to apply, the block is
+// removed, but the file never is.
+func (b pamEnvBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply pam_env proxy configuration")
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := managedBlockConfig(prev, pamEnvVariables(settings, b.socksAllProxy), pamEnvVariableRegexp)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying pam_env proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// pamEnvVariables returns the pam_env configuration lines setting the proxy
+// variables, in upper and lower case.
+func pamEnvVariables(settings []setting, socksAllProxy bool) string {
+	var content string
+	for _, p := range envSettings(settings, socksAllProxy) {
+		content += p.profileString(pamEnvExport)
+	}
+
+	return content
+}
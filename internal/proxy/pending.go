@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+// pendingStateFile is the state file recording the content rendered by the
+// backends whose prerequisites were missing.
+const pendingStateFile = "pending.json"
+
+// PendingContent is content rendered by a backend which couldn't be installed
+// because a prerequisite was missing.
+type PendingContent struct {
+	Backend string `json:"backend"`
+	// Reason is why the content couldn't be installed.
+	Reason string `json:"reason"`
+	// Content is the rendered content, with credentials.
+	Content string `json:"content"`
+}
+
+// deferringBackend is a backend able to install its rendered content later on,
+// once its missing prerequisites are met.
+type deferringBackend interface {
+	backend
+
+	// install installs the given rendered content. It returns a
+	// prerequisiteError if a prerequisite is still missing.
+	install(ctx context.Context, content string) error
+}
+
+// prerequisiteError is returned by backends which can't install their rendered
+// content because a prerequisite is missing.
+type prerequisiteError struct {
+	err error
+	// content is the rendered content which couldn't be installed.
+	content string
+	// skip is true if the backend doesn't fail because of it.
+	skip bool
+}
+
+func (e prerequisiteError) Error() string { return e.err.Error() }
+func (e prerequisiteError) Unwrap() error { return e.err }
+
+// pendingSet collects the content which couldn't be installed during an Apply
+// call.
+type pendingSet struct {
+	mu      sync.Mutex
+	entries []PendingContent
+}
+
+// reset forgets about the content collected so far.
+func (s *pendingSet) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = nil
+}
+
+// collect records the content of the given prerequisiteError returned by b, if
+// err is one. It returns nil if the backend is skipped, and err otherwise.
+func (s *pendingSet) collect(b backend, err error) error {
+	var prereqErr prerequisiteError
+	if !errors.As(err, &prereqErr) {
+		return err
+	}
+
+	log.Warningf("Keeping the %s configuration pending until its prerequisites are met: %v", b.name(), prereqErr)
+	s.mu.Lock()
+	s.entries = append(s.entries, PendingContent{Backend: b.name(), Reason: prereqErr.Error(), Content: prereqErr.content})
+	s.mu.Unlock()
+
+	if prereqErr.skip {
+		return nil
+	}
+	return err
+}
+
+// list returns the content collected since the last reset.
+func (s *pendingSet) list() []PendingContent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PendingContent(nil), s.entries...)
+}
+
+// RetryPending installs the content rendered by the last Apply call for the
+// backends whose prerequisites were missing, if they are met now. The content
+// still pending is kept for the next call, unless a newer Apply call
+// supersedes it. Nothing is pending if no state directory is set.
+func (p Proxy) RetryPending() (err error) {
+	defer decorate.OnError(&err, "couldn't install pending proxy configuration")
+
+	defer p.lock()()
+
+	ctx, cancel := p.fsContext()
+	defer cancel()
+
+	return p.retryPending(ctx)
+}
+
+// retryPending installs the pending content whose backend prerequisites are
+// met, and records the content still pending.
+func (p Proxy) retryPending(ctx context.Context) error {
+	pending, err := p.loadPending()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	var remaining []PendingContent
+	var errs error
+	for _, entry := range pending {
+		var b deferringBackend
+		for _, managed := range p.managedBackends() {
+			if d, ok := managed.(deferringBackend); ok && managed.name() == entry.Backend {
+				b = d
+			}
+		}
+		if b == nil {
+			log.Infof("Dropping pending %s configuration: the backend isn't managed anymore", entry.Backend)
+			continue
+		}
+
+		err := b.install(ctx, entry.Content)
+		var prereqErr prerequisiteError
+		if errors.As(err, &prereqErr) {
+			log.Infof("The %s configuration is still pending: %v", entry.Backend, prereqErr)
+			entry.Reason = prereqErr.Error()
+			remaining = append(remaining, entry)
+			continue
+		} else if err != nil {
+			errs = errors.Join(errs, err)
+			remaining = append(remaining, entry)
+			continue
+		}
+		log.Infof("Installed pending %s configuration", entry.Backend)
+	}
+
+	return errors.Join(errs, p.savePending(remaining))
+}
+
+// loadPending returns the pending content recorded in the state directory.
+func (p Proxy) loadPending() ([]PendingContent, error) {
+	if p.state == nil {
+		return nil, nil
+	}
+
+	var pending []PendingContent
+	if err := p.state.Load(pendingStateFile, &pending); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// savePending records the given pending content in the state directory,
+// replacing the previous one.
+func (p Proxy) savePending(pending []PendingContent) error {
+	if p.state == nil {
+		return nil
+	}
+	if len(pending) == 0 {
+		// Don't create the state file until something is pending.
+		var previous []PendingContent
+		if err := p.state.Load(pendingStateFile, &previous); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		pending = []PendingContent{}
+	}
+	return p.state.Save(pendingStateFile, pending)
+}
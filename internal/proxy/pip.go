@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedPipProtocols lists the protocols that are not supported by pip.
+var unsupportedPipProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolNo, protocolAuto}
+
+// pipProxyRegexp matches the proxy option of an INI section, whatever its case.
+var pipProxyRegexp = regexp.MustCompile(`(?i)^proxy\s*[=:]`)
+
+// pipBackend applies the proxy configuration to the proxy option of the
+// [global] section of /etc/pip.conf, the site-wide pip configuration. The file
+// is shared: only the proxy option is managed, and the rest of the file is left
+// untouched. The backend is only applied if pip is installed.
+type pipBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("pip", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return pipBackend{root: opts.root, path: filepath.Join(opts.root, defaultPipConfigPath), fs: r}
+	})
+}
+
+func (b pipBackend) name() string    { return "pip" }
+func (b pipBackend) paths() []string { return []string{b.path} }
+func (b pipBackend) sharesFiles()    {}
+
+func (b pipBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "pip only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "pip only supports SOCKS proxies with an optional dependency"
+	case protocolNo:
+		return "pip has no setting for hosts bypassing the proxy"
+	case protocolAuto:
+		return "pip doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the pip configuration isn't applied: pip isn't
+// installed.
+func (b pipBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "pip", "pip3")
+}
+
+// apply replaces the proxy option of the [global] section with the given proxy
+// settings. If there are no proxy settings to apply, the option is removed, but
+// the file never is. Nothing is done if pip isn't installed.
+func (b pipBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply pip proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping pip proxy configuration", reason)
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := pipConfig(prev, settings)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying pip proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// pipConfig returns content with the proxy option of the [global] section
+// replaced by the given settings. pip has a single proxy option for every
+// request: it is set to the HTTPS proxy if there is one, as package indexes
+// are reached over HTTPS, and to the HTTP proxy otherwise.
+func pipConfig(content string, settings []setting) string {
+	var proxy string
+	for _, s := range settings {
+		if slices.Contains(unsupportedPipProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported pip proxy setting %q", s.protocol)
+			continue
+		}
+		if s.protocol == protocolHTTPS || proxy == "" {
+			proxy = s.escapedURL
+		}
+	}
+	var option string
+	if proxy != "" {
+		option = fmt.Sprintf("proxy = %s\n", proxy)
+	}
+	return replaceINIOptions(content, "global", pipProxyRegexp, option)
+}
+
+// replaceINIOptions returns content with the options of the given section
+// matching option replaced by the given lines, preceded by the managed entries
+// header. The other lines are kept verbatim. If lines is empty, the options
+// are only removed. Otherwise, the section is added if needed.
+func replaceINIOptions(content, section string, option *regexp.Regexp, lines string) string {
+	return replaceSectionOptions(content, section, option, lines, true)
+}
+
+// replaceSectionOptions replaces the options of a section as replaceINIOptions
+// does. If continuation is true, the indented lines following a replaced
+// option are part of its value, and are removed with it.
+func replaceSectionOptions(content, section string, option *regexp.Regexp, lines string, continuation bool) string {
+	var block string
+	if lines != "" {
+		block = managedEntriesHeader + "\n" + lines
+	}
+
+	current := strings.SplitAfter(content, "\n")
+	start, end := configSection(current, section)
+	if start < 0 {
+		if block == "" {
+			return content
+		}
+		if content != "" {
+			content = strings.TrimRight(content, "\n") + "\n\n"
+		}
+		return content + "[" + section + "]\n" + block
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(current); i++ {
+		line := strings.TrimRight(current[i], "\r\n")
+		if i > start && i < end {
+			if line == managedEntriesHeader {
+				continue
+			}
+			if option.MatchString(line) {
+				// Skip the continuation lines of the value as well.
+				for continuation && i+1 < end && strings.TrimSpace(current[i+1]) != "" && strings.TrimLeft(current[i+1], " \t") != current[i+1] {
+					i++
+				}
+				continue
+			}
+		}
+
+		out.WriteString(current[i])
+		if i == start && block != "" {
+			if !strings.HasSuffix(current[i], "\n") {
+				out.WriteString("\n")
+			}
+			out.WriteString(block)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,68 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestPipConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost"}
+
+	tests := map[string]struct {
+		fixture      string
+		settings     proxy.Settings
+		notInstalled bool
+	}{
+		"Create file":                                   {settings: set},
+		"HTTP proxy is used without HTTPS proxy":        {settings: proxy.Settings{HTTP: "http://example.com:8080"}},
+		"Add global section after the other ones":       {fixture: "no_global_section", settings: set},
+		"Add proxy option to the global section":        {fixture: "global_with_options", settings: set},
+		"Add proxy option to a section without newline": {fixture: "global_without_trailing_newline", settings: set},
+		"Replace proxy option set by hand":              {fixture: "hand_written_proxy", settings: set},
+		"Replace previously managed proxy option":       {fixture: "previously_managed", settings: set},
+		"Remove managed proxy option":                   {fixture: "previously_managed"},
+		"Remove proxy option set by hand":               {fixture: "hand_written_proxy"},
+		"File without proxy option is left untouched":   {fixture: "global_without_trailing_newline"},
+		"Missing file is not created on removal":        {},
+		"Nothing is done if pip isn't installed":        {fixture: "global_with_options", settings: set, notInstalled: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+			if !tc.notInstalled {
+				installPrograms(t, root, "pip")
+			}
+
+			// Only the pip backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("pip")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultPipConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultPipConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
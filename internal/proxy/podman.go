@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedPodmanProtocols lists the protocols that are not supported by podman.
+var unsupportedPodmanProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// podmanProxyVariables lists the variables of the engine environment managed
+// by the backend, whatever their case.
+var podmanProxyVariables = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+var (
+	// tomlTableRegexp matches the header of a TOML table or array of tables,
+	// or of an INI section.
+	tomlTableRegexp = regexp.MustCompile(`^\s*(\[\[?)\s*([^\]]*?)\s*\]\]?\s*(#.*)?$`)
+	// podmanEnvRegexp matches the start of the env option.
+	podmanEnvRegexp = regexp.MustCompile(`^\s*env\s*=`)
+)
+
+// tomlEscaper escapes a value to be written in a TOML basic string.
+var tomlEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// podmanString formats a proxy setting as an entry of the engine environment.
+func (p setting) podmanString() string {
+	if slices.Contains(unsupportedPodmanProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported podman proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	return fmt.Sprintf(`"%s_PROXY=%s"`, strings.ToUpper(p.protocol.String()), tomlEscaper.Replace(value))
+}
+
+// podmanBackend applies the proxy configuration to the environment of the
+// podman engine, set by the env option of the [engine] table of
+// /etc/containers/containers.conf. The file is shared: only the proxy entries
+// of env are managed, and the rest of the file is left untouched. The backend
+// is only applied if podman is installed.
+type podmanBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("podman", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return podmanBackend{root: opts.root, path: filepath.Join(opts.root, defaultPodmanConfigPath), fs: r}
+	})
+}
+
+func (b podmanBackend) name() string    { return "podman" }
+func (b podmanBackend) paths() []string { return []string{b.path} }
+func (b podmanBackend) sharesFiles()    {}
+
+func (b podmanBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "podman only pulls images over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "podman has no environment variable for SOCKS proxies"
+	case protocolAuto:
+		return "podman doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the podman configuration isn't applied: podman
+// isn't installed.
+func (b podmanBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "podman")
+}
+
+// apply replaces the proxy entries of the engine environment with the given
+// proxy settings. If there are no proxy settings to apply, the proxy entries
+// are removed, but the file never is. Nothing is done if podman isn't
+// installed.
+func (b podmanBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply podman proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping podman proxy configuration", reason)
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content, err := podmanConfig(prev, settings)
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.path, err)
+	}
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying podman proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// podmanConfig returns content with the proxy entries of the env option of the
+// [engine] table replaced by the given settings. The other lines, and the
+// other entries of env, are kept verbatim. The table and the option are added
+// if needed.
+func podmanConfig(content string, settings []setting) (string, error) {
+	var managed []string
+	for _, s := range sortedSettings(settings) {
+		if entry := s.podmanString(); entry != "" {
+			managed = append(managed, entry)
+		}
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	start, end := configSection(lines, "engine")
+	if start < 0 {
+		if len(managed) == 0 {
+			return content, nil
+		}
+		if content != "" {
+			content = strings.TrimRight(content, "\n") + "\n\n"
+		}
+		return content + "[engine]\n" + podmanEnvBlock(nil, managed), nil
+	}
+
+	// The managed entries header is only found right before env.
+	var markers []int
+	envStart, envEnd := -1, -1
+	// trailing is the comment following env, kept once replaced.
+	var trailing string
+	var kept []string
+	var hadProxyEntries bool
+	for i := start + 1; i < end; i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		if line == managedEntriesHeader {
+			markers = append(markers, i)
+			continue
+		}
+		if envStart >= 0 || !podmanEnvRegexp.MatchString(line) {
+			continue
+		}
+
+		_, value, _ := strings.Cut(strings.Join(lines[i:end], ""), "=")
+		entries, n, err := parseTOMLStringArray(value)
+		if err != nil {
+			return "", fmt.Errorf("couldn't parse env option of the [engine] table at line %d: %w", i+1, err)
+		}
+		envStart, envEnd = i, i+strings.Count(value[:n], "\n")+1
+		trailing = strings.TrimRight(strings.SplitN(value[n:], "\n", 2)[0], "\r")
+		if t := strings.TrimSpace(trailing); t != "" && !strings.HasPrefix(t, "#") {
+			return "", fmt.Errorf("unexpected %q after env option of the [engine] table at line %d", t, envEnd)
+		}
+
+		for _, e := range entries {
+			name, _, _ := strings.Cut(e.value, "=")
+			if slices.Contains(podmanProxyVariables, strings.ToUpper(name)) {
+				hadProxyEntries = true
+				continue
+			}
+			kept = append(kept, e.raw)
+		}
+		i = envEnd - 1
+	}
+
+	// Leave env untouched if it has no proxy entries to replace.
+	var block string
+	replaceEnv := envStart >= 0 && (hadProxyEntries || len(managed) > 0)
+	if envStart < 0 || replaceEnv {
+		block = podmanEnvBlock(kept, managed)
+	}
+	if block != "" && strings.TrimSpace(trailing) != "" {
+		block = strings.TrimSuffix(block, "\n") + trailing + "\n"
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(lines); i++ {
+		switch {
+		case slices.Contains(markers, i):
+			continue
+		case i == envStart && replaceEnv:
+			out.WriteString(block)
+			i = envEnd - 1
+			continue
+		}
+		out.WriteString(lines[i])
+		if i == start && envStart < 0 {
+			if !strings.HasSuffix(lines[i], "\n") {
+				out.WriteString("\n")
+			}
+			out.WriteString(block)
+		}
+	}
+	return out.String(), nil
+}
+
+// configSection returns the index of the header line of the [name] table of a
+// TOML file, or section of an INI file, and the index of the line following its
+// last line, or -1 if there is none.
+func configSection(lines []string, name string) (start, end int) {
+	start = -1
+	for i, line := range lines {
+		m := tomlTableRegexp.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if m == nil {
+			continue
+		}
+		if start >= 0 {
+			return start, i
+		}
+		if m[1] == "[" && m[2] == name {
+			start = i
+		}
+	}
+	return start, len(lines)
+}
+
+// podmanEnvBlock returns the env option setting the kept entries, verbatim,
+// followed by the managed ones, preceded by the managed entries header if
+// there are any. It returns an empty string if there is no entry.
+func podmanEnvBlock(kept, managed []string) string {
+	entries := append(slices.Clone(kept), managed...)
+	if len(entries) == 0 {
+		return ""
+	}
+
+	var block string
+	if len(managed) > 0 {
+		block = managedEntriesHeader + "\n"
+	}
+	return block + fmt.Sprintf("env = [%s]\n", strings.Join(entries, ", "))
+}
+
+// tomlString is a string of a TOML array, with its raw text.
+type tomlString struct {
+	raw   string
+	value string
+}
+
+// parseTOMLStringArray parses the TOML array of single-line strings at the
+// start of s, after optional spaces. It returns the strings and the length of
+// s up to the closing bracket.
+func parseTOMLStringArray(s string) (strs []tomlString, n int, err error) {
+	i := len(s) - len(strings.TrimLeft(s, " \t"))
+	if i >= len(s) || s[i] != '[' {
+		return nil, 0, errors.New("not an array")
+	}
+	i++
+
+	for {
+		// Skip separators and comments.
+		for i < len(s) && strings.ContainsRune(" \t\r\n,#", rune(s[i])) {
+			if s[i] == '#' {
+				for i < len(s) && s[i] != '\n' {
+					i++
+				}
+				continue
+			}
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, errors.New("unterminated array")
+		}
+
+		switch s[i] {
+		case ']':
+			return strs, i + 1, nil
+		case '"', '\'':
+			if strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''") {
+				return nil, 0, errors.New("multi-line strings are not supported")
+			}
+			value, n, err := parseTOMLString(s[i:])
+			if err != nil {
+				return nil, 0, err
+			}
+			strs = append(strs, tomlString{raw: s[i : i+n], value: value})
+			i += n
+		default:
+			return nil, 0, fmt.Errorf("unexpected %q in array of strings", s[i])
+		}
+	}
+}
+
+// parseTOMLString parses the basic or literal TOML string at the start of s,
+// returning its value and its length.
+func parseTOMLString(s string) (value string, n int, err error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, errors.New("unterminated string")
+		case c == '\\' && quote == '"':
+			i++
+			if i >= len(s) {
+				return "", 0, errors.New("unterminated string")
+			}
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'b', 't', 'n', 'f', 'r':
+				b.WriteByte(map[byte]byte{'b': '\b', 't': '\t', 'n': '\n', 'f': '\f', 'r': '\r'}[s[i]])
+			case 'u', 'U':
+				size := 4
+				if s[i] == 'U' {
+					size = 8
+				}
+				if i+size >= len(s) {
+					return "", 0, errors.New("unterminated string")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape sequence %q", s[i-1:i+1+size])
+				}
+				b.WriteRune(rune(r))
+				i += size
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence %q", s[i-1:i+1])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
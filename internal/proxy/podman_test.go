@@ -0,0 +1,80 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestPodmanConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", FTP: "ftp://example.com:2121", NoProxy: "localhost, 127.0.0.1"}
+
+	tests := map[string]struct {
+		fixture      string
+		settings     proxy.Settings
+		notInstalled bool
+
+		wantErr bool
+	}{
+		"Create file":                                    {settings: set},
+		"Add engine table after the other ones":          {fixture: "no_engine_table", settings: set},
+		"Add env option to the engine table":             {fixture: "engine_without_env", settings: set},
+		"Keep other entries of env":                      {fixture: "env_with_other_entries", settings: set},
+		"Replace proxy entries set by hand":              {fixture: "multiline_env_with_proxy_entries", settings: set},
+		"Replace previously managed entries":             {fixture: "previously_managed_entries", settings: set},
+		"Only the engine table is changed":               {fixture: "other_tables", settings: set},
+		"Remove managed entries, keeping the other ones": {fixture: "previously_managed_entries"},
+		"Remove env option without other entries":        {fixture: "only_proxy_entries"},
+		"Remove proxy entries set by hand":               {fixture: "multiline_env_with_proxy_entries"},
+		"File without proxy entries is left untouched":   {fixture: "no_proxy_entries"},
+		"Missing file is not created on removal":         {},
+		"Nothing is done if podman isn't installed":      {fixture: "no_proxy_entries", settings: set, notInstalled: true},
+
+		"Error on invalid env option, file is left untouched": {fixture: "invalid_env", settings: set, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			dir := filepath.Join(root, filepath.Dir(proxy.DefaultPodmanConfigPath))
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), dir, nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+			if !tc.notInstalled {
+				installPrograms(t, root, "podman")
+			}
+
+			// Only the podman backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("podman")))
+			err := p.Apply(tc.settings)
+			if tc.wantErr {
+				require.Error(t, err, "Apply should have failed but didn't")
+			} else {
+				require.NoError(t, err, "Apply failed but shouldn't have")
+			}
+
+			// Applying the same settings again doesn't change anything.
+			if !tc.wantErr {
+				first, err := os.ReadFile(filepath.Join(root, proxy.DefaultPodmanConfigPath))
+				if err == nil {
+					require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+					second, err := os.ReadFile(filepath.Join(root, proxy.DefaultPodmanConfigPath))
+					require.NoError(t, err, "Configuration should still exist after the second Apply")
+					require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+				}
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicyError is returned when a proxy setting is refused by the daemon policy.
+type PolicyError struct {
+	Host string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("proxy host %q is not in the list of allowed proxy hosts", e.Host)
+}
+
+// checkAllowedHosts returns a PolicyError if any proxy host in settings isn't
+// matched by the allowed host patterns. An empty list of patterns allows all hosts.
+func checkAllowedHosts(settings []setting, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	for _, s := range settings {
+		var host string
+		switch s.protocol {
+		case protocolNo:
+			continue
+		case protocolAuto:
+			u, err := url.Parse(s.escapedURL)
+			if err != nil {
+				return err
+			}
+			host = u.Hostname()
+		default:
+			host = s.url.Hostname()
+		}
+
+		if !hostAllowed(host, allowed) {
+			log.Warningf("Refusing %s proxy setting: host %q is not allowed by policy", s.protocol, host)
+			return PolicyError{Host: host}
+		}
+	}
+
+	return nil
+}
+
+// hostAllowed returns true if host matches any of the given patterns, which can
+// be exact hosts, wildcards (*.example.com) or CIDRs (10.0.0.0/8).
+func hostAllowed(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	// Zone identifiers of IPv6 link-local addresses are ignored when matching CIDRs.
+	addr, _, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(addr)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if suffix, found := strings.CutPrefix(pattern, "*."); found {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+
+		if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// previewFilesystem records the filesystem mutations of the backends in memory,
+// on top of the files of the system, which are left untouched.
+type previewFilesystem struct {
+	mu sync.Mutex
+	// files maps the written paths to their content, or to nil once removed.
+	files map[string]*string
+}
+
+func newPreviewFilesystem() *previewFilesystem {
+	return &previewFilesystem{files: make(map[string]*string)}
+}
+
+// read returns the content of path, as written in memory or on the system.
+// The caller must hold the lock.
+func (f *previewFilesystem) read(path string) (*string, error) {
+	if content, found := f.files[path]; found {
+		if content == nil {
+			return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+		}
+		return content, nil
+	}
+
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content := string(data)
+	return &content, nil
+}
+
+func (f *previewFilesystem) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if content, found := f.files[name]; found && content == nil || !found && !existsOnSystem(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	f.files[name] = nil
+	return nil
+}
+
+// MkdirAll does nothing, as the directories of the written files are implied.
+func (f *previewFilesystem) MkdirAll(string, fs.FileMode) error { return nil }
+
+func (f *previewFilesystem) WriteFile(name string, data []byte, _ fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content := string(data)
+	f.files[name] = &content
+	return nil
+}
+
+func (f *previewFilesystem) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, err := f.read(oldpath)
+	if err != nil {
+		return err
+	}
+	f.files[newpath] = content
+	f.files[oldpath] = nil
+	return nil
+}
+
+// existsOnSystem returns true if path exists on the system.
+func existsOnSystem(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// Preview returns the unified diffs of the files an Apply call with the given
+// settings would change, keyed by path, without changing anything on the
+// system. Passwords are masked in the diffs. The backends configured through an
+// API or a command rather than files, like snapd, aren't previewed.
+func (p Proxy) Preview(s Settings) (diffs map[string]string, err error) {
+	defer decorate.OnError(&err, "couldn't preview proxy configuration")
+
+	diffs = make(map[string]string)
+
+	noop := p.emptyMeansNoop
+	if s.EmptyMeansNoop != nil {
+		noop = *s.EmptyMeansNoop
+	}
+	if noop && s.empty() {
+		return diffs, nil
+	}
+
+	p, err = p.selectBackends(s.Backends)
+	if err != nil {
+		return nil, err
+	}
+	settings, hostProxies, ntlm, err := p.parseSettings(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't read files an Apply call is writing.
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+
+	ctx, cancel := p.fsContext()
+	defer cancel()
+
+	opts := p.backendOpts
+	opts.gsettingsVerify = false
+	fsys := newPreviewFilesystem()
+
+	var paths []string
+	for _, b := range newBackends(opts, newFSRunner(fsys), &commandRunner{dryRun: true}) {
+		if _, ok := b.(externalStateBackend); ok {
+			log.Infof("The %s backend isn't previewed, as it isn't configured through files", b.name())
+			continue
+		}
+
+		var applyErr error
+		switch p.backendMode(b) {
+		case BackendModeRemoveOnly:
+			applyErr = b.apply(ctx, nil)
+		case BackendModeDisabled:
+			continue
+		default:
+			applyErr = applyBackend(ctx, b, settings, hostProxies, ntlm, nil)
+		}
+
+		var prereqErr prerequisiteError
+		if errors.As(applyErr, &prereqErr) {
+			log.Infof("The %s configuration would be kept pending: %v", b.name(), prereqErr)
+			continue
+		}
+		err = errors.Join(err, applyErr)
+		paths = append(paths, b.paths()...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	for path, content := range fsys.files {
+		if !slices.Contains(paths, path) {
+			continue
+		}
+		diff, err := fileDiff(path, content)
+		if err != nil {
+			return nil, err
+		}
+		if diff != "" {
+			diffs[path] = diff
+		}
+	}
+	return diffs, nil
+}
+
+// fileDiff returns the unified diff between the content of path on the system
+// and the given content, nil meaning the file is removed, with passwords masked.
+// It returns an empty string if they are the same.
+func fileDiff(path string, content *string) (string, error) {
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	diff := difflib.UnifiedDiff{FromFile: path, ToFile: path, Context: 3}
+	if err != nil {
+		diff.FromFile = os.DevNull
+	} else {
+		diff.A = difflib.SplitLines(redactPasswords(string(data)))
+	}
+	if content == nil {
+		diff.ToFile = os.DevNull
+	} else {
+		diff.B = difflib.SplitLines(redactPasswords(*content))
+	}
+	return difflib.GetUnifiedDiffString(diff)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// profileString formats a proxy setting as the commands or lines exporting its
+// environment variables, using export to format each of them.
+func (p setting) profileString(export func(name, value string) string) string {
+	if slices.Contains(unsupportedEnvProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported profile proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	// As with the environment backend, both uppercase and lowercase variables
+	// are exported.
+	return export(strings.ToUpper(p.protocol.String())+"_PROXY", value) +
+		export(strings.ToLower(p.protocol.String())+"_proxy", value)
+}
+
+// shExport returns the POSIX shell command exporting a variable. Nothing in
+// single quotes is expanded, and the single quotes themselves are escaped
+// outside of them.
+func shExport(name, value string) string {
+	return fmt.Sprintf("export %s='%s'\n", name, strings.ReplaceAll(value, "'", `'\''`))
+}
+
+// fishExport returns the fish command exporting a variable. Only backslashes
+// and single quotes are escaped in single quotes.
+func fishExport(name, value string) string {
+	return fmt.Sprintf("set -gx %s '%s'\n", name, strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value))
+}
+
+// cshExport returns the csh command exporting a variable. As in POSIX shells,
+// single quotes are escaped outside of them, but history substitutions are
+// also expanded in single quotes.
+func cshExport(name, value string) string {
+	return fmt.Sprintf("setenv %s '%s'\n", name, strings.NewReplacer("'", `'\''`, "!", `\!`).Replace(value))
+}
+
+// profileScript is a script exporting the proxy variables for a shell.
+type profileScript struct {
+	path   string
+	export func(name, value string) string
+}
+
+// profileBackend applies the proxy configuration in the form of scripts
+// exporting the proxy environment variables, for the login shells, such as the
+// ones of SSH sessions, which don't read environment.d: a script of
+// /etc/profile.d for POSIX shells and its csh variant, and a script of
+// /etc/fish/conf.d for fish.
+type profileBackend struct {
+	scripts []profileScript
+
+	// socksAllProxy sets all_proxy to the SOCKS proxy when it is the only one set.
+	socksAllProxy bool
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("profile", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return profileBackend{
+			scripts: []profileScript{
+				{path: filepath.Join(opts.root, defaultProfileConfigPath), export: shExport},
+				{path: filepath.Join(opts.root, defaultProfileCshConfigPath), export: cshExport},
+				{path: filepath.Join(opts.root, defaultProfileFishConfigPath), export: fishExport},
+			},
+			socksAllProxy: opts.envSOCKSAllProxy,
+			fs:            r,
+		}
+	})
+}
+
+func (b profileBackend) name() string { return "profile" }
+
+func (b profileBackend) paths() (paths []string) {
+	for _, s := range b.scripts {
+		paths = append(paths, s.path)
+	}
+	return paths
+}
+
+func (b profileBackend) skipReason(proto protocol) string {
+	if proto == protocolAuto {
+		return "autoconfiguration URLs have no environment variable"
+	}
+	return ""
+}
+
+// apply applies the proxy configuration to the profile scripts.
+// If there are no proxy settings to apply, the scripts are removed.
+func (b profileBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply profile proxy configuration")
+
+	remove := noSupportedProtocols(settings, unsupportedEnvProtocols)
+	for _, s := range b.scripts {
+		log.Debugf("Applying profile proxy configuration to %q", s.path)
+		if err := applyConfigFile(ctx, b.fs, s.path, profileConfig(settings, b.socksAllProxy, s.export), remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// profileConfig returns the formatted profile script to be written, using
+// export to format each command.
+func profileConfig(settings []setting, socksAllProxy bool, export func(name, value string) string) string {
+	content := fmt.Sprintln(confHeader)
+	for _, p := range envSettings(settings, socksAllProxy) {
+		content += p.profileString(export)
+	}
+
+	return content
+}
@@ -2,42 +2,149 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/ubuntu/decorate"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/state"
 	"golang.org/x/sync/errgroup"
 )
 
 // Proxy represents a proxy manager.
+//
+// A Proxy is safe for concurrent use by multiple goroutines: its fields are
+// not modified after creation, and the settings of each call are passed to the
+// backends rather than stored on the receiver. Concurrent Apply calls on the
+// same Proxy are serialized, as they write to the same files. Callers must not
+// apply settings concurrently with distinct Proxy instances sharing the same
+// root.
 type Proxy struct {
-	settings []setting
-
-	envConfigPath       string
-	aptConfigPath       string
-	gsettingsConfigPath string
-
+	root     string
+	backends []backend
+	// backendModes maps backend names to their mode, managed if unset.
+	backendModes map[string]string
+
+	allowedHosts []string
+
+	noProxyProfile string
+	hostname       func() (string, error)
+
+	// emptyMeansNoop leaves the configuration untouched on Apply calls with
+	// empty settings, rather than removing it.
+	emptyMeansNoop bool
+
+	// applyMu serializes Apply calls writing to the same root in the process.
+	// The other processes are excluded by the lock of the state directory.
+	applyMu *sync.Mutex
+
+	// state records the last Apply call, if set.
+	state *state.Store
+	// reporter is sent the outcome of each Apply call, if set.
+	reporter Reporter
+
+	// fs runs the filesystem mutations of the backends.
+	fs *fsRunner
+	// commands runs the external commands of the backends.
+	commands *commandRunner
+	// pending collects the content the backends couldn't install.
+	pending *pendingSet
+	// fsTimeout bounds the filesystem mutations of each Apply call.
+	fsTimeout time.Duration
+	// done is cancelled on shutdown, ending the waits for services which
+	// aren't bounded by fsTimeout.
+	done     context.Context
+	shutdown context.CancelFunc
+
+	// backendOpts are the options the backends were created with, to create
+	// the ones previewing an Apply call.
+	backendOpts options
+
+	// External tools reported in support bundles.
 	glibCompileSchemasCmd []string
-	glibSchemasPath       string
+	gsettingsCmd          []string
 }
 
 type options struct {
 	root string
 
+	allowedHosts          []string
 	glibCompileSchemasCmd []string
+
+	envSOCKSAllProxy      bool
+	systemdUserConf       bool
+	gsettingsUseSameProxy bool
+	gsettingsVerify       bool
+	gsettingsCmd          []string
+	dconfCmd              []string
+	systemctlCmd          []string
+
+	noProxyProfile string
+	hostname       func() (string, error)
+
+	extraLines ExtraLines
+
+	backendModes map[string]string
+
+	emptyMeansNoop bool
+
+	stateDir string
+	reporter Reporter
+
+	snapdSocket        string
+	snapdChangeTimeout time.Duration
+	lxdSocket          string
+	incusSocket        string
+
+	livepatchCmd []string
+
+	fs        filesystem
+	fsTimeout time.Duration
 }
 type option func(*options)
 
 const confHeader = "### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten"
 
+// managedEntriesHeader precedes the entries managed by ubuntu-proxy-manager in
+// files shared with other programs.
+const managedEntriesHeader = "### The proxy entries below are managed by ubuntu-proxy-manager - manual changes to them will be overwritten"
+
+// managedEntriesFooter follows the entries managed by ubuntu-proxy-manager in
+// files shared with other programs, when they are delimited as a block.
+const managedEntriesFooter = "### End of the proxy entries managed by ubuntu-proxy-manager"
+
 const (
 	// defaultEnvConfigPath is the relative path to the system environment configuration file.
 	defaultEnvConfigPath = "etc/environment.d/99ubuntu-proxy-manager.conf"
 
+	// defaultLegacyEnvConfigPath is the relative path to the system environment file read by pam_env.
+	defaultLegacyEnvConfigPath = "etc/environment"
+
+	// defaultPamEnvConfigPath is the relative path to the pam_env configuration file.
+	defaultPamEnvConfigPath = "etc/security/pam_env.conf"
+
+	// defaultProfileConfigPath is the relative path to the login shells proxy script.
+	defaultProfileConfigPath = "etc/profile.d/ubuntu-proxy-manager.sh"
+
+	// defaultProfileCshConfigPath is the relative path to the csh login shells proxy script.
+	defaultProfileCshConfigPath = "etc/profile.d/ubuntu-proxy-manager.csh"
+
+	// defaultProfileFishConfigPath is the relative path to the fish proxy script.
+	defaultProfileFishConfigPath = "etc/fish/conf.d/ubuntu-proxy-manager.fish"
+
+	// defaultSystemdConfigPath is the relative path to the drop-in of the systemd system manager configuration.
+	defaultSystemdConfigPath = "etc/systemd/system.conf.d/ubuntu-proxy-manager.conf"
+
+	// defaultSystemdUserConfigPath is the relative path to the drop-in of the systemd user managers configuration.
+	defaultSystemdUserConfigPath = "etc/systemd/user.conf.d/ubuntu-proxy-manager.conf"
+
 	// defaultAPTConfigPath is the relative path to the APT proxy configuration file.
 	defaultAPTConfigPath = "etc/apt/apt.conf.d/99ubuntu-proxy-manager"
 
@@ -46,59 +153,561 @@ const (
 
 	// gschemaOverrideFile is the basename of the GSettings proxy schema override file.
 	gschemaOverrideFile = "99_ubuntu-proxy-manager.gschema.override"
+
+	// defaultDconfDBPath is the relative path to the directory of the dconf system databases.
+	defaultDconfDBPath = "etc/dconf/db"
+
+	// defaultDconfConfigPath is the relative path to the key file of the local dconf system database.
+	defaultDconfConfigPath = "etc/dconf/db/local.d/ubuntu-proxy-manager"
+
+	// defaultDconfLocksPath is the relative path to the locks of the local dconf system database.
+	defaultDconfLocksPath = "etc/dconf/db/local.d/locks/ubuntu-proxy-manager"
+
+	// defaultDconfProfilePath is the relative path to the dconf profile of the users.
+	defaultDconfProfilePath = "etc/dconf/profile/user"
+
+	// defaultDconfGDMConfigPath is the relative path to the key file of the gdm dconf system database.
+	defaultDconfGDMConfigPath = "etc/dconf/db/gdm.d/ubuntu-proxy-manager"
+
+	// defaultDconfGDMLocksPath is the relative path to the locks of the gdm dconf system database.
+	defaultDconfGDMLocksPath = "etc/dconf/db/gdm.d/locks/ubuntu-proxy-manager"
+
+	// defaultDconfGDMProfilePath is the relative path to the dconf profile of the GDM greeter.
+	defaultDconfGDMProfilePath = "etc/dconf/profile/gdm"
+
+	// defaultLibproxyConfigPath is the relative path to the libproxy system configuration file.
+	defaultLibproxyConfigPath = "etc/sysconfig/proxy"
+
+	// defaultContainerdConfigPath is the relative path to the containerd service proxy drop-in.
+	defaultContainerdConfigPath = "etc/systemd/system/containerd.service.d/proxy.conf"
+
+	// defaultFwupdConfigPath is the relative path to the fwupd service proxy drop-in.
+	defaultFwupdConfigPath = "etc/systemd/system/fwupd.service.d/proxy.conf"
+
+	// defaultFwupdRefreshConfigPath is the relative path to the fwupd-refresh service proxy drop-in.
+	defaultFwupdRefreshConfigPath = "etc/systemd/system/fwupd-refresh.service.d/proxy.conf"
+
+	// defaultPodmanConfigPath is the relative path to the containers configuration file, shared with podman.
+	defaultPodmanConfigPath = "etc/containers/containers.conf"
+
+	// defaultGitIncludePath is the relative path to the git configuration file included by the system one.
+	defaultGitIncludePath = "etc/gitconfig.d/ubuntu-proxy-manager"
+
+	// defaultGitConfigPath is the relative path to the system git configuration file, shared with git.
+	defaultGitConfigPath = "etc/gitconfig"
+
+	// defaultPipConfigPath is the relative path to the site-wide pip configuration file, shared with pip.
+	defaultPipConfigPath = "etc/pip.conf"
+
+	// defaultGradleConfigPath is the relative path to the system-wide Gradle properties file.
+	defaultGradleConfigPath = "etc/gradle/gradle.properties"
+
+	// defaultRConfigPath is the relative path to the R site environment file, shared with R.
+	defaultRConfigPath = "etc/R/Renviron.site"
+
+	// defaultRubyGemsConfigPath is the relative path to the system-wide RubyGems configuration file, shared with RubyGems.
+	defaultRubyGemsConfigPath = "etc/gemrc"
+
+	// defaultCargoConfigPath is the relative path to the Cargo configuration file of the system Cargo home, shared with Cargo.
+	defaultCargoConfigPath = "etc/cargo/config.toml"
+
+	// defaultSubversionConfigPath is the relative path to the system-wide Subversion servers file, shared with Subversion.
+	defaultSubversionConfigPath = "etc/subversion/servers"
+
+	// defaultCondaConfigPath is the relative path to the system-wide conda configuration file, shared with conda.
+	defaultCondaConfigPath = "etc/conda/.condarc"
+
+	// defaultMicroK8sConfigPath is the relative path to the containerd environment file of MicroK8s, shared with MicroK8s.
+	defaultMicroK8sConfigPath = "var/snap/microk8s/current/args/containerd-env"
+
+	// defaultCurlConfigPath is the relative path to the system curl configuration file, shared with curl.
+	defaultCurlConfigPath = "etc/curlrc"
+
+	// defaultCntlmConfigPath is the relative path to the cntlm configuration file, shared with cntlm.
+	defaultCntlmConfigPath = "etc/cntlm.conf"
+
+	// defaultCustomFilesDir is the relative path to the directory of the declarations of custom files.
+	defaultCustomFilesDir = "etc/ubuntu-proxy-manager/custom.d"
+
+	// defaultKDEConfigPath is the relative path to the system KDE network settings, shared with KDE.
+	defaultKDEConfigPath = "etc/xdg/kioslaverc"
+
+	// defaultSnapdSocketPath is the relative path to the socket of the snapd REST API.
+	defaultSnapdSocketPath = "run/snapd.socket"
+
+	// defaultSnapdDropInPath is the relative path to the snapd service proxy drop-in, written when the snapd REST API is unavailable.
+	defaultSnapdDropInPath = "etc/systemd/system/snapd.service.d/proxy.conf"
+
+	// defaultLXDSocketPath is the relative path to the socket of the REST API of the LXD snap.
+	defaultLXDSocketPath = "var/snap/lxd/common/lxd/unix.socket"
+
+	// defaultIncusSocketPath is the relative path to the socket of the REST API of Incus.
+	defaultIncusSocketPath = "var/lib/incus/unix.socket"
+
+	// defaultLivepatchCmdPath is the relative path to the command of the canonical-livepatch snap.
+	defaultLivepatchCmdPath = "snap/bin/canonical-livepatch"
 )
 
+// defaultSnapdUnitPaths are the relative paths where the snapd service may be
+// installed, depending on whether /lib is merged into /usr.
+var defaultSnapdUnitPaths = []string{"usr/lib/systemd/system/snapd.service", "lib/systemd/system/snapd.service"}
+
+// defaultFSTimeout is the default time after which the filesystem mutations of
+// an Apply call are abandoned.
+const defaultFSTimeout = 30 * time.Second
+
 // New returns a new instance of a proxy manager.
 func New(args ...option) *Proxy {
 	// Set default options
 	opts := options{
 		root:                  "/",
 		glibCompileSchemasCmd: []string{"glib-compile-schemas"},
+		gsettingsCmd:          []string{"gsettings"},
+		dconfCmd:              []string{"dconf"},
+		systemctlCmd:          []string{"systemctl"},
+		envSOCKSAllProxy:      true,
+		hostname:              os.Hostname,
+		fs:                    osFilesystem{},
+		fsTimeout:             defaultFSTimeout,
 	}
 	// Apply given options
 	for _, f := range args {
 		f(&opts)
 	}
 
-	glibSchemasPath := filepath.Join(opts.root, defaultGLibSchemaPath)
+	var store *state.Store
+	if opts.stateDir != "" {
+		store = state.New(opts.stateDir)
+	}
+
+	fsRunner := newFSRunner(opts.fs)
+	commands := newCommandRunner()
+	done, shutdown := context.WithCancel(context.Background())
 
 	return &Proxy{
-		envConfigPath:       filepath.Join(opts.root, defaultEnvConfigPath),
-		aptConfigPath:       filepath.Join(opts.root, defaultAPTConfigPath),
-		gsettingsConfigPath: filepath.Join(glibSchemasPath, gschemaOverrideFile),
+		root:           opts.root,
+		backends:       newBackends(opts, fsRunner, commands),
+		backendModes:   opts.backendModes,
+		allowedHosts:   opts.allowedHosts,
+		noProxyProfile: opts.noProxyProfile,
+		hostname:       opts.hostname,
+		emptyMeansNoop: opts.emptyMeansNoop,
+		applyMu:        &sync.Mutex{},
+		state:          store,
+		reporter:       opts.reporter,
+		fs:             fsRunner,
+		commands:       commands,
+		pending:        &pendingSet{},
+		fsTimeout:      opts.fsTimeout,
+		done:           done,
+		shutdown:       shutdown,
+		backendOpts:    opts,
 
-		glibSchemasPath:       glibSchemasPath,
 		glibCompileSchemasCmd: opts.glibCompileSchemasCmd,
+		gsettingsCmd:          opts.gsettingsCmd,
+	}
+}
+
+// newBackends creates the backends compiled in, in the order they are applied,
+// with the given options and runners.
+func newBackends(opts options, r *fsRunner, c *commandRunner) (backends []backend) {
+	for _, name := range BackendNames {
+		if newBackend, found := backendFactories[name]; found {
+			backends = append(backends, newBackend(opts, r, c))
+		}
+	}
+
+	// The custom files can't overwrite the files of the other backends.
+	for i, b := range backends {
+		if custom, ok := b.(customBackend); ok {
+			backends[i] = custom.rejectManagedPaths(backends)
+		}
+	}
+	return backends
+}
+
+// WithAllowedHosts restricts the proxy hosts that can be applied to the ones
+// matching the given patterns: exact hosts, wildcards (*.example.com) or CIDRs
+// (10.0.0.0/8). An empty list means no restriction.
+func WithAllowedHosts(patterns []string) func(o *options) {
+	return func(o *options) {
+		o.allowedHosts = patterns
+	}
+}
+
+// WithEnvSOCKSAllProxy sets whether the environment backend also sets all_proxy
+// to the SOCKS proxy when it is the only proxy set. It is enabled by default.
+func WithEnvSOCKSAllProxy(enabled bool) func(o *options) {
+	return func(o *options) {
+		o.envSOCKSAllProxy = enabled
+	}
+}
+
+// WithSystemdUserConf sets whether the systemd backend also sets the proxy
+// variables of the systemd user managers, and not only the system one.
+func WithSystemdUserConf(enabled bool) func(o *options) {
+	return func(o *options) {
+		o.systemdUserConf = enabled
+	}
+}
+
+// WithNoProxyProfile adds the exclusions of the given profile to the no_proxy
+// setting whenever a proxy is set. See NoProxyProfiles for supported profiles.
+func WithNoProxyProfile(profile string) func(o *options) {
+	return func(o *options) {
+		o.noProxyProfile = profile
+	}
+}
+
+// WithGSettingsUseSameProxy makes the GSettings backend rely on use-same-proxy
+// instead of writing identical sections when all protocols use the HTTP proxy.
+func WithGSettingsUseSameProxy(enabled bool) func(o *options) {
+	return func(o *options) {
+		o.gsettingsUseSameProxy = enabled
+	}
+}
+
+// WithGSettingsVerification makes the GSettings backend query gsettings after
+// applying the configuration, and warn about the values which differ from the
+// applied ones. It requires the gsettings binary and is disabled by default.
+func WithGSettingsVerification(enabled bool) func(o *options) {
+	return func(o *options) {
+		o.gsettingsVerify = enabled
+	}
+}
+
+// WithExtraLines appends the given raw lines to the file managed by each
+// backend. The lines are expected to be checked with ExtraLines.Check.
+func WithExtraLines(lines ExtraLines) func(o *options) {
+	return func(o *options) {
+		o.extraLines = lines
+	}
+}
+
+// WithBackendModes sets the mode of the given backends, indexed by name. The
+// mode of the other backends is managed. The modes are expected to be checked
+// with CheckBackendMode.
+func WithBackendModes(modes map[string]string) func(o *options) {
+	return func(o *options) {
+		o.backendModes = modes
+	}
+}
+
+// WithEmptyMeansNoop makes Apply calls with empty settings succeed without
+// changing anything, rather than removing the configuration. It can be
+// overridden for each call with Settings.EmptyMeansNoop.
+func WithEmptyMeansNoop(noop bool) func(o *options) {
+	return func(o *options) {
+		o.emptyMeansNoop = noop
+	}
+}
+
+// WithStateDir records the last Apply call in the given state directory, to be
+// reported in support bundles. Nothing is recorded if dir is empty.
+func WithStateDir(dir string) func(o *options) {
+	return func(o *options) {
+		o.stateDir = dir
+	}
+}
+
+// Reporter is sent the outcome of each Apply call.
+type Reporter interface {
+	// Report is called once the settings are applied, with credentials
+	// masked. Errors are logged and don't fail the Apply call.
+	Report(LastApply) error
+}
+
+// WithReporter sends the outcome of each Apply call to r.
+func WithReporter(r Reporter) func(o *options) {
+	return func(o *options) {
+		o.reporter = r
+	}
+}
+
+// WithFilesystemTimeout sets the time after which the filesystem mutations of
+// an Apply call are abandoned, so that an unresponsive filesystem doesn't block
+// the caller forever. The default is 30 seconds, and 0 means no timeout.
+func WithFilesystemTimeout(timeout time.Duration) func(o *options) {
+	return func(o *options) {
+		o.fsTimeout = timeout
 	}
 }
 
 // Apply applies the proxy configuration to the system.
-func (p Proxy) Apply(http, https, ftp, socks, no, auto string) (err error) {
+func (p Proxy) Apply(s Settings) (err error) {
 	defer decorate.OnError(&err, "couldn't apply proxy configuration")
 
+	noop := p.emptyMeansNoop
+	if s.EmptyMeansNoop != nil {
+		noop = *s.EmptyMeansNoop
+	}
+	if noop && s.empty() {
+		log.Warningf("Ignoring Apply call with empty settings: the proxy configuration is left untouched as empty settings mean no-op")
+		return nil
+	}
+
 	log.Infof("Applying proxy configuration")
 
-	p.settings, err = newSettings(http, https, ftp, socks, no, auto)
+	return p.apply(s, operationApply)
+}
+
+// Reset removes the proxy configuration of every backend, as an Apply call with
+// empty settings does, even if empty settings mean no-op.
+func (p Proxy) Reset() (err error) {
+	defer decorate.OnError(&err, "couldn't reset proxy configuration")
+
+	log.Infof("Resetting proxy configuration")
+
+	return p.apply(Settings{}, operationReset)
+}
+
+// apply applies the given proxy settings to every backend, recording the call
+// as the given operation.
+func (p Proxy) apply(s Settings, operation string) error {
+	p, err := p.selectBackends(s.Backends)
+	if err != nil {
+		return err
+	}
+	settings, hostProxies, ntlm, err := p.parseSettings(s)
 	if err != nil {
 		return err
 	}
 
+	defer p.lock()()
+
+	ctx, cancel := p.fsContext()
+	defer cancel()
+
+	if err := p.retryPending(ctx); err != nil {
+		log.Warningf("Couldn't install pending proxy configuration: %v", err)
+	}
+
+	for _, skipped := range skippedSettings(p.managedBackends(), settings) {
+		log.Infof("Skipping %s setting for the %s backend: %s", skipped.Protocol, skipped.Backend, skipped.Reason)
+	}
+
+	p.fs.resetDiskFull()
+	p.commands.reset()
+	p.pending.reset()
+
+	results := p.backendResults(settings, hostProxies, ntlm)
+	for _, r := range results {
+		if r.AlreadyClean {
+			log.Debugf("The %s configuration is already clean", r.Backend)
+		}
+	}
+
 	var g errgroup.Group
-	g.Go(func() error { return p.applyToEnvironment() })
-	g.Go(func() error { return p.applyToAPT() })
-	g.Go(func() error { return p.applyToGSettings() })
+	for _, b := range p.backends {
+		b := b
+		switch p.backendMode(b) {
+		case BackendModeRemoveOnly:
+			log.Infof("The %s backend is remove-only, removing its configuration", b.name())
+			g.Go(func() error { return b.apply(ctx, nil) })
+		case BackendModeDisabled:
+			log.Infof("The %s backend is disabled, leaving its configuration untouched", b.name())
+		default:
+			g.Go(func() error {
+				return p.pending.collect(b, applyBackend(ctx, b, settings, hostProxies, ntlm, s.SnapStoreID))
+			})
+		}
+	}
+
+	err = g.Wait()
+	// The hooks requested by several backends only run once, after all of them.
+	if hookErr := p.commands.runHooks(ctx); hookErr != nil {
+		err = errors.Join(err, fmt.Errorf("couldn't run post-apply hooks: %w", hookErr))
+	}
+	// Once the filesystem is full, the other backends skip their writes:
+	// report the cause rather than whichever backend failed first.
+	if diskFullErr := p.fs.diskFull(); diskFullErr != nil {
+		err = diskFullErr
+	}
+	// Pending content from previous calls is superseded.
+	if saveErr := p.savePending(p.pending.list()); saveErr != nil {
+		log.Warningf("Couldn't record the pending proxy configuration: %v", saveErr)
+	}
+	p.recordLastApply(operation, settings, hostProxies, results, err)
+	if err == nil {
+		p.recordApplied(s)
+	}
+	return err
+}
+
+// lock serializes the calls changing the configuration, within the process and
+// with the other processes sharing the state directory, such as the import
+// command running next to the service. The returned function releases it.
+func (p Proxy) lock() (unlock func()) {
+	p.applyMu.Lock()
+	if p.state == nil {
+		return p.applyMu.Unlock
+	}
+
+	release, err := p.state.Lock()
+	if err != nil {
+		log.Warningf("Not serializing the changes with the other processes: %v", err)
+		return p.applyMu.Unlock
+	}
+	return func() {
+		release()
+		p.applyMu.Unlock()
+	}
+}
+
+// fsContext returns the context bounding the filesystem mutations of a call.
+// The backends waiting for a service rather than for the filesystem use its
+// service context instead, which is only cancelled on shutdown.
+func (p Proxy) fsContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), serviceContextKey{}, p.done)
+	if p.fsTimeout > 0 {
+		return context.WithTimeout(ctx, p.fsTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// serviceContextKey is the key of the service context in the contexts returned
+// by fsContext.
+type serviceContextKey struct{}
+
+// serviceContext returns the context of the call of ctx which isn't bounded by
+// the filesystem timeout, to wait for a service to apply the configuration. It
+// returns ctx if there is none.
+func serviceContext(ctx context.Context) context.Context {
+	if s, ok := ctx.Value(serviceContextKey{}).(context.Context); ok {
+		return s
+	}
+	return ctx
+}
+
+// Shutdown abandons the waits for services, such as snapd, to apply the
+// configuration, in the current and next calls. Their filesystem mutations
+// still run.
+func (p Proxy) Shutdown() {
+	p.shutdown()
+}
+
+// Validate parses and validates the given proxy settings without applying them.
+// It doesn't access the filesystem.
+func (p Proxy) Validate(s Settings) error {
+	p, err := p.selectBackends(s.Backends)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = p.parseSettings(s)
+	return err
+}
+
+// Normalize parses and validates the given proxy settings without applying
+// them, as Validate does. It returns the settings as they would be applied,
+// with their URLs escaped and passwords masked, along with the warnings about
+// the managed backends which won't apply them as given.
+func (p Proxy) Normalize(s Settings) (normalized Settings, warnings []Warning, err error) {
+	defer decorate.OnError(&err, "invalid proxy settings")
 
-	return g.Wait()
+	p, err = p.selectBackends(s.Backends)
+	if err != nil {
+		return Settings{}, nil, err
+	}
+	settings, hostProxies, _, err := p.parseSettings(s)
+	if err != nil {
+		return Settings{}, nil, err
+	}
+
+	normalized = Settings{NTLMDomain: s.NTLMDomain, SnapStoreID: s.SnapStoreID, EmptyMeansNoop: s.EmptyMeansNoop}
+	for _, setting := range settings {
+		if uri := normalized.get(setting.protocol); uri != nil {
+			*uri = redactPasswords(setting.escapedURL)
+		}
+	}
+	if len(hostProxies) > 0 {
+		normalized.APTHostProxies = make(map[string]string)
+		for _, h := range hostProxies {
+			normalized.APTHostProxies[h.host] = redactPasswords(h.value())
+		}
+	}
+
+	return normalized, settingWarnings(p.managedBackends(), settings), nil
 }
 
-// noSupportedProtocols returns true if the current list of settings doesn't
+// parseSettings parses the given proxy settings, per-host proxies, NTLM proxy
+// and Snap Store Proxy, and checks them against the daemon policy. If the HTTP
+// and HTTPS proxies require NTLM authentication, they are replaced by the local
+// cntlm listener in the returned settings.
+func (p Proxy) parseSettings(s Settings) ([]setting, []hostProxy, *ntlmProxy, error) {
+	if s.HTTP != "" || s.HTTPS != "" || s.FTP != "" || s.SOCKS != "" {
+		s.NoProxy = addExclusions(s.NoProxy, p.noProxyExclusions())
+	}
+
+	settings, err := newSettings(s)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hostProxies, err := newHostProxies(s.APTHostProxies)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := checkAllowedHosts(settings, p.allowedHosts); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, h := range hostProxies {
+		if h.proxy == nil {
+			continue
+		}
+		if err := checkAllowedHosts([]setting{*h.proxy}, p.allowedHosts); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	ntlm, settings, err := newNTLMProxy(s.NTLMDomain, settings)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ntlm != nil && !p.ntlmManaged() {
+		return nil, nil, nil, errors.New("NTLM authentication requires the cntlm backend to be managed")
+	}
+
+	if s.SnapStoreID != nil {
+		if err := checkSnapStoreID(*s.SnapStoreID); err != nil {
+			return nil, nil, nil, err
+		}
+		if !p.snapStoreManaged() {
+			return nil, nil, nil, errors.New("the Snap Store Proxy requires the snapd backend to be managed")
+		}
+	}
+
+	return settings, hostProxies, ntlm, nil
+}
+
+// ntlmManaged returns true if a backend authenticating to NTLM proxies is
+// managed.
+func (p Proxy) ntlmManaged() bool {
+	for _, b := range p.backends {
+		if _, ok := b.(ntlmBackend); ok && p.backendMode(b) == BackendModeManaged {
+			return true
+		}
+	}
+	return false
+}
+
+// snapStoreManaged returns true if a backend registering against a Snap Store
+// Proxy is managed.
+func (p Proxy) snapStoreManaged() bool {
+	for _, b := range p.backends {
+		if _, ok := b.(snapStoreBackend); ok && p.backendMode(b) == BackendModeManaged {
+			return true
+		}
+	}
+	return false
+}
+
+// noSupportedProtocols returns true if the given list of settings doesn't
 // contain any supported protocols.
-func (p Proxy) noSupportedProtocols(unsupportedProtocols []protocol) bool {
-	return len(validProtocols(p.settings, unsupportedProtocols)) == 0
+func noSupportedProtocols(settings []setting, unsupportedProtocols []protocol) bool {
+	return len(validProtocols(settings, unsupportedProtocols)) == 0
 }
 
-// previousConfig returns the previous configuration if it exists. No error is
-// returned if the file doesn't exist, but other errors are.
+// previousConfig returns the previous configuration if it exists.
 func previousConfig(path string) (content string, err error) {
 	defer decorate.OnError(&err, "couldn't read previous configuration")
 
@@ -114,46 +723,71 @@ func previousConfig(path string) (content string, err error) {
 // createParentDirectories creates the parent directory of the given path if it
 // doesn't already exist.
 // It returns an error if the parent directory can't be created.
-func createParentDirectories(path string) error {
+func createParentDirectories(ctx context.Context, r *fsRunner, path string) error {
 	parentDir := filepath.Dir(path)
 
 	log.Debugf("Creating directory %q", parentDir)
 	//nolint:gosec // G301 - parent directory permissions are 0755, so we should keep the same pattern
-	if err := os.MkdirAll(parentDir, 0755); err != nil {
+	if err := r.mkdirAll(ctx, parentDir, 0755); err != nil {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 	return nil
 }
 
-// safeWriteFile writes the given contents to path, applying the write to .new and
-// rename workflow.
-func safeWriteFile(path string, contents string) error {
-	//nolint:gosec // G306 - config file permissions are 0644, so we should keep the same pattern
-	if err := os.WriteFile(path+".new", []byte(contents), 0644); err != nil {
+// safeWriteFile writes the given contents to path with the given mode, applying
+// the write to .new and rename workflow.
+// If the filesystem is full, a DiskFullError is returned and the previous file is
+// left intact.
+func safeWriteFile(ctx context.Context, r *fsRunner, path string, contents string, perm fs.FileMode) error {
+	tmpPath := path + ".new"
+	if err := r.writeFile(ctx, tmpPath, []byte(contents), perm); err != nil {
+		var diskFullErr DiskFullError
+		var timeoutErr TimeoutError
+		if errors.As(err, &diskFullErr) || errors.As(err, &timeoutErr) {
+			return err
+		}
+
+		// Don't leave a partially written file behind.
+		if rmErr := r.remove(ctx, tmpPath); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			log.Warningf("Couldn't remove partially written file %q: %v", tmpPath, rmErr)
+		}
+
+		if errors.Is(err, syscall.ENOSPC) {
+			diskFullErr = DiskFullError{Path: path, Filesystem: mountPoint(path)}
+			r.setDiskFull(diskFullErr)
+			return diskFullErr
+		}
 		return err
 	}
-	return os.Rename(path+".new", path)
+	return r.rename(ctx, tmpPath, path)
 }
 
 // backupFileIfExists moves the given file to a backup file suffixed with .old,
 // returning the path to the backup file and a function to restore the original.
-// If the file doesn't exist, no error is returned.
-func backupFileIfExists(path string) (string, func() error, error) {
+// If the file doesn't exist, no error is returned, and the restore function
+// removes any file written to path since, so that it's absent again.
+func backupFileIfExists(ctx context.Context, r *fsRunner, path string) (string, func() error, error) {
 	backupPath := path + ".old"
 	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
-		return backupPath, func() error { return nil }, nil
+		return backupPath, func() error {
+			log.Debugf("Removing file %q, which didn't exist before", path)
+			if err := r.remove(ctx, path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}, nil
 	}
 
 	log.Debugf("Backing up file %q to %q", path, backupPath)
 
-	err := os.Rename(path, backupPath)
+	err := r.rename(ctx, path, backupPath)
 	if err != nil {
 		return backupPath, func() error { return nil }, err
 	}
 
 	return backupPath, func() error {
 		log.Debugf("Restoring file %q from backup %q", path, backupPath)
-		return os.Rename(backupPath, path)
+		return r.rename(ctx, backupPath, path)
 	}, nil
 }
 
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedRProtocols lists the protocols that are not supported by the R backend.
+var unsupportedRProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// rVariableRegexp matches the proxy variables of the managed block of the R
+// site environment file.
+var rVariableRegexp = regexp.MustCompile(`^(http|https|no)_proxy=`)
+
+// rString formats a proxy setting as a line of an R environment file. Only the
+// lowercase variable is set, as it is the one read by both download methods of
+// R. The value isn't quoted: proxy URLs and no_proxy lists, once trimmed, have
+// no space, quote or backslash, and the braces R would expand are escaped in
+// URLs.
+func (p setting) rString() string {
+	if slices.Contains(unsupportedRProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported R proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+	return fmt.Sprintf("%s_proxy=%s\n", strings.ToLower(p.protocol.String()), value)
+}
+
+// rBackend applies the proxy configuration to a managed block of
+// /etc/R/Renviron.site, the site environment file read by every R session, so
+// that install.packages() and download.file() use the proxy. On Ubuntu, the
+// etc directory of R_HOME links to /etc/R. The file is shared: only the block
+// is managed, and the rest of the file is left untouched.
+type rBackend struct {
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("r", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return rBackend{path: filepath.Join(opts.root, defaultRConfigPath), fs: r}
+	})
+}
+
+func (b rBackend) name() string    { return "r" }
+func (b rBackend) paths() []string { return []string{b.path} }
+func (b rBackend) sharesFiles()    {}
+
+func (b rBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "R only downloads packages over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "R doesn't support SOCKS proxies"
+	case protocolAuto:
+		return "R doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the R configuration isn't applied: R isn't
+// installed.
+func (b rBackend) unavailableReason() string {
+	if _, err := os.Stat(filepath.Dir(b.path)); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("R configuration directory %q doesn't exist", filepath.Dir(b.path))
+	}
+	return ""
+}
+
+// apply replaces the managed block of the R site environment file with the
+// given proxy settings. If there are no proxy settings to apply, the block is
+// removed, but the file never is. Nothing is done if R isn't installed.
+func (b rBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply R proxy configuration")
+
+	if _, err := os.Stat(filepath.Dir(b.path)); errors.Is(err, fs.ErrNotExist) {
+		log.Debugf("R configuration directory %q doesn't exist, skipping R proxy configuration", filepath.Dir(b.path))
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var variables string
+	for _, p := range sortedSettings(settings) {
+		variables += p.rString()
+	}
+	content := managedBlockConfig(prev, variables, rVariableRegexp)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying R proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
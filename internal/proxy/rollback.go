@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"io/fs"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+// rollbackStateFile is the state file recording the settings of the last two
+// successful Apply calls, credentials included, to roll back to the previous
+// one.
+const rollbackStateFile = "rollback.json"
+
+// ErrNoPreviousConfiguration is returned when rolling back while no previous
+// configuration was recorded.
+var ErrNoPreviousConfiguration = errors.New("no previous proxy configuration is recorded")
+
+// appliedSettings are the settings of the last two successful Apply calls.
+type appliedSettings struct {
+	Current  *Settings `json:"current,omitempty"`
+	Previous *Settings `json:"previous,omitempty"`
+}
+
+// Rollback applies again the settings of the successful Apply, RotateCredentials
+// or Reset call before the last one, to every backend, restoring the previous
+// known-good configuration. Rolling back twice restores the configuration
+// rolled back from.
+// It returns ErrNoPreviousConfiguration if there were less than two successful
+// calls, or without a state directory.
+func (p Proxy) Rollback() (err error) {
+	defer decorate.OnError(&err, "couldn't roll back proxy configuration")
+
+	applied, err := p.loadApplied()
+	if err != nil {
+		return err
+	}
+	if applied.Previous == nil {
+		return ErrNoPreviousConfiguration
+	}
+
+	log.Infof("Rolling back to the previous proxy configuration")
+
+	return p.apply(*applied.Previous, operationRollback)
+}
+
+// loadApplied returns the settings of the last successful Apply calls recorded
+// in the state directory, if any.
+func (p Proxy) loadApplied() (applied appliedSettings, err error) {
+	if p.state == nil {
+		return applied, nil
+	}
+	if err := p.state.Load(rollbackStateFile, &applied); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return applied, err
+	}
+	return applied, nil
+}
+
+// recordApplied records the given settings of a successful Apply call in the
+// state directory, keeping the ones of the previous call to roll back to.
+// They are recorded as applied to every backend, whatever backends the call
+// was restricted to. Failures are only logged, as they don't affect the
+// applied configuration.
+func (p Proxy) recordApplied(s Settings) {
+	if p.state == nil {
+		return
+	}
+
+	applied, err := p.loadApplied()
+	if err != nil {
+		log.Warningf("Couldn't record the applied settings to roll back to: %v", err)
+		return
+	}
+
+	// Rolling back to empty settings removes the configuration.
+	noop := false
+	s.EmptyMeansNoop, s.Backends = &noop, nil
+	applied.Previous, applied.Current = applied.Current, &s
+	if err := p.state.Save(rollbackStateFile, applied); err != nil {
+		log.Warningf("Couldn't record the applied settings to roll back to: %v", err)
+	}
+}
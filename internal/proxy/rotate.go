@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// operationApply is the operation recorded for Apply calls.
+	operationApply = "apply"
+	// operationRotateCredentials is the operation recorded for RotateCredentials calls.
+	operationRotateCredentials = "rotate-credentials"
+	// operationReset is the operation recorded for Reset calls.
+	operationReset = "reset"
+	// operationRollback is the operation recorded for Rollback calls.
+	operationRollback = "rollback"
+)
+
+// ErrNoConfiguration is returned when credentials are rotated while no proxy
+// configuration is applied.
+var ErrNoConfiguration = errors.New("no proxy configuration is applied")
+
+// Credentials are the username and password of a proxy.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// rotatableProtocols lists the protocols whose credentials can be rotated.
+var rotatableProtocols = []protocol{protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS}
+
+// CheckCredentials returns an error if creds is empty, or if any of its keys
+// isn't one of http, https, ftp or socks, or has an empty username.
+func CheckCredentials(creds map[string]Credentials) error {
+	if len(creds) == 0 {
+		return errors.New("no credentials to rotate")
+	}
+	for name, c := range creds {
+		if _, err := rotatableProtocol(name); err != nil {
+			return err
+		}
+		if c.Username == "" {
+			return fmt.Errorf("empty username for %s proxy", name)
+		}
+	}
+	return nil
+}
+
+// rotatableProtocol returns the protocol whose credentials can be rotated
+// matching the given lowercase name.
+func rotatableProtocol(name string) (protocol, error) {
+	for _, proto := range rotatableProtocols {
+		if strings.ToLower(proto.String()) == name {
+			return proto, nil
+		}
+	}
+	return 0, fmt.Errorf("can't rotate credentials of unknown protocol %q, must be one of http, https, ftp, socks", name)
+}
+
+// RotateCredentials replaces the credentials of the proxies of the given
+// protocols (http, https, ftp or socks) in the applied configuration, and
+// applies it again. Every other setting is kept.
+// It returns ErrNoConfiguration if no configuration is applied, and an error
+// if the proxy of a given protocol isn't set or has no credentials.
+func (p Proxy) RotateCredentials(creds map[string]Credentials) (err error) {
+	defer decorate.OnError(&err, "couldn't rotate proxy credentials")
+
+	if err := CheckCredentials(creds); err != nil {
+		return err
+	}
+
+	// Iterate in a stable order, so that the first error is always the same.
+	names := maps.Keys(creds)
+	slices.Sort(names)
+
+	log.Infof("Rotating proxy credentials for %s", strings.Join(names, ", "))
+
+	s, err := p.currentSettings()
+	if err != nil {
+		return err
+	}
+	// The credentials of NTLM proxies are only known to cntlm.
+	if s.HTTP == cntlmListenURL || s.HTTPS == cntlmListenURL {
+		return errors.New("the proxies are reached through cntlm: apply the settings again with the new NTLM credentials")
+	}
+
+	for _, name := range names {
+		proto, _ := rotatableProtocol(name)
+		uri := s.get(proto)
+		if uri == nil || *uri == "" {
+			return fmt.Errorf("no %s proxy is set", name)
+		}
+		u, err := url.Parse(*uri)
+		if err != nil {
+			return err
+		}
+		if u.User == nil {
+			return fmt.Errorf("the %s proxy has no credentials", name)
+		}
+		u.User = url.User(creds[name].Username)
+		if creds[name].Password != "" {
+			u.User = url.UserPassword(creds[name].Username, creds[name].Password)
+		}
+		*uri = u.String()
+	}
+
+	return p.apply(s, operationRotateCredentials)
+}
+
+// get returns a pointer to the URL of the given proxy protocol in s.
+func (s *Settings) get(proto protocol) *string {
+	switch proto {
+	case protocolHTTP:
+		return &s.HTTP
+	case protocolHTTPS:
+		return &s.HTTPS
+	case protocolFTP:
+		return &s.FTP
+	case protocolSOCKS:
+		return &s.SOCKS
+	case protocolNo:
+		return &s.NoProxy
+	case protocolAuto:
+		return &s.Auto
+	}
+	return nil
+}
+
+// currentSettings returns the applied proxy settings. They are read back from
+// the environment file, the only one containing every proxy URL with its
+// credentials. The autoconfiguration URL, which isn't part of it, is taken from
+// the last recorded Apply call, and the per-host proxies are read back from the
+// backend supporting them.
+func (p Proxy) currentSettings() (s Settings, err error) {
+	var envPath string
+	for _, b := range p.backends {
+		if env, ok := b.(envBackend); ok {
+			envPath = env.path
+		}
+		if hb, ok := b.(hostProxiesBackend); ok && p.backendMode(b) == BackendModeManaged {
+			if s.APTHostProxies, err = hb.appliedHostProxies(); err != nil {
+				return Settings{}, err
+			}
+		}
+	}
+
+	content, err := previousConfig(envPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, ErrNoConfiguration
+	} else if err != nil {
+		return s, err
+	}
+	if !strings.HasPrefix(content, confHeader) {
+		return s, fmt.Errorf("%w: %q is not managed by ubuntu-proxy-manager", ErrNoConfiguration, envPath)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		// Extra lines are not part of the proxy settings.
+		if line == extraLinesHeader {
+			break
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		var uri *string
+		for _, proto := range []protocol{protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS, protocolNo} {
+			if key == strings.ToUpper(proto.String())+"_PROXY" {
+				uri = s.get(proto)
+			}
+		}
+		if uri == nil {
+			continue
+		}
+		if *uri, err = strconv.Unquote(value); err != nil {
+			return Settings{}, fmt.Errorf("invalid value for %s in %q: %w", key, envPath, err)
+		}
+	}
+
+	// The hosts reached directly because of no_proxy aren't per-host proxies
+	// of the settings.
+	for _, host := range directHosts(s.NoProxy) {
+		if s.APTHostProxies[host] == aptDirect {
+			delete(s.APTHostProxies, host)
+		}
+	}
+
+	if p.state != nil {
+		var last LastApply
+		if err := p.state.Load(lastApplyStateFile, &last); err == nil {
+			s.Auto = last.Settings[strings.ToLower(protocolAuto.String())]
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return Settings{}, err
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedRubyGemsProtocols lists the protocols that are not supported by RubyGems.
+var unsupportedRubyGemsProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolNo, protocolAuto}
+
+// rubyGemsProxyRegexp matches the http_proxy key of a gemrc file, as a string
+// or a symbol.
+var rubyGemsProxyRegexp = regexp.MustCompile(`^:?http_proxy\s*:`)
+
+// rubyGemsBackend applies the proxy configuration to the http_proxy key of
+// /etc/gemrc, the system-wide RubyGems configuration. The file is shared: only
+// the http_proxy key is managed, and the rest of the file is left untouched.
+// The backend is only applied if RubyGems is installed.
+type rubyGemsBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("rubygems", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return rubyGemsBackend{root: opts.root, path: filepath.Join(opts.root, defaultRubyGemsConfigPath), fs: r}
+	})
+}
+
+func (b rubyGemsBackend) name() string    { return "rubygems" }
+func (b rubyGemsBackend) paths() []string { return []string{b.path} }
+func (b rubyGemsBackend) sharesFiles()    {}
+
+func (b rubyGemsBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP, protocolSOCKS:
+		return "RubyGems has a single proxy setting, used for HTTP and HTTPS"
+	case protocolNo:
+		return "RubyGems only reads the hosts bypassing the proxy from the environment"
+	case protocolAuto:
+		return "RubyGems doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the RubyGems configuration isn't applied:
+// RubyGems isn't installed.
+func (b rubyGemsBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "gem")
+}
+
+// apply replaces the http_proxy key of the gemrc file with the given proxy
+// settings. If there are no proxy settings to apply, the key is removed, but
+// the file never is. Nothing is done if RubyGems isn't installed.
+func (b rubyGemsBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply RubyGems proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping RubyGems proxy configuration", reason)
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := rubyGemsConfig(prev, settings)
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying RubyGems proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// rubyGemsConfig returns content with the http_proxy keys removed and, if there
+// are settings to apply, the managed one added at the end of the file. RubyGems
+// has a single proxy key for every request: it is set to the HTTPS proxy if
+// there is one, as gem sources are reached over HTTPS, and to the HTTP proxy
+// otherwise. The key is written as a symbol, which RubyGems reads first, and
+// its value single-quoted.
+func rubyGemsConfig(content string, settings []setting) string {
+	var proxy string
+	for _, s := range settings {
+		if slices.Contains(unsupportedRubyGemsProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported RubyGems proxy setting %q", s.protocol)
+			continue
+		}
+		if s.protocol == protocolHTTPS || proxy == "" {
+			proxy = s.escapedURL
+		}
+	}
+
+	var key string
+	if proxy != "" {
+		key = fmt.Sprintf(":http_proxy: %s\n", yamlQuote(proxy))
+	}
+	return replaceYAMLKey(content, rubyGemsProxyRegexp, key)
+}
+
+// replaceYAMLKey returns content with the top-level keys matching key and
+// their indented values removed and, if entry isn't empty, entry added at the
+// end of the file, preceded by the managed entries header. The other lines are
+// kept verbatim.
+func replaceYAMLKey(content string, key *regexp.Regexp, entry string) string {
+	lines := strings.SplitAfter(content, "\n")
+	var out strings.Builder
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		if line == managedEntriesHeader {
+			continue
+		}
+		if key.MatchString(line) {
+			// Skip the indented continuation lines of the value as well.
+			for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" && strings.TrimLeft(lines[i+1], " \t") != lines[i+1] {
+				i++
+			}
+			continue
+		}
+		out.WriteString(lines[i])
+	}
+	result := out.String()
+
+	if entry == "" {
+		return result
+	}
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result + managedEntriesHeader + "\n" + entry
+}
+
+// yamlQuote returns value as a single-quoted YAML scalar, in which nothing is
+// escaped but the single quotes themselves.
+func yamlQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,70 @@
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestRubyGemsConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: "localhost"}
+
+	tests := map[string]struct {
+		fixture      string
+		settings     proxy.Settings
+		notInstalled bool
+	}{
+		"Create file":                                {settings: set},
+		"HTTP proxy is used without HTTPS proxy":     {settings: proxy.Settings{HTTP: "http://example.com:8080"}},
+		"Credentials are quoted":                     {settings: proxy.Settings{HTTP: "http://bob'smith:p@ss@example.com:8080"}},
+		"Add proxy key after the other ones":         {fixture: "with_options", settings: set},
+		"Add proxy key to a file without newline":    {fixture: "without_trailing_newline", settings: set},
+		"Replace proxy key set by hand":              {fixture: "hand_written_proxy", settings: set},
+		"Replace multiline proxy symbol set by hand": {fixture: "hand_written_symbol_proxy", settings: set},
+		"Replace previously managed proxy key":       {fixture: "previously_managed", settings: set},
+		"Remove managed proxy key":                   {fixture: "previously_managed"},
+		"Remove proxy key set by hand":               {fixture: "hand_written_proxy"},
+		"Remove proxy key with unsupported settings": {fixture: "previously_managed", settings: proxy.Settings{SOCKS: "socks://example.com:1080"}},
+		"File without proxy key is left untouched":   {fixture: "without_trailing_newline"},
+		"Missing file is not created on removal":     {},
+		"Nothing is done without RubyGems":           {fixture: "with_options", settings: set, notInstalled: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.fixture != "" {
+				err := shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), tc.fixture), filepath.Join(root, "etc"), nil)
+				require.NoError(t, err, "Setup: couldn't copy fixture")
+			}
+			if !tc.notInstalled {
+				installPrograms(t, root, "gem")
+			}
+
+			// Only the RubyGems backend is managed.
+			p := proxy.New(proxy.WithRoot(root), proxy.WithBackendModes(proxy.OnlyBackend("rubygems")))
+			err := p.Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			// Applying the same settings again doesn't change anything.
+			first, err := os.ReadFile(filepath.Join(root, proxy.DefaultRubyGemsConfigPath))
+			if err == nil {
+				require.NoError(t, p.Apply(tc.settings), "Second Apply failed but shouldn't have")
+				second, err := os.ReadFile(filepath.Join(root, proxy.DefaultRubyGemsConfigPath))
+				require.NoError(t, err, "Configuration should still exist after the second Apply")
+				require.Equal(t, string(first), string(second), "Second Apply should not change the configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,104 @@
+//go:build !noapt && !nogsettings
+
+package proxy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+// scenarioStep is a single Apply call in a scenario.
+type scenarioStep struct {
+	name string
+
+	http    string
+	https   string
+	ftp     string
+	socks   string
+	noProxy string
+	auto    string
+
+	wantUnchangedFiles []string
+}
+
+// TestScenarios replays sequences of Apply calls against the same root,
+// comparing the system tree against goldens after each step.
+func TestScenarios(t *testing.T) {
+	t.Parallel()
+
+	envConfigPath := proxy.DefaultEnvConfigPath
+	aptConfigPath := proxy.DefaultAPTConfigPath
+	gsettingsConfigPath := proxy.DefaultGSettingsConfigPath
+
+	tests := map[string][]scenarioStep{
+		"Corporate rollout": {
+			{name: "Set full corporate configuration at boot",
+				http: "http://proxy.corp.example.com:3128", https: "http://proxy.corp.example.com:3128", ftp: "http://proxy.corp.example.com:3128", socks: "socks5://socks.corp.example.com:1080",
+				noProxy: "localhost,127.0.0.1,.corp.example.com", auto: "http://wpad.corp.example.com/proxy.pac"},
+			{name: "Reapply corporate configuration at boot",
+				http: "http://proxy.corp.example.com:3128", https: "http://proxy.corp.example.com:3128", ftp: "http://proxy.corp.example.com:3128", socks: "socks5://socks.corp.example.com:1080",
+				noProxy: "localhost,127.0.0.1,.corp.example.com", auto: "http://wpad.corp.example.com/proxy.pac",
+				wantUnchangedFiles: []string{envConfigPath, aptConfigPath, gsettingsConfigPath}},
+			{name: "Narrow configuration at user login",
+				http: "http://proxy.corp.example.com:3128", https: "http://proxy.corp.example.com:3128", noProxy: "localhost"},
+			{name: "Clear configuration at logout"},
+		},
+		"Proxy change with credential rotation": {
+			{name: "Set authenticated proxy", http: "http://bob:0ld-p@$$@proxy.example.com:8080", https: "http://bob:0ld-p@$$@proxy.example.com:8080"},
+			{name: "Rotate credentials", http: "http://bob:n3w-p@$$@proxy.example.com:8080", https: "http://bob:n3w-p@$$@proxy.example.com:8080"},
+			{name: "Move to a new proxy host", http: "http://bob:n3w-p@$$@proxy2.example.com:8080", https: "http://bob:n3w-p@$$@proxy2.example.com:8080"},
+			{name: "Drop authentication", http: "http://proxy2.example.com:8080", https: "http://proxy2.example.com:8080"},
+		},
+		"Full decommission": {
+			{name: "Set all settings",
+				http: "http://example.com:8080", https: "https://example.com:8443", ftp: "ftp://example.com:2121", socks: "socks://example.com:1080",
+				noProxy: "localhost", auto: "http://example.com/proxy.pac"},
+			{name: "Remove all settings"},
+			{name: "Remove all settings again"},
+		},
+	}
+	for name, steps := range tests {
+		steps := steps
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// A persistent root directory for all the steps of the scenario, and a
+			// temp scratch directory to use for the mock.
+			root, temp := t.TempDir(), t.TempDir()
+			for _, p := range []string{filepath.Dir(envConfigPath), filepath.Dir(aptConfigPath), filepath.Dir(gsettingsConfigPath)} {
+				err := os.MkdirAll(filepath.Join(root, p), 0700)
+				require.NoError(t, err, "Setup: Couldn't create %s", p)
+			}
+
+			p := proxy.New(proxy.WithRoot(root), proxy.WithGlibCompileSchemasCmd(append(mockGlibCompileSchemasCmd(t, temp), "-Exit0-")))
+			initialTime := time.Unix(0, 0).UTC()
+
+			for _, step := range steps {
+				step := step
+				t.Run(step.name, func(t *testing.T) {
+					for _, file := range step.wantUnchangedFiles {
+						err := os.Chtimes(filepath.Join(root, file), time.Now().UTC(), initialTime)
+						require.NoError(t, err, "Setup: Couldn't change mtime for %q", file)
+					}
+
+					err := p.Apply(proxy.Settings{HTTP: step.http, HTTPS: step.https, FTP: step.ftp, SOCKS: step.socks, NoProxy: step.noProxy, Auto: step.auto})
+					require.NoError(t, err, "Apply failed but shouldn't have")
+
+					testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+					for _, file := range step.wantUnchangedFiles {
+						fi, err := os.Stat(filepath.Join(root, file))
+						require.NoError(t, err, "Failed to stat proxy config file %q", file)
+						require.Equal(t, initialTime, fi.ModTime().UTC(), "Proxy config file %q should not have been rewritten", file)
+					}
+				})
+			}
+		})
+	}
+}
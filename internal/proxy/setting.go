@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -23,6 +24,10 @@ const (
 	protocolAuto // autoconfiguration URL
 )
 
+// protocolOrder is the canonical order of the settings in the rendered
+// configurations.
+var protocolOrder = []protocol{protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS, protocolAll, protocolNo, protocolAuto}
+
 // setting represents a proxy setting to be applied on the system.
 type setting struct {
 	protocol   protocol
@@ -31,37 +36,72 @@ type setting struct {
 	url *url.URL
 }
 
+// Settings are the proxy settings requested by a caller. Empty fields are not set.
+type Settings struct {
+	HTTP  string
+	HTTPS string
+	FTP   string
+	SOCKS string
+	// NoProxy is a comma-separated list of hosts excluded from proxy.
+	NoProxy string
+	// Auto is the proxy autoconfiguration URL.
+	Auto string
+	// APTHostProxies are the proxies used by APT for specific hosts instead of
+	// the global ones, indexed by host. A value of DIRECT makes APT reach the
+	// host without any proxy.
+	APTHostProxies map[string]string
+	// NTLMDomain is the domain of the account of the HTTP and HTTPS proxies,
+	// if they require NTLM authentication. The other backends then reach them
+	// through the local listener of the cntlm backend, which authenticates.
+	NTLMDomain string
+	// SnapStoreID is the ID of the Snap Store Proxy snapd is registered
+	// against, unset if empty. The registration is left untouched if nil.
+	SnapStoreID *string
+
+	// EmptyMeansNoop overrides for this call the daemon default of
+	// WithEmptyMeansNoop, if set. It isn't a setting.
+	EmptyMeansNoop *bool
+	// Backends restricts this call to the backends of the given names, if set.
+	// The other ones are left untouched, as if disabled. It isn't a setting.
+	Backends []string
+}
+
+// empty returns true if none of the settings is set.
+func (s Settings) empty() bool {
+	return s.HTTP == "" && s.HTTPS == "" && s.FTP == "" && s.SOCKS == "" && s.NoProxy == "" && s.Auto == "" && len(s.APTHostProxies) == 0 && s.SnapStoreID == nil
+}
+
 // newSettings parses and validates the given proxy settings, returning them in a
 // format ready to be applied on the system.
-func newSettings(http, https, ftp, socks, noproxy, auto string) (settings []setting, err error) {
+func newSettings(s Settings) (settings []setting, err error) {
 	defer decorate.OnError(&err, "couldn't set proxy configuration")
 
-	if http != "" {
-		setting, err := newSetting(protocolHTTP, http)
+	if s.HTTP != "" {
+		setting, err := newSetting(protocolHTTP, s.HTTP)
 		if err != nil {
 			return nil, err
 		}
 		settings = append(settings, setting)
 	}
 
-	if https != "" {
-		setting, err := newSetting(protocolHTTPS, https)
+	if s.HTTPS != "" {
+		setting, err := newSetting(protocolHTTPS, s.HTTPS)
 		if err != nil {
 			return nil, err
 		}
 		settings = append(settings, setting)
 	}
 
-	if ftp != "" {
-		setting, err := newSetting(protocolFTP, ftp)
+	if s.FTP != "" {
+		setting, err := newSetting(protocolFTP, s.FTP)
 		if err != nil {
 			return nil, err
 		}
 		settings = append(settings, setting)
 	}
 
-	if socks != "" {
-		setting, err := newSetting(protocolSOCKS, socks)
+	if s.SOCKS != "" {
+		setting, err := newSetting(protocolSOCKS, s.SOCKS)
 		if err != nil {
 			return nil, err
 		}
@@ -70,23 +110,23 @@ func newSettings(http, https, ftp, socks, noproxy, auto string) (settings []sett
 
 	// If all protocols are set, and the escaped values are the same, we can safely set all_proxy as well
 	if len(settings) == 4 && slices.EqualFunc(settings, settings, func(a, _ setting) bool { return a.escapedURL == settings[0].escapedURL }) {
-		setting, err := newSetting(protocolAll, http)
+		setting, err := newSetting(protocolAll, s.HTTP)
 		if err != nil {
 			return nil, err
 		}
 		settings = append(settings, setting)
 	}
 
-	if noproxy != "" {
-		setting, err := newSetting(protocolNo, noproxy)
+	if s.NoProxy != "" {
+		setting, err := newSetting(protocolNo, s.NoProxy)
 		if err != nil {
 			return nil, err
 		}
 		settings = append(settings, setting)
 	}
 
-	if auto != "" {
-		setting, err := newSetting(protocolAuto, auto)
+	if s.Auto != "" {
+		setting, err := newSetting(protocolAuto, s.Auto)
 		if err != nil {
 			return nil, err
 		}
@@ -96,6 +136,79 @@ func newSettings(http, https, ftp, socks, noproxy, auto string) (settings []sett
 	return settings, nil
 }
 
+// aptDirect is the APT proxy value reaching the host without any proxy.
+const aptDirect = "DIRECT"
+
+// aptHostRegexp matches the hosts which can be used in the name of an APT
+// configuration option.
+var aptHostRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// hostProxy is a proxy used for a specific host instead of the global one.
+type hostProxy struct {
+	host string
+	// proxy is nil if the host is reached without any proxy.
+	proxy *setting
+}
+
+// value returns the proxy URL of the host, or DIRECT.
+func (h hostProxy) value() string {
+	if h.proxy == nil {
+		return aptDirect
+	}
+	return h.proxy.escapedURL
+}
+
+// newHostProxies parses and validates the given proxies indexed by host,
+// returning them sorted by host.
+func newHostProxies(proxies map[string]string) (hostProxies []hostProxy, err error) {
+	defer decorate.OnError(&err, "couldn't set per-host proxy configuration")
+
+	hosts := maps.Keys(proxies)
+	slices.Sort(hosts)
+	for _, host := range hosts {
+		if !aptHostRegexp.MatchString(host) {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+
+		h := hostProxy{host: host}
+		if proxies[host] != aptDirect {
+			setting, err := newSetting(protocolHTTP, proxies[host])
+			if err != nil {
+				return nil, err
+			}
+			h.proxy = &setting
+		}
+		hostProxies = append(hostProxies, h)
+	}
+
+	return hostProxies, nil
+}
+
+// directHosts returns the hosts of the given no_proxy list which can be reached
+// directly with per-host proxies, lowercased. Only exact hosts can be:
+// domain suffixes, wildcards, CIDRs and entries with a port are left out.
+func directHosts(noProxy string) (hosts []string) {
+	for _, host := range strings.Split(noProxy, ",") {
+		host = strings.ToLower(strings.Trim(host, ` '"`))
+		if !aptHostRegexp.MatchString(host) || slices.Contains(hosts, host) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// sortedSettings returns a copy of the given settings in the canonical
+// protocol order, so that the rendered configurations don't depend on the
+// order in which the settings were built.
+func sortedSettings(settings []setting) []setting {
+	sorted := slices.Clone(settings)
+	slices.SortStableFunc(sorted, func(a, b setting) bool {
+		return slices.Index(protocolOrder, a.protocol) < slices.Index(protocolOrder, b.protocol)
+	})
+	return sorted
+}
+
 // newSetting creates a new proxy setting from the given protocol and URL.
 // It returns an error if the URL is invalid.
 func newSetting(proto protocol, uri string) (p setting, err error) {
@@ -113,7 +226,10 @@ func newSetting(proto protocol, uri string) (p setting, err error) {
 		return p, fmt.Errorf("missing scheme in proxy URI %q", uri)
 	}
 
-	uri = escapeURLCredentials(uri)
+	// The zone identifier separator is escaped before the credentials so that
+	// it's not mistaken for an escaped character, and again after, as the
+	// whole URI is unescaped along with the credentials.
+	uri = escapeIPv6Zone(escapeURLCredentials(escapeIPv6Zone(uri)))
 	parsedURL, err := url.Parse(uri)
 	if err != nil {
 		return p, err
@@ -123,7 +239,7 @@ func newSetting(proto protocol, uri string) (p setting, err error) {
 	if parsedURL.User != nil {
 		host = parsedURL.User.String() + "@"
 	}
-	host += parsedURL.Host
+	host += escapeIPv6Zone(parsedURL.Host)
 	escapedURL := fmt.Sprintf("%s://%s", parsedURL.Scheme, host)
 
 	return setting{
@@ -133,6 +249,24 @@ func newSetting(proto protocol, uri string) (p setting, err error) {
 	}, nil
 }
 
+// ipv6ZoneRegexp matches an IPv6 literal with a zone identifier, whose
+// separator is either escaped or not.
+var ipv6ZoneRegexp = regexp.MustCompile(`\[([0-9a-fA-F:.]+)%(?:25)?([^\]]+)\]`)
+
+// escapeIPv6Zone escapes the zone identifier separator of IPv6 literals in
+// the given URI as %25, as defined in RFC 6874. Already escaped separators are
+// left untouched.
+func escapeIPv6Zone(uri string) string {
+	return ipv6ZoneRegexp.ReplaceAllString(uri, "[$1%25$2]")
+}
+
+// hostZone returns the host of u without its IPv6 zone identifier, and the
+// zone identifier if any.
+func hostZone(u *url.URL) (host, zone string) {
+	host, zone, _ = strings.Cut(u.Hostname(), "%")
+	return host, zone
+}
+
 // escapeURLCredentials escapes special characters from the credentials in the
 // given URL, if any.
 func escapeURLCredentials(uri string) string {
@@ -140,10 +274,12 @@ func escapeURLCredentials(uri string) string {
 	// At best, this prevents us from escaping the URL multiple times
 	// At worst, the URL is not affected (we will treat % signs as part of the
 	// credentials and escape them later)
-	uri, _ = url.PathUnescape(uri)
+	if unescaped, err := url.PathUnescape(uri); err == nil {
+		uri = unescaped
+	}
 
 	// Regexp to check if the URI contains credentials
-	r := regexp.MustCompile(`^\w+://(?:(?P<credentials>.*:?.*)@)[a-zA-Z0-9.-]+(:[0-9]+)?/?$`)
+	r := regexp.MustCompile(`^\w+://(?:(?P<credentials>.*:?.*)@)(\[[0-9a-fA-F:.]+(%[^\]]+)?\]|[a-zA-Z0-9.-]+)(:[0-9]+)?/?$`)
 	matchIndex := r.SubexpIndex("credentials")
 	matches := r.FindStringSubmatch(uri)
 	if len(matches) >= matchIndex {
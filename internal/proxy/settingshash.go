@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// settingsHashVersion prefixes every settings hash. It must be changed whenever
+// the normalization or the hash function changes, so that hashes computed by
+// previous versions are never considered equal to current ones.
+const settingsHashVersion byte = 1
+
+// SettingsHash identifies a set of proxy settings. The credentials are hashed
+// separately from the other settings, so that a credential rotation can be told
+// apart from a proxy change.
+// Both hashes are hexadecimal, starting with the version of the algorithm.
+type SettingsHash struct {
+	// Settings covers every setting, without the credentials.
+	Settings string `json:"settings"`
+	// Credentials covers the credentials of every proxy.
+	Credentials string `json:"credentials"`
+}
+
+// Equal returns true if both hashes are current and identify the same
+// settings, credentials included.
+func (h SettingsHash) Equal(other SettingsHash) bool {
+	return h.current() && other.current() && h == other
+}
+
+// SameSettings returns true if both hashes are current and identify the same
+// settings, regardless of the credentials.
+func (h SettingsHash) SameSettings(other SettingsHash) bool {
+	return h.current() && other.current() && h.Settings == other.Settings
+}
+
+// current returns true if h was computed by the current version of the
+// algorithm.
+func (h SettingsHash) current() bool {
+	version := hex.EncodeToString([]byte{settingsHashVersion})
+	return strings.HasPrefix(h.Settings, version) && strings.HasPrefix(h.Credentials, version)
+}
+
+// hashSettings returns the hash of the given parsed settings. They are
+// normalized first: the order of the settings and of the no_proxy entries
+// doesn't matter, nor do duplicate no_proxy entries or the case of the hosts.
+// The all setting is ignored, as it is derived from the other ones.
+func hashSettings(settings []setting) SettingsHash {
+	var values, credentials []string
+	for _, s := range sortedSettings(settings) {
+		name := strings.ToLower(s.protocol.String())
+		switch s.protocol {
+		case protocolAll:
+			continue
+		case protocolNo:
+			values = append(values, name+"="+strconv.Quote(normalizeNoProxy(s.escapedURL)))
+		case protocolAuto:
+			values = append(values, name+"="+strconv.Quote(s.escapedURL))
+		default:
+			values = append(values, name+"="+strconv.Quote(fmt.Sprintf("%s://%s", s.url.Scheme, strings.ToLower(s.url.Host))))
+			if s.url.User != nil {
+				password, _ := s.url.User.Password()
+				credentials = append(credentials, name+"="+strconv.Quote(s.url.User.Username())+":"+strconv.Quote(password))
+			}
+		}
+	}
+
+	return SettingsHash{
+		Settings:    versionedHash(values),
+		Credentials: versionedHash(credentials),
+	}
+}
+
+// versionedHash returns the hexadecimal SHA-256 hash of the given lines,
+// prefixed with the version of the algorithm.
+func versionedHash(lines []string) string {
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintln(h, l)
+	}
+	return hex.EncodeToString(append([]byte{settingsHashVersion}, h.Sum(nil)...))
+}
+
+// normalizeNoProxy returns the given no_proxy list lowercased, sorted and
+// without duplicates, quotes nor spaces.
+func normalizeNoProxy(noProxy string) string {
+	var hosts []string
+	for _, host := range strings.Split(noProxy, ",") {
+		host = strings.ToLower(strings.Trim(host, ` '"`))
+		if host == "" || slices.Contains(hosts, host) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return strings.Join(hosts, ",")
+}
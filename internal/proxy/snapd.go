@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedSnapdProtocols lists the protocols that are not supported by snapd.
+var unsupportedSnapdProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// snapdProxyKeys maps the supported protocols to the snapd system options
+// setting them.
+var snapdProxyKeys = map[protocol]string{
+	protocolHTTP:  "http",
+	protocolHTTPS: "https",
+	protocolNo:    "no-proxy",
+}
+
+// snapdServiceVariables maps the snapd proxy options, indexed by their name
+// relative to the proxy option, to the environment variables setting them in
+// the snapd service, in the order they are written.
+var snapdServiceVariables = []struct{ key, variable string }{
+	{"http", "HTTP_PROXY"},
+	{"https", "HTTPS_PROXY"},
+	{"no-proxy", "NO_PROXY"},
+}
+
+// snapStoreIDRegexp matches the IDs of Snap Store Proxies.
+var snapStoreIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// errSnapStoreUnavailable is returned when the Snap Store Proxy can't be set,
+// as the snapd API is unavailable.
+var errSnapStoreUnavailable = errors.New("the Snap Store Proxy can only be set through the snapd API, which is unavailable")
+
+// snapdChangePollInterval is the time between two checks of a pending snapd
+// change.
+const snapdChangePollInterval = 100 * time.Millisecond
+
+// defaultSnapdChangeTimeout is the default time after which waiting for snapd
+// to complete a change is abandoned, whatever the filesystem timeout, so that a
+// stuck change doesn't block the other Apply calls.
+const defaultSnapdChangeTimeout = 2 * time.Minute
+
+// unixSocketRequestTimeout bounds each request sent to a REST API listening on
+// a unix socket.
+const unixSocketRequestTimeout = 30 * time.Second
+
+// snapdBackend applies the proxy configuration to the proxy system options of
+// snapd, through its REST API, so that snap refreshes go through the proxy.
+// When the API is unavailable, as while building or seeding an image, the
+// configuration is set in the environment of the snapd service instead, with a
+// systemd drop-in. It also registers the device against a Snap Store Proxy,
+// with the proxy.store option, when asked to.
+type snapdBackend struct {
+	socket string
+	// dropInPath is the path of the snapd service drop-in of the fallback.
+	dropInPath string
+	// unitPaths are the paths where the snapd service may be installed.
+	unitPaths []string
+	// changeTimeout bounds the wait for snapd to complete a change.
+	changeTimeout time.Duration
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("snapd", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		socket := opts.snapdSocket
+		if socket == "" {
+			socket = filepath.Join(opts.root, defaultSnapdSocketPath)
+		}
+		var unitPaths []string
+		for _, path := range defaultSnapdUnitPaths {
+			unitPaths = append(unitPaths, filepath.Join(opts.root, path))
+		}
+		changeTimeout := opts.snapdChangeTimeout
+		if changeTimeout == 0 {
+			changeTimeout = defaultSnapdChangeTimeout
+		}
+		return snapdBackend{socket: socket, dropInPath: filepath.Join(opts.root, defaultSnapdDropInPath), unitPaths: unitPaths, changeTimeout: changeTimeout, fs: r}
+	})
+}
+
+func (b snapdBackend) name() string { return "snapd" }
+
+// paths returns the drop-in of the fallback, as the configuration is otherwise
+// stored by snapd.
+func (b snapdBackend) paths() []string { return []string{b.dropInPath} }
+func (b snapdBackend) externalState()  {}
+
+func (b snapdBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP:
+		return "snapd only downloads over HTTP and HTTPS"
+	case protocolSOCKS:
+		return "snapd doesn't support SOCKS proxies"
+	case protocolAuto:
+		return "snapd doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// apply applies the given proxy settings, leaving the Snap Store Proxy
+// untouched.
+func (b snapdBackend) apply(ctx context.Context, settings []setting) error {
+	return b.applySnapStore(ctx, settings, nil)
+}
+
+// applySnapStore sets the proxy system options of snapd to the given proxy
+// settings and store ID, unless they already have these values, and removes the
+// drop-in of the fallback. If there are no proxy settings to apply, the options
+// are unset. The Snap Store Proxy is unset if storeID is empty, and left
+// untouched if it is nil. If snapd doesn't listen on its socket, the fallback is
+// applied instead, and the Snap Store Proxy can't be set.
+func (b snapdBackend) applySnapStore(ctx context.Context, settings []setting, storeID *string) (err error) {
+	defer decorate.OnError(&err, "couldn't apply snapd proxy configuration")
+
+	if _, err := os.Stat(b.socket); errors.Is(err, fs.ErrNotExist) {
+		log.Debugf("snapd socket %q doesn't exist, falling back to the snapd service environment", b.socket)
+		return b.applyDropIn(ctx, settings, storeID)
+	} else if err != nil {
+		return err
+	}
+
+	client := newSnapdClient(b.socket, b.changeTimeout)
+	current, err := client.proxyOptions(ctx)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		log.Debugf("snapd doesn't listen on %q, falling back to the snapd service environment: %v", b.socket, err)
+		return b.applyDropIn(ctx, settings, storeID)
+	} else if err != nil {
+		return err
+	}
+
+	// The system options supersede the fallback. It is removed first, as
+	// waiting for snapd isn't bounded by the filesystem timeout of ctx.
+	if err := applyConfigFile(ctx, b.fs, b.dropInPath, "", true); err != nil {
+		return err
+	}
+
+	want := snapdConfig(settings)
+	if noSupportedProtocols(settings, unsupportedSnapdProtocols) {
+		log.Debug("No proxy settings to apply, unsetting snapd proxy options if they are set")
+	}
+
+	// Only the options which differ are sent, null unsetting an option.
+	changes := make(map[string]*string)
+	for _, key := range snapdProxyKeys {
+		value, set := want[key]
+		if value == current[key] {
+			continue
+		}
+		if set {
+			changes["proxy."+key] = &value
+		} else {
+			changes["proxy."+key] = nil
+		}
+	}
+	if storeID != nil && *storeID != current["store"] {
+		changes["proxy.store"] = storeID
+		if *storeID == "" {
+			changes["proxy.store"] = nil
+		}
+	}
+	if len(changes) == 0 {
+		log.Debug("snapd proxy configuration is already up to date")
+	} else {
+		log.Debugf("Applying snapd proxy configuration through %q", b.socket)
+		return client.setSystemOptions(ctx, changes)
+	}
+	return nil
+}
+
+// applyDropIn applies the proxy configuration to the snapd service drop-in. If
+// there are no proxy settings to apply, the drop-in is removed. Nothing is
+// written if snapd isn't installed. snapd reads it the next time it starts.
+// As the Snap Store Proxy can't be set in the drop-in, an error is returned
+// once it is applied if storeID isn't nil.
+func (b snapdBackend) applyDropIn(ctx context.Context, settings []setting, storeID *string) error {
+	remove := noSupportedProtocols(settings, unsupportedSnapdProtocols)
+	if !remove && !b.installed() {
+		log.Debug("snapd service isn't installed, skipping snapd proxy configuration")
+	} else {
+		log.Debugf("Applying snapd proxy configuration to %q", b.dropInPath)
+		if err := applyConfigFile(ctx, b.fs, b.dropInPath, snapdDropInConfig(settings), remove); err != nil {
+			return err
+		}
+	}
+
+	if storeID != nil {
+		return errSnapStoreUnavailable
+	}
+	return nil
+}
+
+// checkSnapStoreID returns an error if id isn't empty nor the ID of a Snap
+// Store Proxy.
+func checkSnapStoreID(id string) error {
+	if id != "" && !snapStoreIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid Snap Store Proxy ID %q", id)
+	}
+	return nil
+}
+
+// installed returns true if the snapd service is installed.
+func (b snapdBackend) installed() bool {
+	for _, path := range b.unitPaths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// snapdDropInConfig returns the formatted snapd service drop-in to be written.
+func snapdDropInConfig(settings []setting) string {
+	config := snapdConfig(settings)
+
+	content := fmt.Sprintln(confHeader)
+	content += "[Service]\n"
+	for _, v := range snapdServiceVariables {
+		if value, set := config[v.key]; set {
+			content += fmt.Sprintf("Environment=\"%s=%s\"\n", v.variable, systemdEnvEscaper.Replace(value))
+		}
+	}
+	return content
+}
+
+// snapdConfig returns the values of the snapd proxy options, indexed by their
+// name relative to the proxy option.
+func snapdConfig(settings []setting) map[string]string {
+	config := make(map[string]string)
+	for _, s := range settings {
+		if slices.Contains(unsupportedSnapdProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported snapd proxy setting %q", s.protocol)
+			continue
+		}
+		value := s.escapedURL
+		if s.protocol == protocolNo {
+			value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+		}
+		config[snapdProxyKeys[s.protocol]] = value
+	}
+	return config
+}
+
+// snapdClient is a client of the snapd REST API.
+type snapdClient struct {
+	http *http.Client
+	// changeTimeout bounds the wait for snapd to complete a change.
+	changeTimeout time.Duration
+}
+
+// newSnapdClient returns a client of the snapd REST API listening on the given
+// socket, waiting at most changeTimeout for the changes it requests.
+func newSnapdClient(socket string, changeTimeout time.Duration) snapdClient {
+	return snapdClient{http: unixSocketHTTPClient(socket), changeTimeout: changeTimeout}
+}
+
+// unixSocketHTTPClient returns an HTTP client sending every request to the
+// given unix socket, whatever the host of the request. Each request is
+// abandoned after unixSocketRequestTimeout.
+func unixSocketHTTPClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: unixSocketRequestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// snapdResponse is a response of the snapd REST API.
+type snapdResponse struct {
+	Type   string          `json:"type"`
+	Change string          `json:"change"`
+	Result json.RawMessage `json:"result"`
+}
+
+// snapdError is the result of an error response of the snapd REST API.
+type snapdError struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind"`
+}
+
+func (e snapdError) Error() string { return "snapd: " + e.Message }
+
+// snapdChange is the part of a snapd change we check.
+type snapdChange struct {
+	Status string `json:"status"`
+	Ready  bool   `json:"ready"`
+	Err    string `json:"err"`
+}
+
+// proxyOptions returns the values of the proxy system options, indexed by their
+// name relative to the proxy option. The unset options are absent.
+func (c snapdClient) proxyOptions(ctx context.Context) (map[string]string, error) {
+	var result map[string]map[string]any
+	err := c.do(ctx, http.MethodGet, "/v2/snaps/system/conf?keys=proxy", nil, &result)
+	var snapdErr snapdError
+	if errors.As(err, &snapdErr) && snapdErr.Kind == "option-not-found" {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	options := make(map[string]string)
+	for key, value := range result["proxy"] {
+		if s, ok := value.(string); ok && s != "" {
+			options[key] = s
+		}
+	}
+	return options, nil
+}
+
+// setSystemOptions sets the given system options, unsetting the nil ones, and
+// waits for snapd to complete the change, at most for the change timeout of the
+// client. The wait isn't bounded by the filesystem timeout of ctx, but ends on
+// shutdown.
+func (c snapdClient) setSystemOptions(ctx context.Context, options map[string]*string) error {
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.request(ctx, http.MethodPut, "/v2/snaps/system/conf", body)
+	if err != nil {
+		return err
+	}
+	if resp.Type != "async" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(serviceContext(ctx), c.changeTimeout)
+	defer cancel()
+	for {
+		var change snapdChange
+		if err := c.do(ctx, http.MethodGet, "/v2/changes/"+resp.Change, nil, &change); err != nil {
+			return err
+		}
+		if change.Ready {
+			if change.Err != "" {
+				return fmt.Errorf("snapd change %s failed: %s", resp.Change, change.Err)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("snapd change %s is still %s: %w", resp.Change, strings.ToLower(change.Status), ctx.Err())
+		case <-time.After(snapdChangePollInterval):
+		}
+	}
+}
+
+// do sends a request to the snapd REST API, decoding its result in result.
+func (c snapdClient) do(ctx context.Context, method, path string, body []byte, result any) error {
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// request sends a request to the snapd REST API, returning an error if snapd
+// answers with an error.
+func (c snapdClient) request(ctx context.Context, method, path string, body []byte) (snapdResponse, error) {
+	// The host is ignored, as requests are sent to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, bytes.NewReader(body))
+	if err != nil {
+		return snapdResponse{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return snapdResponse{}, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return snapdResponse{}, err
+	}
+	var resp snapdResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return snapdResponse{}, fmt.Errorf("invalid snapd response: %w", err)
+	}
+	if resp.Type == "error" {
+		var snapdErr snapdError
+		if err := json.Unmarshal(resp.Result, &snapdErr); err != nil {
+			return snapdResponse{}, fmt.Errorf("invalid snapd error response: %w", err)
+		}
+		return snapdResponse{}, snapdErr
+	}
+	return resp, nil
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// unsupportedSubversionProtocols lists the protocols that are not supported by Subversion.
+var unsupportedSubversionProtocols = []protocol{protocolFTP, protocolSOCKS, protocolAll, protocolAuto}
+
+// subversionProxyRegexp matches the proxy options of a section of the
+// Subversion servers file, whatever their case.
+var subversionProxyRegexp = regexp.MustCompile(`(?i)^http-proxy-(host|port|username|password|exceptions)\s*[=:]`)
+
+// subversionBackend applies the proxy configuration to the proxy options of
+// the [global] section of /etc/subversion/servers, the system-wide Subversion
+// servers configuration. The file is shared: only the proxy options of
+// [global] are managed, and the rest of the file, including the server groups
+// and their sections, is left untouched. The backend is only applied if
+// Subversion is installed.
+type subversionBackend struct {
+	root string
+	path string
+
+	fs *fsRunner
+}
+
+func init() {
+	registerBackend("subversion", func(opts options, r *fsRunner, _ *commandRunner) backend {
+		return subversionBackend{root: opts.root, path: filepath.Join(opts.root, defaultSubversionConfigPath), fs: r}
+	})
+}
+
+func (b subversionBackend) name() string    { return "subversion" }
+func (b subversionBackend) paths() []string { return []string{b.path} }
+func (b subversionBackend) sharesFiles()    {}
+
+func (b subversionBackend) skipReason(proto protocol) string {
+	switch proto {
+	case protocolFTP, protocolSOCKS:
+		return "Subversion has a single proxy setting, used for HTTP and HTTPS"
+	case protocolAuto:
+		return "Subversion doesn't support autoconfiguration URLs"
+	}
+	return ""
+}
+
+// unavailableReason returns why the Subversion configuration isn't applied:
+// Subversion isn't installed.
+func (b subversionBackend) unavailableReason() string {
+	return missingProgramReason(b.root, "svn")
+}
+
+// apply replaces the proxy options of the [global] section with the given
+// proxy settings. If there are no proxy settings to apply, the options are
+// removed, but the file never is. Nothing is done if Subversion isn't
+// installed.
+func (b subversionBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply Subversion proxy configuration")
+
+	if reason := b.unavailableReason(); reason != "" {
+		log.Debugf("%s, skipping Subversion proxy configuration", reason)
+		return nil
+	}
+
+	prev, err := previousConfig(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content := replaceINIOptions(prev, "global", subversionProxyRegexp, subversionConfig(settings))
+	if content == prev {
+		log.Debugf("Proxy configuration at %q is already up to date", b.path)
+		return nil
+	}
+
+	log.Debugf("Applying Subversion proxy configuration to %q", b.path)
+	return applySharedConfigFile(ctx, b.fs, b.path, content, 0644)
+}
+
+// subversionConfig returns the proxy options of the [global] section for the
+// given settings. Subversion has a single proxy for every request: it is set to
+// the HTTPS proxy if there is one, and to the HTTP proxy otherwise. The
+// no_proxy hosts are set as exceptions, which are wildcard patterns.
+func subversionConfig(settings []setting) string {
+	var proxy *setting
+	var exceptions []string
+	for i, s := range settings {
+		if slices.Contains(unsupportedSubversionProtocols, s.protocol) {
+			log.Debugf("Skipping unsupported Subversion proxy setting %q", s.protocol)
+			continue
+		}
+		switch s.protocol {
+		case protocolHTTP:
+			if proxy == nil {
+				proxy = &settings[i]
+			}
+		case protocolHTTPS:
+			proxy = &settings[i]
+		case protocolNo:
+			exceptions = wildcardNonProxyHosts(s.escapedURL)
+		}
+	}
+
+	var content string
+	if proxy != nil {
+		content += fmt.Sprintf("http-proxy-host = %s\n", proxy.url.Hostname())
+		if port := proxy.url.Port(); port != "" {
+			content += fmt.Sprintf("http-proxy-port = %s\n", port)
+		}
+		if user := proxy.url.User; user != nil {
+			content += fmt.Sprintf("http-proxy-username = %s\n", user.Username())
+			if password, set := user.Password(); set {
+				content += fmt.Sprintf("http-proxy-password = %s\n", password)
+			}
+		}
+	}
+	if len(exceptions) > 0 {
+		content += fmt.Sprintf("http-proxy-exceptions = %s\n", strings.Join(exceptions, ", "))
+	}
+	return content
+}
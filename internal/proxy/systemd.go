@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/slices"
+)
+
+// systemdValueEscaper escapes an assignment to be quoted in a systemd
+// configuration file.
+var systemdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// systemdString formats a proxy setting as DefaultEnvironment assignments of
+// the systemd manager configuration.
+func (p setting) systemdString() string {
+	if slices.Contains(unsupportedEnvProtocols, p.protocol) {
+		log.Debugf("Skipping unsupported systemd proxy setting %q", p.protocol)
+		return ""
+	}
+
+	value := p.escapedURL
+	if p.protocol == protocolNo {
+		value = strings.NewReplacer(" ", "", "'", "", `"`, "").Replace(value)
+	}
+
+	// As with the environment backend, both uppercase and lowercase variables
+	// are set.
+	var content string
+	for _, name := range []string{strings.ToUpper(p.protocol.String()) + "_PROXY", strings.ToLower(p.protocol.String()) + "_proxy"} {
+		content += fmt.Sprintf("DefaultEnvironment=\"%s\"\n", systemdValueEscaper.Replace(name+"="+value))
+	}
+	return content
+}
+
+// systemdBackend applies the proxy configuration in the form of
+// DefaultEnvironment variables set in a drop-in of the systemd system manager
+// configuration, so that system services inherit them. The same drop-in can
+// be written for the user managers. As every service would inherit them, the
+// backend is disabled unless its mode is set.
+type systemdBackend struct {
+	path     string
+	userPath string
+
+	// user also writes the drop-in of the user managers, which is removed
+	// otherwise.
+	user bool
+
+	fs       *fsRunner
+	reloader daemonReloader
+}
+
+func init() {
+	registerBackend("systemd", func(opts options, r *fsRunner, c *commandRunner) backend {
+		return systemdBackend{
+			path:     filepath.Join(opts.root, defaultSystemdConfigPath),
+			userPath: filepath.Join(opts.root, defaultSystemdUserConfigPath),
+			user:     opts.systemdUserConf,
+			fs:       r,
+			reloader: newDaemonReloader(opts, c),
+		}
+	})
+}
+
+func (b systemdBackend) name() string    { return "systemd" }
+func (b systemdBackend) paths() []string { return []string{b.path, b.userPath} }
+func (b systemdBackend) optIn()          {}
+
+func (b systemdBackend) skipReason(proto protocol) string {
+	if proto == protocolAuto {
+		return "autoconfiguration URLs have no environment variable"
+	}
+	return ""
+}
+
+// apply applies the proxy configuration to the systemd drop-ins. If there are
+// no proxy settings to apply, the drop-ins are removed. If its drop-in changed,
+// the system manager is reloaded once every backend is applied, so that the
+// services started from then on inherit the variables. The user managers only
+// read theirs once they are reloaded themselves, for instance on the next
+// login.
+func (b systemdBackend) apply(ctx context.Context, settings []setting) (err error) {
+	defer decorate.OnError(&err, "couldn't apply systemd proxy configuration")
+
+	content := systemdConfig(settings)
+	remove := noSupportedProtocols(settings, unsupportedEnvProtocols)
+
+	changed, err := configFileChanged(b.path, content, remove)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Applying systemd proxy configuration to %q", b.path)
+	if err := applyConfigFile(ctx, b.fs, b.path, content, remove); err != nil {
+		return err
+	}
+
+	log.Debugf("Applying systemd user proxy configuration to %q", b.userPath)
+	if err := applyConfigFile(ctx, b.fs, b.userPath, content, remove || !b.user); err != nil {
+		return err
+	}
+
+	if changed {
+		b.reloader.request()
+	}
+	return nil
+}
+
+// systemdConfig returns the formatted systemd drop-in to be written.
+func systemdConfig(settings []setting) string {
+	content := fmt.Sprintln(confHeader)
+	content += "[Manager]\n"
+	for _, p := range sortedSettings(settings) {
+		content += p.systemdString()
+	}
+
+	return content
+}
@@ -0,0 +1,50 @@
+package proxy_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/proxy"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/testutils"
+)
+
+func TestSystemdConfig(t *testing.T) {
+	t.Parallel()
+
+	set := proxy.Settings{HTTP: "http://example.com:8080", HTTPS: "https://example.com:8443", NoProxy: `localhost, "example.net"`}
+
+	tests := map[string]struct {
+		settings proxy.Settings
+		user     bool
+
+		// previousUser applies the settings with the user drop-in enabled first.
+		previousUser bool
+	}{
+		"System drop-in only by default":                 {settings: set},
+		"User drop-in is written when enabled":           {settings: set, user: true},
+		"User drop-in is removed when disabled":          {settings: set, previousUser: true},
+		"Drop-ins are removed without settings":          {previousUser: true, user: true},
+		"Drop-ins are removed with unsupported settings": {settings: proxy.Settings{Auto: "http://example.com/proxy.pac"}, previousUser: true, user: true},
+		"FTP and SOCKS proxies are set":                  {settings: proxy.Settings{FTP: "ftp://example.com:2121", SOCKS: "socks://example.com:1080"}},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			// Only the systemd backend is managed.
+			modes := proxy.WithBackendModes(proxy.OnlyBackend("systemd"))
+
+			if tc.previousUser {
+				err := proxy.New(proxy.WithRoot(root), modes, proxy.WithSystemdUserConf(true)).Apply(set)
+				require.NoError(t, err, "Setup: couldn't apply previous configuration")
+			}
+
+			err := proxy.New(proxy.WithRoot(root), modes, proxy.WithSystemdUserConf(tc.user)).Apply(tc.settings)
+			require.NoError(t, err, "Apply failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.Update())
+		})
+	}
+}
@@ -0,0 +1,9 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export HTTPS_PROXY='https://example.com:8443'
+export https_proxy='https://example.com:8443'
+export FTP_PROXY='ftp://ftp.example.com:8080'
+export ftp_proxy='ftp://ftp.example.com:8080'
+export SOCKS_PROXY='socks://socks.example.com:8080'
+export socks_proxy='socks://socks.example.com:8080'
@@ -0,0 +1,11 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://example.com:8080'
+set -gx http_proxy 'http://example.com:8080'
+set -gx HTTPS_PROXY 'https://example.com:8080'
+set -gx https_proxy 'https://example.com:8080'
+set -gx FTP_PROXY 'ftp://example.com:8080'
+set -gx ftp_proxy 'ftp://example.com:8080'
+set -gx SOCKS_PROXY 'socks://example.com:8080'
+set -gx socks_proxy 'socks://example.com:8080'
+set -gx NO_PROXY 'localhost,127.0.0.1'
+set -gx no_proxy 'localhost,127.0.0.1'
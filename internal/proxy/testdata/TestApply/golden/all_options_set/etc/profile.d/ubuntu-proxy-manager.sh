@@ -0,0 +1,11 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export HTTPS_PROXY='https://example.com:8080'
+export https_proxy='https://example.com:8080'
+export FTP_PROXY='ftp://example.com:8080'
+export ftp_proxy='ftp://example.com:8080'
+export SOCKS_PROXY='socks://example.com:8080'
+export socks_proxy='socks://example.com:8080'
+export NO_PROXY='localhost,127.0.0.1'
+export no_proxy='localhost,127.0.0.1'
@@ -0,0 +1,11 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export HTTPS_PROXY='http://example.com:8080'
+export https_proxy='http://example.com:8080'
+export FTP_PROXY='http://example.com:8080'
+export ftp_proxy='http://example.com:8080'
+export SOCKS_PROXY='http://example.com:8080'
+export socks_proxy='http://example.com:8080'
+export ALL_PROXY='http://example.com:8080'
+export all_proxy='http://example.com:8080'
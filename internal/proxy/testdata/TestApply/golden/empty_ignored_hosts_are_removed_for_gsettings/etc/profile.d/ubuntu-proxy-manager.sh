@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export NO_PROXY='localhost,,127.0.0.1,'
+export no_proxy='localhost,,127.0.0.1,'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://[fe80::1%25eth0]:3128'
+export http_proxy='http://[fe80::1%25eth0]:3128'
+export NO_PROXY='localhost'
+export no_proxy='localhost'
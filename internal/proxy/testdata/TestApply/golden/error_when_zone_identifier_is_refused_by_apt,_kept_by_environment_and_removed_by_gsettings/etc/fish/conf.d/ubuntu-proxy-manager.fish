@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://[fe80::1%25eth0]:3128'
+set -gx http_proxy 'http://[fe80::1%25eth0]:3128'
+set -gx NO_PROXY 'localhost'
+set -gx no_proxy 'localhost'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://username:p%40$$w0rd@[fe80::1%25eth0]:3128'
+export http_proxy='http://username:p%40$$w0rd@[fe80::1%25eth0]:3128'
+export SOCKS_PROXY='socks5://us%25er:pa%25ss@[fe80::2%25enp0s3]:1080'
+export socks_proxy='socks5://us%25er:pa%25ss@[fe80::2%25enp0s3]:1080'
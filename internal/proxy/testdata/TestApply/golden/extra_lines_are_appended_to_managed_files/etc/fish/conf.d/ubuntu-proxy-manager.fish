@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://example.com:8080'
+set -gx http_proxy 'http://example.com:8080'
+set -gx NO_PROXY 'localhost'
+set -gx no_proxy 'localhost'
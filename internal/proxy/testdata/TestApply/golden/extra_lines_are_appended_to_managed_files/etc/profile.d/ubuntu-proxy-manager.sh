@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export NO_PROXY='localhost'
+export no_proxy='localhost'
@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx NO_PROXY 'localhost,127.0.0.1,::1'
+set -gx no_proxy 'localhost,127.0.0.1,::1'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://[fe80::1]:3128'
+set -gx http_proxy 'http://[fe80::1]:3128'
+set -gx HTTPS_PROXY 'http://username:p%40$$w0rd@[fe80::1]:3128'
+set -gx https_proxy 'http://username:p%40$$w0rd@[fe80::1]:3128'
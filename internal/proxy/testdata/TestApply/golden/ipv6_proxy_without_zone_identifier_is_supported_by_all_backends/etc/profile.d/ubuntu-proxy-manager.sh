@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://[fe80::1]:3128'
+export http_proxy='http://[fe80::1]:3128'
+export HTTPS_PROXY='http://username:p%40$$w0rd@[fe80::1]:3128'
+export https_proxy='http://username:p%40$$w0rd@[fe80::1]:3128'
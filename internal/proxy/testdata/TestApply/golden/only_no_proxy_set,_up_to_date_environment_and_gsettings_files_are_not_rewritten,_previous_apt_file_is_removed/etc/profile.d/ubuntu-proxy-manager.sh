@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export NO_PROXY='localhost'
+export no_proxy='localhost'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://example.com:8080'
+set -gx http_proxy 'http://example.com:8080'
+set -gx SOCKS_PROXY 'socks5://example.com:1080'
+set -gx socks_proxy 'socks5://example.com:1080'
@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export SOCKS_PROXY='socks5://example.com:1080'
+export socks_proxy='socks5://example.com:1080'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx SOCKS_PROXY 'socks5://example.com:1080'
+set -gx socks_proxy 'socks5://example.com:1080'
+set -gx ALL_PROXY 'socks5://example.com:1080'
+set -gx all_proxy 'socks5://example.com:1080'
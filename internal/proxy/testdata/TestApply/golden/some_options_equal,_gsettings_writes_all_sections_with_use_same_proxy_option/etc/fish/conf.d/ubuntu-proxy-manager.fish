@@ -0,0 +1,7 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://example.com:8080'
+set -gx http_proxy 'http://example.com:8080'
+set -gx HTTPS_PROXY 'http://example.com:8080'
+set -gx https_proxy 'http://example.com:8080'
+set -gx SOCKS_PROXY 'socks://example.com:8080'
+set -gx socks_proxy 'socks://example.com:8080'
@@ -0,0 +1,7 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export HTTPS_PROXY='http://example.com:8080'
+export https_proxy='http://example.com:8080'
+export SOCKS_PROXY='socks://example.com:8080'
+export socks_proxy='socks://example.com:8080'
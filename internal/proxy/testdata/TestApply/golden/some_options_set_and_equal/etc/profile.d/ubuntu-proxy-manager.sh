@@ -0,0 +1,7 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://example.com:8080'
+export http_proxy='http://example.com:8080'
+export HTTPS_PROXY='http://example.com:8080'
+export https_proxy='http://example.com:8080'
+export FTP_PROXY='ftp://example.com:2121'
+export ftp_proxy='ftp://example.com:2121'
@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://old.example.com:8080'
+set -gx http_proxy 'http://old.example.com:8080'
@@ -0,0 +1,3 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://old.example.com:8080'
+export http_proxy='http://old.example.com:8080'
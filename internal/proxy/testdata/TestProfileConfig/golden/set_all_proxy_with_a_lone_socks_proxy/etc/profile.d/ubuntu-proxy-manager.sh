@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export SOCKS_PROXY='socks://example.com:1080'
+export socks_proxy='socks://example.com:1080'
+export ALL_PROXY='socks://example.com:1080'
+export all_proxy='socks://example.com:1080'
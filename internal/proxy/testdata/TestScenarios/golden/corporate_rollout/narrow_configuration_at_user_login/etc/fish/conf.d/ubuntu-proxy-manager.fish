@@ -0,0 +1,7 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://proxy.corp.example.com:3128'
+set -gx http_proxy 'http://proxy.corp.example.com:3128'
+set -gx HTTPS_PROXY 'http://proxy.corp.example.com:3128'
+set -gx https_proxy 'http://proxy.corp.example.com:3128'
+set -gx NO_PROXY 'localhost'
+set -gx no_proxy 'localhost'
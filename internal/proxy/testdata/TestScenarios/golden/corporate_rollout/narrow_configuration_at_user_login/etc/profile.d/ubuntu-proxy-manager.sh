@@ -0,0 +1,7 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://proxy.corp.example.com:3128'
+export http_proxy='http://proxy.corp.example.com:3128'
+export HTTPS_PROXY='http://proxy.corp.example.com:3128'
+export https_proxy='http://proxy.corp.example.com:3128'
+export NO_PROXY='localhost'
+export no_proxy='localhost'
@@ -0,0 +1,11 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://proxy.corp.example.com:3128'
+set -gx http_proxy 'http://proxy.corp.example.com:3128'
+set -gx HTTPS_PROXY 'http://proxy.corp.example.com:3128'
+set -gx https_proxy 'http://proxy.corp.example.com:3128'
+set -gx FTP_PROXY 'http://proxy.corp.example.com:3128'
+set -gx ftp_proxy 'http://proxy.corp.example.com:3128'
+set -gx SOCKS_PROXY 'socks5://socks.corp.example.com:1080'
+set -gx socks_proxy 'socks5://socks.corp.example.com:1080'
+set -gx NO_PROXY 'localhost,127.0.0.1,.corp.example.com'
+set -gx no_proxy 'localhost,127.0.0.1,.corp.example.com'
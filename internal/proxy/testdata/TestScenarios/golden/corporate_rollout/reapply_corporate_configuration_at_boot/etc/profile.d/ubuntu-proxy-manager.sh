@@ -0,0 +1,11 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://proxy.corp.example.com:3128'
+export http_proxy='http://proxy.corp.example.com:3128'
+export HTTPS_PROXY='http://proxy.corp.example.com:3128'
+export https_proxy='http://proxy.corp.example.com:3128'
+export FTP_PROXY='http://proxy.corp.example.com:3128'
+export ftp_proxy='http://proxy.corp.example.com:3128'
+export SOCKS_PROXY='socks5://socks.corp.example.com:1080'
+export socks_proxy='socks5://socks.corp.example.com:1080'
+export NO_PROXY='localhost,127.0.0.1,.corp.example.com'
+export no_proxy='localhost,127.0.0.1,.corp.example.com'
@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+set -gx HTTP_PROXY 'http://proxy2.example.com:8080'
+set -gx http_proxy 'http://proxy2.example.com:8080'
+set -gx HTTPS_PROXY 'http://proxy2.example.com:8080'
+set -gx https_proxy 'http://proxy2.example.com:8080'
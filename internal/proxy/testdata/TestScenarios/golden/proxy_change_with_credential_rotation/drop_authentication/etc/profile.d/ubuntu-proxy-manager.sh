@@ -0,0 +1,5 @@
+### This file was generated by ubuntu-proxy-manager - manual changes will be overwritten
+export HTTP_PROXY='http://proxy2.example.com:8080'
+export http_proxy='http://proxy2.example.com:8080'
+export HTTPS_PROXY='http://proxy2.example.com:8080'
+export https_proxy='http://proxy2.example.com:8080'
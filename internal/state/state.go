@@ -0,0 +1,214 @@
+// Package state persists the proxy manager state across activations.
+//
+// Every state file is stored as a versioned JSON envelope, allowing newer
+// versions of the program to change the payload schema without older versions
+// (e.g. after a package downgrade) crashing or overwriting data they don't
+// understand.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// DefaultDir is the relative path to the default state directory.
+	DefaultDir = "var/lib/ubuntu-proxy-manager"
+
+	// formatMajor is the major version of the state file format. It is bumped
+	// on incompatible payload changes, and requires a migration for older files.
+	formatMajor = 1
+	// formatMinor is the minor version of the state file format. It is bumped
+	// on backward compatible payload changes, such as new optional fields.
+	formatMinor = 0
+
+	// lockFile is the name of the file locked by Lock.
+	lockFile = "lock"
+)
+
+// ErrNewerFormat is returned when a state file was written with a newer major
+// format version than the one supported by this program.
+var ErrNewerFormat = errors.New("state file format is newer than supported")
+
+// Migration converts the payload of a state file from one major format version
+// to the next one.
+type Migration func(payload json.RawMessage) (json.RawMessage, error)
+
+// Store reads and writes versioned state files in a given directory.
+type Store struct {
+	dir string
+
+	// migrations maps a state file name to its migrations, indexed by the major
+	// version they migrate from.
+	migrations map[string]map[int]Migration
+}
+
+type options struct {
+	migrations map[string]map[int]Migration
+}
+type option func(*options)
+
+// envelope is the on-disk representation of every state file.
+type envelope struct {
+	FormatVersion string          `json:"format_version"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// New returns a new state store rooted at dir.
+func New(dir string, args ...option) *Store {
+	opts := options{
+		migrations: make(map[string]map[int]Migration),
+	}
+	for _, f := range args {
+		f(&opts)
+	}
+
+	return &Store{
+		dir:        dir,
+		migrations: opts.migrations,
+	}
+}
+
+// WithMigration registers a migration for the state file name, converting its
+// payload from the major version from to from+1.
+// Files predating the versioned envelope are considered to be version 0.
+func WithMigration(name string, from int, m Migration) func(*options) {
+	return func(o *options) {
+		if o.migrations[name] == nil {
+			o.migrations[name] = make(map[int]Migration)
+		}
+		o.migrations[name][from] = m
+	}
+}
+
+// Load reads the state file name into v, migrating it from older format
+// versions if needed. Unknown fields are ignored.
+// It returns an error wrapping fs.ErrNotExist if the file doesn't exist, and
+// ErrNewerFormat if it was written with a newer major version.
+func (s Store) Load(name string, v any) (err error) {
+	defer decorate.OnError(&err, "couldn't load state file %q", name)
+
+	path := filepath.Join(s.dir, name)
+	// #nosec G304 - path not controllable by user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	major, payload, err := decode(data)
+	if err != nil {
+		return err
+	}
+
+	if major > formatMajor {
+		log.Warningf("State file %q was written by a newer version of ubuntu-proxy-manager (format %d, supported %d), ignoring it", path, major, formatMajor)
+		return ErrNewerFormat
+	}
+
+	for ; major < formatMajor; major++ {
+		migrate, ok := s.migrations[name][major]
+		if !ok {
+			return fmt.Errorf("no migration available from format version %d", major)
+		}
+		log.Debugf("Migrating state file %q from format version %d to %d", path, major, major+1)
+		if payload, err = migrate(payload); err != nil {
+			return fmt.Errorf("migration from format version %d failed: %w", major, err)
+		}
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+// Save writes v to the state file name in the current format version.
+// An existing file written with a newer major version is never overwritten, and
+// ErrNewerFormat is returned instead.
+func (s Store) Save(name string, v any) (err error) {
+	defer decorate.OnError(&err, "couldn't save state file %q", name)
+
+	path := filepath.Join(s.dir, name)
+	// #nosec G304 - path not controllable by user
+	if data, err := os.ReadFile(path); err == nil {
+		if major, _, err := decode(data); err == nil && major > formatMajor {
+			log.Warningf("State file %q was written by a newer version of ubuntu-proxy-manager (format %d, supported %d), not overwriting it", path, major, formatMajor)
+			return ErrNewerFormat
+		}
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(envelope{
+		FormatVersion: fmt.Sprintf("%d.%d", formatMajor, formatMinor),
+		Payload:       payload,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	//nolint:gosec // G301 - state directory permissions are 0755, matching /var/lib
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".new", append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// Lock takes an exclusive lock on the store, shared with the other processes
+// using the same directory, waiting for it to be released if needed. The
+// returned function releases it.
+func (s Store) Lock() (unlock func(), err error) {
+	defer decorate.OnError(&err, "couldn't lock state directory %q", s.dir)
+
+	//nolint:gosec // G301 - state directory permissions are 0755, matching /var/lib
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	// #nosec G304 - path not controllable by user
+	f, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return func() { _ = f.Close() }, nil
+}
+
+// decode returns the major format version and the payload of a state file.
+// Files without a format version predate the envelope, and are returned as a
+// whole with major version 0.
+func decode(data []byte) (major int, payload json.RawMessage, err error) {
+	if !json.Valid(data) {
+		return 0, nil, errors.New("invalid state file: not a JSON document")
+	}
+
+	// Legacy files may not even be JSON objects, so any decoding error means
+	// there is no envelope.
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.FormatVersion == "" {
+		return 0, data, nil
+	}
+
+	majorStr, _, _ := strings.Cut(env.FormatVersion, ".")
+	major, err = strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid format version %q: %w", env.FormatVersion, err)
+	}
+
+	return major, env.Payload, nil
+}
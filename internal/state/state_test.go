@@ -0,0 +1,182 @@
+package state_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/ubuntu-proxy-manager/internal/state"
+)
+
+type manifest struct {
+	Files []string `json:"files"`
+}
+
+// migrateManifestV0 converts a fabricated v0 manifest, a bare list of files, to
+// the v1 object format.
+func migrateManifestV0(payload json.RawMessage) (json.RawMessage, error) {
+	var files []string
+	if err := json.Unmarshal(payload, &files); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest{Files: files})
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content      string
+		noFile       bool
+		noMigrations bool
+
+		want          manifest
+		wantNewer     bool
+		wantNotExists bool
+		wantErr       bool
+	}{
+		"Load current format version":             {content: `{"format_version": "1.0", "payload": {"files": ["a", "b"]}}`, want: manifest{Files: []string{"a", "b"}}},
+		"Load newer minor format version":         {content: `{"format_version": "1.3", "payload": {"files": ["a"]}}`, want: manifest{Files: []string{"a"}}},
+		"Unknown fields are ignored":              {content: `{"format_version": "1.0", "extra": true, "payload": {"files": ["a"], "hashes": {"a": "123"}}}`, want: manifest{Files: []string{"a"}}},
+		"Migrate v0 manifest without an envelope": {content: `["a", "b"]`, want: manifest{Files: []string{"a", "b"}}},
+
+		"Error when file does not exist":                     {noFile: true, wantNotExists: true, wantErr: true},
+		"Error when file has a newer major format version":   {content: `{"format_version": "2.0", "payload": {"files": 42}}`, wantNewer: true, wantErr: true},
+		"Error when file is not valid JSON":                  {content: `{"format_version": "1.0", `, wantErr: true},
+		"Error when format version is invalid":               {content: `{"format_version": "one", "payload": {}}`, wantErr: true},
+		"Error when no migration exists for older version":   {content: `["a", "b"]`, noMigrations: true, wantErr: true},
+		"Error when migration fails":                         {content: `{"files": ["a"]}`, wantErr: true},
+		"Error when payload does not match the expected one": {content: `{"format_version": "1.0", "payload": {"files": 42}}`, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			if !tc.noFile {
+				err := os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(tc.content), 0600)
+				require.NoError(t, err, "Setup: couldn't write state file")
+			}
+
+			s := state.New(dir, state.WithMigration("manifest.json", 0, migrateManifestV0))
+			if tc.noMigrations {
+				s = state.New(dir)
+			}
+
+			var got manifest
+			err := s.Load("manifest.json", &got)
+			if tc.wantErr {
+				require.Error(t, err, "Load should have failed but didn't")
+				require.Equal(t, tc.wantNewer, errors.Is(err, state.ErrNewerFormat), "Load should return ErrNewerFormat only for newer major versions")
+				require.Equal(t, tc.wantNotExists, errors.Is(err, fs.ErrNotExist), "Load should return ErrNotExist only for missing files")
+				return
+			}
+			require.NoError(t, err, "Load failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Loaded state doesn't match")
+		})
+	}
+}
+
+func TestSave(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		prevContent string
+		noStateDir  bool
+
+		wantErr bool
+	}{
+		"Save new state file":                         {},
+		"Save creates the state directory":            {noStateDir: true},
+		"Overwrite state file with same version":      {prevContent: `{"format_version": "1.0", "payload": {"files": ["old"]}}`},
+		"Overwrite state file with older version":     {prevContent: `["old"]`},
+		"Overwrite state file with newer minor":       {prevContent: `{"format_version": "1.1", "payload": {"files": ["old"]}}`},
+		"Overwrite state file which is not even JSON": {prevContent: `garbage`},
+
+		"Error when state file has a newer major version": {prevContent: `{"format_version": "2.0", "payload": {"entries": []}}`, wantErr: true},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			if tc.noStateDir {
+				dir = filepath.Join(dir, "state")
+			}
+			path := filepath.Join(dir, "manifest.json")
+			if tc.prevContent != "" {
+				err := os.WriteFile(path, []byte(tc.prevContent), 0600)
+				require.NoError(t, err, "Setup: couldn't write previous state file")
+			}
+
+			s := state.New(dir)
+			err := s.Save("manifest.json", manifest{Files: []string{"a", "b"}})
+			if tc.wantErr {
+				require.ErrorIs(t, err, state.ErrNewerFormat, "Save should have refused to overwrite the state file")
+				got, err := os.ReadFile(path)
+				require.NoError(t, err, "Couldn't read state file")
+				require.Equal(t, tc.prevContent, string(got), "State file should not have been modified")
+				return
+			}
+			require.NoError(t, err, "Save failed but shouldn't have")
+
+			var got manifest
+			err = s.Load("manifest.json", &got)
+			require.NoError(t, err, "Couldn't load saved state file")
+			require.Equal(t, manifest{Files: []string{"a", "b"}}, got, "Saved state doesn't match")
+			require.NoFileExists(t, path+".new", "Temporary state file should have been renamed")
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "state")
+
+	unlock, err := state.New(dir).Lock()
+	require.NoError(t, err, "Lock failed but shouldn't have")
+
+	// Another store on the same directory, as in another process, waits for it.
+	locked := make(chan struct{})
+	go func() {
+		unlockOther, err := state.New(dir).Lock()
+		if err != nil {
+			t.Errorf("Second Lock failed but shouldn't have: %v", err)
+			return
+		}
+		close(locked)
+		unlockOther()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Second Lock should have waited for the first lock to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Second Lock should have been taken once the first lock was released")
+	}
+}
+
+func TestLockErrorOnInvalidDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "state")
+	err := os.WriteFile(dir, nil, 0600)
+	require.NoError(t, err, "Setup: couldn't write file in place of the state directory")
+
+	_, err = state.New(dir).Lock()
+	require.Error(t, err, "Lock should have failed on a file")
+}
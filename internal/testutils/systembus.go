@@ -2,6 +2,7 @@ package testutils
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -24,12 +25,35 @@ var (
 	savedDbusSystemAddress string
 )
 
+type systemBusOptions struct {
+	deniedNames []string
+}
+type systemBusOption func(*systemBusOptions)
+
+// WithDeniedNameOwnership installs a restrictive bus policy denying ownership
+// of the given well-known name to everyone.
+func WithDeniedNameOwnership(name string) func(*systemBusOptions) {
+	return func(o *systemBusOptions) {
+		o.deniedNames = append(o.deniedNames, name)
+	}
+}
+
 // StartLocalSystemBus allows to start and set environment variable to a local bus, preventing polluting system ones.
-func StartLocalSystemBus() func() {
+// Options are only taken into account when starting the bus, and ignored if it is already running.
+func StartLocalSystemBus(args ...systemBusOption) func() {
 	sdbusMU.Lock()
 	defer sdbusMU.Unlock()
 	nbRunningTestsSdbus++
 
+	var opts systemBusOptions
+	for _, f := range args {
+		f(&opts)
+	}
+	var deniedPolicies string
+	for _, name := range opts.deniedNames {
+		deniedPolicies += fmt.Sprintf("\n    <deny own=%q/>", name)
+	}
+
 	sdbus.Do(func() {
 		dir, err := os.MkdirTemp("", "tests-dbus")
 		if err != nil {
@@ -48,7 +72,7 @@ func StartLocalSystemBus() func() {
   <policy context="default">
     <allow send_destination="*" eavesdrop="true"/>
     <allow eavesdrop="true"/>
-    <allow own="*"/>
+    <allow own="*"/>`+deniedPolicies+`
   </policy>
 </busconfig>`), 0600)
 		if err != nil {